@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ISUCON13_ADMIN_TOKEN が設定されている場合のみ管理用APIを受け付ける
+// 管理用APIは X-Admin-Token ヘッダでこのトークンを送る必要がある
+var adminToken = os.Getenv("ISUCON13_ADMIN_TOKEN")
+
+const headerAdminToken = "X-Admin-Token"
+
+// 一括予約APIで1回に受け付ける予約の最大数
+const maxBulkReserveEntries = 1000
+
+type BulkReserveLivestreamEntry struct {
+	UserID int64 `json:"user_id"`
+	ReserveLivestreamRequest
+}
+
+type BulkReserveLivestreamRequest struct {
+	Livestreams []BulkReserveLivestreamEntry `json:"livestreams"`
+}
+
+type BulkReserveLivestreamResponse struct {
+	LivestreamIDs []int64 `json:"livestream_ids"`
+}
+
+func verifyAdminToken(c echo.Context) error {
+	if adminToken == "" {
+		// 管理用APIが無効な場合は存在しないものとして扱う
+		return httpError(c, http.StatusNotFound, errCodeNotFound, "not found", nil)
+	}
+	token := c.Request().Header.Get(headerAdminToken)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		return httpError(c, http.StatusUnauthorized, errCodeUnauthorized, "invalid admin token", nil)
+	}
+	return nil
+}
+
+// (管理者向け)配信一括予約API
+// POST /api/admin/livestream/bulk-reserve
+// 負荷試験のデータ投入用。すべての予約を1トランザクションで行い、1件でも予約できなければ何も登録しない
+func bulkReserveLivestreamsHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+
+	var req *BulkReserveLivestreamRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return err
+	}
+	if len(req.Livestreams) == 0 {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "livestreams must not be empty", nil)
+	}
+	if len(req.Livestreams) > maxBulkReserveEntries {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, fmt.Sprintf("too many livestreams: at most %d livestreams are allowed", maxBulkReserveEntries), nil)
+	}
+
+	minStartAt, maxEndAt := req.Livestreams[0].StartAt, req.Livestreams[0].EndAt
+	userIDs := make([]int64, 0, len(req.Livestreams))
+	for i := range req.Livestreams {
+		entry := &req.Livestreams[i]
+		if err := validateReserveLivestreamRequest(&entry.ReserveLivestreamRequest); err != nil {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, fmt.Sprintf("livestreams[%d]: %s", i, err.Error()), nil)
+		}
+		if entry.StartAt < minStartAt {
+			minStartAt = entry.StartAt
+		}
+		if entry.EndAt > maxEndAt {
+			maxEndAt = entry.EndAt
+		}
+		userIDs = append(userIDs, entry.UserID)
+	}
+	userIDs = uniqueIDs(userIDs)
+
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	query, params, err := sqlx.In("SELECT id FROM users WHERE id IN (?)", userIDs)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to construct IN query", err)
+	}
+	var existingUserIDs []int64
+	if err := tx.SelectContext(ctx, &existingUserIDs, tx.Rebind(query), params...); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get users", err)
+	}
+	if len(existingUserIDs) != len(userIDs) {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "some user_id do not exist", nil)
+	}
+
+	// 対象期間の予約枠をまとめてロックし、枠ごとの必要数を数える
+	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
+	slots, err := overlappingSlots(ctx, tx, minStartAt, maxEndAt, true)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reservation_slots", err)
+	}
+	demands := make(map[int64]int64, len(slots))
+	for i, entry := range req.Livestreams {
+		if !slotsAlignWith(slots, entry.StartAt, entry.EndAt) {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, fmt.Sprintf("livestreams[%d]: start_at and end_at must be on reservation slot boundaries", i), nil)
+		}
+		for _, slot := range slots {
+			if slot.overlaps(entry.StartAt, entry.EndAt) {
+				demands[slot.ID]++
+			}
+		}
+	}
+	conflicts := []ReservationSlotConflict{}
+	for _, slot := range slots {
+		if demand := demands[slot.ID]; demand > slot.Slot {
+			conflicts = append(conflicts, ReservationSlotConflict{
+				StartAt:   slot.StartAt,
+				EndAt:     slot.EndAt,
+				Remaining: slot.Slot,
+			})
+		}
+	}
+	if len(conflicts) > 0 {
+		return &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    errCodeReservationSlotFull,
+			Message: "予約枠が足りないため、一括予約できません",
+			Details: conflicts,
+		}
+	}
+
+	// 減らす数が同じ枠をまとめて1回のUPDATEで減らす
+	slotIDsByDemand := make(map[int64][]int64)
+	for slotID, demand := range demands {
+		slotIDsByDemand[demand] = append(slotIDsByDemand[demand], slotID)
+	}
+	for demand, ids := range slotIDsByDemand {
+		if err := adjustSlots(ctx, tx, ids, -demand); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to update reservation_slot", err)
+		}
+	}
+
+	now := time.Now().Unix()
+	livestreamModels := make([]LivestreamModel, 0, len(req.Livestreams))
+	for _, entry := range req.Livestreams {
+		livestreamModels = append(livestreamModels, LivestreamModel{
+			UserID:       entry.UserID,
+			Title:        entry.Title,
+			Description:  entry.Description,
+			PlaylistUrl:  entry.PlaylistUrl,
+			ThumbnailUrl: entry.ThumbnailUrl,
+			StartAt:      entry.StartAt,
+			EndAt:        entry.EndAt,
+			CreatedAt:    now,
+		})
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, created_at) VALUES (:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :created_at)", livestreamModels)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to insert livestreams", err)
+	}
+	// 行数が決まっている複数行INSERTでは、AUTO_INCREMENTの値は連続して払い出される
+	firstID, err := rs.LastInsertId()
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get last inserted livestream id", err)
+	}
+
+	livestreamIDs := make([]int64, 0, len(req.Livestreams))
+	var livestreamTagModels []LivestreamTagModel
+	for i, entry := range req.Livestreams {
+		livestreamID := firstID + int64(i)
+		livestreamIDs = append(livestreamIDs, livestreamID)
+		for _, tagID := range entry.Tags {
+			livestreamTagModels = append(livestreamTagModels, LivestreamTagModel{
+				LivestreamID: livestreamID,
+				TagID:        tagID,
+			})
+		}
+	}
+	if len(livestreamTagModels) > 0 {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", livestreamTagModels); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to insert livestream tags", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	return c.JSON(http.StatusCreated, BulkReserveLivestreamResponse{
+		LivestreamIDs: livestreamIDs,
+	})
+}
+
+type AdjustSlotsRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// 区間に重なる各予約枠の残数に足す数 (負なら減らす)
+	Delta int64 `json:"delta"`
+}
+
+// (管理者向け)予約枠数調整API
+// POST /api/admin/slots/adjust
+// 区間 [start_at, end_at) に重なる予約枠の残数をまとめて増減する。1枠でも負になる場合は何も変更しない
+func adjustSlotsHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+
+	var req *AdjustSlotsRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return err
+	}
+	if req.StartAt >= req.EndAt {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "start_at must be before end_at", nil)
+	}
+	if req.Delta == 0 {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "delta must not be zero", nil)
+	}
+
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	// NOTE: 並列な予約と競合しないようFOR UPDATEが必要
+	slots, err := overlappingSlots(ctx, tx, req.StartAt, req.EndAt, true)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reservation_slots", err)
+	}
+	if len(slots) == 0 {
+		return httpError(c, http.StatusNotFound, errCodeNotFound, "no reservation slots in the given range", nil)
+	}
+	conflicts := []ReservationSlotConflict{}
+	for _, slot := range slots {
+		if slot.Slot+req.Delta < 0 {
+			conflicts = append(conflicts, ReservationSlotConflict{
+				StartAt:   slot.StartAt,
+				EndAt:     slot.EndAt,
+				Remaining: slot.Slot,
+			})
+		}
+	}
+	if len(conflicts) > 0 {
+		return &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    errCodeBadRequest,
+			Message: "予約枠の残数が負になるため、調整できません",
+			Details: conflicts,
+		}
+	}
+
+	if err := adjustSlots(ctx, tx, slotIDs(slots), req.Delta); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to update reservation_slot", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	for _, slot := range slots {
+		slot.Slot += req.Delta
+	}
+	return c.JSON(http.StatusOK, slots)
+}
+
+// SlotUtilization は予約枠1つの利用状況
+type SlotUtilization struct {
+	StartAt int64 `db:"start_at" json:"start_at"`
+	EndAt   int64 `db:"end_at" json:"end_at"`
+	// 予約で減らす前の枠数 (残数 + 枠に重なる配信数)
+	Capacity    int64   `db:"capacity" json:"capacity"`
+	Remaining   int64   `db:"remaining" json:"remaining"`
+	PercentFull float64 `db:"-" json:"percent_full"`
+}
+
+// (管理者向け)予約枠利用状況取得API
+// GET /api/admin/slots/utilization
+// 元の枠数は保存されていないので、枠に重なる(削除されていない)配信数を残数に足し戻して求める
+func getSlotUtilizationHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	utilizations := []SlotUtilization{}
+	if err := tx.SelectContext(ctx, &utilizations, `
+		SELECT rs.start_at, rs.end_at, rs.slot AS remaining, rs.slot + COUNT(l.id) AS capacity
+		FROM reservation_slots rs
+		LEFT JOIN livestreams l ON l.start_at < rs.end_at AND l.end_at > rs.start_at AND l.deleted_at IS NULL
+		GROUP BY rs.id, rs.start_at, rs.end_at, rs.slot
+		ORDER BY rs.start_at ASC`); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reservation slot utilization", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	for i := range utilizations {
+		if capacity := utilizations[i].Capacity; capacity > 0 {
+			utilizations[i].PercentFull = float64(capacity-utilizations[i].Remaining) / float64(capacity) * 100
+		}
+	}
+
+	return c.JSON(http.StatusOK, utilizations)
+}
+
+// 予約枠1つあたりの元の枠数 (初期データの reservation_slots.slot)
+var reservationSlotCapacity = int64(getEnvInt("ISUCON13_RESERVATION_SLOT_CAPACITY", 5))
+
+// SlotMismatch は残数が予約状況と合っていない予約枠
+type SlotMismatch struct {
+	ID      int64 `db:"id" json:"id"`
+	StartAt int64 `db:"start_at" json:"start_at"`
+	EndAt   int64 `db:"end_at" json:"end_at"`
+	// 枠に重なる(削除されていない)配信と、確定前の仮押さえの数
+	Livestreams int64 `db:"livestreams" json:"livestreams"`
+	Holds       int64 `db:"holds" json:"holds"`
+	Remaining   int64 `db:"remaining" json:"remaining"`
+	// 元の枠数から配信と仮押さえの数を引いた、あるべき残数 (枠数を超えて予約されていれば負)
+	Expected int64 `db:"-" json:"expected"`
+}
+
+type VerifySlotsResponse struct {
+	Checked    int            `json:"checked"`
+	Mismatches []SlotMismatch `json:"mismatches"`
+	// fix=1 で、mismatches の残数を修正した場合に true
+	Fixed bool `json:"fixed"`
+}
+
+// (管理者向け)予約枠整合性検査API
+// POST /api/admin/slots/verify
+// 各予約枠の残数が、元の枠数 - 重なる配信数 - 重なる仮押さえ数 と一致するかを検査し、一致しない枠を返す
+// fix=1 を指定すると、一致しない枠の残数を同じトランザクションで修正する (枠数を超えている場合は0にする)
+// 元の枠数は ISUCON13_RESERVATION_SLOT_CAPACITY なので、予約枠数調整APIで増減した枠も不一致として報告される
+func verifySlotsHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+	fix := c.QueryParam("fix") == "1"
+
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	// NOTE: 集計中に予約・キャンセルで残数が変わらないよう、全予約枠の行ロックを取る
+	// 予約の処理も配信を登録する前に予約枠をFOR UPDATEするので、これで直列化される
+	var checked []int64
+	if err := tx.SelectContext(ctx, &checked, "SELECT id FROM reservation_slots ORDER BY id FOR UPDATE"); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to lock reservation_slots", err)
+	}
+
+	mismatches := []SlotMismatch{}
+	if err := tx.SelectContext(ctx, &mismatches, `
+		SELECT * FROM (
+			SELECT rs.id, rs.start_at, rs.end_at, rs.slot AS remaining,
+				(SELECT COUNT(*) FROM livestreams l WHERE l.start_at < rs.end_at AND l.end_at > rs.start_at AND l.deleted_at IS NULL) AS livestreams,
+				(SELECT COUNT(*) FROM reservation_holds h WHERE h.start_at < rs.end_at AND h.end_at > rs.start_at) AS holds
+			FROM reservation_slots rs
+		) s
+		WHERE remaining <> ? - livestreams - holds
+		ORDER BY start_at ASC`, reservationSlotCapacity); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to verify reservation_slots", err)
+	}
+	for i := range mismatches {
+		mismatches[i].Expected = reservationSlotCapacity - mismatches[i].Livestreams - mismatches[i].Holds
+	}
+
+	if fix {
+		for _, m := range mismatches {
+			remaining := m.Expected
+			if remaining < 0 {
+				remaining = 0
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = ? WHERE id = ?", remaining, m.ID); err != nil {
+				return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fix reservation_slot", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	return c.JSON(http.StatusOK, VerifySlotsResponse{
+		Checked:    len(checked),
+		Mismatches: mismatches,
+		Fixed:      fix,
+	})
+}
+
+// ユーザ別配信一括取得APIで1回に指定できるユーザ数の上限
+const maxBulkUserLivestreamsUsernames = 100
+
+type BulkUserLivestreamsRequest struct {
+	Usernames []string `json:"usernames"`
+}
+
+// (管理者向け)ユーザ別配信一括取得API
+// POST /api/admin/users/livestreams
+// 指定したユーザそれぞれの配信一覧を、ユーザ名をキーにまとめて返す。存在しないユーザ名は結果に含めない
+func getBulkUserLivestreamsHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyAdminToken(c); err != nil {
+		return err
+	}
+
+	var req *BulkUserLivestreamsRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return err
+	}
+	if len(req.Usernames) == 0 {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "usernames must not be empty", nil)
+	}
+	if len(req.Usernames) > maxBulkUserLivestreamsUsernames {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, fmt.Sprintf("too many usernames: at most %d usernames are allowed", maxBulkUserLivestreamsUsernames), nil)
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	var users []UserModel
+	query, params, err := sqlx.In("SELECT * FROM users WHERE name IN (?)", req.Usernames)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to construct IN query", err)
+	}
+	if err := tx.SelectContext(ctx, &users, tx.Rebind(query), params...); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get users", err)
+	}
+
+	result := make(map[string][]Livestream, len(users))
+	if len(users) == 0 {
+		return c.JSON(http.StatusOK, result)
+	}
+	usernames := make(map[int64]string, len(users))
+	userIDs := make([]int64, 0, len(users))
+	for _, user := range users {
+		usernames[user.ID] = user.Name
+		userIDs = append(userIDs, user.ID)
+		// 配信が無いユーザも空の配列で返す
+		result[user.Name] = []Livestream{}
+	}
+
+	var livestreamModels []LivestreamModel
+	query, params, err = sqlx.In("SELECT * FROM livestreams WHERE user_id IN (?) AND deleted_at IS NULL ORDER BY id ASC", userIDs)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to construct IN query", err)
+	}
+	if err := tx.SelectContext(ctx, &livestreamModels, tx.Rebind(query), params...); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestreams", err)
+	}
+	livestreamMap, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill livestreams", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	for _, livestreamModel := range livestreamModels {
+		livestream, ok := livestreamMap[livestreamModel.ID]
+		if !ok {
+			continue
+		}
+		username := usernames[livestreamModel.UserID]
+		result[username] = append(result[username], livestream)
+	}
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testAdminToken = "test-admin-token"
+
+// doAdminRequest は管理用APIを token 付きで呼ぶ (token が空ならヘッダを付けない)
+func doAdminRequest(t *testing.T, method, target string, body interface{}, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to marshal request body: %v", err)
+	}
+	req := httptest.NewRequest(method, target, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set(headerAdminToken, token)
+	}
+	rec := httptest.NewRecorder()
+	testEcho.ServeHTTP(rec, req)
+	return rec
+}
+
+func newTestBulkReserveEntry(userID, startAt, endAt int64, tags ...int64) BulkReserveLivestreamEntry {
+	return BulkReserveLivestreamEntry{UserID: userID, ReserveLivestreamRequest: newTestReserveRequest(startAt, endAt, tags...)}
+}
+
+func TestAdminTokenIsRequired(t *testing.T) {
+	body := BulkReserveLivestreamRequest{Livestreams: []BulkReserveLivestreamEntry{newTestBulkReserveEntry(1, testTermStart, testTermStart+3600)}}
+
+	// トークンが設定されていなければ管理用APIは存在しない
+	setTestVar(t, &adminToken, "")
+	assertErrorCode(t, doAdminRequest(t, http.MethodPost, "/api/admin/livestream/bulk-reserve", body, testAdminToken), http.StatusNotFound, errCodeNotFound)
+
+	setTestVar(t, &adminToken, testAdminToken)
+	assertErrorCode(t, doAdminRequest(t, http.MethodPost, "/api/admin/livestream/bulk-reserve", body, ""), http.StatusUnauthorized, errCodeUnauthorized)
+	assertErrorCode(t, doAdminRequest(t, http.MethodPost, "/api/admin/livestream/bulk-reserve", body, "wrong"), http.StatusUnauthorized, errCodeUnauthorized)
+}
+
+func TestBulkReserveLivestreams(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &adminToken, testAdminToken)
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	tagID := insertTestTag(t, "music")
+	insertTestSlots(t, testTermStart, testTermStart+3*3600, 2)
+	warmTestCaches(t)
+
+	body := BulkReserveLivestreamRequest{Livestreams: []BulkReserveLivestreamEntry{
+		newTestBulkReserveEntry(aliceID, testTermStart, testTermStart+2*3600, tagID),
+		newTestBulkReserveEntry(bobID, testTermStart, testTermStart+3600),
+		newTestBulkReserveEntry(bobID, testTermStart+2*3600, testTermStart+3*3600, tagID),
+	}}
+	var res BulkReserveLivestreamResponse
+	decodeResponse(t, doAdminRequest(t, http.MethodPost, "/api/admin/livestream/bulk-reserve", body, testAdminToken), http.StatusCreated, &res)
+	if len(res.LivestreamIDs) != 3 {
+		t.Fatalf("livestream_ids = %v, want 3 ids", res.LivestreamIDs)
+	}
+	for i, id := range res.LivestreamIDs {
+		var model LivestreamModel
+		if err := dbConn.Get(&model, "SELECT * FROM livestreams WHERE id = ?", id); err != nil {
+			t.Fatalf("livestream %d: %v", id, err)
+		}
+		entry := body.Livestreams[i]
+		if model.UserID != entry.UserID || model.StartAt != entry.StartAt || model.EndAt != entry.EndAt {
+			t.Errorf("livestream %d = %+v, want %+v", id, model, entry)
+		}
+		if n := mustCount(t, "SELECT COUNT(*) FROM livestream_tags WHERE livestream_id = ?", id); n != int64(len(entry.Tags)) {
+			t.Errorf("livestream %d tags = %d, want %d", id, n, len(entry.Tags))
+		}
+	}
+
+	// 1枠目は2件、2枠目と3枠目は1件ずつ予約された
+	wantSlots := []int64{0, 1, 1}
+	for i, want := range wantSlots {
+		if n := mustCount(t, "SELECT slot FROM reservation_slots WHERE start_at = ?", testTermStart+int64(i)*3600); n != want {
+			t.Errorf("slot %d remaining = %d, want %d", i, n, want)
+		}
+	}
+}
+
+func TestBulkReserveLivestreamsIsAtomic(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &adminToken, testAdminToken)
+	userID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+2*3600, 2)
+	warmTestCaches(t)
+
+	tests := []struct {
+		name     string
+		entries  []BulkReserveLivestreamEntry
+		wantCode string
+	}{
+		{
+			// 2枠目だけが溢れる場合も、1枠目の予約を含めて何も登録しない
+			name: "over capacity",
+			entries: []BulkReserveLivestreamEntry{
+				newTestBulkReserveEntry(userID, testTermStart, testTermStart+3600),
+				newTestBulkReserveEntry(userID, testTermStart+3600, testTermStart+2*3600),
+				newTestBulkReserveEntry(userID, testTermStart+3600, testTermStart+2*3600),
+				newTestBulkReserveEntry(userID, testTermStart+3600, testTermStart+2*3600),
+			},
+			wantCode: errCodeReservationSlotFull,
+		},
+		{
+			name: "unknown user",
+			entries: []BulkReserveLivestreamEntry{
+				newTestBulkReserveEntry(userID, testTermStart, testTermStart+3600),
+				newTestBulkReserveEntry(999999, testTermStart, testTermStart+3600),
+			},
+			wantCode: errCodeBadRequest,
+		},
+		{
+			name: "misaligned entry",
+			entries: []BulkReserveLivestreamEntry{
+				newTestBulkReserveEntry(userID, testTermStart, testTermStart+3600),
+				newTestBulkReserveEntry(userID, testTermStart+1800, testTermStart+5400),
+			},
+			wantCode: errCodeBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doAdminRequest(t, http.MethodPost, "/api/admin/livestream/bulk-reserve", BulkReserveLivestreamRequest{Livestreams: tt.entries}, testAdminToken)
+			assertErrorCode(t, rec, http.StatusBadRequest, tt.wantCode)
+			if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != 0 {
+				t.Errorf("livestreams = %d, want 0", n)
+			}
+			if n := mustCount(t, "SELECT COUNT(*) FROM reservation_slots WHERE slot <> 2"); n != 0 {
+				t.Errorf("%d slots were decremented, want 0", n)
+			}
+		})
+	}
+
+	var resp struct {
+		Details []ReservationSlotConflict `json:"details"`
+	}
+	rec := doAdminRequest(t, http.MethodPost, "/api/admin/livestream/bulk-reserve", BulkReserveLivestreamRequest{Livestreams: tests[0].entries}, testAdminToken)
+	decodeResponse(t, rec, http.StatusBadRequest, &resp)
+	want := ReservationSlotConflict{StartAt: testTermStart + 3600, EndAt: testTermStart + 2*3600, Remaining: 2}
+	if len(resp.Details) != 1 || resp.Details[0] != want {
+		t.Errorf("details = %+v, want [%+v]", resp.Details, want)
+	}
+}
+
+func TestGetSlotUtilization(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &adminToken, testAdminToken)
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	const h = 3600
+	insertTestSlots(t, testTermStart, testTermStart+3*h, 5)
+	warmTestCaches(t)
+
+	reserveTestLivestream(t, aliceID, newTestReserveRequest(testTermStart, testTermStart+2*h))
+	reserveTestLivestream(t, bobID, newTestReserveRequest(testTermStart, testTermStart+h))
+	// 削除した配信は枠を戻すので数えない
+	canceled := reserveTestLivestream(t, bobID, newTestReserveRequest(testTermStart+2*h, testTermStart+3*h))
+	decodeResponse(t, doRequest(t, http.MethodDelete, "/api/livestream/"+itoa(canceled.ID), nil, bobID), http.StatusNoContent, nil)
+
+	var got []SlotUtilization
+	decodeResponse(t, doAdminRequest(t, http.MethodGet, "/api/admin/slots/utilization", nil, testAdminToken), http.StatusOK, &got)
+	want := []SlotUtilization{
+		{StartAt: testTermStart, EndAt: testTermStart + h, Capacity: 5, Remaining: 3, PercentFull: 40},
+		{StartAt: testTermStart + h, EndAt: testTermStart + 2*h, Capacity: 5, Remaining: 4, PercentFull: 20},
+		{StartAt: testTermStart + 2*h, EndAt: testTermStart + 3*h, Capacity: 5, Remaining: 5, PercentFull: 0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("utilization = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("utilization[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	assertErrorCode(t, doAdminRequest(t, http.MethodGet, "/api/admin/slots/utilization", nil, "wrong"), http.StatusUnauthorized, errCodeUnauthorized)
+}
+
+func TestAdjustSlots(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &adminToken, testAdminToken)
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	insertTestSlots(t, testTermStart, testTermStart+2*3600, 1)
+	warmTestCaches(t)
+	slotAt := func(startAt int64) int64 {
+		return mustCount(t, "SELECT slot FROM reservation_slots WHERE start_at = ?", startAt)
+	}
+
+	reserveTestLivestream(t, aliceID, newTestReserveRequest(testTermStart, testTermStart+3600))
+	assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(testTermStart, testTermStart+3600), bobID), http.StatusBadRequest, errCodeReservationSlotFull)
+
+	increase := AdjustSlotsRequest{StartAt: testTermStart, EndAt: testTermStart + 3600, Delta: 1}
+	assertErrorCode(t, doAdminRequest(t, http.MethodPost, "/api/admin/slots/adjust", increase, ""), http.StatusUnauthorized, errCodeUnauthorized)
+	var adjusted []ReservationSlotModel
+	decodeResponse(t, doAdminRequest(t, http.MethodPost, "/api/admin/slots/adjust", increase, testAdminToken), http.StatusOK, &adjusted)
+	if len(adjusted) != 1 || adjusted[0].StartAt != testTermStart || adjusted[0].Slot != 1 {
+		t.Errorf("adjusted = %+v, want the first slot with 1 remaining", adjusted)
+	}
+	// 元の枠数を超えて予約できる
+	reserveTestLivestream(t, bobID, newTestReserveRequest(testTermStart, testTermStart+3600))
+	if got := slotAt(testTermStart); got != 0 {
+		t.Errorf("first slot = %d after reserving the added capacity, want 0", got)
+	}
+	if got := slotAt(testTermStart + 3600); got != 1 {
+		t.Errorf("second slot = %d, want it untouched at 1", got)
+	}
+
+	// 1枠でも負になるなら、どの枠も変更しない
+	decrease := AdjustSlotsRequest{StartAt: testTermStart, EndAt: testTermStart + 2*3600, Delta: -1}
+	rec := doAdminRequest(t, http.MethodPost, "/api/admin/slots/adjust", decrease, testAdminToken)
+	var resp struct {
+		APIErrorResponse
+		Details []ReservationSlotConflict `json:"details"`
+	}
+	decodeResponse(t, rec, http.StatusBadRequest, &resp)
+	if resp.ErrorCode != errCodeBadRequest || len(resp.Details) != 1 || resp.Details[0].StartAt != testTermStart {
+		t.Errorf("response = %+v, want one conflict at the first slot", resp)
+	}
+	if got := slotAt(testTermStart); got != 0 {
+		t.Errorf("first slot = %d after a rejected decrease, want 0", got)
+	}
+	if got := slotAt(testTermStart + 3600); got != 1 {
+		t.Errorf("second slot = %d after a rejected decrease, want 1", got)
+	}
+
+	for _, req := range []AdjustSlotsRequest{
+		{StartAt: testTermStart + 3600, EndAt: testTermStart, Delta: 1},
+		{StartAt: testTermStart, EndAt: testTermStart + 3600, Delta: 0},
+	} {
+		assertErrorCode(t, doAdminRequest(t, http.MethodPost, "/api/admin/slots/adjust", req, testAdminToken), http.StatusBadRequest, errCodeBadRequest)
+	}
+	outside := AdjustSlotsRequest{StartAt: testTermStart - 3600, EndAt: testTermStart, Delta: 1}
+	assertErrorCode(t, doAdminRequest(t, http.MethodPost, "/api/admin/slots/adjust", outside, testAdminToken), http.StatusNotFound, errCodeNotFound)
+}
+
+func TestVerifySlots(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &adminToken, testAdminToken)
+	setTestVar(t, &reservationSlotCapacity, 3)
+	const h = 3600
+	streamerID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+3*h, 3)
+	warmTestCaches(t)
+	slotAt := func(startAt int64) int64 {
+		return mustCount(t, "SELECT slot FROM reservation_slots WHERE start_at = ?", startAt)
+	}
+	verify := func(query string) VerifySlotsResponse {
+		t.Helper()
+		var res VerifySlotsResponse
+		decodeResponse(t, doAdminRequest(t, http.MethodPost, "/api/admin/slots/verify"+query, nil, testAdminToken), http.StatusOK, &res)
+		return res
+	}
+
+	// 予約・仮押さえ・削除した配信は数え方どおりなので不一致にならない
+	reserveTestLivestream(t, streamerID, newTestReserveRequest(testTermStart, testTermStart+h))
+	holdTestReservation(t, streamerID, testTermStart+h, testTermStart+2*h)
+	deleted := reserveTestLivestream(t, streamerID, newTestReserveRequest(testTermStart+2*h, testTermStart+3*h))
+	if rec := doRequest(t, http.MethodDelete, "/api/livestream/"+itoa(deleted.ID), nil, streamerID); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d: %s", rec.Code, rec.Body)
+	}
+	if res := verify(""); res.Checked != 3 || len(res.Mismatches) != 0 {
+		t.Fatalf("consistent slots = %+v, want 3 checked and no mismatches", res)
+	}
+
+	// 予約で減らし忘れた枠と、減らしすぎた枠を作る
+	mustExec(t, "UPDATE reservation_slots SET slot = 3 WHERE start_at = ?", testTermStart)
+	mustExec(t, "UPDATE reservation_slots SET slot = 1 WHERE start_at = ?", testTermStart+2*h)
+	res := verify("")
+	if res.Fixed || len(res.Mismatches) != 2 {
+		t.Fatalf("corrupted slots = %+v, want 2 mismatches and nothing fixed", res)
+	}
+	for i, want := range []SlotMismatch{
+		{StartAt: testTermStart, Livestreams: 1, Remaining: 3, Expected: 2},
+		{StartAt: testTermStart + 2*h, Remaining: 1, Expected: 3},
+	} {
+		got := res.Mismatches[i]
+		got.ID, got.EndAt = 0, 0
+		if got != want {
+			t.Errorf("mismatch[%d] = %+v, want %+v", i, got, want)
+		}
+	}
+	if slotAt(testTermStart) != 3 || slotAt(testTermStart+2*h) != 1 {
+		t.Errorf("verify without fix changed slots")
+	}
+
+	// fix=1 であるべき残数に直す
+	if res := verify("?fix=1"); !res.Fixed || len(res.Mismatches) != 2 {
+		t.Errorf("fix = %+v, want 2 fixed mismatches", res)
+	}
+	if got := []int64{slotAt(testTermStart), slotAt(testTermStart + h), slotAt(testTermStart + 2*h)}; !equalIDs(got, []int64{2, 2, 3}) {
+		t.Errorf("slots after fix = %v, want [2 2 3]", got)
+	}
+	if res := verify(""); len(res.Mismatches) != 0 {
+		t.Errorf("mismatches after fix = %+v, want none", res.Mismatches)
+	}
+
+	// 枠数を超えて予約されている枠は0に直し、不一致として報告し続ける
+	for i := 0; i < 3; i++ {
+		insertTestLivestream(t, streamerID, "overbooked", testTermStart+h, testTermStart+2*h)
+	}
+	verify("?fix=1")
+	if got := slotAt(testTermStart + h); got != 0 {
+		t.Errorf("overbooked slot after fix = %d, want 0", got)
+	}
+	if res := verify(""); len(res.Mismatches) != 1 || res.Mismatches[0].Expected != -1 {
+		t.Errorf("overbooked mismatches = %+v, want one with expected -1", res.Mismatches)
+	}
+
+	assertErrorCode(t, doAdminRequest(t, http.MethodPost, "/api/admin/slots/verify", nil, ""), http.StatusUnauthorized, errCodeUnauthorized)
+}
+
+func TestGetBulkUserLivestreams(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &adminToken, testAdminToken)
+	aliceID := insertTestUser(t, "alice")
+	insertTestUser(t, "bob")
+	carolID := insertTestUser(t, "carol")
+	aliceFirst := insertTestLivestream(t, aliceID, "alice first", testTermStart, testTermStart+3600)
+	carolLive := insertTestLivestream(t, carolID, "carol live", testTermStart, testTermStart+3600)
+	aliceSecond := insertTestLivestream(t, aliceID, "alice second", testTermStart+3600, testTermStart+7200)
+	aliceDeleted := insertTestLivestream(t, aliceID, "alice deleted", testTermStart+7200, testTermStart+10800)
+	mustExec(t, "UPDATE livestreams SET deleted_at = ? WHERE id = ?", testTermStart, aliceDeleted)
+	warmTestCaches(t)
+	const path = "/api/admin/users/livestreams"
+
+	recorder := recordQueries(t)
+	var res map[string][]Livestream
+	body := BulkUserLivestreamsRequest{Usernames: []string{"alice", "ghost", "bob", "carol", "alice"}}
+	decodeResponse(t, doAdminRequest(t, http.MethodPost, path, body, testAdminToken), http.StatusOK, &res)
+	// 存在しないユーザ名は含めず、配信の無いユーザは空の配列にする
+	if len(res) != 3 {
+		t.Errorf("grouped usernames = %v, want alice, bob and carol", res)
+	}
+	for username, want := range map[string][]int64{
+		"alice": {aliceFirst, aliceSecond},
+		"bob":   {},
+		"carol": {carolLive},
+	} {
+		livestreams, ok := res[username]
+		if !ok || livestreams == nil {
+			t.Errorf("%s is missing from %v", username, res)
+			continue
+		}
+		if got := livestreamIDs(livestreams); !equalIDs(got, want) {
+			t.Errorf("%s livestreams = %v, want %v", username, got, want)
+		}
+		for _, l := range livestreams {
+			if l.Owner.Name != username {
+				t.Errorf("livestream %d owner = %q, grouped under %q", l.ID, l.Owner.Name, username)
+			}
+		}
+	}
+	// ユーザも配信も1回ずつまとめて引く
+	for _, q := range []string{"FROM users WHERE name IN", "FROM livestreams WHERE user_id IN"} {
+		if n := len(recorder.matching(q)); n != 1 {
+			t.Errorf("%q ran %d times, want 1", q, n)
+		}
+	}
+
+	var unknown map[string][]Livestream
+	decodeResponse(t, doAdminRequest(t, http.MethodPost, path, BulkUserLivestreamsRequest{Usernames: []string{"ghost"}}, testAdminToken), http.StatusOK, &unknown)
+	if unknown == nil || len(unknown) != 0 {
+		t.Errorf("unknown usernames = %v, want an empty object", unknown)
+	}
+
+	tooMany := make([]string, maxBulkUserLivestreamsUsernames+1)
+	for i := range tooMany {
+		tooMany[i] = "user" + itoa(int64(i))
+	}
+	for _, usernames := range [][]string{nil, tooMany} {
+		assertErrorCode(t, doAdminRequest(t, http.MethodPost, path, BulkUserLivestreamsRequest{Usernames: usernames}, testAdminToken), http.StatusBadRequest, errCodeBadRequest)
+	}
+	assertErrorCode(t, doAdminRequest(t, http.MethodPost, path, body, ""), http.StatusUnauthorized, errCodeUnauthorized)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// フィードの項目の種類
+// 同じ時刻の項目は配信、リアクションの順に並べる
+const (
+	feedItemTypeLivestream = "livestream"
+	feedItemTypeReaction   = "reaction"
+)
+
+// feedItemTypeOrder は同じ created_at の項目の並び順
+var feedItemTypeOrder = map[string]int{
+	feedItemTypeLivestream: 0,
+	feedItemTypeReaction:   1,
+}
+
+// FeedItem はアクティビティフィードの1項目
+// Type に応じて Livestream か Reaction のどちらか一方が入る
+type FeedItem struct {
+	Type       string      `json:"type"`
+	CreatedAt  int64       `json:"created_at"`
+	Livestream *Livestream `json:"livestream,omitempty"`
+	Reaction   *Reaction   `json:"reaction,omitempty"`
+}
+
+func (item FeedItem) id() int64 {
+	if item.Livestream != nil {
+		return item.Livestream.ID
+	}
+	return item.Reaction.ID
+}
+
+// feedCursor はフィードのキーセットページネーションの位置
+// (created_at, 種類, id) の降順で、この位置より後の項目を返す
+type feedCursor struct {
+	CreatedAt int64
+	Type      string
+	ID        int64
+}
+
+func (fc feedCursor) String() string {
+	return fmt.Sprintf("%d:%s:%d", fc.CreatedAt, fc.Type, fc.ID)
+}
+
+func parseFeedCursor(v string) (feedCursor, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) != 3 {
+		return feedCursor{}, fmt.Errorf("invalid cursor %q", v)
+	}
+	createdAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return feedCursor{}, fmt.Errorf("invalid cursor %q", v)
+	}
+	if _, ok := feedItemTypeOrder[parts[1]]; !ok {
+		return feedCursor{}, fmt.Errorf("invalid cursor %q", v)
+	}
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return feedCursor{}, fmt.Errorf("invalid cursor %q", v)
+	}
+	return feedCursor{CreatedAt: createdAt, Type: parts[1], ID: id}, nil
+}
+
+// condition は created_at と id のカラムを持つ種類 itemType のテーブルに対して、カーソルより後の項目を選ぶ条件を返す
+func (fc feedCursor) condition(itemType string) (string, []interface{}) {
+	switch order := feedItemTypeOrder[itemType] - feedItemTypeOrder[fc.Type]; {
+	case order < 0:
+		// 同じ時刻のこの種類の項目は返却済み
+		return "created_at < ?", []interface{}{fc.CreatedAt}
+	case order > 0:
+		// 同じ時刻のこの種類の項目はまだ返していない
+		return "created_at <= ?", []interface{}{fc.CreatedAt}
+	default:
+		return "(created_at < ? OR (created_at = ? AND id < ?))", []interface{}{fc.CreatedAt, fc.CreatedAt, fc.ID}
+	}
+}
+
+// parseUserIDsQuery はカンマ区切りのuser_idsクエリパラメータを重複なしで読み取る
+func parseUserIDsQuery(c echo.Context) ([]int64, error) {
+	v := c.QueryParam("user_ids")
+	if v == "" {
+		return nil, httpError(c, http.StatusBadRequest, errCodeBadRequest, "user_ids query parameter is required", nil)
+	}
+	parts := strings.Split(v, ",")
+	userIDs := make([]int64, 0, len(parts))
+	for _, part := range parts {
+		userID, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || userID < 1 {
+			return nil, httpError(c, http.StatusBadRequest, errCodeBadRequest, "user_ids query parameter must be comma separated positive integers", nil)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	userIDs = uniqueIDs(userIDs)
+	if len(userIDs) > maxLimit {
+		return nil, httpError(c, http.StatusBadRequest, errCodeBadRequest, fmt.Sprintf("too many user_ids: at most %d users are allowed", maxLimit), nil)
+	}
+	return userIDs, nil
+}
+
+// アクティビティフィード取得API
+// GET /api/feed?user_ids=1,2,3&limit=...&cursor=...
+// 指定したユーザ(フォロー中の配信者)の新しい配信と、そのユーザが送ったリアクションを新しい順にまとめて返す
+// 続きはレスポンスの next_cursor を cursor に渡して取得する
+func getActivityFeedHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	userIDs, err := parseUserIDsQuery(c)
+	if err != nil {
+		return err
+	}
+	limit, err := parseLimitQuery(c)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		limit = defaultRankingLimit
+	}
+	var cursor *feedCursor
+	if v := c.QueryParam("cursor"); v != "" {
+		fc, err := parseFeedCursor(v)
+		if err != nil {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, err.Error(), nil)
+		}
+		cursor = &fc
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	// 種類ごとに limit+1 件ずつ取得してマージすれば、マージ後の先頭 limit+1 件は必ず揃う
+	livestreamQuery := "SELECT * FROM livestreams WHERE user_id IN (?) AND deleted_at IS NULL"
+	livestreamParams := []interface{}{userIDs}
+	reactionQuery := "SELECT * FROM reactions WHERE user_id IN (?)"
+	reactionParams := []interface{}{userIDs}
+	if cursor != nil {
+		cond, params := cursor.condition(feedItemTypeLivestream)
+		livestreamQuery += " AND " + cond
+		livestreamParams = append(livestreamParams, params...)
+		cond, params = cursor.condition(feedItemTypeReaction)
+		reactionQuery += " AND " + cond
+		reactionParams = append(reactionParams, params...)
+	}
+	livestreamQuery += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	livestreamParams = append(livestreamParams, limit+1)
+	reactionQuery += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	reactionParams = append(reactionParams, limit+1)
+
+	var livestreamModels []LivestreamModel
+	query, params, err := sqlx.In(livestreamQuery, livestreamParams...)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to construct IN query", err)
+	}
+	if err := tx.SelectContext(ctx, &livestreamModels, tx.Rebind(query), params...); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestreams", err)
+	}
+	var reactionModels []ReactionModel
+	query, params, err = sqlx.In(reactionQuery, reactionParams...)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to construct IN query", err)
+	}
+	if err := tx.SelectContext(ctx, &reactionModels, tx.Rebind(query), params...); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reactions", err)
+	}
+
+	livestreamMap, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill livestreams", err)
+	}
+	reactions, err := fillReactionResponseBulk(ctx, tx, reactionModels)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill reactions", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	items := make([]FeedItem, 0, len(livestreamModels)+len(reactions))
+	for _, livestreamModel := range livestreamModels {
+		livestream, ok := livestreamMap[livestreamModel.ID]
+		if !ok {
+			// 配信者が見つからず読み飛ばされた配信
+			continue
+		}
+		items = append(items, FeedItem{
+			Type:       feedItemTypeLivestream,
+			CreatedAt:  livestream.CreatedAt,
+			Livestream: &livestream,
+		})
+	}
+	for i := range reactions {
+		items = append(items, FeedItem{
+			Type:      feedItemTypeReaction,
+			CreatedAt: reactions[i].CreatedAt,
+			Reaction:  &reactions[i],
+		})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].CreatedAt != items[j].CreatedAt {
+			return items[i].CreatedAt > items[j].CreatedAt
+		}
+		if items[i].Type != items[j].Type {
+			return feedItemTypeOrder[items[i].Type] < feedItemTypeOrder[items[j].Type]
+		}
+		return items[i].id() > items[j].id()
+	})
+
+	envelope := ListEnvelope{Items: items}
+	if len(items) > limit {
+		items = items[:limit]
+		last := items[len(items)-1]
+		envelope.Items = items
+		envelope.HasMore = true
+		envelope.NextCursor = feedCursor{CreatedAt: last.CreatedAt, Type: last.Type, ID: last.id()}.String()
+	}
+	return c.JSON(http.StatusOK, envelope)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// feedEnvelope はアクティビティフィードのレスポンス
+type feedEnvelope struct {
+	Items      []FeedItem `json:"items"`
+	NextCursor string     `json:"next_cursor"`
+	HasMore    bool       `json:"has_more"`
+}
+
+// feedKey は並び順の比較に使う項目の識別子
+type feedKey struct {
+	Type string
+	ID   int64
+}
+
+func feedKeys(items []FeedItem) []feedKey {
+	keys := make([]feedKey, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, feedKey{Type: item.Type, ID: item.id()})
+	}
+	return keys
+}
+
+func TestGetActivityFeedInterleaves(t *testing.T) {
+	setupTestDB(t)
+	alice := insertTestUser(t, "alice")
+	bob := insertTestUser(t, "bob")
+	viewer := insertTestUser(t, "viewer")
+	warmTestCaches(t)
+
+	// 配信の created_at は start_at
+	aliceLive := insertTestLivestream(t, alice, "alice live", testTermStart+100, testTermStart+3600)
+	bobLive := insertTestLivestream(t, bob, "bob live", testTermStart+300, testTermStart+3600)
+	r200 := insertTestReaction(t, alice, bobLive, "innocent", testTermStart+200)
+	r300 := insertTestReaction(t, bob, aliceLive, "smile", testTermStart+300)
+	r400 := insertTestReaction(t, alice, bobLive, "heart", testTermStart+400)
+	// フォローしていないユーザの配信とリアクションは含めない
+	insertTestLivestream(t, viewer, "viewer live", testTermStart+500, testTermStart+3600)
+	insertTestReaction(t, viewer, aliceLive, "tada", testTermStart+500)
+
+	// 新しい順。同じ時刻なら配信がリアクションより先
+	want := []feedKey{
+		{feedItemTypeReaction, r400},
+		{feedItemTypeLivestream, bobLive},
+		{feedItemTypeReaction, r300},
+		{feedItemTypeReaction, r200},
+		{feedItemTypeLivestream, aliceLive},
+	}
+	userIDs := itoa(alice) + "," + itoa(bob)
+
+	var all feedEnvelope
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/feed?user_ids="+userIDs, nil, viewer), http.StatusOK, &all)
+	if got := feedKeys(all.Items); !equalFeedKeys(got, want) {
+		t.Errorf("feed = %v, want %v", got, want)
+	}
+	if all.HasMore || all.NextCursor != "" {
+		t.Errorf("has_more = %v, next_cursor = %q, want the last page", all.HasMore, all.NextCursor)
+	}
+	for _, item := range all.Items {
+		if (item.Livestream != nil) == (item.Reaction != nil) {
+			t.Errorf("item %s/%d must have exactly one of livestream and reaction", item.Type, item.id())
+		}
+		if item.Type == feedItemTypeLivestream && item.Livestream.Owner.ID == 0 {
+			t.Errorf("livestream %d has no owner filled", item.id())
+		}
+		if item.Type == feedItemTypeReaction && (item.Reaction.User.ID == 0 || item.Reaction.Livestream.ID == 0) {
+			t.Errorf("reaction %d is not filled", item.id())
+		}
+	}
+
+	// 2件ずつ辿っても、取りこぼしも重複もなく同じ順になる
+	var paged []feedKey
+	cursor := ""
+	for page := 0; page < len(want); page++ {
+		target := "/api/feed?limit=2&user_ids=" + userIDs
+		if cursor != "" {
+			target += "&cursor=" + url.QueryEscape(cursor)
+		}
+		var envelope feedEnvelope
+		decodeResponse(t, doRequest(t, http.MethodGet, target, nil, viewer), http.StatusOK, &envelope)
+		paged = append(paged, feedKeys(envelope.Items)...)
+		if !envelope.HasMore {
+			break
+		}
+		cursor = envelope.NextCursor
+	}
+	if !equalFeedKeys(paged, want) {
+		t.Errorf("paged feed = %v, want %v", paged, want)
+	}
+}
+
+func TestGetActivityFeedValidation(t *testing.T) {
+	setupTestDB(t)
+	viewer := insertTestUser(t, "viewer")
+	warmTestCaches(t)
+
+	for _, target := range []string{
+		"/api/feed",
+		"/api/feed?user_ids=1,x",
+		"/api/feed?user_ids=0",
+		"/api/feed?user_ids=1&cursor=broken",
+		"/api/feed?user_ids=1&cursor=1:comment:2",
+	} {
+		assertErrorCode(t, doRequest(t, http.MethodGet, target, nil, viewer), http.StatusBadRequest, errCodeBadRequest)
+	}
+}
+
+func TestParseFeedCursor(t *testing.T) {
+	want := feedCursor{CreatedAt: testTermStart, Type: feedItemTypeReaction, ID: 42}
+	got, err := parseFeedCursor(want.String())
+	if err != nil || got != want {
+		t.Errorf("parseFeedCursor(%q) = %+v, %v, want %+v", want.String(), got, err, want)
+	}
+}
+
+func equalFeedKeys(a, b []feedKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
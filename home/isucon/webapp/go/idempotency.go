@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 配信予約APIで Idempotency-Key を覚えておく期間
+var idempotencyKeyTTL = getEnvDuration("ISUCON13_IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+
+// 期限切れの Idempotency-Key をまとめて捨てる間隔
+// 同じkeyで再送されなかったエントリが溜まり続けないようにする
+var idempotencySweepInterval = getEnvDuration("ISUCON13_IDEMPOTENCY_SWEEP_INTERVAL", time.Minute)
+
+const headerIdempotencyKey = "Idempotency-Key"
+
+// idempotencyCache は Idempotency-Key ごとに処理済みの予約結果を保持する
+// タイムアウト後にクライアントが再送しても、二重予約・枠の二重消費をしないために使う
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	// 最初のリクエストの処理が終わると閉じられる
+	done       chan struct{}
+	succeeded  bool
+	livestream Livestream
+	expiresAt  time.Time
+}
+
+var reservationIdempotencyCache = &idempotencyCache{entries: map[string]*idempotencyEntry{}}
+
+// begin はkeyの処理を開始する。同じkeyの処理済み・処理中のエントリがあればそれを返し、ownerはfalseになる
+// ownerがtrueの場合、呼び出し側は必ずfinishを呼ぶこと
+func (ic *idempotencyCache) begin(key string, now time.Time) (entry *idempotencyEntry, owner bool) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if e, ok := ic.entries[key]; ok {
+		if !e.expired(now) {
+			// 処理済みか処理中
+			return e, false
+		}
+		delete(ic.entries, key)
+	}
+	e := &idempotencyEntry{done: make(chan struct{})}
+	ic.entries[key] = e
+	return e, true
+}
+
+// finish はbeginで開始した処理の結果を記録する
+// 失敗した場合は記録せず、同じkeyで再試行できるようにする
+func (ic *idempotencyCache) finish(key string, entry *idempotencyEntry, livestream Livestream, err error, now time.Time) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if err != nil {
+		delete(ic.entries, key)
+	} else {
+		entry.succeeded = true
+		entry.livestream = livestream
+		entry.expiresAt = now.Add(idempotencyKeyTTL)
+	}
+	close(entry.done)
+}
+
+// expired は処理が終わっていて、有効期限を過ぎているかを返す。呼び出し側で ic.mu を取っていること
+func (e *idempotencyEntry) expired(now time.Time) bool {
+	select {
+	case <-e.done:
+		return !now.Before(e.expiresAt)
+	default:
+		return false
+	}
+}
+
+// sweep は期限切れのエントリを削除し、削除した数を返す
+func (ic *idempotencyCache) sweep(now time.Time) int {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	swept := 0
+	for key, e := range ic.entries {
+		if e.expired(now) {
+			delete(ic.entries, key)
+			swept++
+		}
+	}
+	return swept
+}
+
+// runIdempotencySweeper は ctx が終わるまで定期的に期限切れの Idempotency-Key を捨てる
+func runIdempotencySweeper(ctx context.Context) {
+	ticker := time.NewTicker(idempotencySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			reservationIdempotencyCache.sweep(now)
+		}
+	}
+}
+
+func (ic *idempotencyCache) reset() {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.entries = map[string]*idempotencyEntry{}
+}
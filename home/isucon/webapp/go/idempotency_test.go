@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// reserveWithIdempotencyKey は Idempotency-Key を付けて配信予約APIを呼ぶ
+func reserveWithIdempotencyKey(t *testing.T, userID int64, req ReserveLivestreamRequest, key string) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("failed to marshal request body: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/livestream/reservation", bytes.NewReader(b))
+	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	r.Header.Set(headerIdempotencyKey, key)
+	r.AddCookie(sessionCookie(t, userID))
+	rec := httptest.NewRecorder()
+	testEcho.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestReserveLivestreamIdempotencyKey(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	otherID := insertTestUser(t, "other")
+	insertTestSlots(t, testTermStart, testTermStart+3600, 5)
+	req := newTestReserveRequest(testTermStart, testTermStart+3600)
+
+	var first, retried Livestream
+	decodeResponse(t, reserveWithIdempotencyKey(t, userID, req, "key-1"), http.StatusCreated, &first)
+	decodeResponse(t, reserveWithIdempotencyKey(t, userID, req, "key-1"), http.StatusCreated, &retried)
+	if retried.ID != first.ID {
+		t.Errorf("retried reservation = livestream %d, want the original %d", retried.ID, first.ID)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != 1 {
+		t.Errorf("livestreams after a retry = %d, want 1", n)
+	}
+	if n := mustCount(t, "SELECT slot FROM reservation_slots"); n != 4 {
+		t.Errorf("slot after a retry = %d, want 4", n)
+	}
+
+	// 別のキーや別のユーザの同じキーは別の予約になる
+	decodeResponse(t, reserveWithIdempotencyKey(t, userID, req, "key-2"), http.StatusCreated, nil)
+	decodeResponse(t, reserveWithIdempotencyKey(t, otherID, req, "key-1"), http.StatusCreated, nil)
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != 3 {
+		t.Errorf("livestreams = %d, want 3", n)
+	}
+	if n := mustCount(t, "SELECT slot FROM reservation_slots"); n != 2 {
+		t.Errorf("slot = %d, want 2", n)
+	}
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	setTestVar(t, &idempotencyKeyTTL, time.Minute)
+	ic := &idempotencyCache{entries: map[string]*idempotencyEntry{}}
+	now := time.Unix(testTermStart, 0)
+
+	entry, owner := ic.begin("key", now)
+	if !owner {
+		t.Fatal("first begin is not the owner")
+	}
+	if _, owner := ic.begin("key", now); owner {
+		t.Error("begin while in flight is the owner")
+	}
+	ic.finish("key", entry, Livestream{ID: 1}, nil, now)
+
+	if e, owner := ic.begin("key", now.Add(idempotencyKeyTTL-time.Second)); owner || !e.succeeded || e.livestream.ID != 1 {
+		t.Errorf("begin before the TTL = %+v (owner %v), want the stored livestream 1", e, owner)
+	}
+	if n := ic.sweep(now.Add(idempotencyKeyTTL - time.Second)); n != 0 {
+		t.Errorf("sweep before the TTL removed %d entries, want 0", n)
+	}
+	if n := ic.sweep(now.Add(idempotencyKeyTTL)); n != 1 {
+		t.Errorf("sweep after the TTL removed %d entries, want 1", n)
+	}
+	if _, owner := ic.begin("key", now.Add(idempotencyKeyTTL)); !owner {
+		t.Error("begin after the TTL is not the owner")
+	}
+
+	// 失敗した結果は覚えず、同じキーでやり直せる
+	failed, _ := ic.begin("failed", now)
+	ic.finish("failed", failed, Livestream{}, errors.New("failed"), now)
+	if _, owner := ic.begin("failed", now); !owner {
+		t.Error("begin after a failure is not the owner")
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -65,20 +67,54 @@ type NGWord struct {
 	CreatedAt    int64  `json:"created_at" db:"created_at"`
 }
 
+type TipRankingEntry struct {
+	User     User  `json:"user"`
+	TotalTip int64 `json:"total_tip"`
+}
+
+// ngWordMatcher はNGワード一覧を1つの正規表現にまとめたもの
+// NGワードが無い場合は何にもマッチしない
+type ngWordMatcher struct {
+	re *regexp.Regexp
+}
+
+func newNGWordMatcher(ngwords []*NGWord) *ngWordMatcher {
+	patterns := make([]string, 0, len(ngwords))
+	for _, ngword := range ngwords {
+		if ngword.Word == "" {
+			continue
+		}
+		patterns = append(patterns, regexp.QuoteMeta(ngword.Word))
+	}
+	if len(patterns) == 0 {
+		return &ngWordMatcher{}
+	}
+	return &ngWordMatcher{re: regexp.MustCompile(strings.Join(patterns, "|"))}
+}
+
+// Match はtextがいずれかのNGワードを含むかを返す
+func (m *ngWordMatcher) Match(text string) bool {
+	if m.re == nil {
+		return false
+	}
+	return m.re.MatchString(text)
+}
+
 func getLivecommentsHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseID(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -120,7 +156,8 @@ func getLivecommentsHandler(c echo.Context) error {
 }
 
 func getNgwords(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
 	if err := verifyUserSession(c); err != nil {
 		return err
@@ -131,12 +168,12 @@ func getNgwords(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseID(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -159,36 +196,33 @@ func getNgwords(c echo.Context) error {
 }
 
 func postLivecommentHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := sessionUserID(c)
 
 	var req *PostLivecommentRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must not be null")
+	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
 	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? AND deleted_at IS NULL", livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
 		} else {
@@ -224,7 +258,7 @@ func postLivecommentHandler(c echo.Context) error {
 	now := time.Now().Unix()
 	livecommentModel := LivecommentModel{
 		UserID:       userID,
-		LivestreamID: int64(livestreamID),
+		LivestreamID: livestreamID,
 		Comment:      req.Comment,
 		Tip:          req.Tip,
 		CreatedAt:    now,
@@ -254,35 +288,29 @@ func postLivecommentHandler(c echo.Context) error {
 }
 
 func reportLivecommentHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
-	if err := verifyUserSession(c); err != nil {
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livecommentID, err := parseID(c, "livecomment_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
-	}
+	userID := sessionUserID(c)
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
 	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? AND deleted_at IS NULL", livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
 		} else {
@@ -298,16 +326,23 @@ func reportLivecommentHandler(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
 		}
 	}
+	if livecommentModel.LivestreamID != livestreamModel.ID {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment does not belong to the livestream")
+	}
 
 	now := time.Now().Unix()
 	reportModel := LivecommentReportModel{
 		UserID:        int64(userID),
-		LivestreamID:  int64(livestreamID),
-		LivecommentID: int64(livecommentID),
+		LivestreamID:  livestreamID,
+		LivecommentID: livecommentID,
 		CreatedAt:     now,
 	}
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
 	if err != nil {
+		// 同じユーザによる同じライブコメントの重複報告はユニークキーで弾く
+		if isDuplicateEntryError(err) {
+			return echo.NewHTTPError(http.StatusConflict, "livecomment has already been reported")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error())
 	}
 	reportID, err := rs.LastInsertId()
@@ -329,29 +364,26 @@ func reportLivecommentHandler(c echo.Context) error {
 
 // NGワードを登録
 func moderateHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseID(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := sessionUserID(c)
 
 	var req *ModerateRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must not be null")
+	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -359,7 +391,7 @@ func moderateHandler(c echo.Context) error {
 
 	// 配信者自身の配信に対するmoderateなのかを検証
 	var ownedLivestreams []LivestreamModel
-	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
+	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ? AND deleted_at IS NULL", livestreamID, userID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 	if len(ownedLivestreams) == 0 {
@@ -368,7 +400,7 @@ func moderateHandler(c echo.Context) error {
 
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
 		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
+		LivestreamID: livestreamID,
 		Word:         req.NGWord,
 		CreatedAt:    time.Now().Unix(),
 	})
@@ -480,3 +512,108 @@ func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel
 	}
 	return report, nil
 }
+
+// 配信ごとのチップ投稿者ランキング
+// GET /api/livestream/:livestream_id/tips/ranking
+func getTipRankingHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	limit, err := parseLimitQuery(c)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		limit = defaultRankingLimit
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? AND deleted_at IS NULL", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's tip ranking")
+	}
+
+	var rows []struct {
+		UserID   int64 `db:"user_id"`
+		TotalTip int64 `db:"total_tip"`
+	}
+	query := `
+	SELECT user_id, SUM(tip) AS total_tip
+	FROM livecomments
+	WHERE livestream_id = ? AND tip > 0
+	GROUP BY user_id
+	ORDER BY total_tip DESC, user_id ASC
+	LIMIT ?`
+	if err := tx.SelectContext(ctx, &rows, query, livestreamID, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to aggregate tips: "+err.Error())
+	}
+
+	ranking := make([]TipRankingEntry, 0, len(rows))
+	if len(rows) == 0 {
+		if err := tx.Commit(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, ranking)
+	}
+
+	userIDs := make([]int64, 0, len(rows))
+	for _, row := range rows {
+		userIDs = append(userIDs, row.UserID)
+	}
+	query, params, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, tx.Rebind(query), params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	// アイコンとテーマも含めて返す
+	userMap, err := fillUserResponseBulk(ctx, tx, userModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	for _, row := range rows {
+		user, ok := userMap[row.UserID]
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("user not found for ID %d", row.UserID))
+		}
+		ranking = append(ranking, TipRankingEntry{
+			User:     user,
+			TotalTip: row.TotalTip,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, ranking)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// insertTestLivecomment はライブコメントを作る
+func insertTestLivecomment(t *testing.T, userID, livestreamID int64, comment string, tip int64) int64 {
+	t.Helper()
+	return mustExec(t, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, ?, ?, ?)", userID, livestreamID, comment, tip, testTermStart)
+}
+
+func TestTipRanking(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	carolID := insertTestUser(t, "carol")
+	daveID := insertTestUser(t, "dave")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	quietID := insertTestLivestream(t, streamerID, "quiet", testTermStart, testTermStart+3600)
+	insertTestLivecomment(t, aliceID, livestreamID, "hi", 100)
+	insertTestLivecomment(t, aliceID, livestreamID, "again", 200)
+	insertTestLivecomment(t, bobID, livestreamID, "hey", 500)
+	// carol と dave は同額なので user_id の昇順
+	insertTestLivecomment(t, daveID, livestreamID, "yo", 300)
+	insertTestLivecomment(t, carolID, livestreamID, "yo", 300)
+	// チップの無いコメントはランキングに入らない
+	insertTestLivecomment(t, streamerID, livestreamID, "thanks", 0)
+	insertTestLivecomment(t, aliceID, quietID, "no tip", 0)
+	warmTestCaches(t)
+
+	var ranking []TipRankingEntry
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/tips/ranking", nil, streamerID), http.StatusOK, &ranking)
+	want := []struct {
+		userID   int64
+		totalTip int64
+	}{{bobID, 500}, {aliceID, 300}, {carolID, 300}, {daveID, 300}}
+	if len(ranking) != len(want) {
+		t.Fatalf("ranking = %+v, want %d entries", ranking, len(want))
+	}
+	for i, w := range want {
+		if ranking[i].User.ID != w.userID || ranking[i].TotalTip != w.totalTip {
+			t.Errorf("ranking[%d] = user %d tip %d, want user %d tip %d", i, ranking[i].User.ID, ranking[i].TotalTip, w.userID, w.totalTip)
+		}
+	}
+
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/tips/ranking?limit=2", nil, streamerID), http.StatusOK, &ranking)
+	if len(ranking) != 2 || ranking[0].User.ID != bobID || ranking[1].User.ID != aliceID {
+		t.Errorf("ranking with limit=2 = %+v, want bob and alice", ranking)
+	}
+
+	rec := doRequest(t, http.MethodGet, "/api/livestream/"+itoa(quietID)+"/tips/ranking", nil, streamerID)
+	decodeResponse(t, rec, http.StatusOK, &ranking)
+	if len(ranking) != 0 || rec.Body.String() != "[]\n" {
+		t.Errorf("zero-tip livestream ranking = %s, want []", rec.Body.String())
+	}
+
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/tips/ranking", nil, aliceID), http.StatusForbidden, nil)
+}
+
+func TestTipRankingFillsUsersAndIgnoresDeletedLivestreams(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	aliceID := insertTestUser(t, "alice")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	deletedID := insertTestLivestream(t, streamerID, "deleted", testTermStart, testTermStart+3600)
+	insertTestLivecomment(t, aliceID, livestreamID, "hi", 100)
+	insertTestLivecomment(t, aliceID, deletedID, "hi", 100)
+	icon := []byte("alice icon")
+	mustExec(t, "INSERT INTO icons (user_id, image) VALUES (?, ?)", aliceID, icon)
+	mustExec(t, "UPDATE themes SET dark_mode = TRUE WHERE user_id = ?", aliceID)
+	mustExec(t, "UPDATE livestreams SET deleted_at = ? WHERE id = ?", testTermStart, deletedID)
+	warmTestCaches(t)
+
+	// ランキングのユーザにもアイコンとテーマを含める
+	var ranking []TipRankingEntry
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/tips/ranking", nil, streamerID), http.StatusOK, &ranking)
+	if len(ranking) != 1 {
+		t.Fatalf("ranking = %+v, want alice only", ranking)
+	}
+	user := ranking[0].User
+	if want := fmt.Sprintf("%x", sha256.Sum256(icon)); user.ID != aliceID || user.IconHash != want {
+		t.Errorf("ranking user = %+v, want alice with icon hash %s", user, want)
+	}
+	if user.Theme.ID == 0 || !user.Theme.DarkMode {
+		t.Errorf("ranking user theme = %+v, want alice's dark theme", user.Theme)
+	}
+
+	// 削除済みの配信のランキングは返さない
+	rec := doRequest(t, http.MethodGet, "/api/livestream/"+itoa(deletedID)+"/tips/ranking", nil, streamerID)
+	decodeResponse(t, rec, http.StatusNotFound, nil)
+}
+
+func TestReportLivecomment(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	otherViewerID := insertTestUser(t, "other")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	otherLivestreamID := insertTestLivestream(t, streamerID, "other", testTermStart, testTermStart+3600)
+	livecommentID := insertTestLivecomment(t, streamerID, livestreamID, "hello", 0)
+	otherLivecommentID := insertTestLivecomment(t, streamerID, otherLivestreamID, "hello", 0)
+	warmTestCaches(t)
+	report := func(userID, livestreamID, livecommentID int64) *httptest.ResponseRecorder {
+		t.Helper()
+		return doRequest(t, http.MethodPost, "/api/livestream/"+itoa(livestreamID)+"/livecomment/"+itoa(livecommentID)+"/report", nil, userID)
+	}
+
+	var created LivecommentReport
+	decodeResponse(t, report(viewerID, livestreamID, livecommentID), http.StatusCreated, &created)
+	if created.ID == 0 || created.Reporter.ID != viewerID || created.Livecomment.ID != livecommentID {
+		t.Errorf("report = %+v, want a report of livecomment %d by user %d", created, livecommentID, viewerID)
+	}
+
+	// 重複はユニークキーで弾くので、報告済みかをロックを取って確認しない
+	recorder := recordQueries(t)
+	if rec := report(viewerID, livestreamID, livecommentID); rec.Code != http.StatusConflict {
+		t.Errorf("duplicate report = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if q := recorder.matching("FROM livecomment_reports"); len(q) != 0 {
+		t.Errorf("report lookups before insert = %d, want 0", len(q))
+	}
+	// 別の配信のライブコメントは報告できない
+	if rec := report(viewerID, livestreamID, otherLivecommentID); rec.Code != http.StatusBadRequest {
+		t.Errorf("cross-livestream report = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := report(viewerID, livestreamID, otherLivecommentID+100); rec.Code != http.StatusNotFound {
+		t.Errorf("report of a missing livecomment = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	// 別のユーザは同じライブコメントを報告できる
+	decodeResponse(t, report(otherViewerID, livestreamID, livecommentID), http.StatusCreated, nil)
+
+	if n := mustCount(t, "SELECT COUNT(*) FROM livecomment_reports"); n != 2 {
+		t.Errorf("reports = %d, want 2", n)
+	}
+	var reports []LivecommentReport
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/report", nil, streamerID), http.StatusOK, &reports)
+	if len(reports) != 2 {
+		t.Errorf("owner sees %d reports, want 2", len(reports))
+	}
+}
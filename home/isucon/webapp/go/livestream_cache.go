@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 組み立て済みの配信レスポンスをキャッシュする期間 (0以下ならキャッシュしない)
+// 人気の配信の単体取得やリアクション投稿のたびに、配信者とタグを引き直さないようにする
+var livestreamCacheTTL = getEnvDuration("ISUCON13_LIVESTREAM_CACHE_TTL", time.Second)
+
+// livestreamCache は livestream_id ごとの組み立て済みの Livestream を保持する
+// エントリは取得時の version と一致する場合のみ使う。更新・削除時には明示的にも破棄する
+// is_live は時刻で変わるので、キャッシュから返すたびに計算し直す
+// 署名付きURLの有効期限は、キャッシュした時点から最大 livestreamCacheTTL だけ早まる
+type livestreamCache struct {
+	mu      sync.Mutex
+	entries map[int64]livestreamCacheEntry
+}
+
+type livestreamCacheEntry struct {
+	livestream Livestream
+	expiresAt  time.Time
+}
+
+var livestreamResponseCache = &livestreamCache{entries: map[int64]livestreamCacheEntry{}}
+
+// get は期限内で version が一致するエントリがあればその配信を返す
+func (lc *livestreamCache) get(livestreamID, version int64, now time.Time) (Livestream, bool) {
+	if livestreamCacheTTL <= 0 {
+		return Livestream{}, false
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	e, ok := lc.entries[livestreamID]
+	if !ok || !now.Before(e.expiresAt) || e.livestream.Version != version {
+		return Livestream{}, false
+	}
+	return e.livestream, true
+}
+
+func (lc *livestreamCache) set(livestream Livestream, now time.Time) {
+	if livestreamCacheTTL <= 0 {
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.entries[livestream.ID] = livestreamCacheEntry{
+		livestream: livestream,
+		expiresAt:  now.Add(livestreamCacheTTL),
+	}
+}
+
+func (lc *livestreamCache) invalidate(livestreamID int64) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	delete(lc.entries, livestreamID)
+}
+
+// invalidateOwner は userID が配信者の配信をすべて破棄する (アイコン変更など配信者の情報が変わった場合)
+func (lc *livestreamCache) invalidateOwner(userID int64) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for id, e := range lc.entries {
+		if e.livestream.Owner.ID == userID {
+			delete(lc.entries, id)
+		}
+	}
+}
+
+func (lc *livestreamCache) reset() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.entries = map[int64]livestreamCacheEntry{}
+}
+
+// fillLivestreamResponseCached は fillLivestreamResponse の結果をキャッシュから返す
+// 配信の単体取得やリアクションなど、同じ配信を繰り返し組み立てる箇所で使う
+func fillLivestreamResponseCached(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (Livestream, error) {
+	now := time.Now()
+	if livestream, ok := livestreamResponseCache.get(livestreamModel.ID, livestreamModel.Version, now); ok {
+		livestream.IsLive = livestreamModel.isLiveAt(now.Unix())
+		return livestream, nil
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return Livestream{}, err
+	}
+	livestreamResponseCache.set(livestream, now)
+	return livestream, nil
+}
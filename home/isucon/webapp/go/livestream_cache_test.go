@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLivestreamCacheGet(t *testing.T) {
+	setTestVar(t, &livestreamCacheTTL, time.Second)
+	lc := &livestreamCache{entries: map[int64]livestreamCacheEntry{}}
+	now := time.Unix(testTermStart, 0)
+	lc.set(Livestream{ID: 1, Title: "cached", Version: 2}, now)
+
+	if livestream, ok := lc.get(1, 2, now.Add(999*time.Millisecond)); !ok || livestream.Title != "cached" {
+		t.Errorf("get within the ttl = %+v, %v, want the cached livestream", livestream, ok)
+	}
+	if _, ok := lc.get(1, 2, now.Add(time.Second)); ok {
+		t.Error("get at the expiry hit the cache")
+	}
+	if _, ok := lc.get(1, 3, now); ok {
+		t.Error("get with a newer version hit the cache")
+	}
+	if _, ok := lc.get(2, 2, now); ok {
+		t.Error("get of another livestream hit the cache")
+	}
+
+	lc.invalidate(1)
+	if _, ok := lc.get(1, 2, now); ok {
+		t.Error("get after invalidate hit the cache")
+	}
+
+	// TTLが0以下ならキャッシュしない
+	setTestVar(t, &livestreamCacheTTL, 0)
+	lc.set(Livestream{ID: 1, Version: 2}, now)
+	if _, ok := lc.get(1, 2, now); ok {
+		t.Error("get with caching disabled hit the cache")
+	}
+}
+
+func TestFillLivestreamResponseCachedRecomputesIsLive(t *testing.T) {
+	setTestVar(t, &livestreamCacheTTL, time.Minute)
+	livestreamResponseCache.reset()
+	t.Cleanup(livestreamResponseCache.reset)
+
+	now := time.Now()
+	// キャッシュした時点では配信中だったが、その後終了した配信
+	livestreamResponseCache.set(Livestream{ID: 1, Title: "cached", IsLive: true}, now)
+	ended := LivestreamModel{ID: 1, StartAt: now.Unix() - 3600, EndAt: now.Unix() - 1}
+	// キャッシュに当たればDBを引かないので tx は不要
+	livestream, err := fillLivestreamResponseCached(context.Background(), nil, ended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if livestream.Title != "cached" || livestream.IsLive {
+		t.Errorf("livestream = %q is_live = %v, want the cached livestream with is_live = false", livestream.Title, livestream.IsLive)
+	}
+}
+
+func livestreamResponseCached(livestreamID int64) bool {
+	livestreamResponseCache.mu.Lock()
+	defer livestreamResponseCache.mu.Unlock()
+	_, ok := livestreamResponseCache.entries[livestreamID]
+	return ok
+}
+
+func TestGetLivestreamUsesResponseCache(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &livestreamCacheTTL, time.Minute)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	tagID := insertTestTag(t, "music")
+	now := time.Now().Unix()
+	livestreamID := insertTestLivestream(t, streamerID, "before", now-60, now+3600)
+	mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", livestreamID, tagID)
+	warmTestCaches(t)
+
+	getLivestream := func() Livestream {
+		t.Helper()
+		var livestream Livestream
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID), nil, viewerID), http.StatusOK, &livestream)
+		return livestream
+	}
+	recorder := recordQueries(t)
+	tagQueries := func() int {
+		return len(recorder.matching("SELECT * FROM livestream_tags WHERE livestream_id"))
+	}
+
+	getLivestream()
+	if n := tagQueries(); n != 1 {
+		t.Fatalf("first get fetched tags %d times, want 1", n)
+	}
+
+	// 2回目以降の取得とリアクションの投稿はキャッシュを使い、タグを引き直さない
+	livestream := getLivestream()
+	decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "tada"), http.StatusCreated, nil)
+	if n := tagQueries(); n != 1 {
+		t.Errorf("cached reads fetched tags %d times in total, want 1", n)
+	}
+	if livestream.Title != "before" || !livestream.IsLive || len(livestream.Tags) != 1 || livestream.Tags[0].ID != tagID {
+		t.Errorf("cached livestream = %+v", livestream)
+	}
+
+	// 更新すると破棄され、次の取得で組み立て直す
+	title := "after"
+	decodeResponse(t, doRequest(t, http.MethodPatch, "/api/livestream/"+itoa(livestreamID), UpdateLivestreamRequest{Version: &livestream.Version, Title: &title}, streamerID), http.StatusOK, nil)
+	if livestreamResponseCached(livestreamID) {
+		t.Error("the cache entry survived the update")
+	}
+	recorder.reset()
+	if livestream := getLivestream(); livestream.Title != "after" {
+		t.Errorf("title after update = %q, want %q", livestream.Title, "after")
+	}
+	if n := tagQueries(); n != 1 {
+		t.Errorf("get after update fetched tags %d times, want 1", n)
+	}
+
+	// 削除しても破棄される
+	deleteTestLivestream(t, streamerID, livestreamID)
+	if livestreamResponseCached(livestreamID) {
+		t.Error("the cache entry survived the delete")
+	}
+}
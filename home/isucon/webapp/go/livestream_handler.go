@@ -3,18 +3,72 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
+// 予約枠(reservation_slots)1つあたりの長さ
+const reservationSlotSeconds = 60 * 60
+
+// ISUCON13_SKIP_LIVESTREAMS_WITH_MISSING_OWNER が設定されていれば、
+// 一覧取得時に配信者が存在しない配信をエラーにせず読み飛ばす
+var skipLivestreamsWithMissingOwner = os.Getenv("ISUCON13_SKIP_LIVESTREAMS_WITH_MISSING_OWNER") != ""
+
+// 1配信に付けられるタグの最大数
+var maxLivestreamTags = getEnvInt("ISUCON13_MAX_LIVESTREAM_TAGS", 10)
+
+// ISUCON13_REJECT_OVERLAPPING_OWN_RESERVATIONS が設定されていれば、
+// 自分の(削除されていない)配信と区間が重なる予約を409で拒否する
+var rejectOverlappingOwnReservations = os.Getenv("ISUCON13_REJECT_OVERLAPPING_OWN_RESERVATIONS") != ""
+
+// 1ユーザーが同時に視聴できる配信数の上限 (0以下なら無制限)
+// 視聴履歴を大量に作って同時視聴者数を水増しされるのを防ぐ
+var maxViewingLivestreamsPerUser = getEnvInt("ISUCON13_MAX_VIEWING_LIVESTREAMS_PER_USER", 0)
+
+// 予約可能な期間 (2023/11/25 10:00 JST からの1年間)
+var (
+	termStartAt = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
+	termEndAt   = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
+)
+
+const (
+	// 予約トランザクションをリトライする最大回数
+	maxReserveRetries = 3
+	// リトライ間隔の初期値 (リトライごとに倍にする)
+	reserveRetryBackoff = 10 * time.Millisecond
+)
+
+// isRetryableTxError はデッドロック(1213)かロック待ちタイムアウト(1205)によるエラーかを返す
+func isRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+}
+
+// isDuplicateEntryError はユニークキー違反(1062)によるエラーかを返す
+func isDuplicateEntryError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == 1062
+}
+
 type ReserveLivestreamRequest struct {
 	Tags         []int64 `json:"tags"`
 	Title        string  `json:"title"`
@@ -25,6 +79,33 @@ type ReserveLivestreamRequest struct {
 	EndAt        int64   `json:"end_at"`
 }
 
+// UpdateLivestreamRequest は配信情報の部分更新リクエスト
+// 指定されたフィールドのみ更新する
+type UpdateLivestreamRequest struct {
+	// 取得時のバージョン。他のセッションで先に更新されていれば409を返す
+	Version      *int64  `json:"version"`
+	Title        *string `json:"title"`
+	Description  *string `json:"description"`
+	ThumbnailUrl *string `json:"thumbnail_url"`
+	// 予約枠の計算が狂うため、配信区間は変更できない
+	StartAt *int64 `json:"start_at"`
+	EndAt   *int64 `json:"end_at"`
+}
+
+// 配信情報の各フィールドの最大長 (文字数)
+var (
+	maxLivestreamTitleLength        = getEnvInt("ISUCON13_MAX_LIVESTREAM_TITLE_LENGTH", 255)
+	maxLivestreamDescriptionLength  = getEnvInt("ISUCON13_MAX_LIVESTREAM_DESCRIPTION_LENGTH", 4096)
+	maxLivestreamThumbnailURLLength = 255
+)
+
+type GetLivestreamsByIDsRequest struct {
+	IDs []int64 `json:"ids"`
+}
+
+// 一括取得APIで指定できる配信IDの最大数
+const maxLivestreamBatchIDs = 200
+
 type LivestreamViewerModel struct {
 	UserID       int64 `db:"user_id" json:"user_id"`
 	LivestreamID int64 `db:"livestream_id" json:"livestream_id"`
@@ -40,6 +121,17 @@ type LivestreamModel struct {
 	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
 	StartAt      int64  `db:"start_at" json:"start_at"`
 	EndAt        int64  `db:"end_at" json:"end_at"`
+	CreatedAt    int64  `db:"created_at" json:"created_at"`
+	// 楽観ロック用のバージョン。配信情報を更新するたびに1増える
+	Version int64 `db:"version" json:"version"`
+	// 論理削除された日時。削除されていなければNULL
+	DeletedAt sql.NullInt64 `db:"deleted_at" json:"-"`
+}
+
+// isLiveAt はサーバ時刻 now (unix秒) に配信中かを返す
+// 配信中の一覧と同じく start_at <= now < end_at で判定する
+func (l *LivestreamModel) isLiveAt(now int64) bool {
+	return l.StartAt <= now && now < l.EndAt
 }
 
 type Livestream struct {
@@ -52,6 +144,32 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+	CreatedAt    int64  `json:"created_at"`
+	// 配信情報更新APIに渡すバージョン
+	Version int64 `json:"version"`
+	// start_at, end_at からレスポンス作成時に計算する (保存はしない)
+	DurationSeconds int64 `json:"duration_seconds"`
+	IsLive          bool  `json:"is_live"`
+	// with_reactions=1 を指定した一覧取得でのみ含める
+	ReactionSummary *LivestreamReactionSummary `json:"reaction_summary,omitempty"`
+}
+
+// LivestreamReactionSummary は配信へのリアクションの集計
+type LivestreamReactionSummary struct {
+	// 最も多く使われた絵文字 (リアクションが無ければ空文字)
+	TopEmojiName   string `json:"top_emoji_name"`
+	TopEmojiCount  int64  `json:"top_emoji_count"`
+	TotalReactions int64  `json:"total_reactions"`
+}
+
+// addEmojiCount は絵文字 emojiName の count 件のリアクションを集計に加える
+// 同数の場合は絵文字名の昇順で先のものを採用し、集計する順序によらず結果を安定させる
+func (s *LivestreamReactionSummary) addEmojiCount(emojiName string, count int64) {
+	s.TotalReactions += count
+	if count > s.TopEmojiCount || (count == s.TopEmojiCount && emojiName < s.TopEmojiName) {
+		s.TopEmojiName = emojiName
+		s.TopEmojiCount = count
+	}
 }
 
 type LivestreamTagModel struct {
@@ -60,6 +178,13 @@ type LivestreamTagModel struct {
 	TagID        int64 `db:"tag_id" json:"tag_id"`
 }
 
+// ReservationSlotConflict は予約できなかった枠
+type ReservationSlotConflict struct {
+	StartAt   int64 `json:"start_at"`
+	EndAt     int64 `json:"end_at"`
+	Remaining int64 `json:"remaining"`
+}
+
 type ReservationSlotModel struct {
 	ID      int64 `db:"id" json:"id"`
 	Slot    int64 `db:"slot" json:"slot"`
@@ -67,57 +192,324 @@ type ReservationSlotModel struct {
 	EndAt   int64 `db:"end_at" json:"end_at"`
 }
 
+// overlaps は予約枠が区間 [startAt, endAt) と重なっているかを返す
+// 内包ではなく重なりで判定する。枠の途中で始まる・終わる区間も対象になるよう、overlappingSlots のSQLと同じ条件にすること
+// 長さ0の区間はどの枠とも重ならない
+func (s *ReservationSlotModel) overlaps(startAt, endAt int64) bool {
+	return startAt < endAt && s.StartAt < endAt && s.EndAt > startAt
+}
+
+// overlappingSlots は区間 [startAt, endAt) と重なる予約枠を返す
+// 予約枠の増減はすべてこれで対象を決め、判定条件を1箇所にまとめる
+// forUpdate がtrueならoverbooking防止のため行ロックを取る
+func overlappingSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64, forUpdate bool) ([]*ReservationSlotModel, error) {
+	if startAt >= endAt {
+		// 長さ0の区間は overlaps と同じくどの枠とも重ならない (SQLの条件だけでは枠の内側の点に一致してしまう)
+		return nil, nil
+	}
+	query := "SELECT * FROM reservation_slots WHERE start_at < ? AND end_at > ? ORDER BY start_at ASC"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	var slots []*ReservationSlotModel
+	done := traceQuery(ctx, query)
+	err := tx.SelectContext(ctx, &slots, query, endAt, startAt)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	return slots, nil
+}
+
+// slotsAlignWith は start_at 順に並んだ slots のうち区間 [startAt, endAt) と重なる枠が、
+// 区間を過不足なく隙間なく覆っているかを返す
+// 枠の途中で始まる・終わる区間や、枠が存在しない時間を含む区間を予約させないために使う
+func slotsAlignWith(slots []*ReservationSlotModel, startAt, endAt int64) bool {
+	next := startAt
+	for _, slot := range slots {
+		if !slot.overlaps(startAt, endAt) {
+			continue
+		}
+		if slot.StartAt != next {
+			return false
+		}
+		next = slot.EndAt
+	}
+	return next == endAt
+}
+
+// errReservationSlotsNotAdjusted は増減しようとした予約枠の一部が更新されなかった場合のエラー
+var errReservationSlotsNotAdjusted = errors.New("reservation slots not adjusted")
+
+// adjustSlots は指定した予約枠の残数を delta だけ増減する
+// 更新された行数が slotIDs の数と一致しなければ errReservationSlotsNotAdjusted を返すので、呼び出し側はロールバックすること
+func adjustSlots(ctx context.Context, tx *sqlx.Tx, slotIDs []int64, delta int64) error {
+	if len(slotIDs) == 0 {
+		return nil
+	}
+	query, params, err := sqlx.In("UPDATE reservation_slots SET slot = slot + ? WHERE id IN (?)", delta, slotIDs)
+	if err != nil {
+		return err
+	}
+	query = tx.Rebind(query)
+	done := traceQuery(ctx, query)
+	rs, err := tx.ExecContext(ctx, query, params...)
+	done()
+	if err != nil {
+		return err
+	}
+	affected, err := rs.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != int64(len(slotIDs)) {
+		return fmt.Errorf("%w: %d of %d slots updated", errReservationSlotsNotAdjusted, affected, len(slotIDs))
+	}
+	return nil
+}
+
+// insertReservedLivestream は予約枠を減らした後に、配信とタグを登録して livestreamModel.ID を設定する
+// コミットはしない。予約枠の増減と同じトランザクションで呼び、呼び出し側の最後で1回だけコミットすること
+// 途中で失敗しても、ロールバックで予約枠の増減ごと取り消される
+func insertReservedLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, tagIDs []int64) error {
+	const insertLivestreamQuery = "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, created_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :created_at)"
+	done := traceQuery(ctx, insertLivestreamQuery)
+	rs, err := tx.NamedExecContext(ctx, insertLivestreamQuery, livestreamModel)
+	done()
+	if err != nil {
+		return err
+	}
+	livestreamID, err := rs.LastInsertId()
+	if err != nil {
+		return err
+	}
+	livestreamModel.ID = livestreamID
+
+	if len(tagIDs) == 0 {
+		return nil
+	}
+	livestreamTagModels := make([]LivestreamTagModel, 0, len(tagIDs))
+	for _, tagID := range tagIDs {
+		livestreamTagModels = append(livestreamTagModels, LivestreamTagModel{
+			LivestreamID: livestreamID,
+			TagID:        tagID,
+		})
+	}
+	const insertTagsQuery = "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)"
+	done = traceQuery(ctx, insertTagsQuery)
+	_, err = tx.NamedExecContext(ctx, insertTagsQuery, livestreamTagModels)
+	done()
+	return err
+}
+
+// slotIDs は予約枠のIDを返す
+func slotIDs(slots []*ReservationSlotModel) []int64 {
+	ids := make([]int64, 0, len(slots))
+	for _, slot := range slots {
+		ids = append(ids, slot.ID)
+	}
+	return ids
+}
+
 func reserveLivestreamHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+	userID := sessionUserID(c)
+
+	var req *ReserveLivestreamRequest
+	if err := decodeJSONBody(c, &req); err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	if err := validateReserveLivestreamRequest(req); err != nil {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, err.Error(), nil)
+	}
 
-	var req *ReserveLivestreamRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	// Idempotency-Key が指定されていれば、同じキーでの再送には最初の結果を返す
+	if key := c.Request().Header.Get(headerIdempotencyKey); key != "" {
+		cacheKey := fmt.Sprintf("%d:%s", userID, key)
+		for {
+			entry, owner := reservationIdempotencyCache.begin(cacheKey, time.Now())
+			if owner {
+				livestream, err := reserveLivestreamWithRetry(ctx, c, userID, req)
+				reservationIdempotencyCache.finish(cacheKey, entry, livestream, err, time.Now())
+				if err != nil {
+					return err
+				}
+				return c.JSON(http.StatusCreated, livestream)
+			}
+			select {
+			case <-entry.done:
+			case <-ctx.Done():
+				return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to wait for the request with the same idempotency key", ctx.Err())
+			}
+			if entry.succeeded {
+				return c.JSON(http.StatusCreated, entry.livestream)
+			}
+			// 先行リクエストが失敗した場合は、改めて予約を試みる
+		}
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	livestream, err := reserveLivestreamWithRetry(ctx, c, userID, req)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return err
+	}
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// reserveLivestreamWithRetry はデッドロック・ロック待ちタイムアウトの場合にロールバックしてやり直す
+func reserveLivestreamWithRetry(ctx context.Context, c echo.Context, userID int64, req *ReserveLivestreamRequest) (Livestream, error) {
+	for attempt := 0; ; attempt++ {
+		livestream, err := reserveLivestream(ctx, c, userID, req)
+		if err == nil {
+			return livestream, nil
+		}
+		if attempt >= maxReserveRetries || !isRetryableTxError(err) {
+			return Livestream{}, err
+		}
+		c.Logger().Warnf("予約トランザクションをリトライします (attempt=%d): %+v", attempt+1, err)
+		select {
+		case <-ctx.Done():
+			return Livestream{}, httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to reserve livestream", ctx.Err())
+		case <-time.After(reserveRetryBackoff << attempt):
+		}
+	}
+}
+
+// validateReserveLivestreamRequest はロックを取る前に弾ける不正な予約リクエストを検出する
+// タイトルと説明文は前後の空白を取り除いた値に書き換える
+func validateReserveLivestreamRequest(req *ReserveLivestreamRequest) error {
+	var err error
+	if req.Title, err = normalizeLivestreamTitle(req.Title); err != nil {
+		return err
+	}
+	if req.Description, err = normalizeLivestreamDescription(req.Description); err != nil {
+		return err
+	}
+
+	if len(req.Tags) > maxLivestreamTags {
+		return fmt.Errorf("too many tags: at most %d tags are allowed", maxLivestreamTags)
+	}
+	seenTags := make(map[int64]struct{}, len(req.Tags))
+	for i, tagID := range req.Tags {
+		// null の要素は0としてデコードされるので、ここで弾く
+		if tagID < 1 {
+			return fmt.Errorf("tags[%d] must be a positive integer", i)
+		}
+		if _, ok := seenTags[tagID]; ok {
+			return fmt.Errorf("duplicate tag id %d", tagID)
+		}
+		seenTags[tagID] = struct{}{}
+	}
+
+	return validateReservationRange(req.StartAt, req.EndAt)
+}
+
+// normalizeLivestreamTitle は前後の空白を取り除いたタイトルを返す。空・長すぎる・制御文字を含むタイトルはエラーにする
+// 予約と更新(PATCH)で同じ検証をするために使う
+func normalizeLivestreamTitle(title string) (string, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return "", errors.New("title must not be empty")
+	}
+	if utf8.RuneCountInString(title) > maxLivestreamTitleLength {
+		return "", fmt.Errorf("title must be at most %d characters", maxLivestreamTitleLength)
+	}
+	if strings.IndexFunc(title, unicode.IsControl) >= 0 {
+		return "", errors.New("title must not contain control characters")
+	}
+	return title, nil
+}
+
+// normalizeLivestreamDescription は前後の空白を取り除いた説明文を返す。長すぎる説明文はエラーにする
+func normalizeLivestreamDescription(description string) (string, error) {
+	description = strings.TrimSpace(description)
+	if utf8.RuneCountInString(description) > maxLivestreamDescriptionLength {
+		return "", fmt.Errorf("description must be at most %d characters", maxLivestreamDescriptionLength)
+	}
+	return description, nil
+}
+
+// validateReservationRange は予約区間 [startAt, endAt) が予約可能な期間内で、予約枠の単位に揃っているかを検証する
+func validateReservationRange(startAt, endAt int64) error {
+	if startAt >= endAt {
+		return errors.New("start_at must be before end_at")
+	}
+	// 予約枠は1時間単位なので、区間も1時間単位に揃っている必要がある
+	if startAt%reservationSlotSeconds != 0 || endAt%reservationSlotSeconds != 0 {
+		return errors.New("start_at and end_at must be aligned to hourly reservation slots")
 	}
-	defer tx.Rollback()
 
 	// 2023/11/25 10:00からの１年間の期間内であるかチェック
+	// time.Unix はサーバのローカルタイムゾーンになるので、期間の境界と同じUTCに揃えて比較する
 	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
+		reserveStartAt = time.Unix(startAt, 0).UTC()
+		reserveEndAt   = time.Unix(endAt, 0).UTC()
 	)
 	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+		return errors.New("bad reservation time range")
 	}
+	return nil
+}
+
+// reserveLivestream は予約枠の確保から配信の登録までを1トランザクションで行う
+// コミットは末尾の1回だけで、それより前で返るとdeferのRollbackで予約枠の減算ごと取り消される
+func reserveLivestream(ctx context.Context, c echo.Context, userID int64, req *ReserveLivestreamRequest) (Livestream, error) {
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return Livestream{}, httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
 
 	// 予約枠をみて、予約が可能か調べる
 	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
+	slots, err := overlappingSlots(ctx, tx, req.StartAt, req.EndAt, true)
+	if err != nil {
 		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+		return Livestream{}, httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reservation_slots", err)
 	}
+	if !slotsAlignWith(slots, req.StartAt, req.EndAt) {
+		return Livestream{}, httpError(c, http.StatusBadRequest, errCodeBadRequest, "start_at and end_at must be on reservation slot boundaries", nil)
+	}
+	// 埋まっている枠をすべて集めて、どの枠が予約できないかをクライアントに返す
+	conflicts := []ReservationSlotConflict{}
 	for _, slot := range slots {
-		var count int
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+		var count int64
+		const query = "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?"
+		done := traceQuery(ctx, query)
+		err := tx.GetContext(ctx, &count, query, slot.StartAt, slot.EndAt)
+		done()
+		if err != nil {
+			return Livestream{}, httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reservation_slots", err)
 		}
 		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
 		if count < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
+			conflicts = append(conflicts, ReservationSlotConflict{
+				StartAt:   slot.StartAt,
+				EndAt:     slot.EndAt,
+				Remaining: count,
+			})
+		}
+	}
+	if len(conflicts) > 0 {
+		return Livestream{}, &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    errCodeReservationSlotFull,
+			Message: fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt),
+			Details: conflicts,
+		}
+	}
+
+	if rejectOverlappingOwnReservations {
+		// 重なる予約同士は同じ予約枠の行ロックで直列化されるので、ここでのロックは不要
+		var overlapping int64
+		if err := tx.GetContext(ctx, &overlapping, "SELECT COUNT(*) FROM livestreams WHERE user_id = ? AND deleted_at IS NULL AND start_at < ? AND end_at > ?", userID, req.EndAt, req.StartAt); err != nil {
+			return Livestream{}, httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to count overlapping livestreams", err)
+		}
+		if overlapping > 0 {
+			return Livestream{}, httpError(c, http.StatusConflict, errCodeReservationOverlap, "you already have a livestream overlapping the requested time range", nil)
 		}
 	}
 
@@ -130,136 +522,655 @@ func reserveLivestreamHandler(c echo.Context) error {
 			ThumbnailUrl: req.ThumbnailUrl,
 			StartAt:      req.StartAt,
 			EndAt:        req.EndAt,
+			CreatedAt:    time.Now().Unix(),
 		}
 	)
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	if len(slots) == 0 {
+		// 予約枠を1つも消費しない予約は作らない
+		return Livestream{}, httpError(c, http.StatusBadRequest, errCodeBadRequest, "no reservation slots match the requested time range", nil)
+	}
+	if err := adjustSlots(ctx, tx, slotIDs(slots), -1); err != nil {
+		if errors.Is(err, errReservationSlotsNotAdjusted) {
+			return Livestream{}, httpError(c, http.StatusBadRequest, errCodeBadRequest, "reservation slots for the requested time range could not be consumed", err)
+		}
+		return Livestream{}, httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to update reservation_slot", err)
+	}
+
+	if err := insertReservedLivestream(ctx, tx, livestreamModel, req.Tags); err != nil {
+		return Livestream{}, httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to insert livestream", err)
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
+	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+		return Livestream{}, httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill livestream", err)
 	}
 
-	livestreamID, err := rs.LastInsertId()
+	if err := tx.Commit(); err != nil {
+		return Livestream{}, httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	return livestream, nil
+}
+
+// searchPagination は検索系APIのlimit/offset/orderクエリパラメータ
+type searchPagination struct {
+	// Limit が0の場合は件数制限なし
+	Limit  int
+	Offset int
+	// Desc がtrueなら新しい順(newest)、falseなら古い順(oldest)
+	Desc bool
+}
+
+// 一覧系APIで指定できるlimitの上限
+const maxLimit = 100
+
+// ランキング系APIでlimitが省略された場合の件数
+const defaultRankingLimit = 10
+
+// parseLimitQuery はlimitクエリパラメータを読み取り、[1, maxLimit] に収めて返す
+// 指定されていない場合は0を返す
+func parseLimitQuery(c echo.Context) (int, error) {
+	v := c.QueryParam("limit")
+	if v == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(v)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+		return 0, httpError(c, http.StatusBadRequest, errCodeBadRequest, "limit query parameter must be integer", nil)
 	}
-	livestreamModel.ID = livestreamID
+	if limit < 1 {
+		return 0, httpError(c, http.StatusBadRequest, errCodeBadRequest, "limit query parameter must be positive", nil)
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return limit, nil
+}
 
-	// タグ追加
-	for _, tagID := range req.Tags {
-		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
-			LivestreamID: livestreamID,
-			TagID:        tagID,
-		}); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+// parseID はパスパラメータ name をIDとして読み取る
+// 整数でない値や0以下の値は400を返す
+func parseID(c echo.Context, name string) (int64, error) {
+	id, err := strconv.ParseInt(c.Param(name), 10, 64)
+	if err != nil {
+		return 0, httpError(c, http.StatusBadRequest, errCodeBadRequest, name+" in path must be integer", nil)
+	}
+	if id < 1 {
+		return 0, httpError(c, http.StatusBadRequest, errCodeBadRequest, name+" in path must be positive", nil)
+	}
+	return id, nil
+}
+
+func parseSearchPagination(c echo.Context) (searchPagination, error) {
+	p := searchPagination{Desc: true}
+	limit, err := parseLimitQuery(c)
+	if err != nil {
+		return p, err
+	}
+	p.Limit = limit
+	if v := c.QueryParam("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil {
+			return p, httpError(c, http.StatusBadRequest, errCodeBadRequest, "offset query parameter must be integer", nil)
+		}
+		if offset < 0 {
+			return p, httpError(c, http.StatusBadRequest, errCodeBadRequest, "offset query parameter must not be negative", nil)
+		}
+		p.Offset = offset
+	}
+	switch c.QueryParam("order") {
+	case "", "newest":
+		p.Desc = true
+	case "oldest":
+		p.Desc = false
+	default:
+		return p, httpError(c, http.StatusBadRequest, errCodeBadRequest, "order query parameter must be newest or oldest", nil)
+	}
+	return p, nil
+}
+
+// apply は query に ORDER BY と LIMIT/OFFSET を付与し、バインドするパラメータを返す
+// orderColumn が同じ値の行でもページ間で順序が揺れないよう、同じ向きの id で順序を確定させる
+func (p searchPagination) apply(query string, orderColumn string, args []interface{}) (string, []interface{}) {
+	direction := " ASC"
+	if p.Desc {
+		direction = " DESC"
+	}
+	query += " ORDER BY " + orderColumn + direction
+	// "l.id" のようなテーブル別名付きの列ならタイブレークにも同じ別名を付ける
+	idColumn := "id"
+	if i := strings.LastIndex(orderColumn, "."); i >= 0 {
+		idColumn = orderColumn[:i+1] + "id"
+	}
+	if idColumn != orderColumn {
+		query += ", " + idColumn + direction
+	}
+	switch {
+	case p.Limit > 0:
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, p.Limit, p.Offset)
+	case p.Offset > 0:
+		// MySQLはLIMIT無しのOFFSETを受け付けないので、上限なしのLIMITを指定する
+		query += " LIMIT 18446744073709551615 OFFSET ?"
+		args = append(args, p.Offset)
+	}
+	return query, args
+}
+
+// ListEnvelope は envelope=1 を指定した一覧取得APIのレスポンス
+// 続きがあるか (has_more) を、追加のリクエスト無しに判定できるようにする
+type ListEnvelope struct {
+	Items interface{} `json:"items"`
+	// 次のページを取得するためのカーソル。続きが無い場合は省略する
+	// 配信検索では before_id (order=oldest なら after_id)、リアクション一覧では cursor に渡す
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// envelopeQuery は一覧をListEnvelopeで包んで返すか (envelope=1) を返す
+// デフォルトは互換性のため配列のまま返す
+func envelopeQuery(c echo.Context) bool {
+	return c.QueryParam("envelope") == "1"
+}
+
+// fetchOneMore は続きがあるかを判定するため、enabled なら limit を1件多くしたものを返す
+func (p searchPagination) fetchOneMore(enabled bool) searchPagination {
+	if enabled && p.Limit > 0 {
+		p.Limit++
+	}
+	return p
+}
+
+// 配信検索で次のページの before_id を返すレスポンスヘッダ
+const headerNextBeforeID = "X-Next-Before-Id"
+
+// escapeLike はLIKE句のメタ文字(%, _)とエスケープ文字をエスケープし、リテラルとして検索できるようにする
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// startAtRange は配信検索の開始時刻による絞り込み [From, To)。nil の側は制限しない
+type startAtRange struct {
+	From *int64
+	To   *int64
+}
+
+// parseStartAtRangeQuery は from, to (unix秒) クエリパラメータを読み取る
+// 両方指定された場合は from < to でなければ400を返す
+func parseStartAtRangeQuery(c echo.Context) (startAtRange, error) {
+	from, err := parseOptionalUnixQuery(c, "from")
+	if err != nil {
+		return startAtRange{}, err
+	}
+	to, err := parseOptionalUnixQuery(c, "to")
+	if err != nil {
+		return startAtRange{}, err
+	}
+	if from != nil && to != nil && *from >= *to {
+		return startAtRange{}, httpError(c, http.StatusBadRequest, errCodeBadRequest, "from must be before to", nil)
+	}
+	return startAtRange{From: from, To: to}, nil
+}
+
+// parseOptionalUnixQuery はunix秒のクエリパラメータ name を読み取る。未指定なら nil を返す
+func parseOptionalUnixQuery(c echo.Context, name string) (*int64, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return nil, httpError(c, http.StatusBadRequest, errCodeBadRequest, name+" query parameter must be non-negative integer", nil)
+	}
+	return &n, nil
+}
+
+// 配信検索で一度に指定できるタグの数
+const maxSearchTags = 20
+
+// tagFilter は配信検索のタグによる絞り込み条件
+type tagFilter struct {
+	Names []string
+	// MatchAll が true ならすべてのタグ、false ならいずれかのタグが付いた配信に絞り込む
+	MatchAll bool
+}
+
+// parseTagFilterQuery はタグによる絞り込みのクエリパラメータを読み取る
+// tags はカンマ区切りのタグ名、match は any (いずれか、省略時) か all (すべて)
+// 従来の tag も1つのタグとして扱い、tags と併用した場合は合わせて絞り込む
+func parseTagFilterQuery(c echo.Context) (tagFilter, error) {
+	var filter tagFilter
+	switch c.QueryParam("match") {
+	case "", "any":
+	case "all":
+		filter.MatchAll = true
+	default:
+		return tagFilter{}, httpError(c, http.StatusBadRequest, errCodeBadRequest, "match query parameter must be any or all", nil)
+	}
+
+	seen := map[string]struct{}{}
+	for _, name := range append([]string{c.QueryParam("tag")}, strings.Split(c.QueryParam("tags"), ",")...) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		filter.Names = append(filter.Names, name)
+	}
+	if len(filter.Names) > maxSearchTags {
+		return tagFilter{}, httpError(c, http.StatusBadRequest, errCodeBadRequest, fmt.Sprintf("tags query parameter must have at most %d tags", maxSearchTags), nil)
+	}
+	return filter, nil
+}
+
+func searchLivestreamsHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+	tagQuery, err := parseTagFilterQuery(c)
+	if err != nil {
+		return err
+	}
+
+	pagination, err := parseSearchPagination(c)
+	if err != nil {
+		return err
+	}
+	// before_id を指定するとキーセットページネーションになり、ページ送り中に配信が追加されても重複・欠落しない
+	var beforeID int64
+	if v := c.QueryParam("before_id"); v != "" {
+		beforeID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, "before_id query parameter must be integer", nil)
+		}
+		if beforeID < 1 {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, "before_id query parameter must be positive", nil)
+		}
+		if pagination.Offset > 0 || !pagination.Desc {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, "before_id can't be used with offset or order=oldest", nil)
+		}
+	}
+	// order=oldest では after_id で同じようにページ送りする
+	var afterID int64
+	if v := c.QueryParam("after_id"); v != "" {
+		afterID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, "after_id query parameter must be integer", nil)
+		}
+		if afterID < 1 {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, "after_id query parameter must be positive", nil)
+		}
+		if pagination.Offset > 0 || pagination.Desc {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, "after_id can only be used with order=oldest and without offset", nil)
+		}
+	}
+	startRange, err := parseStartAtRangeQuery(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		livestreamModels []*LivestreamModel
+		query            = "SELECT l.* FROM livestreams l"
+		// 論理削除された配信は検索対象外
+		conditions = []string{"l.deleted_at IS NULL"}
+		params     []interface{}
+		// タグで絞り込む場合に、WHERE の後ろに付けるGROUP BY・HAVING句とその引数
+		groupBy       string
+		groupByParams []interface{}
+	)
+	if len(tagQuery.Names) > 0 {
+		// タグによる絞り込み
+		// タグごとに副問い合わせを作らず、livestream_tags を1度だけJOINして配信ごとにまとめる
+		var tagIDList []int64
+		missing := false
+		for _, name := range tagQuery.Names {
+			ids, err := getTagIDsByName(ctx, tx, name)
+			if err != nil {
+				return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get tags", err)
+			}
+			if len(ids) == 0 {
+				missing = true
+			}
+			tagIDList = append(tagIDList, ids...)
+		}
+		if len(tagIDList) == 0 || (tagQuery.MatchAll && missing) {
+			// 存在しないタグ名で絞り込んだ場合は空のIN句を作らずに空の結果を返す
+			// match=all では、1つでも存在しないタグがあれば該当する配信はない
+			if err := tx.Commit(); err != nil {
+				return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+			}
+			if envelopeQuery(c) {
+				return negotiatedResponse(c, http.StatusOK, ListEnvelope{Items: []Livestream{}})
+			}
+			return negotiatedResponse(c, http.StatusOK, []Livestream{})
+		}
+		query += " INNER JOIN livestream_tags lt ON lt.livestream_id = l.id"
+		conditions = append(conditions, "lt.tag_id IN (?)")
+		params = append(params, tagIDList)
+		// 複数のタグが付いた配信が重複しないよう配信ごとにまとめる (l.id は主キーなので l.* をそのまま選べる)
+		groupBy = " GROUP BY l.id"
+		if tagQuery.MatchAll {
+			// タグ名は一意なので、一致したタグの種類数がタグ名の数と等しければすべてのタグが付いている
+			groupBy += " HAVING COUNT(DISTINCT lt.tag_id) = ?"
+			groupByParams = append(groupByParams, len(tagQuery.Names))
+		}
+	}
+	if keyword := c.QueryParam("q"); keyword != "" {
+		// タイトルの部分一致による絞り込み
+		conditions = append(conditions, "l.title LIKE CONCAT('%', ?, '%')")
+		params = append(params, escapeLike(keyword))
+	}
+	if startRange.From != nil {
+		conditions = append(conditions, "l.start_at >= ?")
+		params = append(params, *startRange.From)
+	}
+	if startRange.To != nil {
+		conditions = append(conditions, "l.start_at < ?")
+		params = append(params, *startRange.To)
+	}
+	if beforeID > 0 {
+		conditions = append(conditions, "l.id < ?")
+		params = append(params, beforeID)
+	}
+	if afterID > 0 {
+		conditions = append(conditions, "l.id > ?")
+		params = append(params, afterID)
+	}
+	query += " WHERE " + strings.Join(conditions, " AND ") + groupBy
+	params = append(params, groupByParams...)
+
+	query, params, err = sqlx.In(query, params...)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to construct IN query", err)
+	}
+	envelope := envelopeQuery(c)
+	query, params = pagination.fetchOneMore(envelope).apply(query, "l.id", params)
+	if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestreams", err)
+	}
+	hasMore := false
+	if envelope && pagination.Limit > 0 && len(livestreamModels) > pagination.Limit {
+		hasMore = true
+		livestreamModels = livestreamModels[:pagination.Limit]
+	}
+	// 新しい順でページが埋まった場合は、次のページを取得するための before_id をヘッダで返す
+	// レスポンスボディは従来通り配列のまま
+	// envelope の next_cursor は、新しい順なら before_id、古い順なら after_id に渡す
+	var nextCursor string
+	if pagination.Limit > 0 && len(livestreamModels) == pagination.Limit {
+		nextCursor = strconv.FormatInt(livestreamModels[len(livestreamModels)-1].ID, 10)
+		if pagination.Desc {
+			c.Response().Header().Set(headerNextBeforeID, nextCursor)
+		}
+	}
+
+	// []*LivestreamModel から []LivestreamModel に変換
+	livestreamModelsValue := make([]LivestreamModel, len(livestreamModels))
+	for i, lm := range livestreamModels {
+		livestreamModelsValue[i] = *lm
+	}
+
+	// バルク関数で一括取得したLivestreamレスポンスを処理
+	livestreamMap, err := fillLivestreamResponseBulk(ctx, tx, livestreamModelsValue)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill livestreams", err)
+	}
+	if withReactionsQuery(c) {
+		if err := fillLivestreamReactionSummaries(ctx, tx, livestreamMap); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill reaction summaries", err)
+		}
+	}
+
+	// 取得したデータを返却用のスライスに変換
+	livestreams := make([]Livestream, 0, len(livestreamModels))
+	for _, livestreamModel := range livestreamModels {
+		livestream, ok := livestreamMap[livestreamModel.ID]
+		if !ok {
+			// 配信者が見つからず読み飛ばされた配信
+			continue
+		}
+		livestreams = append(livestreams, livestream)
+	}
+
+	// トランザクションをコミット
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	if envelope {
+		if !hasMore {
+			nextCursor = ""
+		}
+		return negotiatedResponse(c, http.StatusOK, ListEnvelope{
+			Items:      livestreams,
+			NextCursor: nextCursor,
+			HasMore:    hasMore,
+		})
+	}
+	return negotiatedResponse(c, http.StatusOK, livestreams)
+}
+
+// 配信一括取得API
+// POST /api/livestream/batch
+// 指定されたIDの順に配信を返す。存在しない(削除済みを含む)IDは読み飛ばし、重複したIDは最初の1件だけ返す
+func getLivestreamsByIDsHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	var req *GetLivestreamsByIDsRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return err
+	}
+	// 上限は重複を除いた件数で判定する
+	ids := uniqueIDs(req.IDs)
+	if len(ids) > maxLivestreamBatchIDs {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, fmt.Sprintf("too many ids: at most %d ids are allowed", maxLivestreamBatchIDs), nil)
+	}
+	if len(ids) == 0 {
+		return c.JSON(http.StatusOK, []Livestream{})
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?) AND deleted_at IS NULL", ids)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to construct IN query", err)
+	}
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, tx.Rebind(query), params...); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestreams", err)
+	}
+
+	livestreamMap, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill livestreams", err)
+	}
+	if withReactionsQuery(c) {
+		if err := fillLivestreamReactionSummaries(ctx, tx, livestreamMap); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill reaction summaries", err)
+		}
+	}
+
+	// リクエストされた順に並べる
+	livestreams := make([]Livestream, 0, len(livestreamModels))
+	for _, id := range ids {
+		livestream, ok := livestreamMap[id]
+		if !ok {
+			continue
+		}
+		livestreams = append(livestreams, livestream)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+// 配信中の配信一覧取得API
+// GET /api/livestream/live
+// サーバ時刻で start_at <= now < end_at の配信を返す (開始時刻ちょうどは配信中、終了時刻ちょうどは終了済み)
+func getLivePlayingHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	pagination, err := parseSearchPagination(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	query, params := pagination.apply("SELECT * FROM livestreams WHERE start_at <= ? AND end_at > ? AND deleted_at IS NULL", "start_at", []interface{}{now, now})
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestreams", err)
+	}
+
+	livestreamMap, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill livestreams", err)
+	}
+
+	livestreams := make([]Livestream, 0, len(livestreamModels))
+	for _, livestreamModel := range livestreamModels {
+		livestream, ok := livestreamMap[livestreamModel.ID]
+		if !ok {
+			// 配信者が見つからず読み飛ばされた配信
+			continue
 		}
-	}
-
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		livestreams = append(livestreams, livestream)
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
 	}
 
-	return c.JSON(http.StatusCreated, livestream)
+	return c.JSON(http.StatusOK, livestreams)
 }
 
-func searchLivestreamsHandler(c echo.Context) error {
-	ctx := c.Request().Context()
-	keyTagName := c.QueryParam("tag")
+// トレンドの集計対象とする直近のリアクションの期間
+const trendingWindowSeconds = 10 * 60
+
+// トレンド配信一覧取得API
+// GET /api/livestream/trending
+// 直近 trendingWindowSeconds のリアクション数が多い順に返す。直近のリアクションが無ければ新しい順に返す
+// exclude_ended=1 を指定すると終了済みの配信を除く
+func getTrendingHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	limit, err := parseLimitQuery(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return err
 	}
-	defer tx.Rollback()
+	if limit == 0 {
+		limit = defaultRankingLimit
+	}
+	excludeEnded := c.QueryParam("exclude_ended") == "1"
 
-	var livestreamModels []*LivestreamModel
-	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		var tagIDList []int
-		if err := tx.SelectContext(ctx, &tagIDList, "SELECT id FROM tags WHERE name = ?", keyTagName); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
-		}
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
 
-		query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDList)
+	now := time.Now().Unix()
+	query := `SELECT l.id FROM reactions r
+		INNER JOIN livestreams l ON l.id = r.livestream_id
+		WHERE r.created_at >= ? AND l.deleted_at IS NULL`
+	params := []interface{}{now - trendingWindowSeconds}
+	if excludeEnded {
+		query += " AND l.end_at > ?"
+		params = append(params, now)
+	}
+	query += " GROUP BY l.id ORDER BY COUNT(*) DESC, l.id DESC LIMIT ?"
+	params = append(params, limit)
+	var trendingIDs []int64
+	if err := tx.SelectContext(ctx, &trendingIDs, query, params...); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get trending livestreams", err)
+	}
+
+	var livestreamModels []LivestreamModel
+	if len(trendingIDs) > 0 {
+		query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", trendingIDs)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to construct IN query", err)
 		}
-		var keyTaggedLivestreams []*LivestreamTagModel
-		if err := tx.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
-		}
-
-		for _, keyTaggedLivestream := range keyTaggedLivestreams {
-			ls := LivestreamModel{}
-			if err := tx.GetContext(ctx, &ls, "SELECT * FROM livestreams WHERE id = ?", keyTaggedLivestream.LivestreamID); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-			}
-
-			livestreamModels = append(livestreamModels, &ls)
+		if err := tx.SelectContext(ctx, &livestreamModels, tx.Rebind(query), params...); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestreams", err)
 		}
 	} else {
-		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
+		// 直近のリアクションが無い場合は新しい順
+		query := "SELECT * FROM livestreams WHERE deleted_at IS NULL"
+		params := []interface{}{}
+		if excludeEnded {
+			query += " AND end_at > ?"
+			params = append(params, now)
 		}
-
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		query += " ORDER BY id DESC LIMIT ?"
+		params = append(params, limit)
+		if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestreams", err)
+		}
+		for _, livestreamModel := range livestreamModels {
+			trendingIDs = append(trendingIDs, livestreamModel.ID)
 		}
 	}
 
-	// []*LivestreamModel から []LivestreamModel に変換
-	livestreamModelsValue := make([]LivestreamModel, len(livestreamModels))
-	for i, lm := range livestreamModels {
-		livestreamModelsValue[i] = *lm
-	}
-
-	// バルク関数で一括取得したLivestreamレスポンスを処理
-	livestreamMap, err := fillLivestreamResponseBulk(ctx, tx, livestreamModelsValue)
+	livestreamMap, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill livestreams", err)
 	}
 
-	// 取得したデータを返却用のスライスに変換
-	livestreams := make([]Livestream, 0, len(livestreamModels))
-	for _, livestreamModel := range livestreamModels {
-		livestream, ok := livestreamMap[livestreamModel.ID]
+	livestreams := make([]Livestream, 0, len(trendingIDs))
+	for _, id := range trendingIDs {
+		livestream, ok := livestreamMap[id]
 		if !ok {
-			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("livestream not found for ID %d", livestreamModel.ID))
+			// 配信者が見つからず読み飛ばされた配信
+			continue
 		}
 		livestreams = append(livestreams, livestream)
 	}
 
-	// トランザクションをコミット
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
 	}
 
 	return c.JSON(http.StatusOK, livestreams)
 }
 
 func getMyLivestreamsHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 	if err := verifyUserSession(c); err != nil {
 		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
 	}
 	defer tx.Rollback()
 
@@ -269,63 +1180,64 @@ func getMyLivestreamsHandler(c echo.Context) error {
 	userID := sess.Values[defaultUserIDKey].(int64)
 
 	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? AND deleted_at IS NULL", userID); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestreams", err)
 	}
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i := range livestreamModels {
 		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+			return fillLivestreamErrorResponse(c, err)
 		}
 		livestreams[i] = livestream
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
 	}
 
 	return c.JSON(http.StatusOK, livestreams)
 }
 
 func getUserLivestreamsHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 	if err := verifyUserSession(c); err != nil {
 		return err
 	}
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
 	}
 	defer tx.Rollback()
 
 	var user UserModel
 	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "user not found")
+			return httpError(c, http.StatusNotFound, errCodeNotFound, "user not found", nil)
 		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get user", err)
 		}
 	}
 
 	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? AND deleted_at IS NULL", user.ID); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestreams", err)
 	}
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i := range livestreamModels {
 		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+			return fillLivestreamErrorResponse(c, err)
 		}
 		livestreams[i] = livestream
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
 	}
 
 	return c.JSON(http.StatusOK, livestreams)
@@ -333,139 +1245,417 @@ func getUserLivestreamsHandler(c echo.Context) error {
 
 // viewerテーブルの廃止
 func enterLivestreamHandler(c echo.Context) error {
-	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	ctx, cancel := txContext(c)
+	defer cancel()
+	userID := sessionUserID(c)
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseID(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id must be integer")
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
 	}
 	defer tx.Rollback()
 
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
+		LivestreamID: livestreamID,
 		CreatedAt:    time.Now().Unix(),
 	}
 
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
+	if maxViewingLivestreamsPerUser > 0 {
+		// 視聴中の配信への再入室は上限に数えない
+		var viewingCount int64
+		if err := tx.GetContext(ctx, &viewingCount, "SELECT COUNT(*) FROM livestream_viewers_history WHERE user_id = ? AND livestream_id <> ? FOR UPDATE", viewer.UserID, viewer.LivestreamID); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to count livestream_view_history", err)
+		}
+		if viewingCount >= int64(maxViewingLivestreamsPerUser) {
+			return httpError(c, http.StatusTooManyRequests, errCodeTooManyViewingLivestreams, fmt.Sprintf("too many viewing livestreams: at most %d livestreams can be viewed at the same time", maxViewingLivestreamsPerUser), nil)
+		}
+	}
+
+	// 再入室(リロードや再接続)で行が増えないよう、既に視聴中ならcreated_atの更新のみ行う
+	// NOTE: livestream_viewers_history に UNIQUE KEY (user_id, livestream_id) が必要
+	// 同時に入室しても一意キーで1行にまとまるので、存在確認のロックは取らない
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at) ON DUPLICATE KEY UPDATE created_at = VALUES(created_at)", viewer); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to insert livestream_view_history", err)
+	}
+
+	// livestream_viewers_history は退出で消えるので、延べ視聴者数や推移のために入室を別に追記しておく
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewer_entries (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to insert livestream_viewer_entry", err)
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
 	}
 
 	return c.NoContent(http.StatusOK)
 }
 
 func exitLivestreamHandler(c echo.Context) error {
-	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+	ctx, cancel := txContext(c)
+	defer cancel()
+	userID := sessionUserID(c)
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if _, err := deleteViewerHistory(ctx, tx, userID, livestreamID); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to delete livestream_view_history", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// deleteViewerHistory はユーザの配信の視聴記録を削除し、削除した行数を返す
+func deleteViewerHistory(ctx context.Context, tx *sqlx.Tx, userID, livestreamID int64) (int64, error) {
+	rs, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return 0, err
+	}
+	return rs.RowsAffected()
+}
+
+type ExitAllLivestreamResponse struct {
+	Deleted int64 `json:"deleted"`
+}
+
+// 視聴終了API (全セッション分)
+// DELETE /api/livestream/:livestream_id/exit/all
+// 視聴記録は (user_id, livestream_id) で一意なので、複数タブから入室していても記録は1行で、exit と同じ行を削除する
+// exit の別名で、違いは削除した件数 (0か1) を返すことだけ。入室の履歴 (livestream_viewer_entries) は統計に使うので残す
+func exitAllLivestreamHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+	userID := sessionUserID(c)
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
+	deleted, err := deleteViewerHistory(ctx, tx, userID, livestreamID)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to delete livestream_view_history", err)
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
 	}
 
-	return c.NoContent(http.StatusOK)
+	return c.JSON(http.StatusOK, ExitAllLivestreamResponse{
+		Deleted: deleted,
+	})
 }
 
 func getLivestreamHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
 	if err := verifyUserSession(c); err != nil {
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseID(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
 	}
 	defer tx.Rollback()
 
 	livestreamModel := LivestreamModel{}
-	err = tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
+	err = tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? AND deleted_at IS NULL", livestreamID)
 	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		return httpError(c, http.StatusNotFound, errCodeNotFound, "not found livestream that has the given id", nil)
+	}
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestream", err)
+	}
+
+	livestream, err := fillLivestreamResponseCached(ctx, tx, livestreamModel)
+	if err != nil {
+		return fillLivestreamErrorResponse(c, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// 配信情報更新API
+// PATCH /api/livestream/:livestream_id
+func updateLivestreamHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	userID := sessionUserID(c)
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	var req *UpdateLivestreamRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return err
+	}
+	if req.StartAt != nil || req.EndAt != nil {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "start_at and end_at can't be changed", nil)
+	}
+	if req.Version == nil {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "version is required", nil)
+	}
+
+	var (
+		sets   []string
+		params []interface{}
+	)
+	// 予約時と同じ検証をし、予約では弾かれるタイトルを更新で保存できないようにする
+	if req.Title != nil {
+		title, err := normalizeLivestreamTitle(*req.Title)
+		if err != nil {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, err.Error(), nil)
+		}
+		sets = append(sets, "title = ?")
+		params = append(params, title)
+	}
+	if req.Description != nil {
+		description, err := normalizeLivestreamDescription(*req.Description)
+		if err != nil {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, err.Error(), nil)
+		}
+		sets = append(sets, "description = ?")
+		params = append(params, description)
+	}
+	if req.ThumbnailUrl != nil {
+		if utf8.RuneCountInString(*req.ThumbnailUrl) > maxLivestreamThumbnailURLLength {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, fmt.Sprintf("thumbnail_url must be at most %d characters", maxLivestreamThumbnailURLLength), nil)
+		}
+		sets = append(sets, "thumbnail_url = ?")
+		params = append(params, *req.ThumbnailUrl)
 	}
+
+	tx, err := beginTx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	livestreamModel := LivestreamModel{}
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? AND deleted_at IS NULL FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return httpError(c, http.StatusNotFound, errCodeNotFound, "not found livestream that has the given id", nil)
+		}
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestream", err)
+	}
+	if livestreamModel.UserID != userID {
+		return httpError(c, http.StatusForbidden, errCodeForbidden, "can't update other streamer's livestream", nil)
+	}
+
+	if len(sets) == 0 && livestreamModel.Version != *req.Version {
+		return httpError(c, http.StatusConflict, errCodeLivestreamVersionConflict, "livestream has been updated by another session", nil)
+	}
+	if len(sets) > 0 {
+		sets = append(sets, "version = version + 1")
+		query := "UPDATE livestreams SET " + strings.Join(sets, ", ") + " WHERE id = ? AND version = ?"
+		params = append(params, livestreamID, *req.Version)
+		rs, err := tx.ExecContext(ctx, query, params...)
+		if err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to update livestream", err)
+		}
+		updated, err := rs.RowsAffected()
+		if err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get affected rows", err)
+		}
+		if updated == 0 {
+			return httpError(c, http.StatusConflict, errCodeLivestreamVersionConflict, "livestream has been updated by another session", nil)
+		}
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestream", err)
+		}
 	}
 
 	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		return fillLivestreamErrorResponse(c, err)
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
 	}
+	livestreamResponseCache.invalidate(livestreamID)
 
 	return c.JSON(http.StatusOK, livestream)
 }
 
+// 配信削除API
+// DELETE /api/livestream/:livestream_id
+// リアクションやライブコメントが孤立しないよう論理削除し、確保していた予約枠を戻す
+func deleteLivestreamHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	userID := sessionUserID(c)
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	livestreamModel := LivestreamModel{}
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? AND deleted_at IS NULL FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return httpError(c, http.StatusNotFound, errCodeNotFound, "not found livestream that has the given id", nil)
+		}
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestream", err)
+	}
+	if livestreamModel.UserID != userID {
+		return httpError(c, http.StatusForbidden, errCodeForbidden, "can't delete other streamer's livestream", nil)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET deleted_at = ? WHERE id = ?", time.Now().Unix(), livestreamID); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to delete livestream", err)
+	}
+
+	// 予約時に減らした枠を戻す
+	slots, err := overlappingSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt, true)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reservation_slots", err)
+	}
+	if err := adjustSlots(ctx, tx, slotIDs(slots), 1); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to restore reservation_slot", err)
+	}
+	// 戻した枠を待っている予約待ちがあれば、同じトランザクションで予約に繰り上げる
+	promotedID, err := promoteReservationWaitlist(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to promote reservation waitlist", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+	livestreamResponseCache.invalidate(livestreamID)
+	if promotedID != 0 {
+		c.Logger().Infof("予約待ちを配信 %d として予約しました (削除された配信 %d の枠)", promotedID, livestreamID)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 配信のタグ一覧取得API
+// GET /api/livestream/:livestream_id/tags
+func getLivestreamTagsHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM livestreams WHERE id = ? AND deleted_at IS NULL)", livestreamID); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestream", err)
+	}
+	if !exists {
+		return httpError(c, http.StatusNotFound, errCodeNotFound, "not found livestream that has the given id", nil)
+	}
+
+	// タグ名はタグキャッシュから引き、livestream_tags からはIDだけを取る
+	var tagIDs []int64
+	if err := tx.SelectContext(ctx, &tagIDs, "SELECT tag_id FROM livestream_tags WHERE livestream_id = ? ORDER BY id", livestreamID); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestream tags", err)
+	}
+	tagMap, err := getTagsByIDs(ctx, tx, uniqueIDs(tagIDs))
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get tags", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	tags := make([]Tag, 0, len(tagIDs))
+	for _, tagID := range tagIDs {
+		tag, ok := tagMap[tagID]
+		if !ok {
+			// fillLivestreamResponseBulk と同じく、削除済みのタグは読み飛ばす
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return c.JSON(http.StatusOK, tags)
+}
+
 func getLivecommentReportsHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
 	if err := verifyUserSession(c); err != nil {
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseID(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
 	}
 	defer tx.Rollback()
 
 	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? AND deleted_at IS NULL", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return httpError(c, http.StatusNotFound, errCodeNotFound, "livestream not found", nil)
+		}
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestream", err)
 	}
 
 	// error already check
@@ -474,33 +1664,55 @@ func getLivecommentReportsHandler(c echo.Context) error {
 	userID := sess.Values[defaultUserIDKey].(int64)
 
 	if livestreamModel.UserID != userID {
-		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
+		return httpError(c, http.StatusForbidden, errCodeForbidden, "can't get other streamer's livecomment reports", nil)
 	}
 
 	var reportModels []*LivecommentReportModel
 	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livecomment reports", err)
 	}
 
 	reports := make([]LivecommentReport, len(reportModels))
 	for i := range reportModels {
 		report, err := fillLivecommentReportResponse(ctx, tx, *reportModels[i])
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill livecomment report", err)
 		}
 		reports[i] = report
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
 	}
 
 	return c.JSON(http.StatusOK, reports)
 }
 
+var (
+	// errLivestreamOwnerNotFound は配信者のユーザが削除されている場合のエラー
+	errLivestreamOwnerNotFound = errors.New("livestream owner not found")
+	// errLivestreamTagNotFound は配信に紐づくタグが削除されている場合のエラー
+	errLivestreamTagNotFound = errors.New("livestream tag not found")
+)
+
+// fillLivestreamErrorResponse は fillLivestreamResponse のエラーをレスポンスに変換する
+func fillLivestreamErrorResponse(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, errLivestreamOwnerNotFound):
+		return httpError(c, http.StatusNotFound, errCodeLivestreamOwnerNotFound, "owner of the livestream not found", err)
+	case errors.Is(err, errLivestreamTagNotFound):
+		return httpError(c, http.StatusInternalServerError, errCodeLivestreamTagNotFound, "tag of the livestream not found", err)
+	default:
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill livestream", err)
+	}
+}
+
 func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (Livestream, error) {
 	ownerModel := UserModel{}
 	if err := tx.GetContext(ctx, &ownerModel, "SELECT * FROM users WHERE id = ?", livestreamModel.UserID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Livestream{}, fmt.Errorf("%w: livestream_id=%d, user_id=%d", errLivestreamOwnerNotFound, livestreamModel.ID, livestreamModel.UserID)
+		}
 		return Livestream{}, err
 	}
 	owner, err := fillUserResponse(ctx, tx, ownerModel)
@@ -513,29 +1725,39 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 		return Livestream{}, err
 	}
 
-	tags := make([]Tag, len(livestreamTagModels))
+	// タグはまとめて引く (キャッシュにあればDBを引かない)
+	tagIDs := make([]int64, len(livestreamTagModels))
 	for i := range livestreamTagModels {
-		tagModel := TagModel{}
-		if err := tx.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ?", livestreamTagModels[i].TagID); err != nil {
-			return Livestream{}, err
-		}
-
-		tags[i] = Tag{
-			ID:   tagModel.ID,
-			Name: tagModel.Name,
+		tagIDs[i] = livestreamTagModels[i].TagID
+	}
+	tagMap, err := getTagsByIDs(ctx, tx, uniqueIDs(tagIDs))
+	if err != nil {
+		return Livestream{}, err
+	}
+	tags := make([]Tag, len(livestreamTagModels))
+	for i, tagID := range tagIDs {
+		tag, ok := tagMap[tagID]
+		if !ok {
+			return Livestream{}, fmt.Errorf("%w: livestream_id=%d, tag_id=%d", errLivestreamTagNotFound, livestreamModel.ID, tagID)
 		}
+		tags[i] = tag
 	}
 
+	now := time.Now()
 	livestream := Livestream{
-		ID:           livestreamModel.ID,
-		Owner:        owner,
-		Title:        livestreamModel.Title,
-		Tags:         tags,
-		Description:  livestreamModel.Description,
-		PlaylistUrl:  livestreamModel.PlaylistUrl,
-		ThumbnailUrl: livestreamModel.ThumbnailUrl,
-		StartAt:      livestreamModel.StartAt,
-		EndAt:        livestreamModel.EndAt,
+		ID:              livestreamModel.ID,
+		Owner:           owner,
+		Title:           livestreamModel.Title,
+		Tags:            tags,
+		Description:     livestreamModel.Description,
+		PlaylistUrl:     responseMediaURL(livestreamModel.PlaylistUrl, now),
+		ThumbnailUrl:    responseMediaURL(livestreamModel.ThumbnailUrl, now),
+		StartAt:         livestreamModel.StartAt,
+		EndAt:           livestreamModel.EndAt,
+		CreatedAt:       livestreamModel.CreatedAt,
+		Version:         livestreamModel.Version,
+		DurationSeconds: livestreamModel.EndAt - livestreamModel.StartAt,
+		IsLive:          livestreamModel.isLiveAt(now.Unix()),
 	}
 	return livestream, nil
 }
@@ -545,39 +1767,45 @@ func fillLivestreamResponseBulk(ctx context.Context, tx *sqlx.Tx, livestreamMode
 		return nil, nil
 	}
 
-	// 1. UserIDとLivestreamIDを収集
+	// 1. UserIDを重複なしで収集
 	userIDs := make([]int64, 0, len(livestreamModels))
-	livestreamIDs := make([]int64, 0, len(livestreamModels))
 	for _, livestream := range livestreamModels {
 		userIDs = append(userIDs, livestream.UserID)
-		livestreamIDs = append(livestreamIDs, livestream.ID)
 	}
 
-	// 2. ユーザー情報を一括取得
-	var ownerModels []UserModel
-	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
+	// 2. ユーザー情報を一括取得 (キャッシュにあるものはDBを引かない)
+	// OwnerIDをキーにしたマップを作成
+	ownerMap, err := getUsersByIDs(ctx, tx, uniqueIDs(userIDs))
 	if err != nil {
-		return nil, fmt.Errorf("failed to build owner query: %w", err)
+		return nil, fmt.Errorf("failed to process owner responses: %w", err)
 	}
-	query = tx.Rebind(query)
-	if err := tx.SelectContext(ctx, &ownerModels, query, args...); err != nil {
-		return nil, fmt.Errorf("failed to fetch owners: %w", err)
+
+	return fillLivestreamResponseBulkWithOwners(ctx, tx, livestreamModels, ownerMap)
+}
+
+// fillLivestreamResponseBulkWithOwners は取得済みの配信者情報(ownerMap)を使って配信一覧のレスポンスを組み立てる
+// 呼び出し側で他のユーザとまとめて取得した場合に、配信者を二重に引かないために使う
+func fillLivestreamResponseBulkWithOwners(ctx context.Context, tx *sqlx.Tx, livestreamModels []LivestreamModel, ownerMap map[int64]User) (map[int64]Livestream, error) {
+	if len(livestreamModels) == 0 {
+		return nil, nil
 	}
 
-	// OwnerIDをキーにしたマップを作成
-	ownerMap, err := fillUserResponseBulk(ctx, tx, ownerModels)
-	if err != nil {
-		return nil, fmt.Errorf("failed to process owner responses: %w", err)
+	livestreamIDs := make([]int64, 0, len(livestreamModels))
+	for _, livestream := range livestreamModels {
+		livestreamIDs = append(livestreamIDs, livestream.ID)
 	}
 
 	// 3. LivestreamTag情報を一括取得
 	var livestreamTagModels []LivestreamTagModel
-	query, args, err = sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?)", livestreamIDs)
+	query, args, err := sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?)", livestreamIDs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build livestream tag query: %w", err)
 	}
 	query = tx.Rebind(query)
-	if err := tx.SelectContext(ctx, &livestreamTagModels, query, args...); err != nil {
+	done := traceQuery(ctx, query)
+	err = tx.SelectContext(ctx, &livestreamTagModels, query, args...)
+	done()
+	if err != nil {
 		return nil, fmt.Errorf("failed to fetch livestream tags: %w", err)
 	}
 
@@ -593,31 +1821,24 @@ func fillLivestreamResponseBulk(ctx context.Context, tx *sqlx.Tx, livestreamMode
 		tagIDs = append(tagIDs, tag.TagID)
 	}
 
-	var tagModels []TagModel
-	query, args, err = sqlx.In("SELECT * FROM tags WHERE id IN (?)", tagIDs)
+	// TagIDをキーにマッピング (キャッシュにあればDBを引かない)
+	tagMap, err := getTagsByIDs(ctx, tx, uniqueIDs(tagIDs))
 	if err != nil {
-		return nil, fmt.Errorf("failed to build tag query: %w", err)
-	}
-	query = tx.Rebind(query)
-	if err := tx.SelectContext(ctx, &tagModels, query, args...); err != nil {
-		return nil, fmt.Errorf("failed to fetch tags: %w", err)
-	}
-
-	// TagIDをキーにマッピング
-	tagMap := make(map[int64]Tag)
-	for _, tagModel := range tagModels {
-		tagMap[tagModel.ID] = Tag{
-			ID:   tagModel.ID,
-			Name: tagModel.Name,
-		}
+		return nil, err
 	}
 
 	// 5. Livestreamオブジェクトを構築
+	// 一覧内の署名付きURLの有効期限と配信中の判定の時刻を揃える
+	now := time.Now()
 	livestreamMap := make(map[int64]Livestream, len(livestreamModels))
 	for _, livestreamModel := range livestreamModels {
 		// Owner取得
 		owner, ok := ownerMap[livestreamModel.UserID]
 		if !ok {
+			if skipLivestreamsWithMissingOwner {
+				log.Printf("[WARN] skip livestream %d: owner not found for UserID %d", livestreamModel.ID, livestreamModel.UserID)
+				continue
+			}
 			return nil, fmt.Errorf("owner not found for UserID %d", livestreamModel.UserID)
 		}
 
@@ -631,24 +1852,89 @@ func fillLivestreamResponseBulk(ctx context.Context, tx *sqlx.Tx, livestreamMode
 		for _, livestreamTag := range livestreamTags {
 			tag, ok := tagMap[livestreamTag.TagID]
 			if !ok {
-				return nil, fmt.Errorf("tag not found for TagID %d", livestreamTag.TagID)
+				// 削除済みのタグを参照している場合、1件のために一覧全体を失敗させずに読み飛ばす
+				log.Printf("[WARN] livestream %d references missing TagID %d", livestreamModel.ID, livestreamTag.TagID)
+				continue
 			}
 			tags = append(tags, tag)
 		}
 
 		// Livestream作成
 		livestreamMap[livestreamModel.ID] = Livestream{
-			ID:           livestreamModel.ID,
-			Owner:        owner,
-			Title:        livestreamModel.Title,
-			Tags:         tags,
-			Description:  livestreamModel.Description,
-			PlaylistUrl:  livestreamModel.PlaylistUrl,
-			ThumbnailUrl: livestreamModel.ThumbnailUrl,
-			StartAt:      livestreamModel.StartAt,
-			EndAt:        livestreamModel.EndAt,
+			ID:              livestreamModel.ID,
+			Owner:           owner,
+			Title:           livestreamModel.Title,
+			Tags:            tags,
+			Description:     livestreamModel.Description,
+			PlaylistUrl:     responseMediaURL(livestreamModel.PlaylistUrl, now),
+			ThumbnailUrl:    responseMediaURL(livestreamModel.ThumbnailUrl, now),
+			StartAt:         livestreamModel.StartAt,
+			EndAt:           livestreamModel.EndAt,
+			CreatedAt:       livestreamModel.CreatedAt,
+			Version:         livestreamModel.Version,
+			DurationSeconds: livestreamModel.EndAt - livestreamModel.StartAt,
+			IsLive:          livestreamModel.isLiveAt(now.Unix()),
 		}
 	}
 
 	return livestreamMap, nil
 }
+
+// withReactionsQuery は一覧にリアクションの集計を含めるか (with_reactions=1) を返す
+// 集計のクエリが増えるので、指定された場合のみ行う
+func withReactionsQuery(c echo.Context) bool {
+	v := c.QueryParam("with_reactions")
+	return v == "1" || v == "true"
+}
+
+// fillLivestreamReactionSummaries は livestreamMap の全配信について、絵文字ごとのリアクション数を1クエリで集計して付与する
+// reactionSummaryCacheTTL の間はキャッシュした集計を使い、キャッシュに無い配信だけを集計する
+func fillLivestreamReactionSummaries(ctx context.Context, tx *sqlx.Tx, livestreamMap map[int64]Livestream) error {
+	if len(livestreamMap) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	summaries := make(map[int64]*LivestreamReactionSummary, len(livestreamMap))
+	livestreamIDs := make([]int64, 0, len(livestreamMap))
+	for id := range livestreamMap {
+		if summary, ok := livestreamReactionSummaryCache.get(id, now); ok {
+			summaries[id] = &summary
+			continue
+		}
+		summaries[id] = &LivestreamReactionSummary{}
+		livestreamIDs = append(livestreamIDs, id)
+	}
+
+	if len(livestreamIDs) > 0 {
+		var counts []struct {
+			LivestreamID int64  `db:"livestream_id"`
+			EmojiName    string `db:"emoji_name"`
+			Count        int64  `db:"cnt"`
+		}
+		query, args, err := sqlx.In("SELECT livestream_id, emoji_name, COUNT(*) AS cnt FROM reactions WHERE livestream_id IN (?) GROUP BY livestream_id, emoji_name", livestreamIDs)
+		if err != nil {
+			return fmt.Errorf("failed to build reaction count query: %w", err)
+		}
+		query = tx.Rebind(query)
+		done := traceQuery(ctx, query)
+		err = tx.SelectContext(ctx, &counts, query, args...)
+		done()
+		if err != nil {
+			return fmt.Errorf("failed to count reactions: %w", err)
+		}
+
+		for _, cnt := range counts {
+			summaries[cnt.LivestreamID].addEmojiCount(cnt.EmojiName, cnt.Count)
+		}
+		for _, id := range livestreamIDs {
+			livestreamReactionSummaryCache.set(id, *summaries[id], now)
+		}
+	}
+
+	for id, livestream := range livestreamMap {
+		livestream.ReactionSummary = summaries[id]
+		livestreamMap[id] = livestream
+	}
+	return nil
+}
@@ -0,0 +1,1988 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+)
+
+func TestReserveLivestreamSetsCreatedAt(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+3600, 5)
+
+	livestream := reserveTestLivestream(t, userID, newTestReserveRequest(testTermStart, testTermStart+3600))
+	if livestream.CreatedAt <= 0 {
+		t.Fatalf("created_at = %d, want a positive unix time", livestream.CreatedAt)
+	}
+
+	var stored int64
+	if err := dbConn.Get(&stored, "SELECT created_at FROM livestreams WHERE id = ?", livestream.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stored != livestream.CreatedAt {
+		t.Errorf("stored created_at = %d, want %d", stored, livestream.CreatedAt)
+	}
+
+	var got Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestream.ID), nil, userID), http.StatusOK, &got)
+	if got.CreatedAt != livestream.CreatedAt {
+		t.Errorf("GET created_at = %d, want %d", got.CreatedAt, livestream.CreatedAt)
+	}
+}
+
+func TestValidateReservationRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		startAt int64
+		endAt   int64
+		wantErr bool
+	}{
+		{name: "one slot", startAt: testTermStart, endAt: testTermStart + 3600},
+		{name: "several slots", startAt: testTermStart, endAt: testTermStart + 3*3600},
+		{name: "inverted", startAt: testTermStart + 3600, endAt: testTermStart, wantErr: true},
+		{name: "equal", startAt: testTermStart, endAt: testTermStart, wantErr: true},
+		{name: "misaligned start", startAt: testTermStart + 1800, endAt: testTermStart + 3600, wantErr: true},
+		{name: "misaligned end", startAt: testTermStart, endAt: testTermStart + 5400, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateReservationRange(tt.startAt, tt.endAt)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateReservationRange(%d, %d) = %v, wantErr %v", tt.startAt, tt.endAt, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReserveLivestreamRejectsInvalidRange(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+2*3600, 5)
+
+	tests := []struct {
+		name    string
+		startAt int64
+		endAt   int64
+	}{
+		{name: "inverted", startAt: testTermStart + 3600, endAt: testTermStart},
+		{name: "equal", startAt: testTermStart, endAt: testTermStart},
+		{name: "misaligned", startAt: testTermStart + 1800, endAt: testTermStart + 5400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(tt.startAt, tt.endAt), userID)
+			assertErrorCode(t, rec, http.StatusBadRequest, errCodeBadRequest)
+		})
+	}
+
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != 0 {
+		t.Errorf("livestreams = %d, want 0", n)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reservation_slots WHERE slot <> 5"); n != 0 {
+		t.Errorf("%d slots were decremented, want 0", n)
+	}
+}
+
+// enterTestLivestream は視聴開始APIを呼ぶ
+func enterTestLivestream(t *testing.T, userID, livestreamID int64) {
+	t.Helper()
+	decodeResponse(t, doRequest(t, http.MethodPost, "/api/livestream/"+itoa(livestreamID)+"/enter", nil, userID), http.StatusOK, nil)
+}
+
+// exitTestLivestream は視聴終了APIを呼ぶ
+func exitTestLivestream(t *testing.T, userID, livestreamID int64) {
+	t.Helper()
+	decodeResponse(t, doRequest(t, http.MethodDelete, "/api/livestream/"+itoa(livestreamID)+"/exit", nil, userID), http.StatusOK, nil)
+}
+
+func TestEnterLivestreamIsIdempotent(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	enterTestLivestream(t, viewerID, livestreamID)
+	enterTestLivestream(t, viewerID, livestreamID)
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", viewerID, livestreamID); n != 1 {
+		t.Fatalf("viewer rows after entering twice = %d, want 1", n)
+	}
+
+	exitTestLivestream(t, viewerID, livestreamID)
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", viewerID, livestreamID); n != 0 {
+		t.Errorf("viewer rows after exiting once = %d, want 0", n)
+	}
+}
+
+// searchTestLivestreams は配信検索APIを呼び、配信IDを返却順に返す
+func searchTestLivestreams(t *testing.T, userID int64, query string) []int64 {
+	t.Helper()
+	var livestreams []Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search"+query, nil, userID), http.StatusOK, &livestreams)
+	return livestreamIDs(livestreams)
+}
+
+func livestreamIDs(livestreams []Livestream) []int64 {
+	ids := make([]int64, 0, len(livestreams))
+	for _, l := range livestreams {
+		ids = append(ids, l.ID)
+	}
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSearchLivestreamsPagination(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	tagID := insertTestTag(t, "music")
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		id := insertTestLivestream(t, streamerID, fmt.Sprintf("live %d", i), testTermStart, testTermStart+3600)
+		mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", id, tagID)
+		ids = append(ids, id)
+	}
+	// タグの付いていない配信はタグ検索に出てこない
+	untagged := insertTestLivestream(t, streamerID, "untagged", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	newest := []int64{untagged, ids[4], ids[3], ids[2], ids[1], ids[0]}
+	taggedNewest := []int64{ids[4], ids[3], ids[2], ids[1], ids[0]}
+	taggedOldest := []int64{ids[0], ids[1], ids[2], ids[3], ids[4]}
+
+	tests := []struct {
+		name  string
+		query string
+		pages [][]int64
+	}{
+		{name: "no tag newest", query: "?limit=4", pages: [][]int64{newest[0:4], newest[4:]}},
+		{name: "no tag oldest", query: "?order=oldest&limit=4", pages: [][]int64{{ids[0], ids[1], ids[2], ids[3]}, {ids[4], untagged}}},
+		{name: "tag newest", query: "?tag=music&limit=2", pages: [][]int64{taggedNewest[0:2], taggedNewest[2:4], taggedNewest[4:]}},
+		{name: "tag oldest", query: "?tag=music&order=oldest&limit=2", pages: [][]int64{taggedOldest[0:2], taggedOldest[2:4], taggedOldest[4:]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.pages {
+				query := fmt.Sprintf("%s&offset=%d", tt.query, i*len(tt.pages[0]))
+				if got := searchTestLivestreams(t, streamerID, query); !equalIDs(got, want) {
+					t.Errorf("page %d = %v, want %v", i, got, want)
+				}
+			}
+			// 最後のページより後は空
+			query := fmt.Sprintf("%s&offset=%d", tt.query, len(tt.pages)*len(tt.pages[0]))
+			if got := searchTestLivestreams(t, streamerID, query); len(got) != 0 {
+				t.Errorf("page after the last = %v, want empty", got)
+			}
+		})
+	}
+}
+
+func TestSearchLivestreamsRejectsInvalidPagination(t *testing.T) {
+	for _, query := range []string{"?offset=-1", "?offset=abc", "?order=random"} {
+		rec := doRequest(t, http.MethodGet, "/api/livestream/search"+query, nil, 0)
+		assertErrorCode(t, rec, http.StatusBadRequest, errCodeBadRequest)
+	}
+}
+
+// newTestContext はハンドラを通さずにクエリパラメータなどを読む関数を試すためのコンテキストを返す
+func newTestContext(target string) echo.Context {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	return testEcho.NewContext(req, httptest.NewRecorder())
+}
+
+func TestParseLimitQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{query: "", want: 0},
+		{query: "limit=1", want: 1},
+		{query: "limit=100", want: maxLimit},
+		{query: "limit=101", want: maxLimit},
+		{query: "limit=99999999999", want: maxLimit},
+		{query: "limit=99999999999999999999", wantErr: true},
+		{query: "limit=0", wantErr: true},
+		{query: "limit=-5", wantErr: true},
+		{query: "limit=1%20OR%201=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLimitQuery(newTestContext("/?" + tt.query))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLimitQuery(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseLimitQuery(%q) = %d, want %d", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSearchPaginationApplyOrdersByID(t *testing.T) {
+	tests := []struct {
+		pagination searchPagination
+		column     string
+		want       string
+	}{
+		{pagination: searchPagination{Desc: true}, column: "created_at", want: "SELECT * FROM t ORDER BY created_at DESC, id DESC"},
+		{pagination: searchPagination{}, column: "start_at", want: "SELECT * FROM t ORDER BY start_at ASC, id ASC"},
+		{pagination: searchPagination{Desc: true}, column: "l.start_at", want: "SELECT * FROM t ORDER BY l.start_at DESC, l.id DESC"},
+		// id 自体で並べる場合はタイブレーク不要
+		{pagination: searchPagination{Desc: true}, column: "l.id", want: "SELECT * FROM t ORDER BY l.id DESC"},
+		{pagination: searchPagination{Limit: 2, Offset: 4}, column: "id", want: "SELECT * FROM t ORDER BY id ASC LIMIT ? OFFSET ?"},
+	}
+	for _, tt := range tests {
+		got, _ := tt.pagination.apply("SELECT * FROM t", tt.column, nil)
+		if got != tt.want {
+			t.Errorf("apply(%+v, %q) = %q, want %q", tt.pagination, tt.column, got, tt.want)
+		}
+	}
+}
+
+func TestListLimitBounds(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	for i := 0; i < maxLimit; i++ {
+		insertTestLivestream(t, streamerID, "filler", testTermStart, testTermStart+3600)
+		insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart+int64(i))
+	}
+	insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart+maxLimit)
+	warmTestCaches(t)
+
+	for _, path := range []string{"/api/livestream/search", "/api/livestream/" + itoa(livestreamID) + "/reaction"} {
+		for _, limit := range []string{"0", "-5"} {
+			rec := doRequest(t, http.MethodGet, path+"?limit="+limit, nil, streamerID)
+			assertErrorCode(t, rec, http.StatusBadRequest, errCodeBadRequest)
+		}
+	}
+
+	var livestreams []Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search?limit=1000", nil, streamerID), http.StatusOK, &livestreams)
+	if len(livestreams) != maxLimit {
+		t.Errorf("search with limit over the cap returned %d livestreams, want %d", len(livestreams), maxLimit)
+	}
+	var reactions []Reaction
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/reaction?limit=1000", nil, streamerID), http.StatusOK, &reactions)
+	if len(reactions) != maxLimit {
+		t.Errorf("reactions with limit over the cap returned %d reactions, want %d", len(reactions), maxLimit)
+	}
+}
+
+func TestIsRetryableTxError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &mysql.MySQLError{Number: 1213}, want: true},
+		{err: &mysql.MySQLError{Number: 1205}, want: true},
+		{err: fmt.Errorf("wrapped: %w", &mysql.MySQLError{Number: 1213}), want: true},
+		{err: &mysql.MySQLError{Number: 1062}, want: false},
+		{err: errors.New("deadlock"), want: false},
+	}
+	for _, tt := range tests {
+		if got := isRetryableTxError(tt.err); got != tt.want {
+			t.Errorf("isRetryableTxError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// deadlockSlotLocks は予約枠の行ロックを取るクエリを fail が true を返す間デッドロックで失敗させ、行ロックを取ろうとした回数を返す
+func deadlockSlotLocks(recorder *queryRecorder, fail func(n int64) bool) *atomic.Int64 {
+	var locks atomic.Int64
+	recorder.injectErrors(func(query string) error {
+		if strings.Contains(query, "FROM reservation_slots") && strings.HasSuffix(query, "FOR UPDATE") && fail(locks.Add(1)) {
+			return &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock; try restarting transaction"}
+		}
+		return nil
+	})
+	return &locks
+}
+
+func TestIsDuplicateEntryError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &mysql.MySQLError{Number: 1062}, want: true},
+		{err: fmt.Errorf("wrapped: %w", &mysql.MySQLError{Number: 1062}), want: true},
+		{err: &mysql.MySQLError{Number: 1213}, want: false},
+		{err: errors.New("duplicate"), want: false},
+	}
+	for _, tt := range tests {
+		if got := isDuplicateEntryError(tt.err); got != tt.want {
+			t.Errorf("isDuplicateEntryError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestReserveLivestreamRetriesDeadlock(t *testing.T) {
+	setupTestDB(t)
+	const users = 5
+	insertTestSlots(t, testTermStart, testTermStart+2*3600, users)
+	userIDs := make([]int64, 0, users)
+	for i := 0; i < users; i++ {
+		userIDs = append(userIDs, insertTestUser(t, fmt.Sprintf("streamer%d", i)))
+	}
+	warmTestCaches(t)
+
+	// テスト用のDBは行ロックを取らないので、競合する予約を順に投げ、各予約の初回の行ロックをデッドロックさせる
+	recorder := recordQueries(t)
+	locks := deadlockSlotLocks(recorder, func(n int64) bool { return n%2 == 1 })
+	for _, userID := range userIDs {
+		rec := doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(testTermStart, testTermStart+2*3600), userID)
+		if rec.Code != http.StatusCreated {
+			t.Errorf("reservation by %d status = %d, want %d: %s", userID, rec.Code, http.StatusCreated, rec.Body)
+		}
+	}
+
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != users {
+		t.Errorf("livestreams = %d, want %d", n, users)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reservation_slots WHERE slot <> 0"); n != 0 {
+		t.Errorf("%d slots are not fully booked, want 0", n)
+	}
+	if locks.Load() != 2*users {
+		t.Errorf("slot locks = %d, want %d (each reservation retried once)", locks.Load(), 2*users)
+	}
+}
+
+func TestReserveLivestreamGivesUpAfterRetries(t *testing.T) {
+	setupTestDB(t)
+	insertTestSlots(t, testTermStart, testTermStart+3600, 5)
+	userID := insertTestUser(t, "streamer")
+	warmTestCaches(t)
+
+	recorder := recordQueries(t)
+	locks := deadlockSlotLocks(recorder, func(int64) bool { return true })
+	rec := doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(testTermStart, testTermStart+3600), userID)
+	assertErrorCode(t, rec, http.StatusInternalServerError, errCodeInternal)
+	if locks.Load() != maxReserveRetries+1 {
+		t.Errorf("slot locks = %d, want %d", locks.Load(), maxReserveRetries+1)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reservation_slots WHERE slot <> 5"); n != 0 {
+		t.Errorf("%d slots were decremented, want 0", n)
+	}
+}
+
+func TestReserveLivestreamDoesNotRetryOtherErrors(t *testing.T) {
+	setupTestDB(t)
+	insertTestSlots(t, testTermStart, testTermStart+3600, 5)
+	userID := insertTestUser(t, "streamer")
+	warmTestCaches(t)
+
+	recorder := recordQueries(t)
+	var locks atomic.Int64
+	recorder.injectErrors(func(query string) error {
+		if strings.Contains(query, "FROM reservation_slots") && strings.HasSuffix(query, "FOR UPDATE") {
+			locks.Add(1)
+			return &mysql.MySQLError{Number: 1146, Message: "Table doesn't exist"}
+		}
+		return nil
+	})
+
+	rec := doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(testTermStart, testTermStart+3600), userID)
+	assertErrorCode(t, rec, http.StatusInternalServerError, errCodeInternal)
+	if locks.Load() != 1 {
+		t.Errorf("slot locks = %d, want 1 (no retry)", locks.Load())
+	}
+}
+
+func TestSearchLivestreamsSkipsOrphanedTags(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	tagID := insertTestTag(t, "music")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", livestreamID, tagID)
+	// 削除されたタグを指す行
+	mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", livestreamID, 999999)
+	warmTestCaches(t)
+
+	var livestreams []Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search", nil, streamerID), http.StatusOK, &livestreams)
+	if len(livestreams) != 1 || livestreams[0].ID != livestreamID {
+		t.Fatalf("search = %+v, want livestream %d", livestreams, livestreamID)
+	}
+	if tags := livestreams[0].Tags; len(tags) != 1 || tags[0].ID != tagID || tags[0].Name != "music" {
+		t.Errorf("tags = %+v, want only the valid tag %d", tags, tagID)
+	}
+}
+
+func TestSearchLivestreamsWithMissingOwner(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	// 削除されたユーザの配信
+	insertTestLivestream(t, 999999, "orphan", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	assertErrorCode(t, doRequest(t, http.MethodGet, "/api/livestream/search", nil, streamerID), http.StatusInternalServerError, errCodeInternal)
+
+	setTestVar(t, &skipLivestreamsWithMissingOwner, true)
+	if got := searchTestLivestreams(t, streamerID, ""); !equalIDs(got, []int64{livestreamID}) {
+		t.Errorf("search with missing owners skipped = %v, want [%d]", got, livestreamID)
+	}
+}
+
+func TestValidateReserveLivestreamRequestTags(t *testing.T) {
+	setTestVar(t, &maxLivestreamTags, 3)
+	tests := []struct {
+		name    string
+		tags    []int64
+		wantErr bool
+	}{
+		{name: "none", tags: []int64{}},
+		{name: "at the limit", tags: []int64{1, 2, 3}},
+		{name: "over the limit", tags: []int64{1, 2, 3, 4}, wantErr: true},
+		{name: "duplicate", tags: []int64{1, 2, 1}, wantErr: true},
+		{name: "zero", tags: []int64{0}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestReserveRequest(testTermStart, testTermStart+3600, tt.tags...)
+			if err := validateReserveLivestreamRequest(&req); (err != nil) != tt.wantErr {
+				t.Errorf("validateReserveLivestreamRequest(tags=%v) = %v, wantErr %v", tt.tags, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReserveLivestreamRejectsInvalidTags(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &maxLivestreamTags, 3)
+	userID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+3600, 5)
+	var tagIDs []int64
+	for i := 0; i < 4; i++ {
+		tagIDs = append(tagIDs, insertTestTag(t, fmt.Sprintf("tag%d", i)))
+	}
+	warmTestCaches(t)
+
+	recorder := recordQueries(t)
+	for _, tags := range [][]int64{tagIDs, {tagIDs[0], tagIDs[1], tagIDs[0]}} {
+		rec := doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(testTermStart, testTermStart+3600, tags...), userID)
+		assertErrorCode(t, rec, http.StatusBadRequest, errCodeBadRequest)
+	}
+	// トランザクションを始める前に弾く
+	if q := recorder.matching("reservation_slots"); len(q) != 0 {
+		t.Errorf("rejected requests queried reservation_slots %d times, want 0", len(q))
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestream_tags"); n != 0 {
+		t.Errorf("livestream_tags = %d, want 0", n)
+	}
+
+	livestream := reserveTestLivestream(t, userID, newTestReserveRequest(testTermStart, testTermStart+3600, tagIDs[:3]...))
+	if len(livestream.Tags) != 3 {
+		t.Errorf("tags at the limit = %+v, want 3 tags", livestream.Tags)
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"live":    "live",
+		"100%":    `100\%`,
+		"a_b":     `a\_b`,
+		`back\sl`: `back\\sl`,
+	}
+	for in, want := range tests {
+		if got := escapeLike(in); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSearchLivestreamsByTitle(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	tagID := insertTestTag(t, "music")
+	guitar := insertTestLivestream(t, streamerID, "guitar practice", testTermStart, testTermStart+3600)
+	mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", guitar, tagID)
+	guitarUntagged := insertTestLivestream(t, streamerID, "GUITAR night", testTermStart, testTermStart+3600)
+	discount := insertTestLivestream(t, streamerID, "100% off sale", testTermStart, testTermStart+3600)
+	insertTestLivestream(t, streamerID, "1000 subscribers", testTermStart, testTermStart+3600)
+	underscore := insertTestLivestream(t, streamerID, "snake_case talk", testTermStart, testTermStart+3600)
+	snakeX := insertTestLivestream(t, streamerID, "snakeXcase talk", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []int64
+	}{
+		{name: "keyword", query: "?q=guitar", want: []int64{guitar}},
+		{name: "keyword and tag", query: "?q=guitar&tag=music", want: []int64{guitar}},
+		{name: "no match", query: "?q=piano", want: []int64{}},
+		{name: "literal percent", query: "?q=100%25", want: []int64{discount}},
+		{name: "literal underscore", query: "?q=e_c", want: []int64{underscore}},
+		// タイトルは utf8mb4_bin なので大文字小文字を区別する
+		{name: "case sensitive", query: "?q=GUITAR", want: []int64{guitarUntagged}},
+		{name: "first page", query: "?q=talk&limit=1", want: []int64{snakeX}},
+		{name: "second page", query: "?q=talk&limit=1&offset=1", want: []int64{underscore}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := searchTestLivestreams(t, streamerID, tt.query); !equalIDs(got, tt.want) {
+				t.Errorf("search%s = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetLivestreamWithMissingOwner(t *testing.T) {
+	setupTestDB(t)
+	viewerID := insertTestUser(t, "viewer")
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	mustExec(t, "DELETE FROM users WHERE id = ?", streamerID)
+	warmTestCaches(t)
+
+	rec := doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID), nil, viewerID)
+	assertErrorCode(t, rec, http.StatusNotFound, errCodeLivestreamOwnerNotFound)
+	if body := rec.Body.String(); strings.Contains(body, "sql:") || strings.Contains(body, "no rows") {
+		t.Errorf("response leaks the SQL error: %s", body)
+	}
+}
+
+func TestFillLivestreamResponseTypedErrors(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	ownerless := insertTestLivestream(t, 999999, "ownerless", testTermStart, testTermStart+3600)
+	orphanTagged := insertTestLivestream(t, streamerID, "orphan tag", testTermStart, testTermStart+3600)
+	mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", orphanTagged, 999999)
+
+	tests := []struct {
+		livestreamID int64
+		want         error
+	}{
+		{livestreamID: ownerless, want: errLivestreamOwnerNotFound},
+		{livestreamID: orphanTagged, want: errLivestreamTagNotFound},
+	}
+	for _, tt := range tests {
+		tx, err := dbConn.Beginx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var model LivestreamModel
+		if err := tx.Get(&model, "SELECT * FROM livestreams WHERE id = ?", tt.livestreamID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fillLivestreamResponse(context.Background(), tx, model); !errors.Is(err, tt.want) {
+			t.Errorf("fillLivestreamResponse(%d) error = %v, want %v", tt.livestreamID, err, tt.want)
+		}
+		tx.Rollback()
+	}
+}
+
+func TestReserveLivestreamListsAllFullSlots(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+4*3600, 3)
+	// 1枠目と3枠目を埋める
+	mustExec(t, "UPDATE reservation_slots SET slot = 0 WHERE start_at IN (?, ?)", testTermStart, testTermStart+2*3600)
+	warmTestCaches(t)
+
+	rec := doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(testTermStart, testTermStart+4*3600), userID)
+	var resp struct {
+		ErrorCode string                    `json:"error_code"`
+		Details   []ReservationSlotConflict `json:"details"`
+	}
+	decodeResponse(t, rec, http.StatusBadRequest, &resp)
+	if resp.ErrorCode != errCodeReservationSlotFull {
+		t.Errorf("error_code = %q, want %q", resp.ErrorCode, errCodeReservationSlotFull)
+	}
+	want := []ReservationSlotConflict{
+		{StartAt: testTermStart, EndAt: testTermStart + 3600, Remaining: 0},
+		{StartAt: testTermStart + 2*3600, EndAt: testTermStart + 3*3600, Remaining: 0},
+	}
+	if len(resp.Details) != len(want) {
+		t.Fatalf("details = %+v, want %+v", resp.Details, want)
+	}
+	for i := range want {
+		if resp.Details[i] != want[i] {
+			t.Errorf("details[%d] = %+v, want %+v", i, resp.Details[i], want[i])
+		}
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reservation_slots WHERE slot = 3"); n != 2 {
+		t.Errorf("free slots left at 3 = %d, want 2", n)
+	}
+}
+
+func TestGetLivestreamTags(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+3600, 5)
+	var tagIDs []int64
+	for _, name := range []string{"music", "game", "art"} {
+		tagIDs = append(tagIDs, insertTestTag(t, name))
+	}
+	warmTestCaches(t)
+	livestream := reserveTestLivestream(t, streamerID, newTestReserveRequest(testTermStart, testTermStart+3600, tagIDs[2], tagIDs[0]))
+
+	recorder := recordQueries(t)
+	var tags []Tag
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestream.ID)+"/tags", nil, streamerID), http.StatusOK, &tags)
+	// livestream_tags を1回だけ引き、タグ名はキャッシュから引く
+	if q := recorder.matching("FROM livestream_tags"); len(q) != 1 {
+		t.Errorf("livestream_tags queried %d times, want 1", len(q))
+	}
+	if q := recorder.matching("FROM tags"); len(q) != 0 {
+		t.Errorf("tags table queried %d times, want 0", len(q))
+	}
+
+	var full Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestream.ID), nil, streamerID), http.StatusOK, &full)
+	if len(tags) != len(full.Tags) || len(tags) != 2 {
+		t.Fatalf("tags = %+v, want %+v", tags, full.Tags)
+	}
+	for i := range tags {
+		if tags[i] != full.Tags[i] {
+			t.Errorf("tags[%d] = %+v, want %+v", i, tags[i], full.Tags[i])
+		}
+	}
+
+	rec := doRequest(t, http.MethodGet, "/api/livestream/999999/tags", nil, streamerID)
+	assertErrorCode(t, rec, http.StatusNotFound, errCodeNotFound)
+}
+
+func TestDeleteLivestreamIsSoft(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	insertTestSlots(t, testTermStart, testTermStart+2*3600, 5)
+	warmTestCaches(t)
+	deleted := reserveTestLivestream(t, streamerID, newTestReserveRequest(testTermStart, testTermStart+3600))
+	kept := reserveTestLivestream(t, streamerID, newTestReserveRequest(testTermStart+3600, testTermStart+2*3600))
+	reactionID := insertTestReaction(t, viewerID, deleted.ID, "tada", testTermStart)
+
+	assertErrorCode(t, doRequest(t, http.MethodDelete, "/api/livestream/"+itoa(deleted.ID), nil, viewerID), http.StatusForbidden, errCodeForbidden)
+	rec := doRequest(t, http.MethodDelete, "/api/livestream/"+itoa(deleted.ID), nil, streamerID)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+
+	// 行は残り deleted_at が入る
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestreams WHERE id = ? AND deleted_at IS NOT NULL", deleted.ID); n != 1 {
+		t.Errorf("soft-deleted rows = %d, want 1", n)
+	}
+	// 予約枠は戻る
+	if n := mustCount(t, "SELECT slot FROM reservation_slots WHERE start_at = ?", testTermStart); n != 5 {
+		t.Errorf("slot after delete = %d, want 5", n)
+	}
+
+	assertErrorCode(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(deleted.ID), nil, viewerID), http.StatusNotFound, errCodeNotFound)
+	assertErrorCode(t, doRequest(t, http.MethodDelete, "/api/livestream/"+itoa(deleted.ID), nil, streamerID), http.StatusNotFound, errCodeNotFound)
+	for _, target := range []string{"/api/livestream/search", "/api/livestream", "/api/user/streamer/livestream"} {
+		var livestreams []Livestream
+		decodeResponse(t, doRequest(t, http.MethodGet, target, nil, streamerID), http.StatusOK, &livestreams)
+		if got := livestreamIDs(livestreams); !equalIDs(got, []int64{kept.ID}) {
+			t.Errorf("GET %s = %v, want [%d]", target, got, kept.ID)
+		}
+	}
+
+	// リアクションは消えずに残るが、新たには投稿できない
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE id = ? AND livestream_id = ?", reactionID, deleted.ID); n != 1 {
+		t.Errorf("reactions of the deleted livestream = %d, want 1", n)
+	}
+	assertErrorCode(t, postTestReaction(t, viewerID, deleted.ID, "tada"), http.StatusNotFound, errCodeNotFound)
+}
+
+func TestExitAllLivestream(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	otherID := insertTestUser(t, "other")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID)
+
+	// 複数タブから入室しても視聴記録は1行で、入室の履歴だけが増える
+	for i := 0; i < 3; i++ {
+		enterTestLivestream(t, viewerID, livestreamID)
+	}
+	enterTestLivestream(t, otherID, livestreamID)
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", viewerID, livestreamID); n != 1 {
+		t.Fatalf("viewer rows = %d, want 1", n)
+	}
+
+	// exit/all は exit の別名で、exit と違って削除した件数を返す
+	exitAll := func() ExitAllLivestreamResponse {
+		t.Helper()
+		var res ExitAllLivestreamResponse
+		decodeResponse(t, doRequest(t, http.MethodDelete, path+"/exit/all", nil, viewerID), http.StatusOK, &res)
+		return res
+	}
+	if res := exitAll(); res.Deleted != 1 {
+		t.Errorf("deleted = %d, want 1", res.Deleted)
+	}
+	if res := exitAll(); res.Deleted != 0 {
+		t.Errorf("deleted on second exit/all = %d, want 0", res.Deleted)
+	}
+	if rec := doRequest(t, http.MethodDelete, path+"/exit", nil, otherID); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("exit = %d %q, want 200 with an empty body", rec.Code, rec.Body.String())
+	}
+
+	// どちらも視聴記録だけを消し、統計に使う入室の履歴は残す
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestreamID); n != 0 {
+		t.Errorf("viewer rows after exiting = %d, want 0", n)
+	}
+	stats := getTestLivestreamStatistics(t, streamerID, livestreamID)
+	if stats.ViewersCount != 0 || stats.UniqueViewersCount != 2 {
+		t.Errorf("statistics = %+v, want no current viewers out of 2 unique viewers", stats)
+	}
+}
+
+func TestUpdateLivestream(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "before", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID)
+	patch := func(userID int64, body map[string]interface{}) *httptest.ResponseRecorder {
+		t.Helper()
+		return doRequest(t, http.MethodPatch, path, body, userID)
+	}
+
+	var updated Livestream
+	decodeResponse(t, patch(streamerID, map[string]interface{}{"version": 0, "title": "  after  "}), http.StatusOK, &updated)
+	if updated.Title != "after" || updated.Description != "" || updated.Version != 1 {
+		t.Errorf("updated = %+v, want title after, empty description and version 1", updated)
+	}
+	if updated.StartAt != testTermStart || updated.EndAt != testTermStart+3600 {
+		t.Errorf("updated range = [%d, %d), want it unchanged", updated.StartAt, updated.EndAt)
+	}
+	var got Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, path, nil, viewerID), http.StatusOK, &got)
+	if got.Title != "after" {
+		t.Errorf("GET title = %q, want %q", got.Title, "after")
+	}
+
+	assertErrorCode(t, patch(viewerID, map[string]interface{}{"version": 1, "title": "hijacked"}), http.StatusForbidden, errCodeForbidden)
+	assertErrorCode(t, patch(streamerID, map[string]interface{}{"version": 1, "start_at": testTermStart + 3600}), http.StatusBadRequest, errCodeBadRequest)
+	assertErrorCode(t, patch(streamerID, map[string]interface{}{"version": 1, "title": strings.Repeat("a", maxLivestreamTitleLength+1)}), http.StatusBadRequest, errCodeBadRequest)
+	// 古いバージョンでの更新は他のセッションの変更を上書きしない
+	assertErrorCode(t, patch(streamerID, map[string]interface{}{"version": 0, "title": "stale"}), http.StatusConflict, errCodeLivestreamVersionConflict)
+
+	var stored LivestreamModel
+	if err := dbConn.Get(&stored, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "after" || stored.StartAt != testTermStart || stored.Version != 1 {
+		t.Errorf("stored = %+v, want title after, start_at %d and version 1", stored, testTermStart)
+	}
+}
+
+func TestSearchLivestreamsKeysetPagination(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		ids = append(ids, insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600))
+	}
+	warmTestCaches(t)
+
+	fetch := func(query string) ([]int64, string) {
+		t.Helper()
+		rec := doRequest(t, http.MethodGet, "/api/livestream/search"+query, nil, streamerID)
+		var livestreams []Livestream
+		decodeResponse(t, rec, http.StatusOK, &livestreams)
+		return livestreamIDs(livestreams), rec.Header().Get(headerNextBeforeID)
+	}
+
+	first, next := fetch("?limit=2")
+	if !equalIDs(first, []int64{ids[4], ids[3]}) || next != itoa(ids[3]) {
+		t.Fatalf("first page = %v (next %q), want %v (next %d)", first, next, []int64{ids[4], ids[3]}, ids[3])
+	}
+	// ページ送りの途中で配信が追加されても、次のページはずれない
+	insertTestLivestream(t, streamerID, "new", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	seen := map[int64]bool{}
+	for _, id := range first {
+		seen[id] = true
+	}
+	for next != "" {
+		var page []int64
+		page, next = fetch("?limit=2&before_id=" + next)
+		for _, id := range page {
+			if seen[id] {
+				t.Errorf("livestream %d appeared on two pages", id)
+			}
+			seen[id] = true
+		}
+	}
+	for _, id := range ids {
+		if !seen[id] {
+			t.Errorf("livestream %d was skipped", id)
+		}
+	}
+	if len(seen) != len(ids) {
+		t.Errorf("saw %d livestreams, want %d", len(seen), len(ids))
+	}
+
+	for _, query := range []string{"?before_id=0", "?before_id=abc", "?before_id=3&offset=2", "?before_id=3&order=oldest"} {
+		rec := doRequest(t, http.MethodGet, "/api/livestream/search"+query, nil, streamerID)
+		assertErrorCode(t, rec, http.StatusBadRequest, errCodeBadRequest)
+	}
+}
+
+func TestGetLivestreamsByIDs(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		ids = append(ids, insertTestLivestream(t, streamerID, fmt.Sprintf("live %d", i), testTermStart, testTermStart+3600))
+	}
+	warmTestCaches(t)
+	batch := func(userID int64, ids []int64) *httptest.ResponseRecorder {
+		t.Helper()
+		return doRequest(t, http.MethodPost, "/api/livestream/batch", GetLivestreamsByIDsRequest{IDs: ids}, userID)
+	}
+
+	// 存在しないIDは読み飛ばし、リクエストされた順に返す
+	var livestreams []Livestream
+	decodeResponse(t, batch(streamerID, []int64{ids[2], 999999, ids[0], ids[1]}), http.StatusOK, &livestreams)
+	if got, want := livestreamIDs(livestreams), []int64{ids[2], ids[0], ids[1]}; !equalIDs(got, want) {
+		t.Errorf("batch = %v, want %v", got, want)
+	}
+	if len(livestreams) > 0 && livestreams[0].Owner.Name != "streamer" {
+		t.Errorf("owner = %+v, want streamer", livestreams[0].Owner)
+	}
+
+	// 重複したIDは最初に現れた位置で1件だけ返す
+	decodeResponse(t, batch(streamerID, []int64{ids[1], ids[0], ids[1], ids[0], ids[2]}), http.StatusOK, &livestreams)
+	if got, want := livestreamIDs(livestreams), []int64{ids[1], ids[0], ids[2]}; !equalIDs(got, want) {
+		t.Errorf("batch with repeated ids = %v, want %v", got, want)
+	}
+	// 上限は重複を除いた件数で判定する
+	repeated := make([]int64, maxLivestreamBatchIDs+1)
+	for i := range repeated {
+		repeated[i] = ids[i%len(ids)]
+	}
+	decodeResponse(t, batch(streamerID, repeated), http.StatusOK, &livestreams)
+	if got := livestreamIDs(livestreams); !equalIDs(got, ids) {
+		t.Errorf("batch with many repeated ids = %v, want %v", got, ids)
+	}
+
+	var empty []Livestream
+	decodeResponse(t, batch(streamerID, []int64{}), http.StatusOK, &empty)
+	if len(empty) != 0 {
+		t.Errorf("empty batch = %v, want empty", empty)
+	}
+
+	oversized := make([]int64, maxLivestreamBatchIDs+1)
+	for i := range oversized {
+		oversized[i] = int64(i + 1)
+	}
+	assertErrorCode(t, batch(streamerID, oversized), http.StatusBadRequest, errCodeBadRequest)
+
+	if rec := batch(0, ids); rec.Code != http.StatusUnauthorized {
+		t.Errorf("batch without session status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSearchLivestreamsWithReactionSummaries(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	reactions := map[string][]string{
+		"hearts": {"heart", "heart", "heart", "tada"},
+		"tadas":  {"tada", "tada", "heart", "smile"},
+		"quiet":  {},
+	}
+	ids := map[string]int64{}
+	for title, emojis := range reactions {
+		id := insertTestLivestream(t, streamerID, title, testTermStart, testTermStart+3600)
+		for i, emoji := range emojis {
+			insertTestReaction(t, viewerID, id, emoji, testTermStart+int64(i))
+		}
+		ids[title] = id
+	}
+	warmTestCaches(t)
+
+	recorder := recordQueries(t)
+	var livestreams []Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search?with_reactions=1", nil, viewerID), http.StatusOK, &livestreams)
+	want := map[int64]LivestreamReactionSummary{
+		ids["hearts"]: {TopEmojiName: "heart", TopEmojiCount: 3, TotalReactions: 4},
+		ids["tadas"]:  {TopEmojiName: "tada", TopEmojiCount: 2, TotalReactions: 4},
+		ids["quiet"]:  {},
+	}
+	if len(livestreams) != len(want) {
+		t.Fatalf("search = %d livestreams, want %d", len(livestreams), len(want))
+	}
+	for _, l := range livestreams {
+		if l.ReactionSummary == nil || *l.ReactionSummary != want[l.ID] {
+			t.Errorf("livestream %d summary = %+v, want %+v", l.ID, l.ReactionSummary, want[l.ID])
+		}
+	}
+	// 全配信の集計を1クエリで取る
+	if q := recorder.matching("GROUP BY livestream_id, emoji_name"); len(q) != 1 {
+		t.Errorf("reaction count queries = %d, want 1", len(q))
+	}
+
+	// フラグが無ければ集計しない
+	var plain []Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search", nil, viewerID), http.StatusOK, &plain)
+	for _, l := range plain {
+		if l.ReactionSummary != nil {
+			t.Errorf("livestream %d has a summary without with_reactions", l.ID)
+		}
+	}
+}
+
+func TestUpdateLivestreamOptimisticLock(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID)
+
+	// 2つのセッションが同じバージョンを読んでから編集する
+	var read Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, path, nil, streamerID), http.StatusOK, &read)
+	if read.Version != 0 {
+		t.Fatalf("version = %d, want 0", read.Version)
+	}
+	var first Livestream
+	decodeResponse(t, doRequest(t, http.MethodPatch, path, map[string]interface{}{"version": read.Version, "title": "first"}, streamerID), http.StatusOK, &first)
+	if first.Title != "first" || first.Version != read.Version+1 {
+		t.Errorf("first update = %+v, want title first and version %d", first, read.Version+1)
+	}
+	assertErrorCode(t, doRequest(t, http.MethodPatch, path, map[string]interface{}{"version": read.Version, "description": "second"}, streamerID), http.StatusConflict, errCodeLivestreamVersionConflict)
+	// 変更のない古いバージョンの更新も競合として扱う
+	assertErrorCode(t, doRequest(t, http.MethodPatch, path, map[string]interface{}{"version": read.Version}, streamerID), http.StatusConflict, errCodeLivestreamVersionConflict)
+	assertErrorCode(t, doRequest(t, http.MethodPatch, path, map[string]interface{}{"description": "unversioned"}, streamerID), http.StatusBadRequest, errCodeBadRequest)
+
+	// 読み直したバージョンなら更新できる
+	var retried Livestream
+	decodeResponse(t, doRequest(t, http.MethodPatch, path, map[string]interface{}{"version": first.Version, "description": "second"}, streamerID), http.StatusOK, &retried)
+	if retried.Title != "first" || retried.Description != "second" || retried.Version != first.Version+1 {
+		t.Errorf("retried update = %+v, want title first, description second and version %d", retried, first.Version+1)
+	}
+}
+
+func TestOverlappingSlots(t *testing.T) {
+	setupTestDB(t)
+	const h = 3600
+	insertTestSlots(t, testTermStart, testTermStart+4*h, 5)
+
+	for _, tt := range []struct {
+		name           string
+		startAt, endAt int64
+		want           []int64 // 枠の start_at
+	}{
+		{"exact", testTermStart + h, testTermStart + 2*h, []int64{testTermStart + h}},
+		{"exact multiple", testTermStart + h, testTermStart + 3*h, []int64{testTermStart + h, testTermStart + 2*h}},
+		{"partial", testTermStart + h + h/2, testTermStart + 2*h + h/2, []int64{testTermStart + h, testTermStart + 2*h}},
+		{"inside one slot", testTermStart + 10, testTermStart + 20, []int64{testTermStart}},
+		{"before the term", testTermStart - h, testTermStart, nil},
+		{"after the term", testTermStart + 4*h, testTermStart + 5*h, nil},
+	} {
+		for _, forUpdate := range []bool{false, true} {
+			tx, err := dbConn.Beginx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			slots, err := overlappingSlots(context.Background(), tx, tt.startAt, tt.endAt, forUpdate)
+			tx.Rollback()
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			var got []int64
+			for _, slot := range slots {
+				got = append(got, slot.StartAt)
+			}
+			if !equalIDs(got, tt.want) {
+				t.Errorf("%s (forUpdate %v) = %v, want %v", tt.name, forUpdate, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestSlotsAlignWith(t *testing.T) {
+	const h = 3600
+	contiguous := []*ReservationSlotModel{
+		{StartAt: 0, EndAt: h},
+		{StartAt: h, EndAt: 2 * h},
+		{StartAt: 2 * h, EndAt: 3 * h},
+	}
+	gapped := []*ReservationSlotModel{
+		{StartAt: 0, EndAt: h},
+		{StartAt: 2 * h, EndAt: 3 * h},
+	}
+	for _, tt := range []struct {
+		name           string
+		slots          []*ReservationSlotModel
+		startAt, endAt int64
+		want           bool
+	}{
+		{"one slot", contiguous, h, 2 * h, true},
+		{"all slots", contiguous, 0, 3 * h, true},
+		{"starts mid slot", contiguous, h / 2, 2 * h, false},
+		{"ends mid slot", contiguous, h, 2*h + h/2, false},
+		{"past the last slot", contiguous, 2 * h, 4 * h, false},
+		{"before the first slot", contiguous, -h, h, false},
+		{"across a gap", gapped, 0, 3 * h, false},
+		{"no slots", nil, 0, h, false},
+	} {
+		if got := slotsAlignWith(tt.slots, tt.startAt, tt.endAt); got != tt.want {
+			t.Errorf("%s: slotsAlignWith(%d, %d) = %v, want %v", tt.name, tt.startAt, tt.endAt, got, tt.want)
+		}
+	}
+}
+
+func TestGetLivePlaying(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	const h = 3600
+
+	// 秒の境目をまたぐと境界の配信の扱いが変わるので、同じ秒のうちに終わるまでやり直す
+	for attempt := 0; ; attempt++ {
+		mustExec(t, "DELETE FROM livestreams")
+		now := time.Now().Unix()
+		insertTestLivestream(t, streamerID, "past", now-2*h, now-h)
+		insertTestLivestream(t, streamerID, "ended now", now-h, now)
+		startedNow := insertTestLivestream(t, streamerID, "started now", now, now+h)
+		earlier := insertTestLivestream(t, streamerID, "live", now-h, now+h)
+		insertTestLivestream(t, streamerID, "future", now+h, now+2*h)
+		deleted := insertTestLivestream(t, streamerID, "deleted", now-h, now+h)
+		mustExec(t, "UPDATE livestreams SET deleted_at = ? WHERE id = ?", now, deleted)
+		warmTestCaches(t)
+
+		var newest, oldest, page []Livestream
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/live", nil, streamerID), http.StatusOK, &newest)
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/live?order=oldest", nil, streamerID), http.StatusOK, &oldest)
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/live?limit=1&offset=1", nil, streamerID), http.StatusOK, &page)
+		if time.Now().Unix() != now && attempt < 3 {
+			continue
+		}
+
+		if got, want := livestreamIDs(newest), []int64{startedNow, earlier}; !equalIDs(got, want) {
+			t.Errorf("live = %v, want %v", got, want)
+		}
+		if got, want := livestreamIDs(oldest), []int64{earlier, startedNow}; !equalIDs(got, want) {
+			t.Errorf("live order=oldest = %v, want %v", got, want)
+		}
+		if got, want := livestreamIDs(page), []int64{earlier}; !equalIDs(got, want) {
+			t.Errorf("live limit=1&offset=1 = %v, want %v", got, want)
+		}
+		for _, livestream := range newest {
+			if livestream.Owner.ID != streamerID {
+				t.Errorf("livestream %d owner = %+v, want user %d", livestream.ID, livestream.Owner, streamerID)
+			}
+		}
+		return
+	}
+}
+
+func TestReserveLivestreamAlignsWithSlots(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	const h = 3600
+	// 3時間目の枠だけ存在しない
+	insertTestSlots(t, testTermStart, testTermStart+2*h, 5)
+	insertTestSlots(t, testTermStart+3*h, testTermStart+5*h, 5)
+	slotCounts := func() []int64 {
+		t.Helper()
+		var counts []int64
+		if err := dbConn.Select(&counts, "SELECT slot FROM reservation_slots ORDER BY start_at"); err != nil {
+			t.Fatal(err)
+		}
+		return counts
+	}
+
+	reserveTestLivestream(t, userID, newTestReserveRequest(testTermStart, testTermStart+h))
+	if got, want := slotCounts(), []int64{4, 5, 5, 5}; !equalIDs(got, want) {
+		t.Errorf("slots after a single-slot reservation = %v, want %v", got, want)
+	}
+	reserveTestLivestream(t, userID, newTestReserveRequest(testTermStart+3*h, testTermStart+5*h))
+	if got, want := slotCounts(), []int64{4, 5, 4, 4}; !equalIDs(got, want) {
+		t.Errorf("slots after a multi-slot reservation = %v, want %v", got, want)
+	}
+
+	for _, tt := range []struct {
+		name           string
+		startAt, endAt int64
+	}{
+		{"half a slot", testTermStart + h/2, testTermStart + h},
+		{"across slot boundaries", testTermStart + h/2, testTermStart + h + h/2},
+		{"over a missing slot", testTermStart + h, testTermStart + 4*h},
+		{"past the last slot", testTermStart + 4*h, testTermStart + 6*h},
+	} {
+		assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(tt.startAt, tt.endAt), userID), http.StatusBadRequest, errCodeBadRequest)
+	}
+	if got, want := slotCounts(), []int64{4, 5, 4, 4}; !equalIDs(got, want) {
+		t.Errorf("slots after misaligned reservations = %v, want %v", got, want)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != 2 {
+		t.Errorf("livestreams = %d, want 2", n)
+	}
+}
+
+func TestGetTrending(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	now := time.Now().Unix()
+	const h = 3600
+	warm := insertTestLivestream(t, streamerID, "warm", now-h, now+h)
+	hot := insertTestLivestream(t, streamerID, "hot", now-h, now+h)
+	ended := insertTestLivestream(t, streamerID, "ended", now-2*h, now-60)
+	quiet := insertTestLivestream(t, streamerID, "quiet", now-h, now+h)
+	burst := func(livestreamID int64, n int, createdAt int64) {
+		for i := 0; i < n; i++ {
+			insertTestReaction(t, viewerID, livestreamID, "tada", createdAt)
+		}
+	}
+	burst(hot, 5, now-60)
+	burst(ended, 3, now-120)
+	burst(warm, 2, now-60)
+	// 集計期間より前のリアクションは数えない
+	burst(warm, 10, now-trendingWindowSeconds-60)
+	warmTestCaches(t)
+	trending := func(query string) []int64 {
+		t.Helper()
+		var livestreams []Livestream
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/trending"+query, nil, viewerID), http.StatusOK, &livestreams)
+		return livestreamIDs(livestreams)
+	}
+
+	if got, want := trending(""), []int64{hot, ended, warm}; !equalIDs(got, want) {
+		t.Errorf("trending = %v, want %v", got, want)
+	}
+	if got, want := trending("?exclude_ended=1"), []int64{hot, warm}; !equalIDs(got, want) {
+		t.Errorf("trending exclude_ended=1 = %v, want %v", got, want)
+	}
+	if got, want := trending("?limit=1"), []int64{hot}; !equalIDs(got, want) {
+		t.Errorf("trending limit=1 = %v, want %v", got, want)
+	}
+
+	// 直近のリアクションが無ければ新しい順
+	mustExec(t, "DELETE FROM reactions WHERE created_at >= ?", now-trendingWindowSeconds)
+	if got, want := trending(""), []int64{quiet, ended, hot, warm}; !equalIDs(got, want) {
+		t.Errorf("quiet trending = %v, want %v", got, want)
+	}
+	if got, want := trending("?exclude_ended=1"), []int64{quiet, hot, warm}; !equalIDs(got, want) {
+		t.Errorf("quiet trending exclude_ended=1 = %v, want %v", got, want)
+	}
+}
+
+func TestInvalidLivestreamIDIsBadRequest(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	warmTestCaches(t)
+
+	for _, route := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodGet, "/api/livestream/%s", nil},
+		{http.MethodPatch, "/api/livestream/%s", map[string]interface{}{"version": 0, "title": "t"}},
+		{http.MethodDelete, "/api/livestream/%s", nil},
+		{http.MethodGet, "/api/livestream/%s/reaction", nil},
+		{http.MethodPost, "/api/livestream/%s/reaction", PostReactionRequest{EmojiName: "tada"}},
+		{http.MethodPost, "/api/livestream/%s/enter", nil},
+		{http.MethodDelete, "/api/livestream/%s/exit", nil},
+		{http.MethodGet, "/api/livestream/%s/report", nil},
+		{http.MethodPost, "/api/livestream/%s/livecomment/1/report", nil},
+	} {
+		for _, id := range []string{"0", "-1", "abc"} {
+			target := fmt.Sprintf(route.path, id)
+			t.Run(route.method+" "+target, func(t *testing.T) {
+				assertErrorCode(t, doRequest(t, route.method, target, route.body, userID), http.StatusBadRequest, errCodeBadRequest)
+			})
+		}
+	}
+}
+
+// livestreamEnvelope は envelope=1 の配信一覧のレスポンス
+type livestreamEnvelope struct {
+	Items      []Livestream `json:"items"`
+	NextCursor string       `json:"next_cursor"`
+	HasMore    bool         `json:"has_more"`
+}
+
+func TestSearchLivestreamsEnvelope(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		ids = append(ids, insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600))
+	}
+	warmTestCaches(t)
+	fetch := func(query string) livestreamEnvelope {
+		t.Helper()
+		var page livestreamEnvelope
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search?envelope=1"+query, nil, streamerID), http.StatusOK, &page)
+		return page
+	}
+
+	// 続きのカーソルを辿って最後のページまで取得する
+	var got []int64
+	var pages int
+	for query := "&limit=2"; ; pages++ {
+		page := fetch(query)
+		got = append(got, livestreamIDs(page.Items)...)
+		if page.HasMore != (page.NextCursor != "") {
+			t.Fatalf("page %d has_more = %v with next_cursor %q", pages, page.HasMore, page.NextCursor)
+		}
+		if !page.HasMore {
+			if len(page.Items) != 1 {
+				t.Errorf("last page = %v, want 1 livestream", livestreamIDs(page.Items))
+			}
+			break
+		}
+		if len(page.Items) != 2 {
+			t.Fatalf("page %d = %v, want a full page of 2 with has_more", pages, livestreamIDs(page.Items))
+		}
+		query = "&limit=2&before_id=" + page.NextCursor
+	}
+	if want := []int64{ids[4], ids[3], ids[2], ids[1], ids[0]}; !equalIDs(got, want) || pages+1 != 3 {
+		t.Errorf("paged through %v in %d pages, want %v in 3", got, pages+1, want)
+	}
+
+	// 件数ちょうどのページは最後のページ
+	if page := fetch("&limit=5"); len(page.Items) != 5 || page.HasMore || page.NextCursor != "" {
+		t.Errorf("limit=5 = %d items (has_more %v, next_cursor %q), want 5 and no more", len(page.Items), page.HasMore, page.NextCursor)
+	}
+	if page := fetch("&limit=2&order=oldest"); !equalIDs(livestreamIDs(page.Items), ids[:2]) || !page.HasMore || page.NextCursor != itoa(ids[1]) {
+		t.Errorf("order=oldest page = %+v, want %v with next_cursor %d", page, ids[:2], ids[1])
+	}
+
+	// envelope を指定しなければ配列のまま
+	if got := searchTestLivestreams(t, streamerID, "?limit=2"); !equalIDs(got, []int64{ids[4], ids[3]}) {
+		t.Errorf("bare search = %v, want %v", got, []int64{ids[4], ids[3]})
+	}
+}
+
+func TestEnterLivestreamViewingCap(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &maxViewingLivestreamsPerUser, 2)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	otherViewerID := insertTestUser(t, "other")
+	var livestreamIDs []int64
+	for i := 0; i < 3; i++ {
+		livestreamIDs = append(livestreamIDs, insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600))
+	}
+	warmTestCaches(t)
+	enter := func(userID, livestreamID int64) *httptest.ResponseRecorder {
+		t.Helper()
+		return doRequest(t, http.MethodPost, "/api/livestream/"+itoa(livestreamID)+"/enter", nil, userID)
+	}
+
+	enterTestLivestream(t, viewerID, livestreamIDs[0])
+	enterTestLivestream(t, viewerID, livestreamIDs[1])
+	assertErrorCode(t, enter(viewerID, livestreamIDs[2]), http.StatusTooManyRequests, errCodeTooManyViewingLivestreams)
+	// 視聴中の配信への再入室と、他のユーザの入室は上限に掛からない
+	enterTestLivestream(t, viewerID, livestreamIDs[1])
+	enterTestLivestream(t, otherViewerID, livestreamIDs[2])
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestream_viewers_history WHERE user_id = ?", viewerID); n != 2 {
+		t.Errorf("viewer rows = %d, want 2", n)
+	}
+
+	// 退室すれば次の配信に入れる
+	exitTestLivestream(t, viewerID, livestreamIDs[0])
+	enterTestLivestream(t, viewerID, livestreamIDs[2])
+
+	// 0以下なら無制限
+	setTestVar(t, &maxViewingLivestreamsPerUser, 0)
+	enterTestLivestream(t, viewerID, livestreamIDs[0])
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestream_viewers_history WHERE user_id = ?", viewerID); n != 3 {
+		t.Errorf("viewer rows without a cap = %d, want 3", n)
+	}
+}
+
+func TestValidateReservationRangeIgnoresLocalTimezone(t *testing.T) {
+	const h = 3600
+	start, end := termStartAt.Unix(), termEndAt.Unix()
+	tests := []struct {
+		name           string
+		startAt, endAt int64
+		wantErr        bool
+	}{
+		{name: "first slot", startAt: start, endAt: start + h},
+		{name: "just before the term", startAt: start - h, endAt: start, wantErr: true},
+		{name: "last slot", startAt: end - h, endAt: end},
+		{name: "just after the term", startAt: end, endAt: end + h, wantErr: true},
+	}
+	for _, loc := range []*time.Location{
+		time.UTC,
+		time.FixedZone("JST", 9*h),
+		time.FixedZone("PST", -8*h),
+		time.FixedZone("NPT", 5*h+45*60),
+	} {
+		setTestVar(t, &time.Local, loc)
+		for _, tt := range tests {
+			err := validateReservationRange(tt.startAt, tt.endAt)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("TZ=%s %s: validateReservationRange(%d, %d) = %v, wantErr %v", loc, tt.name, tt.startAt, tt.endAt, err, tt.wantErr)
+			}
+		}
+	}
+}
+
+func TestReserveLivestreamTermBoundaryInLocalTimezone(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &time.Local, time.FixedZone("JST", 9*3600))
+	userID := insertTestUser(t, "streamer")
+	const h = 3600
+	start, end := termStartAt.Unix(), termEndAt.Unix()
+	insertTestSlots(t, start-h, start+h, 5)
+	insertTestSlots(t, end-h, end+h, 5)
+	warmTestCaches(t)
+
+	reserveTestLivestream(t, userID, newTestReserveRequest(start, start+h))
+	reserveTestLivestream(t, userID, newTestReserveRequest(end-h, end))
+	for _, r := range [][2]int64{{start - h, start}, {end, end + h}} {
+		assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(r[0], r[1]), userID), http.StatusBadRequest, errCodeBadRequest)
+	}
+}
+
+func TestNormalizeLivestreamText(t *testing.T) {
+	setTestVar(t, &maxLivestreamTitleLength, 5)
+	setTestVar(t, &maxLivestreamDescriptionLength, 5)
+	for _, tt := range []struct {
+		title   string
+		want    string
+		wantErr bool
+	}{
+		{title: "  live \n", want: "live"},
+		{title: "配信です!", want: "配信です!"},
+		{title: "", wantErr: true},
+		{title: " \t\n", wantErr: true},
+		{title: "sixsix", wantErr: true},
+		{title: "a\x00b", wantErr: true},
+		{title: "a\tb", wantErr: true},
+	} {
+		got, err := normalizeLivestreamTitle(tt.title)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeLivestreamTitle(%q) = %q, %v, want %q (wantErr %v)", tt.title, got, err, tt.want, tt.wantErr)
+		}
+	}
+	for _, tt := range []struct {
+		description string
+		want        string
+		wantErr     bool
+	}{
+		{description: "", want: ""},
+		{description: "  説明  ", want: "説明"},
+		{description: "a\nb", want: "a\nb"},
+		{description: "sixsix", wantErr: true},
+	} {
+		got, err := normalizeLivestreamDescription(tt.description)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeLivestreamDescription(%q) = %q, %v, want %q (wantErr %v)", tt.description, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestReserveLivestreamValidatesText(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+3600, 5)
+	warmTestCaches(t)
+	withText := func(title, description string) ReserveLivestreamRequest {
+		req := newTestReserveRequest(testTermStart, testTermStart+3600)
+		req.Title, req.Description = title, description
+		return req
+	}
+
+	recorder := recordQueries(t)
+	for _, req := range []ReserveLivestreamRequest{
+		withText("", "description"),
+		withText("   ", "description"),
+		withText("bad\x07title", "description"),
+		withText(strings.Repeat("a", maxLivestreamTitleLength+1), "description"),
+		withText("title", strings.Repeat("a", maxLivestreamDescriptionLength+1)),
+	} {
+		assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation", req, userID), http.StatusBadRequest, errCodeBadRequest)
+	}
+	// トランザクションを始める前に弾く
+	if n := len(recorder.transactions()); n != 0 {
+		t.Errorf("invalid reservations began %d transactions, want 0", n)
+	}
+
+	livestream := reserveTestLivestream(t, userID, withText("  trimmed title  ", "\n description \n"))
+	if livestream.Title != "trimmed title" || livestream.Description != "description" {
+		t.Errorf("reserved = %q / %q, want trimmed title and description", livestream.Title, livestream.Description)
+	}
+	var stored LivestreamModel
+	if err := dbConn.Get(&stored, "SELECT * FROM livestreams WHERE id = ?", livestream.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "trimmed title" || stored.Description != "description" {
+		t.Errorf("stored = %q / %q, want trimmed title and description", stored.Title, stored.Description)
+	}
+}
+
+func TestReserveLivestreamRejectsOverlappingOwnReservations(t *testing.T) {
+	setupTestDB(t)
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	insertTestSlots(t, testTermStart, testTermStart+4*3600, 5)
+	warmTestCaches(t)
+
+	// 既定では同じ配信者の重なる予約も受け付ける
+	reserveTestLivestream(t, aliceID, newTestReserveRequest(testTermStart, testTermStart+3600))
+	reserveTestLivestream(t, aliceID, newTestReserveRequest(testTermStart, testTermStart+3600))
+
+	setTestVar(t, &rejectOverlappingOwnReservations, true)
+	first := reserveTestLivestream(t, bobID, newTestReserveRequest(testTermStart+3600, testTermStart+3*3600))
+	before := mustCount(t, "SELECT SUM(slot) FROM reservation_slots")
+	for _, req := range []ReserveLivestreamRequest{
+		newTestReserveRequest(testTermStart+3600, testTermStart+3*3600),
+		newTestReserveRequest(testTermStart+2*3600, testTermStart+4*3600),
+		newTestReserveRequest(testTermStart, testTermStart+2*3600),
+	} {
+		assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation", req, bobID), http.StatusConflict, errCodeReservationOverlap)
+	}
+	if after := mustCount(t, "SELECT SUM(slot) FROM reservation_slots"); after != before {
+		t.Errorf("rejected reservations changed remaining slots from %d to %d", before, after)
+	}
+
+	// 隣接する区間や、他の配信者の重なる区間は予約できる
+	reserveTestLivestream(t, bobID, newTestReserveRequest(testTermStart+3*3600, testTermStart+4*3600))
+	reserveTestLivestream(t, aliceID, newTestReserveRequest(testTermStart+3600, testTermStart+2*3600))
+
+	// 削除した配信とは重なってもよい
+	if rec := doRequest(t, http.MethodDelete, "/api/livestream/"+itoa(first.ID), nil, bobID); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	reserveTestLivestream(t, bobID, newTestReserveRequest(testTermStart+3600, testTermStart+3*3600))
+}
+
+func TestSearchLivestreamsByUnknownTag(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, userID, "live", testTermStart, testTermStart+3600)
+	tagID := insertTestTag(t, "music")
+	mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", livestreamID, tagID)
+	warmTestCaches(t)
+
+	recorder := recordQueries(t)
+	for _, query := range []string{"?tag=nonexistent", "?tags=nonexistent,music&match=all"} {
+		rec := doRequest(t, http.MethodGet, "/api/livestream/search"+query, nil, userID)
+		if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+			t.Errorf("search %s = %d %s, want 200 []", query, rec.Code, rec.Body)
+		}
+	}
+	// 空のIN句を組み立てず、配信を引かずに返す
+	if n := len(recorder.matching("FROM livestreams")); n != 0 {
+		t.Errorf("searches for unknown tags queried livestreams %d times, want 0", n)
+	}
+	var envelope livestreamEnvelope
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search?tag=nonexistent&envelope=1", nil, userID), http.StatusOK, &envelope)
+	if envelope.Items == nil || len(envelope.Items) != 0 || envelope.HasMore {
+		t.Errorf("envelope = %+v, want empty items", envelope)
+	}
+
+	// 存在しないタグが混ざっていても、いずれかに一致すれば返す
+	if got := searchTestLivestreams(t, userID, "?tags=nonexistent,music"); !equalIDs(got, []int64{livestreamID}) {
+		t.Errorf("search any = %v, want %v", got, []int64{livestreamID})
+	}
+}
+
+func TestLivestreamsWithoutTags(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	// タグが1つも存在しない状態でも配信を返せる
+	first := insertTestLivestream(t, userID, "first", testTermStart, testTermStart+3600)
+	second := insertTestLivestream(t, userID, "second", testTermStart+3600, testTermStart+7200)
+	warmTestCaches(t)
+
+	rec := doRequest(t, http.MethodGet, "/api/livestream/"+itoa(first), nil, userID)
+	var livestream Livestream
+	decodeResponse(t, rec, http.StatusOK, &livestream)
+	if livestream.Tags == nil || len(livestream.Tags) != 0 {
+		t.Errorf("tags = %v, want an empty array", livestream.Tags)
+	}
+	if !strings.Contains(rec.Body.String(), `"tags":[]`) {
+		t.Errorf("response %s must encode tags as []", rec.Body)
+	}
+
+	var livestreams []Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search", nil, userID), http.StatusOK, &livestreams)
+	if got := livestreamIDs(livestreams); len(got) != 2 {
+		t.Fatalf("search = %v, want %d and %d", got, first, second)
+	}
+	for _, l := range livestreams {
+		if l.Tags == nil || len(l.Tags) != 0 {
+			t.Errorf("livestream %d tags = %v, want an empty array", l.ID, l.Tags)
+		}
+	}
+
+	tx, err := dbConn.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	ctx := context.Background()
+	if filled, err := fillLivestreamResponseBulk(ctx, tx, nil); err != nil || len(filled) != 0 {
+		t.Errorf("fillLivestreamResponseBulk(nil) = %v, %v, want empty", filled, err)
+	}
+	if users, err := fillUserResponseBulk(ctx, tx, nil); err != nil || len(users) != 0 {
+		t.Errorf("fillUserResponseBulk(nil) = %v, %v, want empty", users, err)
+	}
+	tagsCache.reset()
+	if tags, err := getTagsByIDs(ctx, tx, nil); err != nil || len(tags) != 0 {
+		t.Errorf("getTagsByIDs(nil) = %v, %v, want empty", tags, err)
+	}
+}
+
+func TestReserveLivestreamWithoutSlotsIsRejected(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart+5*3600, testTermStart+6*3600, 5)
+	warmTestCaches(t)
+
+	// 予約期間内でも予約枠が1つも無い区間は、予約枠を消費しない無料の予約にしない
+	assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(testTermStart, testTermStart+3600), userID), http.StatusBadRequest, errCodeBadRequest)
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != 0 {
+		t.Errorf("livestreams = %d, want 0", n)
+	}
+	if n := mustCount(t, "SELECT slot FROM reservation_slots"); n != 5 {
+		t.Errorf("unrelated slot = %d, want 5", n)
+	}
+}
+
+func TestAdjustSlotsVerifiesAffectedRows(t *testing.T) {
+	setupTestDB(t)
+	insertTestSlots(t, testTermStart, testTermStart+2*3600, 5)
+	var ids []int64
+	if err := dbConn.Select(&ids, "SELECT id FROM reservation_slots ORDER BY start_at"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := dbConn.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	ctx := context.Background()
+	if err := adjustSlots(ctx, tx, ids, -1); err != nil {
+		t.Fatalf("adjustSlots(%v) = %v", ids, err)
+	}
+	// 一部の枠しか更新できなければエラーにして、呼び出し側にロールバックさせる
+	if err := adjustSlots(ctx, tx, append(ids, 999999), -1); !errors.Is(err, errReservationSlotsNotAdjusted) {
+		t.Errorf("adjustSlots with a missing slot = %v, want %v", err, errReservationSlotsNotAdjusted)
+	}
+	if err := adjustSlots(ctx, tx, nil, -1); err != nil {
+		t.Errorf("adjustSlots(nil) = %v, want nil", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mustCount(t, "SELECT SUM(slot) FROM reservation_slots"); n != 10 {
+		t.Errorf("slots after rollback = %d, want 10", n)
+	}
+}
+
+func TestAddEmojiCountBreaksTiesByName(t *testing.T) {
+	counts := []struct {
+		emojiName string
+		count     int64
+	}{{"tada", 2}, {"heart", 2}, {"smile", 1}, {"wave", 2}}
+	// 集計する順序によらず、同数なら絵文字名の昇順で先のものが選ばれる
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {1, 0, 3, 2}, {2, 3, 0, 1}} {
+		var s LivestreamReactionSummary
+		for _, i := range order {
+			s.addEmojiCount(counts[i].emojiName, counts[i].count)
+		}
+		if want := (LivestreamReactionSummary{TopEmojiName: "heart", TopEmojiCount: 2, TotalReactions: 7}); s != want {
+			t.Errorf("summary in order %v = %+v, want %+v", order, s, want)
+		}
+	}
+}
+
+func TestReactionSummaryTiesAreAlphabetical(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "tied", testTermStart, testTermStart+3600)
+	// 後に投稿された絵文字やIDの大きい絵文字が先にならない
+	for i, emoji := range []string{"wave", "tada", "smile", "wave", "tada", "smile"} {
+		insertTestReaction(t, viewerID, livestreamID, emoji, testTermStart+int64(i))
+	}
+	warmTestCaches(t)
+
+	for i := 0; i < 3; i++ {
+		livestreamReactionSummaryCache.reset()
+		var livestreams []Livestream
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search?with_reactions=1", nil, viewerID), http.StatusOK, &livestreams)
+		if len(livestreams) != 1 || livestreams[0].ReactionSummary == nil {
+			t.Fatalf("livestreams = %+v, want one with a summary", livestreams)
+		}
+		if got, want := *livestreams[0].ReactionSummary, (LivestreamReactionSummary{TopEmojiName: "smile", TopEmojiCount: 2, TotalReactions: 6}); got != want {
+			t.Errorf("summary = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestReserveLivestreamFailureRestoresSlots(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	tagID := insertTestTag(t, "music")
+	insertTestSlots(t, testTermStart, testTermStart+2*3600, 5)
+	warmTestCaches(t)
+	req := newTestReserveRequest(testTermStart, testTermStart+2*3600, tagID)
+	assertUnchanged := func(name string) {
+		t.Helper()
+		if n := mustCount(t, "SELECT SUM(slot) FROM reservation_slots"); n != 10 {
+			t.Errorf("%s: remaining slots = %d, want 10", name, n)
+		}
+		if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != 0 {
+			t.Errorf("%s: livestreams = %d, want 0", name, n)
+		}
+		if n := mustCount(t, "SELECT COUNT(*) FROM livestream_tags"); n != 0 {
+			t.Errorf("%s: livestream_tags = %d, want 0", name, n)
+		}
+	}
+
+	// 存在しないタグは予約枠を減らし、配信とタグを登録した後に失敗する
+	recorder := recordQueries(t)
+	invalid := newTestReserveRequest(testTermStart, testTermStart+2*3600, tagID, 999999)
+	assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation", invalid, userID), http.StatusInternalServerError, errCodeInternal)
+	if n := len(recorder.matching("INSERT INTO livestream_tags")); n != 1 {
+		t.Fatalf("tags were inserted %d times, want the failure to happen after the insert", n)
+	}
+	assertUnchanged("invalid tag")
+
+	// 予約枠を減らした後のどこで失敗しても、ロールバックで予約枠ごと取り消される
+	for _, failing := range []string{"INSERT INTO livestreams", "INSERT INTO livestream_tags", "SELECT * FROM livestream_tags WHERE livestream_id"} {
+		failing := failing
+		recorder.injectErrors(func(query string) error {
+			if strings.HasPrefix(query, failing) {
+				return errors.New("injected failure")
+			}
+			return nil
+		})
+		if rec := doRequest(t, http.MethodPost, "/api/livestream/reservation", req, userID); rec.Code != http.StatusInternalServerError {
+			t.Errorf("failing %q: status = %d, want %d", failing, rec.Code, http.StatusInternalServerError)
+		}
+		assertUnchanged(failing)
+	}
+
+	// 予約枠の減算から配信の登録までが1つのトランザクションにまとまっている
+	recorder.injectErrors(nil)
+	recorder.reset()
+	reserveTestLivestream(t, userID, req)
+	if n := len(recorder.transactions()); n != 1 {
+		t.Errorf("reservation used %d transactions, want 1", n)
+	}
+	if n := mustCount(t, "SELECT SUM(slot) FROM reservation_slots"); n != 8 {
+		t.Errorf("remaining slots after a reservation = %d, want 8", n)
+	}
+}
+
+func TestLivestreamIsLiveAt(t *testing.T) {
+	livestream := LivestreamModel{StartAt: testTermStart, EndAt: testTermStart + 3600}
+	for _, tt := range []struct {
+		now  int64
+		want bool
+	}{
+		{testTermStart - 1, false},
+		{testTermStart, true},
+		{testTermStart + 1800, true},
+		{testTermStart + 3599, true},
+		{testTermStart + 3600, false},
+		{testTermStart + 3601, false},
+	} {
+		if got := livestream.isLiveAt(tt.now); got != tt.want {
+			t.Errorf("isLiveAt(%d) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestLivestreamDurationAndIsLive(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	now := time.Now().Unix()
+	want := map[int64]struct {
+		duration int64
+		isLive   bool
+	}{
+		insertTestLivestream(t, userID, "past", now-7200, now-3600):    {3600, false},
+		insertTestLivestream(t, userID, "live", now-600, now+3600):     {4200, true},
+		insertTestLivestream(t, userID, "future", now+3600, now+10800): {7200, false},
+	}
+	warmTestCaches(t)
+
+	check := func(path string, livestream Livestream) {
+		t.Helper()
+		w, ok := want[livestream.ID]
+		if !ok {
+			t.Fatalf("%s: unexpected livestream %d", path, livestream.ID)
+		}
+		if livestream.DurationSeconds != w.duration || livestream.IsLive != w.isLive {
+			t.Errorf("%s: livestream %q duration_seconds = %d, is_live = %v, want %d, %v",
+				path, livestream.Title, livestream.DurationSeconds, livestream.IsLive, w.duration, w.isLive)
+		}
+	}
+
+	// 単体の組み立て (fillLivestreamResponse)
+	for id := range want {
+		var livestream Livestream
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(id), nil, userID), http.StatusOK, &livestream)
+		check("single", livestream)
+	}
+
+	// 一覧の組み立て (fillLivestreamResponseBulk)
+	var livestreams []Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search", nil, userID), http.StatusOK, &livestreams)
+	if len(livestreams) != len(want) {
+		t.Fatalf("search returned %d livestreams, want %d", len(livestreams), len(want))
+	}
+	for _, livestream := range livestreams {
+		check("bulk", livestream)
+	}
+}
+
+func TestReserveLivestreamValidatesTagIDs(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	tagID := insertTestTag(t, "music")
+	insertTestSlots(t, testTermStart, testTermStart+3600, 5)
+	warmTestCaches(t)
+
+	body := func(tags string) json.RawMessage {
+		b, err := json.Marshal(newTestReserveRequest(testTermStart, testTermStart+3600))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return json.RawMessage(strings.Replace(string(b), `"tags":[]`, `"tags":`+tags, 1))
+	}
+	tests := []struct {
+		name        string
+		tags        string
+		wantMessage string
+	}{
+		{"string tag id", `["1"]`, `field "tags`},
+		{"float tag id", `[1.5]`, `field "tags`},
+		{"tags is not an array", `1`, `field "tags"`},
+		{"null tag id", `[null]`, `tags[0] must be a positive integer`},
+		{"zero tag id", `[` + itoa(tagID) + `,0]`, `tags[1] must be a positive integer`},
+		{"negative tag id", `[-3]`, `tags[0] must be a positive integer`},
+	}
+	for _, tt := range tests {
+		rec := doRequest(t, http.MethodPost, "/api/livestream/reservation", body(tt.tags), userID)
+		var resp APIErrorResponse
+		decodeResponse(t, rec, http.StatusBadRequest, &resp)
+		if resp.ErrorCode != errCodeBadRequest || !strings.Contains(resp.Message, tt.wantMessage) {
+			t.Errorf("%s: error = %q %q, want %q containing %q", tt.name, resp.ErrorCode, resp.Message, errCodeBadRequest, tt.wantMessage)
+		}
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != 0 {
+		t.Fatalf("invalid requests reserved %d livestreams", n)
+	}
+
+	var livestream Livestream
+	decodeResponse(t, doRequest(t, http.MethodPost, "/api/livestream/reservation", body(`[`+itoa(tagID)+`]`), userID), http.StatusCreated, &livestream)
+	if len(livestream.Tags) != 1 || livestream.Tags[0].ID != tagID {
+		t.Errorf("tags = %+v, want [%d]", livestream.Tags, tagID)
+	}
+}
+
+func TestSearchLivestreamsByStartAtRange(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	tagID := insertTestTag(t, "music")
+	const day = 24 * 3600
+	// 日ごとに2件ずつ、1件目はタグ付きでタイトルに "morning" を含む
+	var ids [5][2]int64
+	for d := int64(0); d < 5; d++ {
+		start := testTermStart + d*day
+		ids[d][0] = insertTestLivestream(t, userID, "morning show", start, start+3600)
+		mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", ids[d][0], tagID)
+		ids[d][1] = insertTestLivestream(t, userID, "night show", start+12*3600, start+13*3600)
+	}
+	warmTestCaches(t)
+	from, to := itoa(testTermStart+day), itoa(testTermStart+3*day)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []int64
+	}{
+		// from は含み、to は含まない
+		{"range", "?from=" + from + "&to=" + to, []int64{ids[2][1], ids[2][0], ids[1][1], ids[1][0]}},
+		{"from only", "?from=" + itoa(testTermStart+3*day+1), []int64{ids[4][1], ids[4][0], ids[3][1]}},
+		{"to only", "?to=" + itoa(testTermStart+day), []int64{ids[0][1], ids[0][0]}},
+		{"to is exclusive", "?from=" + itoa(testTermStart) + "&to=" + itoa(testTermStart+12*3600), []int64{ids[0][0]}},
+		{"with tag", "?tag=music&from=" + from + "&to=" + to, []int64{ids[2][0], ids[1][0]}},
+		{"with title", "?q=night&from=" + from + "&to=" + to, []int64{ids[2][1], ids[1][1]}},
+		{"oldest first", "?order=oldest&from=" + from + "&to=" + to, []int64{ids[1][0], ids[1][1], ids[2][0], ids[2][1]}},
+		{"empty range", "?from=" + itoa(testTermStart+10*day), []int64{}},
+	}
+	for _, tt := range tests {
+		if got := searchTestLivestreams(t, userID, tt.query); !equalIDs(got, tt.want) {
+			t.Errorf("%s: ids = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// ページ送りしても範囲外の配信は混ざらない
+	var pages [][]int64
+	query := "?limit=3&from=" + from + "&to=" + to
+	for {
+		rec := doRequest(t, http.MethodGet, "/api/livestream/search"+query, nil, userID)
+		var page []Livestream
+		decodeResponse(t, rec, http.StatusOK, &page)
+		pages = append(pages, livestreamIDs(page))
+		next := rec.Header().Get(headerNextBeforeID)
+		if next == "" {
+			break
+		}
+		query = "?limit=3&from=" + from + "&to=" + to + "&before_id=" + next
+	}
+	if len(pages) != 2 || !equalIDs(pages[0], []int64{ids[2][1], ids[2][0], ids[1][1]}) || !equalIDs(pages[1], []int64{ids[1][0]}) {
+		t.Errorf("pages = %v", pages)
+	}
+
+	for _, query := range []string{
+		"?from=" + to + "&to=" + from,
+		"?from=" + from + "&to=" + from,
+		"?from=yesterday",
+		"?to=-1",
+	} {
+		assertErrorCode(t, doRequest(t, http.MethodGet, "/api/livestream/search"+query, nil, userID), http.StatusBadRequest, errCodeBadRequest)
+	}
+}
+
+func TestSearchLivestreamsByMultipleTags(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	music := insertTestTag(t, "music")
+	gaming := insertTestTag(t, "gaming")
+	talk := insertTestTag(t, "talk")
+	tagged := func(title string, tagIDs ...int64) int64 {
+		id := insertTestLivestream(t, userID, title, testTermStart, testTermStart+3600)
+		for _, tagID := range tagIDs {
+			mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", id, tagID)
+		}
+		return id
+	}
+	musicOnly := tagged("music", music)
+	gamingOnly := tagged("gaming", gaming)
+	both := tagged("both", music, gaming)
+	tagged("untagged")
+	all := tagged("all", music, gaming, talk)
+	warmTestCaches(t)
+
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		{"?tags=music,gaming", []int64{all, both, gamingOnly, musicOnly}},
+		{"?tags=music,gaming&match=any", []int64{all, both, gamingOnly, musicOnly}},
+		{"?tags=music,gaming&match=all", []int64{all, both}},
+		{"?tags=music,gaming,talk&match=all", []int64{all}},
+		{"?tags=talk,gaming&match=any", []int64{all, both, gamingOnly}},
+		// tag と tags は組み合わせられ、重複や空白は無視する
+		{"?tag=music&tags=gaming&match=all", []int64{all, both}},
+		{"?tags=%20music%20,,music%20&match=all", []int64{all, both, musicOnly}},
+		{"?tags=music,gaming&match=all&order=oldest", []int64{both, all}},
+	}
+	recorder := recordQueries(t)
+	for _, tt := range tests {
+		recorder.reset()
+		if got := searchTestLivestreams(t, userID, tt.query); !equalIDs(got, tt.want) {
+			t.Errorf("%s: ids = %v, want %v", tt.query, got, tt.want)
+		}
+		// タグの数によらず、livestream_tags を1度だけJOINした1つのクエリで絞り込む
+		searches := recorder.matching("FROM livestreams l")
+		if len(searches) != 1 || strings.Count(searches[0].Query, "livestream_tags") != 1 || strings.Contains(searches[0].Query, "EXISTS") {
+			t.Errorf("%s: search queries = %v, want a single query joining livestream_tags once", tt.query, searches)
+		}
+	}
+
+	// ページ送りしても、複数のタグが一致した配信が重複しない
+	var pages [][]int64
+	query := "?tags=music,gaming&limit=2"
+	for {
+		rec := doRequest(t, http.MethodGet, "/api/livestream/search"+query, nil, userID)
+		var page []Livestream
+		decodeResponse(t, rec, http.StatusOK, &page)
+		pages = append(pages, livestreamIDs(page))
+		next := rec.Header().Get(headerNextBeforeID)
+		if next == "" {
+			break
+		}
+		query = "?tags=music,gaming&limit=2&before_id=" + next
+	}
+	if len(pages) != 3 || !equalIDs(pages[0], []int64{all, both}) || !equalIDs(pages[1], []int64{gamingOnly, musicOnly}) || len(pages[2]) != 0 {
+		t.Errorf("pages = %v", pages)
+	}
+
+	tooMany := make([]string, maxSearchTags+1)
+	for i := range tooMany {
+		tooMany[i] = "tag" + itoa(int64(i))
+	}
+	for _, query := range []string{"?tags=music,gaming&match=both", "?tags=" + strings.Join(tooMany, ",")} {
+		assertErrorCode(t, doRequest(t, http.MethodGet, "/api/livestream/search"+query, nil, userID), http.StatusBadRequest, errCodeBadRequest)
+	}
+}
+
+func TestFillLivestreamResponseFetchesTagsAtOnce(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	tagIDs := []int64{insertTestTag(t, "music"), insertTestTag(t, "gaming"), insertTestTag(t, "talk")}
+	livestreamID := insertTestLivestream(t, userID, "live", testTermStart, testTermStart+3600)
+	for _, tagID := range []int64{tagIDs[2], tagIDs[0], tagIDs[1]} {
+		mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", livestreamID, tagID)
+	}
+	warmTestCaches(t)
+	recorder := recordQueries(t)
+	getTags := func() []int64 {
+		t.Helper()
+		livestreamResponseCache.reset()
+		var livestream Livestream
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID), nil, userID), http.StatusOK, &livestream)
+		ids := make([]int64, 0, len(livestream.Tags))
+		for _, tag := range livestream.Tags {
+			ids = append(ids, tag.ID)
+		}
+		return ids
+	}
+	want := []int64{tagIDs[2], tagIDs[0], tagIDs[1]}
+
+	// タグのキャッシュがあればタグをDBから引かない
+	if got := getTags(); !equalIDs(got, want) {
+		t.Errorf("tags = %v, want %v", got, want)
+	}
+	if n := len(recorder.matching("FROM tags WHERE id")); n != 0 {
+		t.Errorf("queried tags %d times with a warm cache, want 0", n)
+	}
+
+	// キャッシュが無くても、タグの数によらず1回でまとめて引く
+	tagsCache.reset()
+	recorder.reset()
+	if got := getTags(); !equalIDs(got, want) {
+		t.Errorf("tags without the cache = %v, want %v", got, want)
+	}
+	queries := recorder.matching("FROM tags WHERE id")
+	if len(queries) != 1 || !strings.Contains(queries[0].Query, "IN (") {
+		t.Errorf("tag queries without the cache = %v, want a single IN query", queries)
+	}
+}
@@ -4,13 +4,22 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"reflect"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -25,6 +34,7 @@ import (
 
 const (
 	listenPort                     = 8080
+	shutdownTimeout                = 10 * time.Second
 	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
 )
 
@@ -32,6 +42,9 @@ var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
 	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	// 1リクエストのトランザクションに許す最大時間
+	// 遅いクエリがコネクションやFOR UPDATEのロックを握り続けないようにする
+	dbTxTimeout = 3 * time.Second
 )
 
 func init() {
@@ -39,13 +52,138 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	if v, ok := os.LookupEnv("ISUCON13_DB_TX_TIMEOUT"); ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable 'ISUCON13_DB_TX_TIMEOUT' as duration: %+v", err)
+		}
+		dbTxTimeout = timeout
+	}
+}
+
+// getEnvInt は環境変数を整数として読み取る。未設定なら defaultValue を返す
+func getEnvInt(key string, defaultValue int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("failed to parse environment variable '%s' as int: %+v", key, err)
+	}
+	return n
+}
+
+// getEnvDuration は環境変数を time.Duration として読み取る。未設定なら defaultValue を返す
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("failed to parse environment variable '%s' as duration: %+v", key, err)
+	}
+	return d
+}
+
+// リクエストボディとして受け付ける最大バイト数
+var maxRequestBodyBytes = int64(getEnvInt("ISUCON13_MAX_REQUEST_BODY_BYTES", 1<<20))
+
+// decodeJSONBody はリクエストボディをサイズ上限付きでJSONとしてデコードする
+// 上限を超えた場合は413、未知のフィールドを含むなどデコードに失敗した場合は400を返す
+// フィールドの型が合わない場合は、400のメッセージにフィールド名を含める
+func decodeJSONBody(c echo.Context, v interface{}) error {
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, maxRequestBodyBytes)
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return httpError(c, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, fmt.Sprintf("request body must be at most %d bytes", maxRequestBodyBytes), nil)
+		}
+		// 型が合わないフィールドは、クライアントが直せるようにフィールド名と期待する型を返す
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, fmt.Sprintf("field %q must be %s, but got %s", typeErr.Field, typeErr.Type, typeErr.Value), err)
+		}
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "failed to decode the request body as json", err)
+	}
+	// ボディが null だとポインタ変数(var req *T)は nil のまま残るので、ハンドラが参照する前に弾く
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer && rv.Elem().Kind() == reflect.Pointer && rv.Elem().IsNil() {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "request body must not be null", nil)
+	}
+	return nil
+}
+
+var (
+	// gzipの圧縮レベル (-1はデフォルト、1が最速、9が最高圧縮)
+	gzipLevel = getEnvInt("ISUCON13_GZIP_LEVEL", -1)
+	// このバイト数未満のレスポンスは圧縮しない
+	gzipMinLength = getEnvInt("ISUCON13_GZIP_MIN_LENGTH", 1024)
+)
+
+// skipGzip はgzip圧縮しないルートを判定する
+// ストリーミングするエクスポートやSSEはバッファされると逐次送れなくなり、アイコン画像は圧縮済み、/metricsは独自に圧縮する
+func skipGzip(c echo.Context) bool {
+	switch c.Path() {
+	case "/api/livestream/:livestream_id/reactions/export", "/api/livestream/:livestream_id/reactions.csv", "/api/livestream/:livestream_id/reactions/sse", "/api/user/:username/icon", "/metrics":
+		return true
+	}
+	return false
+}
+
+// txContext はリクエストのコンテキストに dbTxTimeout のタイムアウトを設定したものを返す
+// 呼び出し側は必ず cancel を defer すること
+func txContext(c echo.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request().Context(), dbTxTimeout)
+}
+
+const (
+	// 接続エラーでトランザクションを開始できなかった場合に試す最大回数
+	maxBeginTxAttempts = 3
+	// 再試行間隔の初期値 (再試行ごとに倍にする)
+	beginTxRetryBackoff = 50 * time.Millisecond
+)
+
+// beginTx は dbConn.BeginTxx のラッパーで、MySQLの再起動などによる一時的な接続エラーの場合に再試行する
+// 制約違反などアプリケーション側のエラーは再試行しない
+func beginTx(ctx context.Context, opts *sql.TxOptions) (*sqlx.Tx, error) {
+	for attempt := 1; ; attempt++ {
+		tx, err := dbConn.BeginTxx(ctx, opts)
+		if err == nil || attempt >= maxBeginTxAttempts || !isTransientConnError(err) {
+			return tx, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(beginTxRetryBackoff << (attempt - 1)):
+		}
+	}
+}
+
+// isTransientConnError はコネクションが切れた・繋がらないことによるエラーかを返す
+func isTransientConnError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// readOnlyTxOptions は参照のみのハンドラで使うトランザクションオプション
+// 書き込みや行ロックを伴うハンドラ(予約など)ではデフォルト(REPEATABLE READ)のまま nil を渡す
+var readOnlyTxOptions = &sql.TxOptions{
+	Isolation: sql.LevelReadCommitted,
+	ReadOnly:  true,
 }
 
 type InitializeResponse struct {
 	Language string `json:"language"`
 }
 
-func connectDB(logger echo.Logger) (*sqlx.DB, error) {
+// newDBConfig は環境変数からMySQLの接続設定を作る
+func newDBConfig() (*mysql.Config, error) {
 	const (
 		networkTypeEnvKey = "ISUCON13_MYSQL_DIALCONFIG_NET"
 		addrEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
@@ -93,12 +231,56 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 		}
 		conf.ParseTime = parseTime
 	}
+	return conf, nil
+}
+
+func connectDB(logger echo.Logger) (*sqlx.DB, error) {
+	const (
+		maxOpenConnsEnvKey    = "ISUCON13_MYSQL_MAX_OPEN_CONNS"
+		maxIdleConnsEnvKey    = "ISUCON13_MYSQL_MAX_IDLE_CONNS"
+		connMaxLifetimeEnvKey = "ISUCON13_MYSQL_CONN_MAX_LIFETIME"
+	)
+
+	conf, err := newDBConfig()
+	if err != nil {
+		return nil, err
+	}
 
-	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	// トランザクション数・クエリ数を計測するためにコネクタをラップする
+	connector, err := mysql.NewConnector(conf)
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(10)
+	db := sqlx.NewDb(sql.OpenDB(&instrumentedConnector{Connector: connector}), "mysql")
+
+	// コネクションプールの設定
+	maxOpenConns := 10
+	maxIdleConns := 10
+	connMaxLifetime := 5 * time.Minute
+	if v, ok := os.LookupEnv(maxOpenConnsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as int: %+v", maxOpenConnsEnvKey, err)
+		}
+		maxOpenConns = n
+	}
+	if v, ok := os.LookupEnv(maxIdleConnsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as int: %+v", maxIdleConnsEnvKey, err)
+		}
+		maxIdleConns = n
+	}
+	if v, ok := os.LookupEnv(connMaxLifetimeEnvKey); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as duration: %+v", connMaxLifetimeEnvKey, err)
+		}
+		connMaxLifetime = d
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxLifetime(connMaxLifetime)
 
 	if err := db.Ping(); err != nil {
 		return nil, err
@@ -108,87 +290,248 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 }
 
 func initializeHandler(c echo.Context) error {
+	// 初期化前のリアクションが初期化後に書き込まれないよう、先に書き込んでおく
+	if reactionBuffer != nil {
+		reactionBuffer.flush()
+	}
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		c.Logger().Warnf("init.sh failed with err=%s", string(out))
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
 
+	if err := warmUserCache(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to warm user cache: "+err.Error())
+	}
+	if err := warmTagCache(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to warm tag cache: "+err.Error())
+	}
+	reservationIdempotencyCache.reset()
+	livestreamReactionSummaryCache.reset()
+	livestreamResponseCache.reset()
+	if err := warmReactionCounts(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to warm reaction counts: "+err.Error())
+	}
+	if reactionBuffer != nil {
+		if err := reactionBuffer.reset(c.Request().Context()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset reaction write buffer: "+err.Error())
+		}
+	}
+
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
 	})
 }
 
-func main() {
-	//pprof設定
-	go func() { 
-		fmt.Println(http.ListenAndServe("localhost:6060", nil)) 
-	}() 
-	
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// ヘルスチェックAPI
+// GET /api/health
+// セッション不要。DBにPingが通らなければ503を返す
+func healthHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), 1*time.Second)
+	defer cancel()
+
+	if err := dbConn.PingContext(ctx); err != nil {
+		c.Logger().Warnf("health check failed: %+v", err)
+		return c.JSON(http.StatusServiceUnavailable, HealthResponse{
+			Status: "unavailable",
+		})
+	}
+
+	return c.JSON(http.StatusOK, HealthResponse{
+		Status: "ok",
+	})
+}
+
+// DBStatsResponse はコネクションプールの状態
+type DBStatsResponse struct {
+	MaxOpenConnections int   `json:"max_open_connections"`
+	OpenConnections    int   `json:"open_connections"`
+	InUse              int   `json:"in_use"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"wait_count"`
+	WaitDurationMs     int64 `json:"wait_duration_ms"`
+	MaxIdleClosed      int64 `json:"max_idle_closed"`
+	MaxLifetimeClosed  int64 `json:"max_lifetime_closed"`
+}
+
+// ISUCON13_ENABLE_DEBUG_ENDPOINTS が設定されている場合のみデバッグ用APIを公開する
+var debugEndpointsEnabled = os.Getenv("ISUCON13_ENABLE_DEBUG_ENDPOINTS") != ""
+
+// コネクションプール状態取得API (チューニング用)
+// GET /api/debug/dbstats
+func getDBStatsHandler(c echo.Context) error {
+	stats := dbConn.Stats()
+	return c.JSON(http.StatusOK, DBStatsResponse{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMs:     stats.WaitDuration.Milliseconds(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	})
+}
+
+// newEcho はミドルウェアとルーティングを設定したechoのインスタンスを返す
+func newEcho() *echo.Echo {
 	e := echo.New()
 	e.Debug = false
 	e.Logger.SetLevel(echolog.ERROR)
+	// リクエストIDの付与 (アクセスログ・ハンドラのログに載せるためLoggerより先に置く)
+	e.Use(requestIDMiddleware())
 	e.Use(middleware.Logger())
+	// レスポンスのgzip圧縮 (Accept-Encodingにgzipを含む場合のみ)
+	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+		Skipper:   skipGzip,
+		Level:     gzipLevel,
+		MinLength: gzipMinLength,
+	}))
 	cookieStore := sessions.NewCookieStore(secret)
 	cookieStore.Options.Domain = "*.u.isucon.local"
 	e.Use(session.Middleware(cookieStore))
-	// e.Use(middleware.Recover())
+	// メトリクス (GET /metrics)
+	registerMetrics(e)
+	// ハンドラがpanicしてもプロセスを落とさず、リクエストIDとスタックをログに残して500を返す
+	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
+		LogErrorFunc: func(c echo.Context, err error, stack []byte) error {
+			c.Logger().Errorf("panic recovered at %s: %v\n%s", c.Path(), err, stack)
+			// panicの内容はクライアントに返さない
+			return &APIError{
+				Status:  http.StatusInternalServerError,
+				Code:    errCodeInternal,
+				Message: "internal server error",
+			}
+		},
+	}))
 
 	// 初期化
 	e.POST("/api/initialize", initializeHandler)
+	// ヘルスチェック
+	e.GET("/api/health", healthHandler)
+	if debugEndpointsEnabled {
+		e.GET("/api/debug/dbstats", getDBStatsHandler)
+	}
 
 	// top
 	e.GET("/api/tag", getTagHandler)
 	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
 
+	// 更新系のAPIはrequireSessionでハンドラより前にセッションを検証する
+	// ハンドラではsessionUserIDでログイン中のユーザIDを読む
+
 	// livestream
 	// reserve livestream
-	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	e.POST("/api/livestream/reservation", reserveLivestreamHandler, requireSession)
+	// 予約枠の仮押さえと、仮押さえした枠での予約確定
+	e.POST("/api/livestream/reservation/hold", holdReservationHandler, requireSession)
+	e.POST("/api/livestream/reservation/confirm", confirmReservationHandler, requireSession)
+	// 予約枠が埋まっている区間の予約待ち
+	e.POST("/api/livestream/reservation/waitlist", joinReservationWaitlistHandler, requireSession)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	e.GET("/api/livestream/live", getLivePlayingHandler)
+	e.GET("/api/livestream/trending", getTrendingHandler)
+	// フォロー中の配信者のアクティビティ
+	e.GET("/api/feed", getActivityFeedHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
+	e.POST("/api/livestream/batch", getLivestreamsByIDsHandler, requireSession)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	// update livestream
+	e.PATCH("/api/livestream/:livestream_id", updateLivestreamHandler, requireSession)
+	// delete livestream
+	e.DELETE("/api/livestream/:livestream_id", deleteLivestreamHandler, requireSession)
+	e.GET("/api/livestream/:livestream_id/tags", getLivestreamTagsHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
 	// ライブコメント投稿
-	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
-	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
+	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler, requireSession)
+	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler, requireSession)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	e.GET("/api/livestream/:livestream_id/reactions/:reaction_id", getReactionHandler)
+	// (配信者向け)リアクションのモデレーション
+	e.DELETE("/api/livestream/:livestream_id/reactions/:reaction_id", deleteReactionHandler, requireSession)
+	e.DELETE("/api/livestream/:livestream_id/reactions", deleteReactionsByEmojiHandler, requireSession)
+	e.GET("/api/livestream/:livestream_id/reactions/export", exportReactionsHandler)
+	e.GET("/api/livestream/:livestream_id/reactions.csv", exportReactionsCSVHandler)
+	e.GET("/api/livestream/:livestream_id/reactions/:emoji/leaderboard", getEmojiLeaderboardHandler)
+	// 投稿されたリアクションの購読 (Server-Sent Events)
+	e.GET("/api/livestream/:livestream_id/reactions/sse", streamReactionsHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
+	// (配信者向け)チップ投稿者ランキング
+	e.GET("/api/livestream/:livestream_id/tips/ranking", getTipRankingHandler)
 	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords)
 	// ライブコメント報告
-	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
+	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler, requireSession)
 	// 配信者によるモデレーション (NGワード登録)
-	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
+	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler, requireSession)
 
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
-	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler, requireSession)
 	// ユーザ視聴終了 (viewer)
-	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler, requireSession)
+	// ユーザ視聴終了 (viewer, 全セッション分)
+	e.DELETE("/api/livestream/:livestream_id/exit/all", exitAllLivestreamHandler, requireSession)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
+	e.POST("/api/session/refresh", refreshSessionHandler, requireSession)
 	e.GET("/api/user/me", getMeHandler)
+	// (配信者向け)自分の配信へのリアクション一覧
+	e.GET("/api/user/me/reactions", getMyReactionsHandler)
+	// 自分が送ったリアクションの履歴
+	e.GET("/api/user/me/reactions/history", getUserReactionHistoryHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
+	e.GET("/api/user/:username/profile", getUserProfileHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
-	e.POST("/api/icon", postIconHandler)
+	e.POST("/api/icon", postIconHandler, requireSession)
 
 	// stats
 	// ライブ配信統計情報
 	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	// 視聴者推移
+	e.GET("/api/livestream/:livestream_id/viewers", getViewerHistoryHandler)
+	// リアクション推移
+	e.GET("/api/livestream/:livestream_id/reactions/histogram", getReactionHistogramHandler)
+
+	// admin
+	// (管理者向け)配信一括予約 (ISUCON13_ADMIN_TOKEN が必要)
+	e.POST("/api/admin/livestream/bulk-reserve", bulkReserveLivestreamsHandler)
+	// (管理者向け)予約枠の利用状況
+	e.GET("/api/admin/slots/utilization", getSlotUtilizationHandler)
+	// (管理者向け)予約枠数の調整
+	e.POST("/api/admin/slots/adjust", adjustSlotsHandler)
+	// (管理者向け)予約枠の残数の検査・修正
+	e.POST("/api/admin/slots/verify", verifySlotsHandler)
+	// (管理者向け)ユーザ別配信一括取得
+	e.POST("/api/admin/users/livestreams", getBulkUserLivestreamsHandler)
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
 
 	e.HTTPErrorHandler = errorResponseHandler
+	return e
+}
+
+func main() {
+	//pprof設定
+	go func() { 
+		fmt.Println(http.ListenAndServe("localhost:6060", nil)) 
+	}() 
+	
+	e := newEcho()
 
 	// DB接続
 	conn, err := connectDB(e.Logger)
@@ -206,11 +549,43 @@ func main() {
 	}
 	powerDNSSubdomainAddress = subdomainAddr
 
+	if bufferReactionWrites {
+		buf, err := startReactionWriteBuffer(context.Background())
+		if err != nil {
+			e.Logger.Errorf("failed to start reaction write buffer: %v", err)
+			os.Exit(1)
+		}
+		reactionBuffer = buf
+	}
+
 	// HTTPサーバ起動
 	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
-	if err := e.Start(listenAddr); err != nil {
-		e.Logger.Errorf("failed to start HTTP server: %v", err)
-		os.Exit(1)
+	go func() {
+		if err := e.Start(listenAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Errorf("failed to start HTTP server: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	// SIGTERM/SIGINTを受けたら新規の受付を止め、処理中のリクエストが終わるのを待ってからDB接続を閉じる
+	// 予約などのトランザクションが途中で切られないようにするため
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	// 期限切れの仮押さえを定期的に解放する
+	go runReservationHoldSweeper(sigCtx, e.Logger)
+	go runIdempotencySweeper(sigCtx)
+	<-sigCtx.Done()
+
+	// SSEの接続はShutdownでは終わらないので、先に購読を終わらせる
+	reactionStreamHub.close()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		e.Logger.Errorf("failed to shutdown HTTP server gracefully: %v", err)
+	}
+	// バッファに残ったリアクションを書き込んでから終了する
+	if reactionBuffer != nil {
+		reactionBuffer.close()
 	}
 }
 
@@ -218,8 +593,73 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// APIErrorResponse はクライアントに返す構造化されたエラー
+// 内部エラーの詳細は含めない
+type APIErrorResponse struct {
+	ErrorCode string      `json:"error_code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+}
+
+const (
+	errCodeBadRequest      = "bad_request"
+	errCodeUnauthorized    = "unauthorized"
+	errCodeForbidden       = "forbidden"
+	errCodeNotFound        = "not_found"
+	errCodeInternal        = "internal_error"
+	errCodePayloadTooLarge = "payload_too_large"
+
+	errCodeLivestreamOwnerNotFound   = "livestream_owner_not_found"
+	errCodeLivestreamTagNotFound     = "livestream_tag_not_found"
+	errCodeReservationSlotFull       = "reservation_slot_full"
+	errCodeLivestreamVersionConflict = "livestream_version_conflict"
+	errCodeTooManyViewingLivestreams = "too_many_viewing_livestreams"
+	errCodeReservationHoldExpired    = "reservation_hold_expired"
+	errCodeReservationOverlap        = "reservation_overlap"
+	errCodeReactionLimitReached      = "reaction_limit_reached"
+	errCodeReservationSlotAvailable  = "reservation_slot_available"
+)
+
+// APIError は errorResponseHandler で APIErrorResponse として出力されるエラー
+// Err はクライアントには返さず、errors.Is/As での判定にのみ使う
+// Details はクライアントが扱える追加情報で、設定されていればそのまま返す
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+	Details interface{}
+	Err     error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("code=%d, error_code=%s, message=%s", e.Status, e.Code, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// httpError は内部エラーをログに出力し、クライアントには公開用のメッセージとエラーコードのみを返すエラーを作る
+func httpError(c echo.Context, status int, code string, publicMessage string, internalErr error) error {
+	if internalErr != nil {
+		c.Logger().Errorf("%s at %s: %+v", publicMessage, c.Path(), internalErr)
+	}
+	return &APIError{
+		Status:  status,
+		Code:    code,
+		Message: publicMessage,
+		Err:     internalErr,
+	}
+}
+
 func errorResponseHandler(err error, c echo.Context) {
 	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
+	if ae, ok := err.(*APIError); ok {
+		if e := c.JSON(ae.Status, &APIErrorResponse{ErrorCode: ae.Code, Message: ae.Message, Details: ae.Details}); e != nil {
+			c.Logger().Errorf("%+v", e)
+		}
+		return
+	}
 	if he, ok := err.(*echo.HTTPError); ok {
 		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
 			c.Logger().Errorf("%+v", e)
@@ -0,0 +1,1043 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// DBを使うテストは ISUCON13_TEST_MYSQL が設定されている場合のみ実行する
+// 接続先は connectDB と同じ ISUCON13_MYSQL_DIALCONFIG_* で指定し、テストのたびに testdata/schema.sql で作り直す
+// (テスト用のDBを指定すること)
+var testDBEnabled = os.Getenv("ISUCON13_TEST_MYSQL") != ""
+
+// testEcho はルーティングを設定したechoのインスタンス (メトリクスを二重登録しないよう1度だけ作る)
+var testEcho *echo.Echo
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	// アイコン未設定のユーザのレスポンスは fallbackImage を読むので、テスト用の画像を置いておく
+	dir, err := os.MkdirTemp("", "isupipe-test")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create temp dir: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	fallbackImage = filepath.Join(dir, "NoImage.jpg")
+	if err := os.WriteFile(fallbackImage, []byte("no image"), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write fallback image: %v\n", err)
+		return 1
+	}
+
+	testEcho = newEcho()
+	// アクセスログやハンドラのログは、ログを確かめるテストでのみ captureLogs で読む
+	testEcho.Logger.SetOutput(io.Discard)
+	if testDBEnabled {
+		conn, err := connectDB(testEcho.Logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to connect db: %v\n", err)
+			return 1
+		}
+		defer conn.Close()
+		dbConn = conn
+	}
+	return m.Run()
+}
+
+// setupTestDB はテーブルを作り直し、キャッシュを空にする
+// ISUCON13_TEST_MYSQL が設定されていなければテストをスキップする
+func setupTestDB(t testing.TB) {
+	t.Helper()
+	if !testDBEnabled {
+		t.Skip("ISUCON13_TEST_MYSQL is not set")
+	}
+
+	schema, err := os.ReadFile(filepath.Join("testdata", "schema.sql"))
+	if err != nil {
+		t.Fatalf("failed to read schema: %v", err)
+	}
+	for _, stmt := range splitSQLStatements(string(schema)) {
+		if _, err := dbConn.Exec(stmt); err != nil {
+			t.Fatalf("failed to apply schema: %v\n%s", err, stmt)
+		}
+	}
+	warmTestCaches(t)
+}
+
+// splitSQLStatements は ; で終わる行ごとにSQLを分ける (コメント行は除く)
+func splitSQLStatements(sql string) []string {
+	var stmts []string
+	var buf strings.Builder
+	for _, line := range strings.Split(sql, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSuffix(strings.TrimSpace(buf.String()), ";"))
+			buf.Reset()
+		}
+	}
+	return stmts
+}
+
+// warmTestCaches は /api/initialize と同じようにキャッシュを作り直す
+// テストデータをDBに直接入れた後に呼ぶ
+func warmTestCaches(t testing.TB) {
+	t.Helper()
+	ctx := context.Background()
+	if err := warmUserCache(ctx); err != nil {
+		t.Fatalf("failed to warm user cache: %v", err)
+	}
+	if err := warmTagCache(ctx); err != nil {
+		t.Fatalf("failed to warm tag cache: %v", err)
+	}
+	reservationIdempotencyCache.reset()
+	livestreamReactionSummaryCache.reset()
+	livestreamResponseCache.reset()
+	if err := warmReactionCounts(ctx); err != nil {
+		t.Fatalf("failed to warm reaction counts: %v", err)
+	}
+}
+
+// setTestVar は設定用のパッケージ変数をテストの間だけ差し替える
+func setTestVar[T any](t testing.TB, p *T, v T) {
+	t.Helper()
+	orig := *p
+	*p = v
+	t.Cleanup(func() { *p = orig })
+}
+
+// captureLogs はテストの間 testEcho のログを読めるようにする
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	testEcho.Logger.SetOutput(&buf)
+	t.Cleanup(func() { testEcho.Logger.SetOutput(io.Discard) })
+	return &buf
+}
+
+// sessionCookie は userID でログインしたセッションのCookieを返す
+func sessionCookie(t *testing.T, userID int64) *http.Cookie {
+	t.Helper()
+	return sessionCookieExpiring(t, userID, time.Now().Add(sessionLifetime))
+}
+
+// sessionCookieExpiring は expiresAt に期限が切れるセッションのCookieを返す
+func sessionCookieExpiring(t *testing.T, userID int64, expiresAt time.Time) *http.Cookie {
+	t.Helper()
+	store := sessions.NewCookieStore(secret)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	sess, err := store.Get(req, defaultSessionIDKey)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	sess.Values[defaultSessionIDKey] = fmt.Sprintf("test-session-%d", userID)
+	sess.Values[defaultUserIDKey] = userID
+	sess.Values[defaultUsernameKey] = fmt.Sprintf("user%d", userID)
+	sess.Values[defaultSessionExpiresKey] = expiresAt.Unix()
+	if err := sess.Save(req, rec); err != nil {
+		t.Fatalf("failed to save session: %v", err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("session cookie was not set")
+	}
+	return cookies[0]
+}
+
+// doRequest は testEcho にリクエストを送る
+// body が nil でなければJSONにして送り、userID が0でなければそのユーザでログインした状態にする
+func doRequest(t *testing.T, method, target string, body interface{}, userID int64) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("failed to marshal request body: %v", err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	if userID != 0 {
+		req.AddCookie(sessionCookie(t, userID))
+	}
+	rec := httptest.NewRecorder()
+	testEcho.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeResponse はレスポンスのステータスを確かめ、ボディをJSONとして v に読む
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder, wantStatus int, v interface{}) {
+	t.Helper()
+	if rec.Code != wantStatus {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, wantStatus, rec.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to decode response: %v; body: %s", err, rec.Body.String())
+	}
+}
+
+// assertErrorCode はエラーレスポンスのステータスと error_code を確かめる
+func assertErrorCode(t *testing.T, rec *httptest.ResponseRecorder, wantStatus int, wantCode string) {
+	t.Helper()
+	var resp APIErrorResponse
+	decodeResponse(t, rec, wantStatus, &resp)
+	if resp.ErrorCode != wantCode {
+		t.Fatalf("error_code = %q, want %q; body: %s", resp.ErrorCode, wantCode, rec.Body.String())
+	}
+}
+
+// mustExec はテストデータを入れるためのSQLを実行し、INSERTしたIDを返す
+func mustExec(t testing.TB, query string, args ...interface{}) int64 {
+	t.Helper()
+	rs, err := dbConn.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("failed to exec %q: %v", query, err)
+	}
+	id, err := rs.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get last insert id: %v", err)
+	}
+	return id
+}
+
+// mustCount は SELECT COUNT(*) の結果を返す
+func mustCount(t testing.TB, query string, args ...interface{}) int64 {
+	t.Helper()
+	var n int64
+	if err := dbConn.Get(&n, query, args...); err != nil {
+		t.Fatalf("failed to count %q: %v", query, err)
+	}
+	return n
+}
+
+// insertTestUser はテーマ付きのユーザを作る
+func insertTestUser(t testing.TB, name string) int64 {
+	t.Helper()
+	id := mustExec(t, "INSERT INTO users (name, display_name, password, description) VALUES (?, ?, ?, ?)", name, name, "password", "")
+	mustExec(t, "INSERT INTO themes (user_id, dark_mode) VALUES (?, ?)", id, false)
+	return id
+}
+
+// insertTestSlots は [startAt, endAt) の1時間ごとの予約枠を残数 slot で作る
+func insertTestSlots(t testing.TB, startAt, endAt, slot int64) {
+	t.Helper()
+	for at := startAt; at < endAt; at += 3600 {
+		mustExec(t, "INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (?, ?, ?)", slot, at, at+3600)
+	}
+}
+
+// insertTestLivestream は予約枠を消費せずに配信を作る
+func insertTestLivestream(t testing.TB, userID int64, title string, startAt, endAt int64) int64 {
+	t.Helper()
+	return mustExec(t, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		userID, title, "", "https://example.com/playlist.m3u8", "https://example.com/thumbnail.jpg", startAt, endAt, startAt)
+}
+
+// insertTestTag はタグを作る
+func insertTestTag(t testing.TB, name string) int64 {
+	t.Helper()
+	return mustExec(t, "INSERT INTO tags (name) VALUES (?)", name)
+}
+
+// insertTestReaction はリアクションを作る
+func insertTestReaction(t testing.TB, userID, livestreamID int64, emojiName string, createdAt int64) int64 {
+	t.Helper()
+	return mustExec(t, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (?, ?, ?, ?)", userID, livestreamID, emojiName, createdAt)
+}
+
+// itoa はIDをパスに埋め込む文字列にする
+func itoa(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// newTestReserveRequest は [startAt, endAt) を予約するリクエストを返す
+func newTestReserveRequest(startAt, endAt int64, tags ...int64) ReserveLivestreamRequest {
+	if tags == nil {
+		tags = []int64{}
+	}
+	return ReserveLivestreamRequest{
+		Tags:         tags,
+		Title:        "test livestream",
+		Description:  "description",
+		PlaylistUrl:  "https://example.com/playlist.m3u8",
+		ThumbnailUrl: "https://example.com/thumbnail.jpg",
+		StartAt:      startAt,
+		EndAt:        endAt,
+	}
+}
+
+// reserveTestLivestream は予約APIで配信を予約する
+func reserveTestLivestream(t *testing.T, userID int64, req ReserveLivestreamRequest) Livestream {
+	t.Helper()
+	var livestream Livestream
+	decodeResponse(t, doRequest(t, http.MethodPost, "/api/livestream/reservation", req, userID), http.StatusCreated, &livestream)
+	return livestream
+}
+
+// testTermStart はテストで予約する期間の始まり (予約可能な期間内の0時UTC)
+const testTermStart int64 = 1711900800 // 2024-04-01T00:00:00Z
+
+func TestHTTPErrorResponse(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = errorResponseHandler
+	var logs bytes.Buffer
+	e.Logger.SetOutput(&logs)
+	e.GET("/internal", func(c echo.Context) error {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestream", errors.New("dial tcp 10.0.0.1:3306: connection refused"))
+	})
+	e.GET("/notfound", func(c echo.Context) error {
+		return httpError(c, http.StatusNotFound, errCodeNotFound, "livestream not found", nil)
+	})
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		want       APIErrorResponse
+	}{
+		{path: "/internal", wantStatus: http.StatusInternalServerError, want: APIErrorResponse{ErrorCode: errCodeInternal, Message: "failed to get livestream"}},
+		{path: "/notfound", wantStatus: http.StatusNotFound, want: APIErrorResponse{ErrorCode: errCodeNotFound, Message: "livestream not found"}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.path, rec.Code, tt.wantStatus)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: body is not json: %s", tt.path, rec.Body.String())
+		}
+		if len(body) != 2 || body["error_code"] != tt.want.ErrorCode || body["message"] != tt.want.Message {
+			t.Errorf("%s: body = %s, want error_code %q and message %q only", tt.path, rec.Body.String(), tt.want.ErrorCode, tt.want.Message)
+		}
+		if strings.Contains(rec.Body.String(), "connection refused") {
+			t.Errorf("%s: internal error leaked to the client: %s", tt.path, rec.Body.String())
+		}
+	}
+	// 内部エラーはクライアントには返さず、ログに残す
+	if !strings.Contains(logs.String(), "connection refused") {
+		t.Errorf("internal error was not logged: %s", logs.String())
+	}
+}
+
+func TestTxContextTimesOutSlowQuery(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &dbTxTimeout, 100*time.Millisecond)
+
+	e := echo.New()
+	e.HTTPErrorHandler = errorResponseHandler
+	e.Logger.SetOutput(io.Discard)
+	var queryErr error
+	e.GET("/slow", func(c echo.Context) error {
+		ctx, cancel := txContext(c)
+		defer cancel()
+		tx, err := beginTx(ctx, nil)
+		if err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+		}
+		defer tx.Rollback()
+		var slept int
+		if queryErr = tx.GetContext(ctx, &slept, "SELECT SLEEP(5)"); queryErr != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to run slow query", queryErr)
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("slow query was not interrupted: took %s", elapsed)
+	}
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if !errors.Is(queryErr, context.DeadlineExceeded) {
+		t.Errorf("query error = %v, want context.DeadlineExceeded", queryErr)
+	}
+}
+
+// recordedQuery はテスト中にDBへ送られたクエリ
+type recordedQuery struct {
+	Query string
+	Args  []driver.NamedValue
+}
+
+// queryRecorder は recordQueries で差し替えた接続から送られたクエリを記録する
+type queryRecorder struct {
+	mu      sync.Mutex
+	queries []recordedQuery
+	txs     []driver.TxOptions
+	// inject が nil 以外を返したクエリはDBに送らず、そのエラーで失敗させる
+	inject func(query string) error
+}
+
+// injectErrors は以降のクエリを inject に通し、返されたエラーで失敗させる
+func (r *queryRecorder) injectErrors(inject func(query string) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inject = inject
+}
+
+func (r *queryRecorder) injected(query string) error {
+	r.mu.Lock()
+	inject := r.inject
+	r.mu.Unlock()
+	if inject == nil {
+		return nil
+	}
+	return inject(query)
+}
+
+func (r *queryRecorder) record(query string, args []driver.NamedValue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries = append(r.queries, recordedQuery{Query: query, Args: append([]driver.NamedValue(nil), args...)})
+}
+
+func (r *queryRecorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries = nil
+	r.txs = nil
+}
+
+// transactions は始めたトランザクションのオプションを始めた順に返す
+func (r *queryRecorder) transactions() []driver.TxOptions {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]driver.TxOptions(nil), r.txs...)
+}
+
+// matching は substr を含むクエリを送られた順に返す
+func (r *queryRecorder) matching(substr string) []recordedQuery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var matched []recordedQuery
+	for _, q := range r.queries {
+		if strings.Contains(q.Query, substr) {
+			matched = append(matched, q)
+		}
+	}
+	return matched
+}
+
+func (r *queryRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queries)
+}
+
+// recordQueries はテストの間 dbConn をクエリを記録する接続に差し替える
+// 接続先は connectDB と同じで、トランザクション数などの計測もそのまま行う
+func recordQueries(t testing.TB) *queryRecorder {
+	t.Helper()
+	conf, err := newDBConfig()
+	if err != nil {
+		t.Fatalf("failed to build db config: %v", err)
+	}
+	connector, err := mysql.NewConnector(conf)
+	if err != nil {
+		t.Fatalf("failed to create connector: %v", err)
+	}
+	recorder := &queryRecorder{}
+	db := sqlx.NewDb(sql.OpenDB(&instrumentedConnector{Connector: &recordingConnector{Connector: connector, recorder: recorder}}), "mysql")
+	t.Cleanup(func() { db.Close() })
+	setTestVar(t, &dbConn, db)
+	return recorder
+}
+
+type recordingConnector struct {
+	driver.Connector
+	recorder *queryRecorder
+}
+
+func (rc *recordingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := rc.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: conn, recorder: rc.recorder}, nil
+}
+
+// recordingConn は送られたクエリを記録し、注入されたエラーが無ければ元のコネクションに渡す
+// 引数付きのクエリはMySQLドライバがErrSkipを返してプリペアドステートメントで送り直すが、記録は最初の1回だけ行う
+type recordingConn struct {
+	driver.Conn
+	recorder *queryRecorder
+}
+
+// beginTxQuery はトランザクションの開始時に injectErrors の関数へ渡すクエリ
+const beginTxQuery = "START TRANSACTION"
+
+func (rc *recordingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	rc.recorder.mu.Lock()
+	rc.recorder.txs = append(rc.recorder.txs, opts)
+	rc.recorder.mu.Unlock()
+	if err := rc.recorder.injected(beginTxQuery); err != nil {
+		return nil, err
+	}
+	return rc.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (rc *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	rc.recorder.record(query, args)
+	if err := rc.recorder.injected(query); err != nil {
+		return nil, err
+	}
+	return rc.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (rc *recordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rc.recorder.record(query, args)
+	if err := rc.recorder.injected(query); err != nil {
+		return nil, err
+	}
+	return rc.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (rc *recordingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return rc.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (rc *recordingConn) Ping(ctx context.Context) error {
+	return rc.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (rc *recordingConn) ResetSession(ctx context.Context) error {
+	return rc.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (rc *recordingConn) IsValid() bool {
+	return rc.Conn.(driver.Validator).IsValid()
+}
+
+func (rc *recordingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return rc.Conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+func TestHealthHandler(t *testing.T) {
+	setupTestDB(t)
+	var res HealthResponse
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/health", nil, 0), http.StatusOK, &res)
+	if res.Status != "ok" {
+		t.Errorf("status = %q, want %q", res.Status, "ok")
+	}
+}
+
+func TestHealthHandlerReportsUnreachableDB(t *testing.T) {
+	// Pingが通らなければ503を返し、ロードバランサが振り分け先から外せるようにする
+	conf := mysql.NewConfig()
+	conf.Net = "tcp"
+	conf.Addr = "127.0.0.1:1"
+	conf.Timeout = 100 * time.Millisecond
+	connector, err := mysql.NewConnector(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sqlx.NewDb(sql.OpenDB(connector), "mysql")
+	t.Cleanup(func() { db.Close() })
+	setTestVar(t, &dbConn, db)
+
+	var res HealthResponse
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/health", nil, 0), http.StatusServiceUnavailable, &res)
+	if res.Status != "unavailable" {
+		t.Errorf("status = %q, want %q", res.Status, "unavailable")
+	}
+}
+
+func TestShutdownDrainsInFlightRequest(t *testing.T) {
+	setupTestDB(t)
+
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.HTTPErrorHandler = errorResponseHandler
+	e.Logger.SetOutput(io.Discard)
+	started, release := make(chan struct{}), make(chan struct{})
+	e.POST("/slow", func(c echo.Context) error {
+		ctx, cancel := txContext(c)
+		defer cancel()
+		tx, err := beginTx(ctx, nil)
+		if err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+		}
+		defer tx.Rollback()
+		if _, err := tx.ExecContext(ctx, "INSERT INTO tags (name) VALUES ('in-flight')"); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to insert tag", err)
+		}
+		close(started)
+		<-release
+		if err := tx.Commit(); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Listener = ln
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- e.Start("") }()
+
+	type result struct {
+		status int
+		err    error
+	}
+	requestDone := make(chan result, 1)
+	go func() {
+		res, err := http.Post("http://"+ln.Addr().String()+"/slow", "application/json", nil)
+		if err != nil {
+			requestDone <- result{err: err}
+			return
+		}
+		res.Body.Close()
+		requestDone <- result{status: res.StatusCode}
+	}()
+	<-started
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		shutdownDone <- e.Shutdown(ctx)
+	}()
+	// 処理中のリクエストが終わるまでShutdownは戻らない
+	select {
+	case err := <-shutdownDone:
+		t.Fatalf("Shutdown returned while a request was in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	if res := <-requestDone; res.err != nil || res.status != http.StatusOK {
+		t.Errorf("in-flight request = %d, %v; want %d", res.status, res.err, http.StatusOK)
+	}
+	if err := <-shutdownDone; err != nil {
+		t.Errorf("Shutdown = %v, want nil", err)
+	}
+	if err := <-serverErr; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Start = %v, want %v", err, http.ErrServerClosed)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM tags WHERE name = 'in-flight'"); n != 1 {
+		t.Errorf("tags committed by the in-flight request = %d, want 1", n)
+	}
+}
+
+func TestDecodeJSONBody(t *testing.T) {
+	setTestVar(t, &maxRequestBodyBytes, 64)
+	type request struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "valid", body: `{"name":"a","count":1}`},
+		{name: "oversized", body: `{"name":"` + strings.Repeat("a", 100) + `"}`, wantStatus: http.StatusRequestEntityTooLarge, wantCode: errCodePayloadTooLarge},
+		{name: "unknown field", body: `{"name":"a","cuont":1}`, wantStatus: http.StatusBadRequest, wantCode: errCodeBadRequest},
+		{name: "wrong type", body: `{"count":"1"}`, wantStatus: http.StatusBadRequest, wantCode: errCodeBadRequest},
+		{name: "null", body: `null`, wantStatus: http.StatusBadRequest, wantCode: errCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := testEcho.NewContext(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)), rec)
+			var req *request
+			err := decodeJSONBody(c, &req)
+			if tt.wantStatus == 0 {
+				if err != nil || req == nil || req.Name != "a" || req.Count != 1 {
+					t.Errorf("decodeJSONBody = %+v, %v; want the decoded request", req, err)
+				}
+				return
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Status != tt.wantStatus || apiErr.Code != tt.wantCode {
+				t.Errorf("decodeJSONBody error = %v, want %d %s", err, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestHandlersLimitRequestBodies(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &maxRequestBodyBytes, 1024)
+	streamerID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+3600, 5)
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	reserve := newTestReserveRequest(testTermStart, testTermStart+3600)
+	oversizedReserve := reserve
+	oversizedReserve.Description = strings.Repeat("a", 2048)
+	tests := []struct {
+		name       string
+		target     string
+		body       interface{}
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "oversized reservation", target: "/api/livestream/reservation", body: oversizedReserve, wantStatus: http.StatusRequestEntityTooLarge, wantCode: errCodePayloadTooLarge},
+		{name: "reservation with unknown field", target: "/api/livestream/reservation", body: map[string]interface{}{"title": "live", "start_at": testTermStart, "end_at": testTermStart + 3600, "tag": []int64{1}}, wantStatus: http.StatusBadRequest, wantCode: errCodeBadRequest},
+		{name: "oversized reaction", target: "/api/livestream/" + itoa(livestreamID) + "/reaction", body: map[string]string{"emoji_name": strings.Repeat("a", 2048)}, wantStatus: http.StatusRequestEntityTooLarge, wantCode: errCodePayloadTooLarge},
+		{name: "reaction with unknown field", target: "/api/livestream/" + itoa(livestreamID) + "/reaction", body: map[string]string{"emoji": "tada"}, wantStatus: http.StatusBadRequest, wantCode: errCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertErrorCode(t, doRequest(t, http.MethodPost, tt.target, tt.body, streamerID), tt.wantStatus, tt.wantCode)
+		})
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != 1 {
+		t.Errorf("livestreams = %d, want 1", n)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions"); n != 0 {
+		t.Errorf("reactions = %d, want 0", n)
+	}
+}
+
+func TestHandlersRejectNullBodies(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &adminToken, testAdminToken)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	logs := captureLogs(t)
+
+	null := json.RawMessage("null")
+	livestreamPath := "/api/livestream/" + itoa(livestreamID)
+	for _, tt := range []struct {
+		method string
+		target string
+		admin  bool
+	}{
+		{http.MethodPost, "/api/livestream/reservation", false},
+		{http.MethodPost, "/api/livestream/reservation/hold", false},
+		{http.MethodPost, "/api/livestream/reservation/confirm", false},
+		{http.MethodPost, "/api/livestream/reservation/waitlist", false},
+		{http.MethodPost, "/api/livestream/batch", false},
+		{http.MethodPatch, livestreamPath, false},
+		{http.MethodPost, livestreamPath + "/livecomment", false},
+		{http.MethodPost, livestreamPath + "/reaction", false},
+		{http.MethodPost, livestreamPath + "/moderate", false},
+		{http.MethodPost, "/api/icon", false},
+		{http.MethodPost, "/api/admin/livestream/bulk-reserve", true},
+		{http.MethodPost, "/api/admin/slots/adjust", true},
+		{http.MethodPost, "/api/admin/users/livestreams", true},
+	} {
+		var rec *httptest.ResponseRecorder
+		if tt.admin {
+			rec = doAdminRequest(t, tt.method, tt.target, null, testAdminToken)
+		} else {
+			rec = doRequest(t, tt.method, tt.target, null, streamerID)
+		}
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %s with a null body: status = %d, want %d; body: %s", tt.method, tt.target, rec.Code, http.StatusBadRequest, rec.Body.String())
+		}
+	}
+	if strings.Contains(logs.String(), "panic recovered") {
+		t.Errorf("a null body made a handler panic: %s", logs)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	logs := captureLogs(t)
+	// newEcho はメトリクスを登録し直せないので、テスト用のインスタンスにpanicするルートを足す
+	testEcho.GET("/test/panic", func(c echo.Context) error {
+		var req *PostReactionRequest
+		return c.String(http.StatusOK, req.EmojiName)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/test/panic", nil)
+	req.Header.Set(echo.HeaderXRequestID, "panic-request")
+	rec := httptest.NewRecorder()
+	testEcho.ServeHTTP(rec, req)
+
+	// panicしてもプロセスは落ちず、中身を伏せた構造化された500を返す
+	assertErrorCode(t, rec, http.StatusInternalServerError, errCodeInternal)
+	if strings.Contains(rec.Body.String(), "nil pointer") {
+		t.Errorf("the response leaks the panic: %s", rec.Body.String())
+	}
+	for _, want := range []string{"[request_id=panic-request]", "panic recovered at /test/panic", "nil pointer dereference", "goroutine "} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logs do not include %q: %s", want, logs.String())
+		}
+	}
+}
+
+func TestConnectDBPoolSettings(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("ISUCON13_MYSQL_MAX_OPEN_CONNS", "7")
+	db, err := connectDB(testEcho.Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if got := db.Stats().MaxOpenConnections; got != 7 {
+		t.Errorf("MaxOpenConnections = %d, want 7", got)
+	}
+
+	t.Setenv("ISUCON13_MYSQL_MAX_OPEN_CONNS", "many")
+	if db, err := connectDB(testEcho.Logger); err == nil {
+		db.Close()
+		t.Error("connectDB with an invalid pool size succeeded")
+	}
+}
+
+func TestGetDBStatsHandler(t *testing.T) {
+	setupTestDB(t)
+	e := echo.New()
+	e.GET("/api/debug/dbstats", getDBStatsHandler)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/debug/dbstats", nil))
+
+	var stats map[string]json.Number
+	decodeResponse(t, rec, http.StatusOK, &stats)
+	for _, field := range []string{"max_open_connections", "open_connections", "in_use", "idle", "wait_count", "wait_duration_ms", "max_idle_closed", "max_lifetime_closed"} {
+		if _, ok := stats[field]; !ok {
+			t.Errorf("dbstats does not include %q: %s", field, rec.Body)
+		}
+	}
+	if got, _ := stats["max_open_connections"].Int64(); got != int64(dbConn.Stats().MaxOpenConnections) {
+		t.Errorf("max_open_connections = %d, want %d", got, dbConn.Stats().MaxOpenConnections)
+	}
+}
+
+func TestDebugEndpointsAreGated(t *testing.T) {
+	if debugEndpointsEnabled {
+		t.Skip("ISUCON13_ENABLE_DEBUG_ENDPOINTS is set")
+	}
+	if rec := doRequest(t, http.MethodGet, "/api/debug/dbstats", nil, 0); rec.Code != http.StatusNotFound {
+		t.Errorf("dbstats without the env gate status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestReadHandlersUseReadOnlyTransactions(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+3600, 5)
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart)
+	warmTestCaches(t)
+	recorder := recordQueries(t)
+
+	readOnly := driver.TxOptions{Isolation: driver.IsolationLevel(sql.LevelReadCommitted), ReadOnly: true}
+	for _, target := range []string{
+		"/api/livestream/search",
+		"/api/livestream/" + itoa(livestreamID) + "/reaction",
+		"/api/livestream/" + itoa(livestreamID) + "/statistics",
+	} {
+		recorder.reset()
+		decodeResponse(t, doRequest(t, http.MethodGet, target, nil, streamerID), http.StatusOK, nil)
+		txs := recorder.transactions()
+		if len(txs) == 0 {
+			t.Errorf("GET %s began no transaction", target)
+		}
+		for _, opts := range txs {
+			if opts != readOnly {
+				t.Errorf("GET %s began a transaction with %+v, want %+v", target, opts, readOnly)
+			}
+		}
+	}
+
+	// 予約は行ロックを取るのでデフォルトの分離レベルのまま
+	recorder.reset()
+	reserveTestLivestream(t, streamerID, newTestReserveRequest(testTermStart, testTermStart+3600))
+	for _, opts := range recorder.transactions() {
+		if opts.ReadOnly || opts.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+			t.Errorf("reservation began a transaction with %+v, want the default options", opts)
+		}
+	}
+}
+
+func TestReadOnlyTransactionRejectsWrites(t *testing.T) {
+	setupTestDB(t)
+	tx, err := beginTx(context.Background(), readOnlyTxOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	// MySQLは ER_CANT_EXECUTE_IN_READ_ONLY_TRANSACTION (1792) を返す
+	// 互換サーバには接続を切るものもあるので、エラー番号は MySQLError の場合のみ確かめる
+	_, err = tx.Exec("INSERT INTO tags (name) VALUES ('written-in-read-only')")
+	var mysqlErr *mysql.MySQLError
+	if err == nil {
+		t.Error("write in a read-only transaction succeeded")
+	} else if errors.As(err, &mysqlErr) && mysqlErr.Number != 1792 {
+		t.Errorf("write error = %v, want error 1792", err)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM tags WHERE name = 'written-in-read-only'"); n != 0 {
+		t.Errorf("tags written in a read-only transaction = %d, want 0", n)
+	}
+}
+
+func TestGzipResponses(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	for i := 0; i < 20; i++ {
+		insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	}
+	insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart)
+	warmTestCaches(t)
+	get := func(target string, gzipped bool) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if gzipped {
+			req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+		}
+		req.AddCookie(sessionCookie(t, streamerID))
+		rec := httptest.NewRecorder()
+		testEcho.ServeHTTP(rec, req)
+		return rec
+	}
+
+	plain := get("/api/livestream/search", false)
+	if plain.Code != http.StatusOK || plain.Header().Get(echo.HeaderContentEncoding) != "" {
+		t.Fatalf("search without Accept-Encoding = %d (Content-Encoding %q), want an uncompressed 200", plain.Code, plain.Header().Get(echo.HeaderContentEncoding))
+	}
+	if plain.Body.Len() < gzipMinLength {
+		t.Fatalf("search response is %d bytes, want at least %d to be compressed", plain.Body.Len(), gzipMinLength)
+	}
+	rec := get("/api/livestream/search", true)
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentEncoding) != "gzip" {
+		t.Fatalf("search with Accept-Encoding: gzip = %d (Content-Encoding %q), want a gzip-encoded 200", rec.Code, rec.Header().Get(echo.HeaderContentEncoding))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want []Livestream
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("decompressed body is not JSON: %v", err)
+	}
+	if err := json.Unmarshal(plain.Body.Bytes(), &want); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 21 || !equalIDs(livestreamIDs(got), livestreamIDs(want)) {
+		t.Errorf("decompressed livestreams = %v, want %v", livestreamIDs(got), livestreamIDs(want))
+	}
+
+	// しきい値未満のレスポンスとストリーミングするエクスポートは圧縮しない
+	for _, target := range []string{
+		"/api/livestream/search?limit=1",
+		"/api/livestream/" + itoa(livestreamID) + "/reactions/export",
+	} {
+		if rec := get(target, true); rec.Header().Get(echo.HeaderContentEncoding) != "" {
+			t.Errorf("%s Content-Encoding = %q, want none", target, rec.Header().Get(echo.HeaderContentEncoding))
+		}
+	}
+}
+
+func TestIsTransientConnError(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad conn", driver.ErrBadConn, true},
+		{"invalid conn", mysql.ErrInvalidConn, true},
+		{"wrapped network error", fmt.Errorf("begin: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), true},
+		{"duplicate entry", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, false},
+		{"context canceled", context.Canceled, false},
+	} {
+		if got := isTransientConnError(tt.err); got != tt.want {
+			t.Errorf("%s: isTransientConnError(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBeginTxRetriesTransientConnErrors(t *testing.T) {
+	setupTestDB(t)
+	recorder := recordQueries(t)
+	// driver.ErrBadConn は database/sql 自体が別の接続でやり直すので、beginTx の再試行を確かめるにはネットワークエラーを注入する
+	connReset := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	failBegins := func(n int, err error) {
+		recorder.reset()
+		recorder.injectErrors(func(query string) error {
+			if query == beginTxQuery && n > 0 {
+				n--
+				return err
+			}
+			return nil
+		})
+	}
+
+	failBegins(1, connReset)
+	tx, err := beginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("beginTx after one bad connection = %v, want success", err)
+	}
+	if _, err := tx.Exec("INSERT INTO tags (name) VALUES (?)", "retried"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(recorder.transactions()); n != 2 {
+		t.Errorf("attempts after one bad connection = %d, want 2", n)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM tags WHERE name = 'retried'"); n != 1 {
+		t.Errorf("rows written by the retried transaction = %d, want 1", n)
+	}
+
+	failBegins(maxBeginTxAttempts, connReset)
+	if _, err := beginTx(context.Background(), nil); !errors.Is(err, connReset) {
+		t.Errorf("beginTx while the connection stays bad = %v, want %v", err, connReset)
+	}
+	if n := len(recorder.transactions()); n != maxBeginTxAttempts {
+		t.Errorf("attempts while the connection stays bad = %d, want %d", n, maxBeginTxAttempts)
+	}
+
+	appErr := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+	failBegins(1, appErr)
+	if _, err := beginTx(context.Background(), nil); !errors.Is(err, appErr) {
+		t.Errorf("beginTx with an application error = %v, want %v", err, appErr)
+	}
+	if n := len(recorder.transactions()); n != 1 {
+		t.Errorf("attempts with an application error = %d, want 1", n)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 署名付きURLの有効期間
+var mediaURLTTL = getEnvDuration("ISUCON13_MEDIA_URL_TTL", time.Hour)
+
+// mediaURLSigner は配信のサムネイル・プレイリストのURLをレスポンス用に書き換える
+// nil ならDBの値をそのまま返す。ISUCON13_MEDIA_URL_SIGNING_KEY が設定されていれば signMediaURL を使う
+// 別の方式(CDNの独自形式など)で署名する場合はここを差し替える
+var mediaURLSigner func(rawURL string, now time.Time) string
+
+func init() {
+	if key, ok := os.LookupEnv("ISUCON13_MEDIA_URL_SIGNING_KEY"); ok && key != "" {
+		signingKey := []byte(key)
+		mediaURLSigner = func(rawURL string, now time.Time) string {
+			return signMediaURL(signingKey, rawURL, now.Add(mediaURLTTL).Unix())
+		}
+	}
+}
+
+// signMediaURL は rawURL に有効期限 expires と、パスと有効期限に対するHMAC-SHA256の署名 signature をクエリとして付与する
+// 配信側は同じ鍵で署名を検証し、期限切れのURLを拒否する
+// URLとして解釈できない値や空文字はそのまま返す
+func signMediaURL(key []byte, rawURL string, expiresAt int64) string {
+	if rawURL == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	expires := strconv.FormatInt(expiresAt, 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(u.EscapedPath() + "\n" + expires))
+
+	q := u.Query()
+	q.Set("expires", expires)
+	q.Set("signature", hex.EncodeToString(mac.Sum(nil)))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// responseMediaURL はレスポンスに含めるメディアのURLを返す
+func responseMediaURL(rawURL string, now time.Time) string {
+	if mediaURLSigner == nil {
+		return rawURL
+	}
+	return mediaURLSigner(rawURL, now)
+}
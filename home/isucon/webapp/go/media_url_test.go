@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testMediaURLSigningKey = "test-signing-key"
+
+// setTestMediaURLSigner はテストの間だけ testMediaURLSigningKey でメディアのURLに署名する
+func setTestMediaURLSigner(t *testing.T) {
+	setTestVar(t, &mediaURLSigner, func(rawURL string, now time.Time) string {
+		return signMediaURL([]byte(testMediaURLSigningKey), rawURL, now.Add(mediaURLTTL).Unix())
+	})
+}
+
+// assertSignedMediaURL は got が rawURL に有効期限内の署名を付けたURLであることを確かめる
+func assertSignedMediaURL(t *testing.T, got, rawURL string) {
+	t.Helper()
+	u, err := url.Parse(got)
+	if err != nil {
+		t.Fatalf("signed url %q: %v", got, err)
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	if err != nil || expires <= time.Now().Unix() {
+		t.Errorf("signed url %q has expires %q, want a future unix time", got, u.Query().Get("expires"))
+		return
+	}
+	assertSignedMediaURLAt(t, got, rawURL, expires)
+}
+
+// assertSignedMediaURLAt は got が rawURL に有効期限 expiresAt の署名を付けたURLであることを確かめる
+func assertSignedMediaURLAt(t *testing.T, got, rawURL string, expiresAt int64) {
+	t.Helper()
+	u, err := url.Parse(got)
+	if err != nil {
+		t.Fatalf("signed url %q: %v", got, err)
+	}
+	raw, _ := url.Parse(rawURL)
+	if u.Scheme != raw.Scheme || u.Host != raw.Host || u.Path != raw.Path {
+		t.Errorf("signed url %q does not point at %q", got, rawURL)
+	}
+	expires := strconv.FormatInt(expiresAt, 10)
+	if u.Query().Get("expires") != expires {
+		t.Errorf("signed url %q has expires %q, want %s", got, u.Query().Get("expires"), expires)
+	}
+	mac := hmac.New(sha256.New, []byte(testMediaURLSigningKey))
+	mac.Write([]byte(u.EscapedPath() + "\n" + expires))
+	if want := hex.EncodeToString(mac.Sum(nil)); u.Query().Get("signature") != want {
+		t.Errorf("signed url %q has signature %q, want %q", got, u.Query().Get("signature"), want)
+	}
+}
+
+func TestSignMediaURL(t *testing.T) {
+	key := []byte(testMediaURLSigningKey)
+	const raw = "https://media.example.com/live/1/thumb%20nail.jpg?size=large"
+	got := signMediaURL(key, raw, testTermStart)
+	assertSignedMediaURLAt(t, got, raw, testTermStart)
+	if u, _ := url.Parse(got); u.Query().Get("size") != "large" {
+		t.Errorf("signed url %q dropped the original query", got)
+	}
+	// 同じ鍵・有効期限なら同じURLになり、鍵や有効期限が変われば署名も変わる
+	if again := signMediaURL(key, raw, testTermStart); again != got {
+		t.Errorf("signing is not deterministic: %q != %q", again, got)
+	}
+	if other := signMediaURL([]byte("other"), raw, testTermStart); other == got {
+		t.Errorf("signing with another key gave the same url %q", other)
+	}
+	if later := signMediaURL(key, raw, testTermStart+1); later == got {
+		t.Errorf("signing with another expiry gave the same url %q", later)
+	}
+
+	for _, raw := range []string{"", "://invalid"} {
+		if got := signMediaURL(key, raw, testTermStart); got != raw {
+			t.Errorf("signMediaURL(%q) = %q, want it unchanged", raw, got)
+		}
+	}
+}
+
+func TestResponseMediaURL(t *testing.T) {
+	const raw = "https://media.example.com/thumb.jpg"
+	setTestVar(t, &mediaURLSigner, nil)
+	if got := responseMediaURL(raw, time.Now()); got != raw {
+		t.Errorf("unsigned responseMediaURL = %q, want %q", got, raw)
+	}
+	setTestMediaURLSigner(t)
+	now := time.Unix(testTermStart, 0)
+	assertSignedMediaURLAt(t, responseMediaURL(raw, now), raw, now.Add(mediaURLTTL).Unix())
+}
+
+func TestLivestreamResponsesSignMediaURLs(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &mediaURLSigner, nil)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	insertTestReaction(t, viewerID, livestreamID, "tada", testTermStart)
+	warmTestCaches(t)
+	const (
+		rawPlaylist  = "https://example.com/playlist.m3u8"
+		rawThumbnail = "https://example.com/thumbnail.jpg"
+	)
+	// 単体・一覧・リアクションに含まれる配信のいずれも同じ fill 関数を通る
+	fetch := func() []Livestream {
+		t.Helper()
+		var livestream Livestream
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID), nil, viewerID), http.StatusOK, &livestream)
+		var searched []Livestream
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search", nil, viewerID), http.StatusOK, &searched)
+		var reactions []Reaction
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/reaction", nil, viewerID), http.StatusOK, &reactions)
+		if len(searched) != 1 || len(reactions) != 1 {
+			t.Fatalf("got %d livestreams and %d reactions, want 1 each", len(searched), len(reactions))
+		}
+		return []Livestream{livestream, searched[0], reactions[0].Livestream}
+	}
+
+	for i, l := range fetch() {
+		if l.PlaylistUrl != rawPlaylist || l.ThumbnailUrl != rawThumbnail {
+			t.Errorf("unsigned response %d = %q, %q, want raw urls", i, l.PlaylistUrl, l.ThumbnailUrl)
+		}
+	}
+
+	// 署名は起動時の設定で決まり、キャッシュには署名済みのレスポンスが入るので、切り替えたらキャッシュを作り直す
+	setTestMediaURLSigner(t)
+	livestreamResponseCache.reset()
+	for _, l := range fetch() {
+		assertSignedMediaURL(t, l.PlaylistUrl, rawPlaylist)
+		assertSignedMediaURL(t, l.ThumbnailUrl, rawThumbnail)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// 負荷試験中のプロファイリング用のPrometheusメトリクス
+// GET /metrics で公開する
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "isupipe_http_requests_total",
+		Help: "Number of HTTP requests by route and status code.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "isupipe_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	dbTransactionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "isupipe_db_transactions_total",
+		Help: "Number of DB transactions begun, committed and rolled back.",
+	}, []string{"event"})
+	dbQueriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "isupipe_db_queries_total",
+		Help: "Number of DB queries and statements executed.",
+	})
+)
+
+// registerMetrics は起動時に一度だけ呼ぶ
+func registerMetrics(e *echo.Echo) {
+	prometheus.MustRegister(httpRequestsTotal, httpRequestDuration, dbTransactionsTotal, dbQueriesTotal)
+	e.Use(metricsMiddleware)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+}
+
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			// ステータスコードを確定させるため、ここでエラーレスポンスを書き込む
+			c.Error(err)
+		}
+
+		status := c.Response().Status
+		route := c.Path()
+		if route == "" {
+			route = "unknown"
+		}
+		labels := prometheus.Labels{
+			"method": c.Request().Method,
+			"route":  route,
+			"status": strconv.Itoa(status),
+		}
+		httpRequestsTotal.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+		return nil
+	}
+}
+
+// instrumentedConnector はMySQLドライバのコネクションをラップし、
+// トランザクションとクエリの回数を計測する
+type instrumentedConnector struct {
+	driver.Connector
+}
+
+func (ic *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := ic.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{Conn: conn}, nil
+}
+
+type instrumentedConn struct {
+	driver.Conn
+}
+
+var (
+	_ driver.ConnBeginTx        = (*instrumentedConn)(nil)
+	_ driver.ExecerContext      = (*instrumentedConn)(nil)
+	_ driver.QueryerContext     = (*instrumentedConn)(nil)
+	_ driver.ConnPrepareContext = (*instrumentedConn)(nil)
+	_ driver.Pinger             = (*instrumentedConn)(nil)
+	_ driver.SessionResetter    = (*instrumentedConn)(nil)
+	_ driver.Validator          = (*instrumentedConn)(nil)
+	_ driver.NamedValueChecker  = (*instrumentedConn)(nil)
+)
+
+func (ic *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	beginner, ok := ic.Conn.(driver.ConnBeginTx)
+	if !ok {
+		return nil, errors.New("driver does not support BeginTx")
+	}
+	tx, err := beginner.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	dbTransactionsTotal.WithLabelValues("begin").Inc()
+	return &instrumentedTx{Tx: tx}, nil
+}
+
+func (ic *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := ic.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	dbQueriesTotal.Inc()
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (ic *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := ic.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	dbQueriesTotal.Inc()
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (ic *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := ic.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return ic.Conn.Prepare(query)
+}
+
+func (ic *instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := ic.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (ic *instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := ic.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (ic *instrumentedConn) IsValid() bool {
+	if validator, ok := ic.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (ic *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := ic.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type instrumentedTx struct {
+	driver.Tx
+}
+
+func (it *instrumentedTx) Commit() error {
+	err := it.Tx.Commit()
+	if err == nil {
+		dbTransactionsTotal.WithLabelValues("commit").Inc()
+	}
+	return err
+}
+
+func (it *instrumentedTx) Rollback() error {
+	dbTransactionsTotal.WithLabelValues("rollback").Inc()
+	return it.Tx.Rollback()
+}
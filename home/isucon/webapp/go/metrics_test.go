@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetric は /metrics を取得し、series (メトリクス名とラベル) の値を返す。出力に無ければ0を返す
+func scrapeMetric(t *testing.T, series string) float64 {
+	t.Helper()
+	rec := doRequest(t, http.MethodGet, "/metrics", nil, 0)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("failed to parse %q: %v", line, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetricsCountRequests(t *testing.T) {
+	rec := doRequest(t, http.MethodGet, "/api/livestream/abc", nil, 0)
+	requests := `isupipe_http_requests_total{method="GET",route="/api/livestream/:livestream_id",status="` + strconv.Itoa(rec.Code) + `"}`
+	latency := `isupipe_http_request_duration_seconds_count{method="GET",route="/api/livestream/:livestream_id",status="` + strconv.Itoa(rec.Code) + `"}`
+	beforeRequests, beforeLatency := scrapeMetric(t, requests), scrapeMetric(t, latency)
+
+	doRequest(t, http.MethodGet, "/api/livestream/abc", nil, 0)
+	doRequest(t, http.MethodGet, "/api/livestream/abc", nil, 0)
+
+	if got := scrapeMetric(t, requests) - beforeRequests; got != 2 {
+		t.Errorf("%s increased by %v, want 2", requests, got)
+	}
+	if got := scrapeMetric(t, latency) - beforeLatency; got != 2 {
+		t.Errorf("%s increased by %v, want 2", latency, got)
+	}
+}
+
+func TestMetricsCountTransactionsAndQueries(t *testing.T) {
+	setupTestDB(t)
+	const (
+		begin   = `isupipe_db_transactions_total{event="begin"}`
+		commit  = `isupipe_db_transactions_total{event="commit"}`
+		queries = `isupipe_db_queries_total`
+	)
+	beforeBegin, beforeCommit, beforeQueries := scrapeMetric(t, begin), scrapeMetric(t, commit), scrapeMetric(t, queries)
+
+	// タグキャッシュを捨ててタグ一覧APIがDBを引くようにする
+	tagsCache.reset()
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/tag", nil, 0), http.StatusOK, nil)
+
+	if got := scrapeMetric(t, begin) - beforeBegin; got < 1 {
+		t.Errorf("%s increased by %v, want at least 1", begin, got)
+	}
+	if got := scrapeMetric(t, commit) - beforeCommit; got < 1 {
+		t.Errorf("%s increased by %v, want at least 1", commit, got)
+	}
+	if got := scrapeMetric(t, queries) - beforeQueries; got < 1 {
+		t.Errorf("%s increased by %v, want at least 1", queries, got)
+	}
+}
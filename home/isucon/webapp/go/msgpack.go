@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const mimeApplicationMsgpack = "application/msgpack"
+
+// acceptsMsgpack はクライアントが Accept で MessagePack を要求しているかを返す
+// 通信量を減らしたいモバイルクライアント向け。明示的に要求された場合のみ使う
+func acceptsMsgpack(c echo.Context) bool {
+	for _, v := range strings.Split(c.Request().Header.Get(echo.HeaderAccept), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		if mediaType == mimeApplicationMsgpack || mediaType == "application/x-msgpack" {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiatedResponse は Accept に応じて v を MessagePack か JSON で返す
+// MessagePack のフィールド名も json タグに合わせるので、どちらでも同じ構造になる
+func negotiatedResponse(c echo.Context, code int, v interface{}) error {
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	if !acceptsMsgpack(c) {
+		return c.JSON(code, v)
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to encode response as msgpack", err)
+	}
+	return c.Blob(code, mimeApplicationMsgpack, buf.Bytes())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// doAcceptRequest は Accept を付けて、userID でログインした状態のGETリクエストを送る
+func doAcceptRequest(t *testing.T, target, accept string, userID int64) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if accept != "" {
+		req.Header.Set(echo.HeaderAccept, accept)
+	}
+	req.AddCookie(sessionCookie(t, userID))
+	rec := httptest.NewRecorder()
+	testEcho.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeMsgpack はクライアントと同じく json タグをフィールド名として MessagePack を読む
+func decodeMsgpack(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if ct := rec.Header().Get(echo.HeaderContentType); ct != mimeApplicationMsgpack {
+		t.Fatalf("Content-Type = %q, want %q", ct, mimeApplicationMsgpack)
+	}
+	dec := msgpack.NewDecoder(bytes.NewReader(rec.Body.Bytes()))
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(v); err != nil {
+		t.Fatalf("failed to decode msgpack: %v", err)
+	}
+}
+
+func TestAcceptsMsgpack(t *testing.T) {
+	for _, tt := range []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"*/*", false},
+		{"application/msgpack", true},
+		{"application/x-msgpack", true},
+		{"application/json;q=0.9, application/msgpack", true},
+		{"Application/MsgPack; q=1", true},
+		{"application/msgpackx", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(echo.HeaderAccept, tt.accept)
+		if got := acceptsMsgpack(echo.New().NewContext(req, httptest.NewRecorder())); got != tt.want {
+			t.Errorf("acceptsMsgpack(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestListEndpointsNegotiateMsgpack(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	tagID := insertTestTag(t, "music")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	insertTestLivestream(t, streamerID, "second", testTermStart+3600, testTermStart+7200)
+	mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", livestreamID, tagID)
+	insertTestReaction(t, viewerID, livestreamID, "tada", testTermStart)
+	insertTestReaction(t, streamerID, livestreamID, "smile", testTermStart+1)
+	warmTestCaches(t)
+
+	for _, tt := range []struct {
+		target string
+		v      func() interface{}
+	}{
+		{"/api/livestream/search", func() interface{} { return &[]Livestream{} }},
+		{"/api/livestream/search?tag=music", func() interface{} { return &[]Livestream{} }},
+		{"/api/livestream/search?envelope=1", func() interface{} { return &livestreamEnvelope{} }},
+		{"/api/livestream/" + itoa(livestreamID) + "/reaction", func() interface{} { return &[]Reaction{} }},
+	} {
+		fromJSON, fromMsgpack := tt.v(), tt.v()
+		rec := doAcceptRequest(t, tt.target, "", viewerID)
+		if ct := rec.Header().Get(echo.HeaderContentType); ct != echo.MIMEApplicationJSONCharsetUTF8 && ct != echo.MIMEApplicationJSON {
+			t.Errorf("%s without Accept Content-Type = %q, want JSON", tt.target, ct)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), fromJSON); err != nil {
+			t.Fatalf("%s: %v", tt.target, err)
+		}
+
+		rec = doAcceptRequest(t, tt.target, mimeApplicationMsgpack, viewerID)
+		decodeMsgpack(t, rec, fromMsgpack)
+		if vary := rec.Header().Values(echo.HeaderVary); !containsString(vary, echo.HeaderAccept) {
+			t.Errorf("%s Vary = %q, want it to include %q", tt.target, vary, echo.HeaderAccept)
+		}
+		// どちらの形式でも同じレスポンスになる
+		if !reflect.DeepEqual(fromJSON, fromMsgpack) {
+			t.Errorf("%s msgpack = %+v, want the JSON response %+v", tt.target, fromMsgpack, fromJSON)
+		}
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
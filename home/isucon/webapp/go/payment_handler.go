@@ -11,9 +11,10 @@ type PaymentResult struct {
 }
 
 func GetPaymentResult(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
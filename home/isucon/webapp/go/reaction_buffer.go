@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ISUCON13_BUFFER_REACTION_WRITES が設定されていれば、リアクションの投稿を1件ずつINSERTせず、
+// バッファに溜めてまとめてINSERTする (リアクションが殺到する配信向け)
+// 投稿APIのレスポンス後、書き込まれるまでの間は一覧に現れない (read-after-write が保証されない)
+// IDは reaction_id_sequence からまとめて確保するので、アプリサーバが複数台でも重複しない
+// ただしAUTO_INCREMENTで採番するサーバと混ぜないよう、全アプリサーバで同じ設定にすること
+// NOTE: reaction_id_sequence (id TINYINT PRIMARY KEY, next_id BIGINT NOT NULL) が必要
+var bufferReactionWrites = os.Getenv("ISUCON13_BUFFER_REACTION_WRITES") != ""
+
+var (
+	// バッファに溜まったリアクションを書き込む間隔
+	reactionFlushInterval = getEnvDuration("ISUCON13_REACTION_FLUSH_INTERVAL", 10*time.Millisecond)
+	// この件数溜まったら間隔を待たずに書き込む
+	reactionFlushRows = getEnvInt("ISUCON13_REACTION_FLUSH_ROWS", 100)
+	// reaction_id_sequence から1度に確保するIDの数
+	reactionIDBlockSize = getEnvInt("ISUCON13_REACTION_ID_BLOCK_SIZE", 1000)
+)
+
+const (
+	// 一時的なエラーで書き込めなかったバッチをやり直す回数の上限 (初回を含む)
+	maxReactionFlushAttempts = 5
+	// 書き込みに失敗したバッチをやり直す間隔の上限
+	maxReactionFlushBackoff = time.Second
+)
+
+// reaction_id_sequence の行のID (行は1つだけ)
+const reactionIDSequenceID = 1
+
+var errReactionIDSequenceMissing = errors.New("reaction_id_sequence is not initialized")
+
+// reactionWriteBuffer は投稿されたリアクションを溜め、バックグラウンドでまとめてINSERTする
+// 一時的なエラーで書き込めなかったバッチはやり直す。その間キューが埋まれば enqueue が待たされる
+// やり直しても書き込めなかったバッチは1行ずつ書き込み、書き込めない行はログに残して捨てる
+type reactionWriteBuffer struct {
+	// mu は確保済みのIDの範囲 [nextID, endID) を守る
+	mu     sync.Mutex
+	nextID int64
+	endID  int64
+	queue  chan ReactionModel
+	// flushReqs に送ったチャネルは、それまでにキューに入ったリアクションを書き込んだ後に閉じられる
+	flushReqs chan chan struct{}
+	done      chan struct{}
+}
+
+// reactionBuffer は bufferReactionWrites が有効な場合のみ startReactionWriteBuffer で作られる
+var reactionBuffer *reactionWriteBuffer
+
+// startReactionWriteBuffer はIDの採番をDBのリアクションIDの最大値より後に合わせ、書き込み用のgoroutineを起動する
+func startReactionWriteBuffer(ctx context.Context) (*reactionWriteBuffer, error) {
+	b := &reactionWriteBuffer{
+		queue:     make(chan ReactionModel, reactionFlushRows*16),
+		flushReqs: make(chan chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if err := syncReactionIDSequence(ctx); err != nil {
+		return nil, err
+	}
+	go b.run()
+	return b, nil
+}
+
+// syncReactionIDSequence は reaction_id_sequence を reactions のIDの最大値より後に進める (戻すことはない)
+// 初期化で reactions の行が入れ替わっても、確保済みのIDと重ならないようにする
+// 行の作成と更新はどちらも何度実行しても同じ結果になるので、複数台で同時に実行してもよい
+func syncReactionIDSequence(ctx context.Context) error {
+	if _, err := dbConn.ExecContext(ctx, "INSERT IGNORE INTO reaction_id_sequence (id, next_id) VALUES (?, 1)", reactionIDSequenceID); err != nil {
+		return err
+	}
+	_, err := dbConn.ExecContext(ctx, "UPDATE reaction_id_sequence SET next_id = GREATEST(next_id, IFNULL((SELECT MAX(id) FROM reactions), 0) + 1) WHERE id = ?", reactionIDSequenceID)
+	return err
+}
+
+// reserveReactionIDs は reaction_id_sequence から n 個のIDを確保し、その範囲 [start, end) を返す
+// LAST_INSERT_ID(expr) は接続ごとの値なので、UPDATE と SELECT を同じ接続で行う
+func reserveReactionIDs(ctx context.Context, n int64) (start, end int64, err error) {
+	conn, err := dbConn.Connx(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	rs, err := conn.ExecContext(ctx, "UPDATE reaction_id_sequence SET next_id = LAST_INSERT_ID(next_id + ?) WHERE id = ?", n, reactionIDSequenceID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if affected, err := rs.RowsAffected(); err != nil {
+		return 0, 0, err
+	} else if affected == 0 {
+		return 0, 0, errReactionIDSequenceMissing
+	}
+	if err := conn.GetContext(ctx, &end, "SELECT LAST_INSERT_ID()"); err != nil {
+		return 0, 0, err
+	}
+	return end - n, end, nil
+}
+
+// allocateID はリアクションのIDを1つ割り当てる。確保済みの範囲を使い切ったらDBから次の範囲を確保する
+// トランザクションのコミット前に呼び、コミットに失敗した場合のIDは欠番になる
+func (b *reactionWriteBuffer) allocateID(ctx context.Context) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.nextID >= b.endID {
+		start, end, err := reserveReactionIDs(ctx, int64(reactionIDBlockSize))
+		if err != nil {
+			return 0, err
+		}
+		b.nextID, b.endID = start, end
+	}
+	id := b.nextID
+	b.nextID++
+	return id, nil
+}
+
+// enqueue は allocateID で割り当てたIDのリアクションをキューに入れる
+// 書き込みが滞ってキューが埋まっている場合は、空くまで待つ
+func (b *reactionWriteBuffer) enqueue(reaction ReactionModel) {
+	b.queue <- reaction
+}
+
+// flush はそれまでにキューに入ったリアクションが書き込まれるまで待つ
+func (b *reactionWriteBuffer) flush() {
+	flushed := make(chan struct{})
+	b.flushReqs <- flushed
+	<-flushed
+}
+
+// reset は初期化後のDBに合わせて採番し直す。溜まっているリアクションは初期化の前に flush で書き込んでおくこと
+func (b *reactionWriteBuffer) reset(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID, b.endID = 0, 0
+	return syncReactionIDSequence(ctx)
+}
+
+// close はキューを閉じ、残りのリアクションを書き込み終えるまで待つ
+// HTTPサーバを止めて、新たに enqueue されなくなってから呼ぶこと
+func (b *reactionWriteBuffer) close() {
+	close(b.queue)
+	<-b.done
+}
+
+func (b *reactionWriteBuffer) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(reactionFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]ReactionModel, 0, reactionFlushRows)
+	for {
+		select {
+		case reaction, ok := <-b.queue:
+			if !ok {
+				b.write(batch)
+				return
+			}
+			batch = append(batch, reaction)
+			if len(batch) >= reactionFlushRows {
+				b.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			b.write(batch)
+			batch = batch[:0]
+		case flushed := <-b.flushReqs:
+			// 要求より前にキューに入ったものをすべて取り出してから書き込む
+			for drained := false; !drained; {
+				select {
+				case reaction, ok := <-b.queue:
+					if !ok {
+						drained = true
+						break
+					}
+					batch = append(batch, reaction)
+				default:
+					drained = true
+				}
+			}
+			b.write(batch)
+			batch = batch[:0]
+			close(flushed)
+		}
+	}
+}
+
+// write は batch を複数行INSERTで書き込む
+// 一時的なエラーなら間隔を空けてやり直し、それでも書き込めなければ1行ずつ書き込んで、書き込めない行だけを捨てる
+// 恒久的なエラー(不正な値など)の行をやり直し続けると、書き込みが止まってキューが埋まり、投稿がすべて待たされるため
+func (b *reactionWriteBuffer) write(batch []ReactionModel) {
+	if len(batch) == 0 {
+		return
+	}
+	err := insertBufferedReactions(batch)
+	if err == nil {
+		return
+	}
+	if len(batch) == 1 {
+		log.Printf("[ERROR] dropped a buffered reaction (id %d): %+v", batch[0].ID, err)
+		return
+	}
+	log.Printf("[ERROR] failed to write %d buffered reactions (ids %d-%d), writing them one by one: %+v", len(batch), batch[0].ID, batch[len(batch)-1].ID, err)
+	for i := range batch {
+		if err := insertBufferedReactions(batch[i : i+1]); err != nil {
+			log.Printf("[ERROR] dropped a buffered reaction (id %d): %+v", batch[i].ID, err)
+		}
+	}
+}
+
+// insertBufferedReactions は reactions を複数行INSERTで書き込む
+// 接続断・デッドロック・ロック待ちタイムアウトなら maxReactionFlushAttempts 回まで間隔を空けてやり直す
+// 失敗と判定した書き込みが実際にはコミットされていた場合もやり直せるよう、既に書き込まれた行は無視する
+func insertBufferedReactions(reactions []ReactionModel) error {
+	backoff := beginTxRetryBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), dbTxTimeout)
+		_, err := dbConn.NamedExecContext(ctx, "INSERT INTO reactions (id, user_id, livestream_id, emoji_name, created_at) VALUES (:id, :user_id, :livestream_id, :emoji_name, :created_at) ON DUPLICATE KEY UPDATE id = id", reactions)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= maxReactionFlushAttempts || !(isTransientConnError(err) || isRetryableTxError(err)) {
+			return err
+		}
+		log.Printf("[ERROR] failed to write %d buffered reactions (ids %d-%d, attempt %d), retrying: %+v", len(reactions), reactions[0].ID, reactions[len(reactions)-1].ID, attempt, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxReactionFlushBackoff {
+			backoff = maxReactionFlushBackoff
+		}
+	}
+}
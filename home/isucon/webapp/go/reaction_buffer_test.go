@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// startTestReactionBuffer はリアクションのバッファを起動し、テストの間だけ postReactionHandler で使う
+// 返した close はバッファを閉じて、残りのリアクションを書き込む (テスト終了時にも呼ばれる)
+func startTestReactionBuffer(t *testing.T) (closeBuffer func()) {
+	t.Helper()
+	buf, err := startReactionWriteBuffer(context.Background())
+	if err != nil {
+		t.Fatalf("failed to start reaction write buffer: %v", err)
+	}
+	setTestVar(t, &reactionBuffer, buf)
+	closed := false
+	closeBuffer = func() {
+		if !closed {
+			closed = true
+			buf.close()
+		}
+	}
+	t.Cleanup(closeBuffer)
+	return closeBuffer
+}
+
+func postTestReactions(t *testing.T, userID, livestreamID int64, emojiNames ...string) []int64 {
+	t.Helper()
+	ids := make([]int64, 0, len(emojiNames))
+	for _, emojiName := range emojiNames {
+		var reaction Reaction
+		decodeResponse(t, doRequest(t, http.MethodPost, "/api/livestream/"+itoa(livestreamID)+"/reaction", PostReactionRequest{EmojiName: emojiName}, userID), http.StatusCreated, &reaction)
+		ids = append(ids, reaction.ID)
+	}
+	return ids
+}
+
+// storedReactionIDs は配信のリアクションのIDを昇順で返す
+func storedReactionIDs(t *testing.T, livestreamID int64) []int64 {
+	t.Helper()
+	var ids []int64
+	if err := dbConn.Select(&ids, "SELECT id FROM reactions WHERE livestream_id = ? ORDER BY id", livestreamID); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// waitForReactions は配信のリアクションが want 件になるまで待つ
+// NOTE: テスト用のDBは書き込み中に並行して読むと書き込みを取りこぼすことがあるので、
+// 書き込みが終わるだけの間を空けてから読む
+func waitForReactions(t *testing.T, livestreamID int64, want int) []int64 {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		time.Sleep(50 * time.Millisecond)
+		ids := storedReactionIDs(t, livestreamID)
+		if len(ids) >= want || time.Now().After(deadline) {
+			return ids
+		}
+	}
+}
+
+func TestReactionBufferPersistsEventually(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	setTestVar(t, &reactionFlushRows, 1000)
+	startTestReactionBuffer(t)
+
+	// 件数が溜まらなくても、reactionFlushInterval ごとに書き込まれる
+	ids := postTestReactions(t, viewerID, livestreamID, "tada")
+	if got := waitForReactions(t, livestreamID, len(ids)); !equalIDs(got, ids) {
+		t.Fatalf("stored reactions = %v, want %v", got, ids)
+	}
+}
+
+func TestReactionBufferFlushesFullBatch(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	setTestVar(t, &reactionFlushInterval, time.Hour)
+	setTestVar(t, &reactionFlushRows, 3)
+	startTestReactionBuffer(t)
+
+	// reactionFlushRows 件溜まれば、間隔を待たずに書き込まれる
+	ids := postTestReactions(t, viewerID, livestreamID, "tada", "smile", "wave")
+	if got := waitForReactions(t, livestreamID, len(ids)); !equalIDs(got, ids) {
+		t.Fatalf("stored reactions = %v, want %v", got, ids)
+	}
+}
+
+func TestReactionBufferFlushesOnClose(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	// 既存のリアクションより後のIDを割り当て、確保したブロックを使い切っても重ならない
+	existingID := insertTestReaction(t, viewerID, livestreamID, "heart", testTermStart)
+	warmTestCaches(t)
+	setTestVar(t, &reactionIDBlockSize, 2)
+	// 間隔や件数では書き込まれないようにする
+	setTestVar(t, &reactionFlushInterval, time.Hour)
+	setTestVar(t, &reactionFlushRows, 1000)
+	closeBuffer := startTestReactionBuffer(t)
+
+	ids := postTestReactions(t, viewerID, livestreamID, "tada", "smile", "wave", "fire", "clap")
+	prev := existingID
+	for _, id := range ids {
+		if id <= prev {
+			t.Errorf("reaction ids = %v, want ascending after %d", ids, existingID)
+		}
+		prev = id
+	}
+	if got := storedReactionIDs(t, livestreamID); !equalIDs(got, []int64{existingID}) {
+		t.Fatalf("reactions written before close: %v", got)
+	}
+
+	closeBuffer()
+	if got, want := storedReactionIDs(t, livestreamID), append([]int64{existingID}, ids...); !equalIDs(got, want) {
+		t.Errorf("stored reactions after close = %v, want %v", got, want)
+	}
+	var emojiNames []string
+	if err := dbConn.Select(&emojiNames, "SELECT emoji_name FROM reactions WHERE livestream_id = ? AND id > ? ORDER BY id", livestreamID, existingID); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(emojiNames, ","); got != "tada,smile,wave,fire,clap" {
+		t.Errorf("stored emoji = %s, want them in posting order", got)
+	}
+}
+
+func TestReactionBufferFlush(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	setTestVar(t, &reactionFlushInterval, time.Hour)
+	setTestVar(t, &reactionFlushRows, 1000)
+	startTestReactionBuffer(t)
+
+	// flush はそれまでに受け付けたリアクションを書き込んでから戻る (初期化の前に呼ばれる)
+	ids := postTestReactions(t, viewerID, livestreamID, "tada", "smile")
+	reactionBuffer.flush()
+	if got := storedReactionIDs(t, livestreamID); !equalIDs(got, ids) {
+		t.Errorf("stored reactions after flush = %v, want %v", got, ids)
+	}
+}
+
+func TestReactionBufferRetriesFailedWrites(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	setTestVar(t, &reactionFlushInterval, time.Hour)
+	setTestVar(t, &reactionFlushRows, 1000)
+	recorder := recordQueries(t)
+	closeBuffer := startTestReactionBuffer(t)
+	captureStdLogs(t)
+
+	ids := postTestReactions(t, viewerID, livestreamID, "tada", "smile")
+	// 最初の2回の書き込みがデッドロックで失敗しても、リアクションを捨てずにやり直す
+	failures := 0
+	recorder.injectErrors(func(query string) error {
+		if strings.HasPrefix(query, "INSERT INTO reactions (id,") && failures < 2 {
+			failures++
+			return &mysql.MySQLError{Number: 1213, Message: "injected deadlock"}
+		}
+		return nil
+	})
+	closeBuffer()
+	if failures != 2 {
+		t.Errorf("injected %d failures, want 2", failures)
+	}
+	if got := storedReactionIDs(t, livestreamID); !equalIDs(got, ids) {
+		t.Errorf("stored reactions after retries = %v, want %v", got, ids)
+	}
+	if n := len(recorder.matching("INSERT INTO reactions (id,")); n != 3 {
+		t.Errorf("write attempts = %d, want 3 batch writes", n)
+	}
+}
+
+// isBatchReactionInsert は複数行をまとめて書き込むINSERTかを返す (1行のINSERTはプレースホルダが5つ)
+func isBatchReactionInsert(query string) bool {
+	return strings.HasPrefix(query, "INSERT INTO reactions (id,") && strings.Count(query, "?") > 5
+}
+
+func TestReactionBufferDropsPermanentlyFailingRows(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	setTestVar(t, &reactionFlushInterval, time.Hour)
+	setTestVar(t, &reactionFlushRows, 1000)
+	recorder := recordQueries(t)
+	closeBuffer := startTestReactionBuffer(t)
+	logs := captureStdLogs(t)
+
+	ids := postTestReactions(t, viewerID, livestreamID, "tada", "smile", "wave")
+	// 恒久的なエラーはやり直さず、1行ずつ書き込んで書き込めない行(最初の1行)だけを捨てる
+	singleRows := 0
+	recorder.injectErrors(func(query string) error {
+		if isBatchReactionInsert(query) {
+			return errors.New("injected data too long")
+		}
+		if strings.HasPrefix(query, "INSERT INTO reactions (id,") {
+			if singleRows++; singleRows == 1 {
+				return errors.New("injected data too long")
+			}
+		}
+		return nil
+	})
+	reactionBuffer.flush()
+	if n := len(recorder.matching("INSERT INTO reactions (id,")); n != 4 {
+		t.Errorf("write attempts = %d, want 1 batch and 3 single-row writes without retrying", n)
+	}
+	if got := storedReactionIDs(t, livestreamID); !equalIDs(got, ids[1:]) {
+		t.Errorf("stored reactions = %v, want %v", got, ids[1:])
+	}
+	if !strings.Contains(logs.String(), "dropped a buffered reaction (id "+itoa(ids[0])+")") {
+		t.Errorf("logs do not mention the dropped reaction: %s", logs)
+	}
+
+	// 捨てた後も書き込みは止まらない
+	recorder.injectErrors(nil)
+	more := postTestReactions(t, viewerID, livestreamID, "clap")
+	closeBuffer()
+	if got := storedReactionIDs(t, livestreamID); !equalIDs(got, append(ids[1:], more...)) {
+		t.Errorf("stored reactions after the drop = %v, want %v", got, append(ids[1:], more...))
+	}
+}
+
+func TestReactionBufferGivesUpOnPersistentTransientErrors(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	setTestVar(t, &reactionFlushInterval, time.Hour)
+	recorder := recordQueries(t)
+	closeBuffer := startTestReactionBuffer(t)
+	captureStdLogs(t)
+
+	postTestReactions(t, viewerID, livestreamID, "tada")
+	recorder.injectErrors(func(query string) error {
+		if strings.HasPrefix(query, "INSERT INTO reactions (id,") {
+			return &mysql.MySQLError{Number: 1205, Message: "injected lock wait timeout"}
+		}
+		return nil
+	})
+	reactionBuffer.flush()
+	if n := len(recorder.matching("INSERT INTO reactions (id,")); n != maxReactionFlushAttempts {
+		t.Errorf("write attempts = %d, want %d", n, maxReactionFlushAttempts)
+	}
+
+	recorder.injectErrors(nil)
+	more := postTestReactions(t, viewerID, livestreamID, "smile")
+	closeBuffer()
+	if got := storedReactionIDs(t, livestreamID); !equalIDs(got, more) {
+		t.Errorf("stored reactions = %v, want only %v", got, more)
+	}
+}
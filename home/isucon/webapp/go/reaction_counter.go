@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// 1配信あたりのリアクション数の上限 (0以下なら無制限)
+// 荒らしによってreactionsテーブルが際限なく増えるのを防ぐための安全装置
+var maxReactionsPerLivestream = getEnvInt("ISUCON13_MAX_REACTIONS_PER_LIVESTREAM", 0)
+
+// reactionCounter は配信ごとのリアクション数を保持し、投稿のたびや統計の取得のたびにCOUNT(*)しなくて済むようにする
+// 初期化時に全配信分を読み込み、載っていない配信は初回のみDBで数え、以降は投稿・削除のコミット後に更新する
+// 上限の判定は tryReserve で判定と増加をまとめて行うので、同時に投稿されても上限を超えない
+// DBで数えている最中の増減は pending に溜め、数え終えた値に足すので取りこぼさない
+// ただし数え始める直前にコミットされ、数え始めた後に add された投稿は二重に数えることがある
+// リアクションの書き込みをバッファする場合、DBで数えるときはまだ書き込まれていない分を含まない
+type reactionCounter struct {
+	mu     sync.Mutex
+	counts map[int64]int64
+	// pending はDBで数えている最中の配信と、その間に add された増減
+	pending map[int64]int64
+}
+
+var livestreamReactionCounts = &reactionCounter{counts: map[int64]int64{}, pending: map[int64]int64{}}
+
+// get は配信のリアクション数を返す。まだ数えていなければDBで数える
+// 呼び出し元のトランザクションのスナップショットは数え始めるより前のことがあるので、数えるときは新しい接続で読む
+func (rc *reactionCounter) get(ctx context.Context, livestreamID int64) (int64, error) {
+	rc.mu.Lock()
+	count, ok := rc.counts[livestreamID]
+	if !ok {
+		if _, counting := rc.pending[livestreamID]; !counting {
+			rc.pending[livestreamID] = 0
+		}
+	}
+	rc.mu.Unlock()
+	if ok {
+		return count, nil
+	}
+
+	query := "SELECT COUNT(*) FROM reactions WHERE livestream_id = ?"
+	done := traceQuery(ctx, query)
+	err := dbConn.GetContext(ctx, &count, query, livestreamID)
+	done()
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	// 数えている間に他のリクエストが数え終えていれば、そちらを正とする
+	if cached, ok := rc.counts[livestreamID]; ok {
+		return cached, nil
+	}
+	if err != nil {
+		// 溜まった増減は捨て、次の get で数え直す
+		delete(rc.pending, livestreamID)
+		return 0, err
+	}
+	count += rc.pending[livestreamID]
+	delete(rc.pending, livestreamID)
+	rc.counts[livestreamID] = count
+	return count, nil
+}
+
+// add は配信のリアクション数を delta だけ増やす
+// DBで数えている最中なら数え終えた後に反映し、まだ数えていない配信は次の get で数える
+func (rc *reactionCounter) add(livestreamID int64, delta int64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if count, ok := rc.counts[livestreamID]; ok {
+		rc.counts[livestreamID] = count + delta
+	} else if pending, ok := rc.pending[livestreamID]; ok {
+		rc.pending[livestreamID] = pending + delta
+	}
+}
+
+// tryReserve は配信のリアクション数が limit 未満なら1つ増やして true を返す。まだ数えていなければ先に数える
+// 判定と増加をロックの中で行うので、同時に投稿されても limit を超えない
+// 確保した投稿をコミットできなかった場合は add(livestreamID, -1) で戻すこと
+func (rc *reactionCounter) tryReserve(ctx context.Context, livestreamID, limit int64) (bool, error) {
+	for {
+		rc.mu.Lock()
+		if count, ok := rc.counts[livestreamID]; ok {
+			defer rc.mu.Unlock()
+			if count >= limit {
+				return false, nil
+			}
+			rc.counts[livestreamID] = count + 1
+			return true, nil
+		}
+		rc.mu.Unlock()
+		// 数え終えた後に warmReactionCounts で入れ替わっていれば、もう一度数える
+		if _, err := rc.get(ctx, livestreamID); err != nil {
+			return false, err
+		}
+	}
+}
+
+// warmReactionCounts は全配信のリアクション数を読み込み直す
+func warmReactionCounts(ctx context.Context) error {
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var rows []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"cnt"`
+	}
+	if err := tx.SelectContext(ctx, &rows, "SELECT l.id AS livestream_id, COUNT(r.id) AS cnt FROM livestreams l LEFT JOIN reactions r ON r.livestream_id = l.id GROUP BY l.id"); err != nil {
+		return err
+	}
+	counts := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		counts[row.LivestreamID] = row.Count
+	}
+
+	livestreamReactionCounts.mu.Lock()
+	livestreamReactionCounts.counts = counts
+	livestreamReactionCounts.pending = map[int64]int64{}
+	livestreamReactionCounts.mu.Unlock()
+
+	return tx.Commit()
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPostReactionCap(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &maxReactionsPerLivestream, 3)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	otherID := insertTestLivestream(t, streamerID, "other", testTermStart, testTermStart+3600)
+	insertTestReaction(t, viewerID, livestreamID, "heart", testTermStart)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reaction"
+
+	// 初期化時に読み込んだ数から数え、投稿のたびにCOUNT(*)しない
+	recorder := recordQueries(t)
+	decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "tada"), http.StatusCreated, nil)
+	decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "smile"), http.StatusCreated, nil)
+	assertErrorCode(t, postTestReaction(t, viewerID, livestreamID, "wave"), http.StatusForbidden, errCodeReactionLimitReached)
+	if n := len(recorder.matching("COUNT(*) FROM reactions")); n != 0 {
+		t.Errorf("posting counted reactions %d times, want 0", n)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE livestream_id = ?", livestreamID); n != 3 {
+		t.Errorf("reactions = %d, want the cap of 3", n)
+	}
+
+	// 件数の増えない更新や、他の配信への投稿は上限に関係ない
+	decodeResponse(t, doRequest(t, http.MethodPost, path, PostReactionRequest{EmojiName: "fire", Unique: true}, viewerID), http.StatusOK, nil)
+	decodeResponse(t, postTestReaction(t, viewerID, otherID, "tada"), http.StatusCreated, nil)
+
+	// 削除すれば、その分だけまた投稿できる
+	var reactionID int64
+	if err := dbConn.Get(&reactionID, "SELECT MAX(id) FROM reactions WHERE livestream_id = ?", livestreamID); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(t, http.MethodDelete, "/api/livestream/"+itoa(livestreamID)+"/reactions/"+itoa(reactionID), nil, streamerID); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete reaction status = %d: %s", rec.Code, rec.Body)
+	}
+	decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "clap"), http.StatusCreated, nil)
+	assertErrorCode(t, postTestReaction(t, viewerID, livestreamID, "wave"), http.StatusForbidden, errCodeReactionLimitReached)
+
+	// 上限が無効なら何件でも投稿できる
+	setTestVar(t, &maxReactionsPerLivestream, 0)
+	decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "wave"), http.StatusCreated, nil)
+}
+
+func TestReactionCounter(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart)
+	insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart)
+	rc := &reactionCounter{counts: map[int64]int64{}, pending: map[int64]int64{}}
+
+	// 数える前の増減は無視し、初回の get でDBから数える
+	rc.add(livestreamID, 5)
+	ctx := context.Background()
+	if count, err := rc.get(ctx, livestreamID); err != nil || count != 2 {
+		t.Fatalf("first get = %d, %v, want 2", count, err)
+	}
+
+	// 以降はDBを見ず、増減だけを反映する
+	insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart)
+	rc.add(livestreamID, 1)
+	rc.add(livestreamID, -2)
+	if count, err := rc.get(ctx, livestreamID); err != nil || count != 1 {
+		t.Errorf("get after add = %d, %v, want 1", count, err)
+	}
+}
+
+func TestReactionCounterAddWhileCounting(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart)
+	rc := &reactionCounter{counts: map[int64]int64{}, pending: map[int64]int64{}}
+	ctx := context.Background()
+
+	// 数えるクエリの直前に、その結果に含まれない投稿がコミットされて add された場合を再現する
+	recorder := recordQueries(t)
+	recorder.injectErrors(func(query string) error {
+		if query == "SELECT COUNT(*) FROM reactions WHERE livestream_id = ?" {
+			rc.add(livestreamID, 1)
+		}
+		return nil
+	})
+	if count, err := rc.get(ctx, livestreamID); err != nil || count != 2 {
+		t.Fatalf("get with an add during the count = %d, %v, want 2", count, err)
+	}
+	if len(rc.pending) != 0 {
+		t.Errorf("pending = %v, want it cleared after the count", rc.pending)
+	}
+
+	// 数えるのに失敗したら溜まった増減は捨て、次の get で数え直す
+	otherID := insertTestLivestream(t, streamerID, "other", testTermStart, testTermStart+3600)
+	recorder.injectErrors(func(query string) error {
+		if query == "SELECT COUNT(*) FROM reactions WHERE livestream_id = ?" {
+			rc.add(otherID, 1)
+			return errors.New("injected failure")
+		}
+		return nil
+	})
+	if _, err := rc.get(ctx, otherID); err == nil {
+		t.Fatal("get succeeded despite the failing count")
+	}
+	recorder.injectErrors(nil)
+	if count, err := rc.get(ctx, otherID); err != nil || count != 0 {
+		t.Errorf("get after a failed count = %d, %v, want 0", count, err)
+	}
+}
+
+func TestReactionCounterConcurrentAdds(t *testing.T) {
+	rc := &reactionCounter{counts: map[int64]int64{1: 0}, pending: map[int64]int64{}}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				rc.add(1, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if count := rc.counts[1]; count != 5000 {
+		t.Errorf("count after concurrent adds = %d, want 5000", count)
+	}
+}
+
+func TestLivestreamStatisticsReactionCounts(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	otherID := insertTestLivestream(t, streamerID, "other", testTermStart, testTermStart+3600)
+	insertTestReaction(t, viewerID, otherID, "tada", testTermStart)
+	warmTestCaches(t)
+
+	totalReactions := func() int64 {
+		t.Helper()
+		var stats LivestreamStatistics
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/statistics", nil, streamerID), http.StatusOK, &stats)
+		return stats.TotalReactions
+	}
+
+	recorder := recordQueries(t)
+	counted := func() (n int) {
+		for _, q := range recorder.matching("SELECT COUNT(*) FROM reactions WHERE livestream_id = ?") {
+			if q.Query == "SELECT COUNT(*) FROM reactions WHERE livestream_id = ?" && q.Args[0].Value == livestreamID {
+				n++
+			}
+		}
+		return n
+	}
+	for i := 0; i < 3; i++ {
+		if rec := postTestReaction(t, viewerID, livestreamID, "tada"); rec.Code != http.StatusCreated {
+			t.Fatalf("post reaction: status = %d, body: %s", rec.Code, rec.Body.String())
+		}
+	}
+	inserted := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE livestream_id = ?", livestreamID)
+	recorder.reset()
+	if got := totalReactions(); got != inserted || got != 3 {
+		t.Errorf("total_reactions = %d, want %d inserted reactions", got, inserted)
+	}
+	if n := counted(); n != 0 {
+		t.Errorf("counted reactions %d times with warm counters, want 0", n)
+	}
+
+	// 再起動で数え直していない状態を再現する。初回だけDBで数え、以降は投稿を反映する
+	livestreamReactionCounts.mu.Lock()
+	livestreamReactionCounts.counts = map[int64]int64{}
+	livestreamReactionCounts.pending = map[int64]int64{}
+	livestreamReactionCounts.mu.Unlock()
+	recorder.reset()
+	if got := totalReactions(); got != 3 {
+		t.Errorf("total_reactions after a cache miss = %d, want 3", got)
+	}
+	if rec := postTestReaction(t, viewerID, livestreamID, "tada"); rec.Code != http.StatusCreated {
+		t.Fatalf("post reaction: status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+	if got := totalReactions(); got != 4 {
+		t.Errorf("total_reactions after reload and post = %d, want 4", got)
+	}
+	if n := counted(); n != 1 {
+		t.Errorf("counted reactions of the livestream %d times after the reload, want 1", n)
+	}
+}
+
+func TestReactionCounterTryReserve(t *testing.T) {
+	rc := &reactionCounter{counts: map[int64]int64{1: 0}, pending: map[int64]int64{}}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		reserved int
+	)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := rc.tryReserve(context.Background(), 1, 10)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 10 || rc.counts[1] != 10 {
+		t.Errorf("reserved %d with count %d, want exactly the limit of 10", reserved, rc.counts[1])
+	}
+}
+
+func TestPostReactionCapConcurrent(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &maxReactionsPerLivestream, 5)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	for i := 0; i < 4; i++ {
+		insertTestReaction(t, viewerID, livestreamID, "heart", testTermStart)
+	}
+	warmTestCaches(t)
+
+	// 上限の1つ手前で同時に投稿しても、通るのは1件だけ
+	var wg sync.WaitGroup
+	statuses := make([]int, 10)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = postTestReaction(t, viewerID, livestreamID, "tada").Code
+		}(i)
+	}
+	wg.Wait()
+	created := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusForbidden:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+	if created != 1 {
+		t.Errorf("concurrent posts created %d reactions, want 1", created)
+	}
+	if count, err := livestreamReactionCounts.get(context.Background(), livestreamID); err != nil || count != 5 {
+		t.Errorf("counted reactions = %d, %v, want the cap of 5", count, err)
+	}
+}
+
+func TestPostReactionCapReleasesFailedPosts(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &maxReactionsPerLivestream, 1)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	// 確保した後に失敗した投稿は、確保した分を戻す
+	recorder := recordQueries(t)
+	recorder.injectErrors(func(query string) error {
+		if strings.HasPrefix(query, "INSERT INTO reactions") {
+			return errors.New("injected failure")
+		}
+		return nil
+	})
+	if rec := postTestReaction(t, viewerID, livestreamID, "tada"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	recorder.injectErrors(nil)
+	if count, err := livestreamReactionCounts.get(context.Background(), livestreamID); err != nil || count != 0 {
+		t.Errorf("counted reactions after a failed post = %d, %v, want 0", count, err)
+	}
+	decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "tada"), http.StatusCreated, nil)
+	assertErrorCode(t, postTestReaction(t, viewerID, livestreamID, "smile"), http.StatusForbidden, errCodeReactionLimitReached)
+}
@@ -2,10 +2,17 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -29,61 +36,343 @@ type Reaction struct {
 	CreatedAt  int64      `json:"created_at"`
 }
 
+// 絵文字のショートコード (例: "+1", "innocent")
+var emojiNamePattern = regexp.MustCompile(`^[A-Za-z0-9_+\-]{1,64}$`)
+
+// ISUCON13_REJECT_SELF_REACTIONS が設定されていれば、配信者が自分の配信へリアクションするのを禁止する
+var rejectSelfReactions = os.Getenv("ISUCON13_REJECT_SELF_REACTIONS") != ""
+
+// リアクション一覧取得APIでlimitが省略された場合の件数
+var defaultReactionsLimit = getEnvInt("ISUCON13_DEFAULT_REACTIONS_LIMIT", 50)
+
+// クライアントが指定したcreated_atとサーバ時刻のずれとして許容する秒数
+const reactionCreatedAtToleranceSeconds = 60
+
+var errReactionCreatedAtOutOfRange = errors.New("created_at is too far from server time")
+
+// normalizeClientCreatedAt はクライアント指定のcreated_at (一括投稿などで使う) を検証する
+// 許容範囲を超えてずれていればエラーを返し、範囲内の未来時刻はサーバ時刻に丸めて
+// created_at DESC の並びが崩れないようにする
+// 単体投稿(postReactionHandler)は常にサーバ時刻を使うので、これを通さない
+func normalizeClientCreatedAt(createdAt, now int64) (int64, error) {
+	if createdAt > now+reactionCreatedAtToleranceSeconds || createdAt < now-reactionCreatedAtToleranceSeconds {
+		return 0, fmt.Errorf("%w: created_at=%d, now=%d", errReactionCreatedAtOutOfRange, createdAt, now)
+	}
+	if createdAt > now {
+		return now, nil
+	}
+	return createdAt, nil
+}
+
+// emojiAliases は別名から正規のショートコードへの対応
+// クライアントによって同じ絵文字の表記が異なり、集計が分散するのを防ぐ
+// ISUCON13_EMOJI_ALIASES に "alias=canonical,alias2=canonical2" の形式で追加・上書きできる
+var emojiAliases = loadEmojiAliases(map[string]string{
+	"thumbsup":   "+1",
+	"thumbsdown": "-1",
+})
+
+func loadEmojiAliases(defaults map[string]string) map[string]string {
+	aliases := make(map[string]string, len(defaults))
+	for alias, canonical := range defaults {
+		aliases[alias] = canonical
+	}
+	v, ok := os.LookupEnv("ISUCON13_EMOJI_ALIASES")
+	if !ok {
+		return aliases
+	}
+	for _, pair := range strings.Split(v, ",") {
+		alias, canonical, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || alias == "" || canonical == "" {
+			log.Fatalf("failed to parse environment variable 'ISUCON13_EMOJI_ALIASES': invalid pair %q", pair)
+		}
+		aliases[alias] = canonical
+	}
+	return aliases
+}
+
+// normalizeEmojiName は ":+1:" のような前後のコロンを取り除き、別名を正規のショートコードに置き換える
+// 未知の絵文字はそのまま返す
+func normalizeEmojiName(emojiName string) string {
+	if len(emojiName) > 2 && strings.HasPrefix(emojiName, ":") && strings.HasSuffix(emojiName, ":") {
+		emojiName = emojiName[1 : len(emojiName)-1]
+	}
+	if canonical, ok := emojiAliases[emojiName]; ok {
+		return canonical
+	}
+	return emojiName
+}
+
 type PostReactionRequest struct {
 	EmojiName string `json:"emoji_name"`
+	// Unique がtrueの場合、1ユーザにつき1配信1リアクションとし、既存のリアクションを更新する (投票形式の配信向け)
+	Unique bool `json:"unique"`
+}
+
+// ポーリング用に次の since / since_id を返すレスポンスヘッダ
+const (
+	headerNextSince   = "X-Next-Since"
+	headerNextSinceID = "X-Next-Since-Id"
+)
+
+// reactionCursor はリアクション一覧のキーセットページネーションの位置 (created_at, id)
+type reactionCursor struct {
+	CreatedAt int64
+	ID        int64
+}
+
+func (rc reactionCursor) String() string {
+	return fmt.Sprintf("%d:%d", rc.CreatedAt, rc.ID)
 }
 
+func parseReactionCursor(v string) (reactionCursor, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) != 2 {
+		return reactionCursor{}, fmt.Errorf("invalid cursor %q", v)
+	}
+	createdAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return reactionCursor{}, fmt.Errorf("invalid cursor %q", v)
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return reactionCursor{}, fmt.Errorf("invalid cursor %q", v)
+	}
+	return reactionCursor{CreatedAt: createdAt, ID: id}, nil
+}
+
+// リアクション一覧取得API
+// GET /api/livestream/:livestream_id/reaction
+// envelope=1 の場合、続きはレスポンスの next_cursor を cursor に渡して同じ並び順 (since の有無) で取得する
+// since (unix秒) を指定すると、それより新しいリアクションのみを古い順に返す (ポーリング用)
+// 同じ秒のリアクションを取りこぼさないよう、前回のレスポンスヘッダの X-Next-Since / X-Next-Since-Id を
+// そのまま since / since_id に渡すと (created_at, id) がそれより後のものを返す
 func getReactionsHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	livestreamID, err := parseID(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	limit, err := parseLimitQuery(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return err
+	}
+	if limit == 0 {
+		// 人気の配信では全件が数万件になるため、limit省略時も件数を制限する
+		// それ以上必要なクライアントはlimit (最大maxLimit) を指定すること
+		limit = defaultReactionsLimit
 	}
-	defer tx.Rollback()
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
+	emojiName := c.QueryParam("emoji")
+	if emojiName != "" {
+		emojiName = normalizeEmojiName(emojiName)
+	}
+	if emojiName != "" && !emojiNamePattern.MatchString(emojiName) {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "emoji query parameter must be emoji shortcode", nil)
+	}
+
+	var (
+		since, sinceID int64
+		polling        = c.QueryParam("since") != ""
+	)
+	if polling {
+		since, err = strconv.ParseInt(c.QueryParam("since"), 10, 64)
+		if err != nil || since < 0 {
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, "since query parameter must be non-negative integer", nil)
+		}
+		if v := c.QueryParam("since_id"); v != "" {
+			sinceID, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || sinceID < 0 {
+				return httpError(c, http.StatusBadRequest, errCodeBadRequest, "since_id query parameter must be non-negative integer", nil)
+			}
+		}
+	} else if c.QueryParam("since_id") != "" {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "since_id can't be used without since", nil)
+	}
+	var cursor *reactionCursor
+	if v := c.QueryParam("cursor"); v != "" {
+		rc, err := parseReactionCursor(v)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+			return httpError(c, http.StatusBadRequest, errCodeBadRequest, "cursor query parameter is invalid", nil)
+		}
+		cursor = &rc
+		if polling {
+			// 古い順では、cursor は since / since_id と同じ位置を表す
+			since, sinceID = rc.CreatedAt, rc.ID
+		}
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	query := "SELECT * FROM reactions WHERE livestream_id = ?"
+	args := []interface{}{livestreamID}
+	if polling {
+		if sinceID > 0 {
+			query += " AND (created_at > ? OR (created_at = ? AND id > ?))"
+			args = append(args, since, since, sinceID)
+		} else {
+			query += " AND created_at > ?"
+			args = append(args, since)
+		}
+	}
+	if cursor != nil && !polling {
+		query += " AND (created_at < ? OR (created_at = ? AND id < ?))"
+		args = append(args, cursor.CreatedAt, cursor.CreatedAt, cursor.ID)
+	}
+	if emojiName != "" {
+		query += " AND emoji_name = ?"
+		args = append(args, emojiName)
+	}
+	if c.QueryParam("mine") == "1" {
+		// 自分のリアクションのみ (管理・削除用)
+		// error already checked
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		// existence already checked
+		userID := sess.Values[defaultUserIDKey].(int64)
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	envelope := envelopeQuery(c)
+	if polling {
+		// クライアントが末尾に追記できるよう古い順に返す
+		query += " ORDER BY created_at ASC, id ASC"
+	} else {
+		// 同じ秒のリアクションもカーソルで一意に位置を決められるよう、id でも並べる
+		query += " ORDER BY created_at DESC, id DESC"
+	}
+	if limit > 0 {
+		query += " LIMIT ?"
+		if envelope {
+			// 続きがあるかを判定するため1件多く取得する
+			args = append(args, limit+1)
+		} else {
+			args = append(args, limit)
 		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
 
 	reactionModels := []ReactionModel{}
-	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
+	if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
+		return httpError(c, http.StatusNotFound, errCodeNotFound, "failed to get reactions", err)
+	}
+	hasMore := false
+	var nextCursor string
+	if envelope && limit > 0 && len(reactionModels) > limit {
+		hasMore = true
+		reactionModels = reactionModels[:limit]
+		last := reactionModels[len(reactionModels)-1]
+		nextCursor = reactionCursor{CreatedAt: last.CreatedAt, ID: last.ID}.String()
+	}
+	if polling {
+		// 取得できなければ次回も同じ位置から取得する
+		nextSince, nextSinceID := since, sinceID
+		if len(reactionModels) > 0 {
+			last := reactionModels[len(reactionModels)-1]
+			nextSince, nextSinceID = last.CreatedAt, last.ID
+		}
+		c.Response().Header().Set(headerNextSince, strconv.FormatInt(nextSince, 10))
+		c.Response().Header().Set(headerNextSinceID, strconv.FormatInt(nextSinceID, 10))
 	}
 
 	reactions, err := fillReactionResponseBulk(ctx, tx, reactionModels)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reactions: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill reactions", err)
 	}	
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
 	}
 
-	return c.JSON(http.StatusOK, reactions)
+	if envelope {
+		return negotiatedResponse(c, http.StatusOK, ListEnvelope{
+			Items:      reactions,
+			NextCursor: nextCursor,
+			HasMore:    hasMore,
+		})
+	}
+	return negotiatedResponse(c, http.StatusOK, reactions)
 }
 
-func postReactionHandler(c echo.Context) error {
-	ctx := c.Request().Context()
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+// 自分の配信へのリアクション一覧取得API
+// GET /api/user/me/reactions?limit=...&offset=...
+// 配信者が持つ全ライブ配信へのリアクションを新しい順にまとめて返す
+func getMyReactionsHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	pagination, err := parseSearchPagination(c)
+	if err != nil {
+		return err
+	}
+	if pagination.Limit == 0 {
+		// 全配信分のリアクションは件数が多くなりやすいので、limit省略時も件数を制限する
+		pagination.Limit = defaultReactionsLimit
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	var livestreamIDs []int64
+	if err := tx.SelectContext(ctx, &livestreamIDs, "SELECT id FROM livestreams WHERE user_id = ? AND deleted_at IS NULL", userID); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestreams", err)
+	}
+	if len(livestreamIDs) == 0 {
+		return c.JSON(http.StatusOK, []Reaction{})
+	}
+
+	query, params, err := sqlx.In("SELECT * FROM reactions WHERE livestream_id IN (?)", livestreamIDs)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to construct IN query", err)
 	}
+	query, params = pagination.apply(query, "created_at", params)
+
+	reactionModels := []ReactionModel{}
+	if err := tx.SelectContext(ctx, &reactionModels, tx.Rebind(query), params...); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reactions", err)
+	}
+
+	reactions, err := fillReactionResponseBulk(ctx, tx, reactionModels)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill reactions", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	return c.JSON(http.StatusOK, reactions)
+}
+
+// リアクション履歴取得API
+// GET /api/user/me/reactions/history?limit=...&offset=...
+// 自分が送ったリアクションを、全ライブ配信について新しい順 (同時刻ならIDの降順) に返す (各リアクションに対象の配信を含む)
+func getUserReactionHistoryHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
@@ -95,45 +384,632 @@ func postReactionHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
+	pagination, err := parseSearchPagination(c)
+	if err != nil {
+		return err
+	}
+	if pagination.Limit == 0 {
+		// 履歴は件数が多くなりやすいので、limit省略時も件数を制限する
+		pagination.Limit = defaultReactionsLimit
+	}
+	envelope := envelopeQuery(c)
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	query, params := pagination.fetchOneMore(envelope).apply("SELECT * FROM reactions WHERE user_id = ?", "created_at", []interface{}{userID})
+	reactionModels := []ReactionModel{}
+	if err := tx.SelectContext(ctx, &reactionModels, query, params...); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reactions", err)
+	}
+	hasMore := false
+	if envelope && len(reactionModels) > pagination.Limit {
+		hasMore = true
+		reactionModels = reactionModels[:pagination.Limit]
+	}
+
+	reactions, err := fillReactionResponseBulk(ctx, tx, reactionModels)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill reactions", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	if envelope {
+		return c.JSON(http.StatusOK, ListEnvelope{
+			Items:   reactions,
+			HasMore: hasMore,
+		})
+	}
+	return c.JSON(http.StatusOK, reactions)
+}
+
+// リアクション単体取得API
+// GET /api/livestream/:livestream_id/reactions/:reaction_id
+func getReactionHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+	reactionID, err := parseID(c, "reaction_id")
+	if err != nil {
+		return err
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	reactionModel := ReactionModel{}
+	if err := tx.GetContext(ctx, &reactionModel, "SELECT * FROM reactions WHERE id = ? AND livestream_id = ?", reactionID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return httpError(c, http.StatusNotFound, errCodeNotFound, "not found reaction that has the given id in the livestream", nil)
+		}
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reaction", err)
+	}
+
+	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill reaction", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	return c.JSON(http.StatusOK, reaction)
+}
+
+// uniqueReactionTxOptions はユニークモードのリアクション投稿で使うトランザクションオプション
+var uniqueReactionTxOptions = &sql.TxOptions{Isolation: sql.LevelReadCommitted}
+
+func postReactionHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	userID := sessionUserID(c)
+
 	var req *PostReactionRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := decodeJSONBody(c, &req); err != nil {
+		return err
+	}
+	// 絞り込みと同じショートコードの形式以外は保存しない
+	req.EmojiName = normalizeEmojiName(req.EmojiName)
+	if !emojiNamePattern.MatchString(req.EmojiName) {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "emoji_name must be emoji shortcode", nil)
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	var txOpts *sql.TxOptions
+	if req.Unique {
+		// 既存のリアクションを探すのに、存在しない行への FOR UPDATE でギャップロックを取らないよう READ COMMITTED にする
+		// (同じユーザの初回の投稿が同時に来るとデッドロックする)
+		txOpts = uniqueReactionTxOptions
+		// バッファに溜まったリアクションはDBから見えないので、先に書き込んでおく
+		if reactionBuffer != nil {
+			reactionBuffer.flush()
+		}
+	}
+	tx, err := beginTx(ctx, txOpts)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
 	}
 	defer tx.Rollback()
 
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? AND deleted_at IS NULL", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return httpError(c, http.StatusNotFound, errCodeNotFound, "livestream not found", nil)
+		}
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestream", err)
+	}
+	if rejectSelfReactions && livestreamModel.UserID == userID {
+		return httpError(c, http.StatusForbidden, errCodeForbidden, "can't react to your own livestream", nil)
+	}
+
+	// 配信者が登録したNGワードを含むリアクションは拒否する
+	var ngwords []*NGWord
+	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get NG words", err)
+	}
+	if newNGWordMatcher(ngwords).Match(req.EmojiName) {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "このリアクションはNGワードを含んでいます", nil)
+	}
+
 	reactionModel := ReactionModel{
 		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
+		LivestreamID: livestreamID,
 		EmojiName:    req.EmojiName,
-		CreatedAt:    time.Now().Unix(),
+		// 単体投稿ではクライアントの時刻を信用せず、サーバ時刻を正とする
+		CreatedAt: time.Now().Unix(),
+	}
+
+	status := http.StatusCreated
+	updated := false
+	if req.Unique {
+		// 通常モードでは同一ユーザが何度でもリアクションできるため、(user_id, livestream_id) にユニークキーは張れない
+		// ON DUPLICATE KEY UPDATE の代わりに、投稿するユーザの行をロックして同じユーザの投稿を直列にしてから、更新か挿入かを決める
+		// READ COMMITTED なので、ロックを取った後の SELECT は先にコミットされた投稿を読める
+		var lockedUserID int64
+		if err := tx.GetContext(ctx, &lockedUserID, "SELECT id FROM users WHERE id = ? FOR UPDATE", reactionModel.UserID); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to lock user", err)
+		}
+		var existingID int64
+		err := tx.GetContext(ctx, &existingID, "SELECT id FROM reactions WHERE user_id = ? AND livestream_id = ? ORDER BY id ASC LIMIT 1", reactionModel.UserID, reactionModel.LivestreamID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reaction", err)
+		}
+		if err == nil {
+			reactionModel.ID = existingID
+			if _, err := tx.NamedExecContext(ctx, "UPDATE reactions SET emoji_name = :emoji_name, created_at = :created_at WHERE id = :id", reactionModel); err != nil {
+				return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to update reaction", err)
+			}
+			status = http.StatusOK
+			updated = true
+		}
 	}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
+	// 上限がある場合は、コミット前にリアクション数を1つ確保しておく (同時に投稿されても上限を超えない)
+	// コミットまで至らなければ確保した分を戻す
+	reserved, committed := false, false
+	if !updated && maxReactionsPerLivestream > 0 {
+		ok, err := livestreamReactionCounts.tryReserve(ctx, livestreamID, int64(maxReactionsPerLivestream))
+		if err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to count reactions", err)
+		}
+		if !ok {
+			return httpError(c, http.StatusForbidden, errCodeReactionLimitReached, "この配信はリアクション数の上限に達しています", nil)
+		}
+		reserved = true
+		defer func() {
+			if !committed {
+				livestreamReactionCounts.add(livestreamID, -1)
+			}
+		}()
+	}
+
+	// バッファを使う場合、INSERTはコミット後にキューへ入れてまとめて行う
+	// fillReactionResponse はリアクションの行を読まないので、書き込み前でもレスポンスを作れる
+	// ユニークモードでは、続く投稿が既存のリアクションを見つけられるようにバッファせずに書き込む
+	buffered := !updated && reactionBuffer != nil && !req.Unique
+	if !updated && !buffered {
+		result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
+		if err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to insert reaction", err)
+		}
+
+		reactionID, err := result.LastInsertId()
+		if err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get last inserted reaction id", err)
+		}
+		reactionModel.ID = reactionID
+	}
+	if buffered {
+		reactionModel.ID, err = reactionBuffer.allocateID(ctx)
+		if err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to allocate reaction id", err)
+		}
+	}
+
+	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill reaction", err)
 	}
 
-	reactionID, err := result.LastInsertId()
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+	committed = true
+	if buffered {
+		reactionBuffer.enqueue(reactionModel)
+	}
+	if !updated && !reserved {
+		livestreamReactionCounts.add(livestreamID, 1)
+	}
+	reactionStreamHub.publish(reaction)
+
+	return c.JSON(status, reaction)
+}
+
+// (配信者向け)リアクション削除API
+// DELETE /api/livestream/:livestream_id/reactions/:reaction_id
+func deleteReactionHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	userID := sessionUserID(c)
+
+	livestreamID, err := parseID(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+		return err
+	}
+	reactionID, err := parseID(c, "reaction_id")
+	if err != nil {
+		return err
 	}
-	reactionModel.ID = reactionID
 
-	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, c, tx, livestreamID, userID); err != nil {
+		return err
+	}
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM reactions WHERE id = ? AND livestream_id = ?", reactionID, livestreamID)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to delete reaction", err)
+	}
+	deleted, err := rs.RowsAffected()
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get affected rows", err)
+	}
+	if deleted == 0 {
+		return httpError(c, http.StatusNotFound, errCodeNotFound, "not found reaction that has the given id in the livestream", nil)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+	livestreamReactionCounts.add(livestreamID, -deleted)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// (配信者向け)絵文字を指定したリアクション一括削除API
+// DELETE /api/livestream/:livestream_id/reactions?emoji=...
+func deleteReactionsByEmojiHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	userID := sessionUserID(c)
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	emojiName := normalizeEmojiName(c.QueryParam("emoji"))
+	if !emojiNamePattern.MatchString(emojiName) {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "emoji query parameter must be emoji shortcode", nil)
+	}
+
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, c, tx, livestreamID, userID); err != nil {
+		return err
+	}
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM reactions WHERE livestream_id = ? AND emoji_name = ?", livestreamID, emojiName)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to delete reactions", err)
+	}
+	deleted, err := rs.RowsAffected()
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get affected rows", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+	livestreamReactionCounts.add(livestreamID, -deleted)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// EmojiLeaderboardEntry は絵文字ランキングの1行
+type EmojiLeaderboardEntry struct {
+	Rank  int64 `json:"rank"`
+	User  User  `json:"user"`
+	Count int64 `json:"count"`
+}
+
+// (配信者向け)絵文字ごとのリアクションランキング取得API
+// GET /api/livestream/:livestream_id/reactions/:emoji/leaderboard?limit=...
+// 指定した絵文字を多く送ったユーザ順に上位limit件(省略時はdefaultRankingLimit件)を返す
+func getEmojiLeaderboardHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	emojiName := normalizeEmojiName(c.Param("emoji"))
+	if !emojiNamePattern.MatchString(emojiName) {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "emoji must be emoji shortcode", nil)
+	}
+
+	limit, err := parseLimitQuery(c)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		limit = defaultRankingLimit
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, c, tx, livestreamID, userID); err != nil {
+		return err
+	}
+
+	// 同数の場合はuser_idの昇順にして順位を安定させる
+	var counts []struct {
+		UserID int64 `db:"user_id"`
+		Count  int64 `db:"cnt"`
+	}
+	if err := tx.SelectContext(ctx, &counts, "SELECT user_id, COUNT(*) AS cnt FROM reactions WHERE livestream_id = ? AND emoji_name = ? GROUP BY user_id ORDER BY cnt DESC, user_id ASC LIMIT ?", livestreamID, emojiName, limit); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to count reactions", err)
+	}
+
+	userIDs := make([]int64, 0, len(counts))
+	for _, cnt := range counts {
+		userIDs = append(userIDs, cnt.UserID)
+	}
+	users, err := getUsersByIDs(ctx, tx, userIDs)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill users", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	leaderboard := make([]EmojiLeaderboardEntry, 0, len(counts))
+	for _, cnt := range counts {
+		user, ok := users[cnt.UserID]
+		if !ok {
+			// 削除されたユーザのリアクションは順位に含めない
+			continue
+		}
+		leaderboard = append(leaderboard, EmojiLeaderboardEntry{
+			Rank:  int64(len(leaderboard) + 1),
+			User:  user,
+			Count: cnt.Count,
+		})
+	}
+
+	return c.JSON(http.StatusOK, leaderboard)
+}
+
+// ReactionExportRecord はリアクションエクスポートの1行
+type ReactionExportRecord struct {
+	ID           int64  `json:"id"`
+	EmojiName    string `json:"emoji_name"`
+	UserID       int64  `json:"user_id"`
+	LivestreamID int64  `json:"livestream_id"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// エクスポート時に何行ごとにクライアントへフラッシュするか
+const reactionExportFlushRows = 1000
+
+// (配信者向け)リアクションエクスポートAPI
+// GET /api/livestream/:livestream_id/reactions/export
+// 数万件になりうるので、全件をメモリに載せずに1行ずつNDJSONで書き出す
+func exportReactionsHandler(c echo.Context) error {
+	// 件数によってはdbTxTimeoutに収まらないので、リクエストのコンテキストをそのまま使う
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, c, tx, livestreamID, userID); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryxContext(ctx, "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY id ASC", livestreamID)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reactions", err)
+	}
+	defer rows.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.WriteHeader(http.StatusOK)
+
+	// ヘッダを書き込んだ後はステータスを変えられないので、途中のエラーはログに残して打ち切る
+	enc := json.NewEncoder(res)
+	written := 0
+	for rows.Next() {
+		var reactionModel ReactionModel
+		if err := rows.StructScan(&reactionModel); err != nil {
+			c.Logger().Errorf("failed to scan reaction while exporting: %+v", err)
+			return nil
+		}
+		if err := enc.Encode(ReactionExportRecord{
+			ID:           reactionModel.ID,
+			EmojiName:    reactionModel.EmojiName,
+			UserID:       reactionModel.UserID,
+			LivestreamID: reactionModel.LivestreamID,
+			CreatedAt:    reactionModel.CreatedAt,
+		}); err != nil {
+			c.Logger().Errorf("failed to write exported reaction: %+v", err)
+			return nil
+		}
+		written++
+		if written%reactionExportFlushRows == 0 {
+			res.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.Logger().Errorf("failed to iterate reactions while exporting: %+v", err)
+		return nil
+	}
+	res.Flush()
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("failed to commit after exporting reactions: %+v", err)
+	}
+	return nil
+}
+
+// (配信者向け)リアクションCSVエクスポートAPI
+// GET /api/livestream/:livestream_id/reactions.csv
+// 表計算ソフトで開けるよう、exportReactionsHandler と同じく1行ずつCSVで書き出す
+func exportReactionsCSVHandler(c echo.Context) error {
+	// 件数によってはdbTxTimeoutに収まらないので、リクエストのコンテキストをそのまま使う
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := parseID(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+		return err
 	}
 
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	if err := verifyLivestreamOwner(ctx, c, tx, livestreamID, userID); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryxContext(ctx, "SELECT r.id, r.emoji_name, r.user_id, IFNULL(u.name, '') AS user_name, r.created_at FROM reactions r LEFT JOIN users u ON u.id = r.user_id WHERE r.livestream_id = ? ORDER BY r.id ASC", livestreamID)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reactions", err)
+	}
+	defer rows.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"livestream-%d-reactions.csv\"", livestreamID))
+	res.WriteHeader(http.StatusOK)
+
+	// ヘッダを書き込んだ後はステータスを変えられないので、途中のエラーはログに残して打ち切る
+	w := csv.NewWriter(res)
+	if err := w.Write([]string{"id", "emoji_name", "user_id", "user_name", "created_at"}); err != nil {
+		c.Logger().Errorf("failed to write csv header: %+v", err)
+		return nil
+	}
+	written := 0
+	for rows.Next() {
+		var record struct {
+			ID        int64  `db:"id"`
+			EmojiName string `db:"emoji_name"`
+			UserID    int64  `db:"user_id"`
+			UserName  string `db:"user_name"`
+			CreatedAt int64  `db:"created_at"`
+		}
+		if err := rows.StructScan(&record); err != nil {
+			c.Logger().Errorf("failed to scan reaction while exporting csv: %+v", err)
+			return nil
+		}
+		if err := w.Write([]string{
+			strconv.FormatInt(record.ID, 10),
+			record.EmojiName,
+			strconv.FormatInt(record.UserID, 10),
+			record.UserName,
+			time.Unix(record.CreatedAt, 0).UTC().Format(time.RFC3339),
+		}); err != nil {
+			c.Logger().Errorf("failed to write exported reaction csv: %+v", err)
+			return nil
+		}
+		written++
+		if written%reactionExportFlushRows == 0 {
+			w.Flush()
+			res.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.Logger().Errorf("failed to iterate reactions while exporting csv: %+v", err)
+		return nil
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		c.Logger().Errorf("failed to flush exported reaction csv: %+v", err)
+		return nil
+	}
+	res.Flush()
+
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		c.Logger().Errorf("failed to commit after exporting reactions csv: %+v", err)
 	}
+	return nil
+}
 
-	return c.JSON(http.StatusCreated, reaction)
+// verifyLivestreamOwner は配信が存在し、userIDのユーザが配信者であることを確認する
+func verifyLivestreamOwner(ctx context.Context, c echo.Context, tx *sqlx.Tx, livestreamID int64, userID int64) error {
+	var ownerID int64
+	if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ? AND deleted_at IS NULL", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return httpError(c, http.StatusNotFound, errCodeNotFound, "livestream not found", nil)
+		}
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestream", err)
+	}
+	if ownerID != userID {
+		return httpError(c, http.StatusForbidden, errCodeForbidden, "can't operate on other streamer's livestream", nil)
+	}
+	return nil
 }
 
 func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
@@ -150,7 +1026,8 @@ func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel Reacti
 	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", reactionModel.LivestreamID); err != nil {
 		return Reaction{}, err
 	}
-	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	// 人気の配信へのリアクションでは同じ配信を繰り返し組み立てるので、キャッシュを使う
+	livestream, err := fillLivestreamResponseCached(ctx, tx, livestreamModel)
 	if err != nil {
 		return Reaction{}, err
 	}
@@ -168,36 +1045,21 @@ func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel Reacti
 
 func fillReactionResponseBulk(ctx context.Context, tx *sqlx.Tx, reactionModels []ReactionModel) ([]Reaction, error) {
 	// 一応何も無いとき対応
+	// 呼び出し側がそのままJSONにするので、nullではなく[]になるよう空のスライスを返す
 	if len(reactionModels) == 0 {
-		return nil, nil
+		return []Reaction{}, nil
 	}
 
-	// 1. UserIDとLivestreamIDを収集
-	userIDs := make([]int64, 0, len(reactionModels))
+	// 1. LivestreamIDを重複なしで収集
 	livestreamIDs := make([]int64, 0, len(reactionModels))
 	for _, reaction := range reactionModels {
-		userIDs = append(userIDs, reaction.UserID)
 		livestreamIDs = append(livestreamIDs, reaction.LivestreamID)
 	}
+	livestreamIDs = uniqueIDs(livestreamIDs)
 
-	// 2. ユーザー情報をバルク取得
-	var userModels []UserModel
-	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
-	if err != nil {
-		return nil, fmt.Errorf("failed to build user query: %w", err)
-	}
-	query = tx.Rebind(query)
-	if err := tx.SelectContext(ctx, &userModels, query, args...); err != nil {
-		return nil, fmt.Errorf("failed to fetch users: %w", err)
-	}
-	userMap, err := fillUserResponseBulk(ctx, tx, userModels)
-	if err != nil {
-		return nil, fmt.Errorf("failed to process user responses: %w", err)
-	}
-
-	// 3. ライブストリーム情報をバルク取得
+	// 2. ライブストリーム情報をバルク取得
 	var livestreamModels []LivestreamModel
-	query, args, err = sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build livestream query: %w", err)
 	}
@@ -205,7 +1067,22 @@ func fillReactionResponseBulk(ctx context.Context, tx *sqlx.Tx, reactionModels [
 	if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
 		return nil, fmt.Errorf("failed to fetch livestreams: %w", err)
 	}
-	livestreamMap, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+
+	// 3. リアクションしたユーザーと配信者をまとめて重複なしで取得する (キャッシュにあるものはDBを引かない)
+	// 配信者が自分の配信にリアクションしている場合もあるので、別々に取得しない
+	userIDs := make([]int64, 0, len(reactionModels)+len(livestreamModels))
+	for _, reaction := range reactionModels {
+		userIDs = append(userIDs, reaction.UserID)
+	}
+	for _, livestream := range livestreamModels {
+		userIDs = append(userIDs, livestream.UserID)
+	}
+	userMap, err := getUsersByIDs(ctx, tx, uniqueIDs(userIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to process user responses: %w", err)
+	}
+
+	livestreamMap, err := fillLivestreamResponseBulkWithOwners(ctx, tx, livestreamModels, userMap)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process livestream responses: %w", err)
 	}
@@ -222,6 +1099,10 @@ func fillReactionResponseBulk(ctx context.Context, tx *sqlx.Tx, reactionModels [
 		// Livestream情報を取得
 		livestream, ok := livestreamMap[reactionModel.LivestreamID]
 		if !ok {
+			if skipLivestreamsWithMissingOwner {
+				// 配信者が見つからず読み飛ばされた配信へのリアクションも、一覧全体を失敗させずに読み飛ばす
+				continue
+			}
 			return nil, fmt.Errorf("livestream not found for ID %d", reactionModel.LivestreamID)
 		}
 
@@ -237,3 +1118,18 @@ func fillReactionResponseBulk(ctx context.Context, tx *sqlx.Tx, reactionModels [
 
 	return reactions, nil
 }
+
+// uniqueIDs は出現順を保ったまま重複を取り除いたIDのスライスを返す
+// IN句のクエリ長とバインド数を減らすために使う
+func uniqueIDs(ids []int64) []int64 {
+	seen := make(map[int64]struct{}, len(ids))
+	unique := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		unique = append(unique, id)
+	}
+	return unique
+}
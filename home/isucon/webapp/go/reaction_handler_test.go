@@ -0,0 +1,1169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// postTestReaction はリアクション投稿APIを呼ぶ
+func postTestReaction(t *testing.T, userID, livestreamID int64, emojiName string) *httptest.ResponseRecorder {
+	t.Helper()
+	return doRequest(t, http.MethodPost, "/api/livestream/"+itoa(livestreamID)+"/reaction", PostReactionRequest{EmojiName: emojiName}, userID)
+}
+
+func TestNGWordMatcher(t *testing.T) {
+	m := newNGWordMatcher([]*NGWord{{Word: "bad"}, {Word: "a.b"}, {Word: ""}})
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{text: "bad", want: true},
+		{text: "very_bad_word", want: true},
+		{text: "a.b", want: true},
+		// NGワードは正規表現ではなく文字列として扱う
+		{text: "axb", want: false},
+		{text: "good", want: false},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.text); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+	if newNGWordMatcher(nil).Match("anything") {
+		t.Error("matcher without NG words must not match")
+	}
+}
+
+func TestPostReactionRejectsNGWord(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	mustExec(t, "INSERT INTO ng_words (user_id, livestream_id, word, created_at) VALUES (?, ?, ?, ?)", streamerID, livestreamID, "spam", testTermStart)
+	warmTestCaches(t)
+
+	assertErrorCode(t, postTestReaction(t, viewerID, livestreamID, "spam_bot"), http.StatusBadRequest, errCodeBadRequest)
+
+	var reaction Reaction
+	decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "tada"), http.StatusCreated, &reaction)
+	if reaction.EmojiName != "tada" {
+		t.Errorf("emoji_name = %q, want %q", reaction.EmojiName, "tada")
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE livestream_id = ?", livestreamID); n != 1 {
+		t.Errorf("reactions = %d, want 1", n)
+	}
+}
+
+func TestGetReaction(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	otherID := insertTestLivestream(t, streamerID, "other", testTermStart, testTermStart+3600)
+	reactionID := insertTestReaction(t, viewerID, livestreamID, "tada", testTermStart)
+	warmTestCaches(t)
+
+	var reaction Reaction
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/reactions/"+itoa(reactionID), nil, viewerID), http.StatusOK, &reaction)
+	if reaction.ID != reactionID || reaction.EmojiName != "tada" || reaction.User.ID != viewerID || reaction.Livestream.ID != livestreamID {
+		t.Errorf("reaction = %+v, want id %d by user %d on livestream %d", reaction, reactionID, viewerID, livestreamID)
+	}
+
+	// 別の配信のリアクションとしては取得できない
+	rec := doRequest(t, http.MethodGet, "/api/livestream/"+itoa(otherID)+"/reactions/"+itoa(reactionID), nil, viewerID)
+	assertErrorCode(t, rec, http.StatusNotFound, errCodeNotFound)
+	rec = doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/reactions/"+itoa(reactionID+100), nil, viewerID)
+	assertErrorCode(t, rec, http.StatusNotFound, errCodeNotFound)
+
+	// セッションが無ければ verifyUserSession が弾く
+	rec = doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/reactions/"+itoa(reactionID), nil, 0)
+	decodeResponse(t, rec, http.StatusForbidden, nil)
+}
+
+func TestFillReactionResponseBulkDeduplicatesIDs(t *testing.T) {
+	setupTestDB(t)
+	// キャッシュに載っているユーザはDBを引かないので、クエリの引数を数えるために無効にする
+	setTestVar(t, &userCacheEnabled, false)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	const viewers = 20
+	viewerIDs := make([]int64, 0, viewers)
+	for i := 0; i < viewers; i++ {
+		viewerIDs = append(viewerIDs, insertTestUser(t, fmt.Sprintf("viewer%d", i)))
+	}
+	var reactionModels []ReactionModel
+	for i := 0; i < 200; i++ {
+		reactionModels = append(reactionModels, ReactionModel{
+			ID:           int64(i + 1),
+			EmojiName:    "tada",
+			UserID:       viewerIDs[i%viewers],
+			LivestreamID: livestreamID,
+			CreatedAt:    testTermStart,
+		})
+	}
+	// 配信者自身のリアクションも含める (配信者と同じユーザを2度引かない)
+	reactionModels = append(reactionModels, ReactionModel{ID: 201, EmojiName: "tada", UserID: streamerID, LivestreamID: livestreamID, CreatedAt: testTermStart})
+
+	recorder := recordQueries(t)
+	tx, err := dbConn.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	reactions, err := fillReactionResponseBulk(context.Background(), tx, reactionModels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reactions) != len(reactionModels) {
+		t.Fatalf("filled %d reactions, want %d", len(reactions), len(reactionModels))
+	}
+
+	livestreamQueries := recorder.matching("FROM livestreams WHERE id IN")
+	if len(livestreamQueries) != 1 || len(livestreamQueries[0].Args) != 1 {
+		t.Errorf("livestream queries = %+v, want one query with 1 arg", livestreamQueries)
+	}
+	userQueries := recorder.matching("FROM users WHERE id IN")
+	if len(userQueries) != 1 || len(userQueries[0].Args) != viewers+1 {
+		t.Errorf("user queries = %+v, want one query with %d args", userQueries, viewers+1)
+	}
+}
+
+func TestGetReactionsFiltersByEmoji(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	var tadaIDs []int64
+	for i := 0; i < 6; i++ {
+		emoji := "heart"
+		if i%2 == 0 {
+			emoji = "tada"
+		}
+		id := insertTestReaction(t, streamerID, livestreamID, emoji, testTermStart+int64(i))
+		if emoji == "tada" {
+			tadaIDs = append([]int64{id}, tadaIDs...)
+		}
+	}
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reaction"
+
+	for _, query := range []string{"?emoji=tada", "?emoji=:tada:"} {
+		var reactions []Reaction
+		decodeResponse(t, doRequest(t, http.MethodGet, path+query, nil, streamerID), http.StatusOK, &reactions)
+		var got []int64
+		for _, r := range reactions {
+			if r.EmojiName != "tada" {
+				t.Errorf("%s returned emoji %q", query, r.EmojiName)
+			}
+			got = append(got, r.ID)
+		}
+		if !equalIDs(got, tadaIDs) {
+			t.Errorf("%s = %v, want %v", query, got, tadaIDs)
+		}
+	}
+
+	// limit は絞り込んだ後の件数に掛かる
+	var limited []Reaction
+	decodeResponse(t, doRequest(t, http.MethodGet, path+"?emoji=tada&limit=2", nil, streamerID), http.StatusOK, &limited)
+	if len(limited) != 2 || limited[0].ID != tadaIDs[0] || limited[1].ID != tadaIDs[1] {
+		t.Errorf("emoji=tada&limit=2 = %+v, want the newest 2 of %v", limited, tadaIDs)
+	}
+
+	var none []Reaction
+	decodeResponse(t, doRequest(t, http.MethodGet, path+"?emoji=smile", nil, streamerID), http.StatusOK, &none)
+	if len(none) != 0 {
+		t.Errorf("emoji=smile = %+v, want empty", none)
+	}
+
+	for _, emoji := range []string{"a%20b", "%27%20OR%201=1", strings.Repeat("a", 65)} {
+		assertErrorCode(t, doRequest(t, http.MethodGet, path+"?emoji="+emoji, nil, streamerID), http.StatusBadRequest, errCodeBadRequest)
+	}
+}
+
+func TestDeleteReaction(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	otherLivestreamID := insertTestLivestream(t, viewerID, "other", testTermStart, testTermStart+3600)
+	reactionID := insertTestReaction(t, viewerID, livestreamID, "tada", testTermStart)
+	keptID := insertTestReaction(t, viewerID, livestreamID, "tada", testTermStart+1)
+	warmTestCaches(t)
+	path := func(lsID, id int64) string {
+		return "/api/livestream/" + itoa(lsID) + "/reactions/" + itoa(id)
+	}
+
+	// 配信者以外は削除できない
+	assertErrorCode(t, doRequest(t, http.MethodDelete, path(livestreamID, reactionID), nil, viewerID), http.StatusForbidden, errCodeForbidden)
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE id = ?", reactionID); n != 1 {
+		t.Fatalf("reaction rows after non-owner delete = %d, want 1", n)
+	}
+
+	rec := doRequest(t, http.MethodDelete, path(livestreamID, reactionID), nil, streamerID)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("owner delete status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE id = ?", reactionID); n != 0 {
+		t.Errorf("reaction rows after owner delete = %d, want 0", n)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE id = ?", keptID); n != 1 {
+		t.Errorf("other reaction rows = %d, want 1", n)
+	}
+
+	// 削除済み・存在しない・別の配信のリアクションは404
+	for _, tt := range []struct {
+		userID int64
+		target string
+	}{
+		{userID: streamerID, target: path(livestreamID, reactionID)},
+		{userID: streamerID, target: path(livestreamID, 999999)},
+		{userID: viewerID, target: path(otherLivestreamID, keptID)},
+	} {
+		assertErrorCode(t, doRequest(t, http.MethodDelete, tt.target, nil, tt.userID), http.StatusNotFound, errCodeNotFound)
+	}
+}
+
+func TestDeleteReactionsByEmoji(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	for i := 0; i < 3; i++ {
+		insertTestReaction(t, viewerID, livestreamID, "tada", testTermStart+int64(i))
+	}
+	insertTestReaction(t, viewerID, livestreamID, "heart", testTermStart)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reactions?emoji=tada"
+
+	assertErrorCode(t, doRequest(t, http.MethodDelete, path, nil, viewerID), http.StatusForbidden, errCodeForbidden)
+	rec := doRequest(t, http.MethodDelete, path, nil, streamerID)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("owner delete status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE emoji_name = 'tada'"); n != 0 {
+		t.Errorf("tada reactions after delete = %d, want 0", n)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE emoji_name = 'heart'"); n != 1 {
+		t.Errorf("heart reactions after delete = %d, want 1", n)
+	}
+}
+
+func TestGetMyReactions(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	first := insertTestLivestream(t, streamerID, "first", testTermStart, testTermStart+3600)
+	second := insertTestLivestream(t, streamerID, "second", testTermStart+3600, testTermStart+2*3600)
+	others := insertTestLivestream(t, viewerID, "others", testTermStart, testTermStart+3600)
+	// 2つの配信に交互にリアクションする
+	var newest []int64
+	for i := 0; i < 4; i++ {
+		livestreamID := first
+		if i%2 == 1 {
+			livestreamID = second
+		}
+		newest = append([]int64{insertTestReaction(t, viewerID, livestreamID, "tada", testTermStart+int64(i))}, newest...)
+	}
+	insertTestReaction(t, streamerID, others, "tada", testTermStart+10)
+	warmTestCaches(t)
+
+	getMyReactions := func(userID int64, query string) []int64 {
+		t.Helper()
+		var reactions []Reaction
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/user/me/reactions"+query, nil, userID), http.StatusOK, &reactions)
+		ids := make([]int64, 0, len(reactions))
+		for _, r := range reactions {
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+	if got := getMyReactions(streamerID, ""); !equalIDs(got, newest) {
+		t.Errorf("my reactions = %v, want %v", got, newest)
+	}
+	if got := getMyReactions(streamerID, "?limit=2&offset=2"); !equalIDs(got, newest[2:]) {
+		t.Errorf("second page = %v, want %v", got, newest[2:])
+	}
+	// 配信の無いユーザは空配列
+	nobodyID := insertTestUser(t, "nobody")
+	if got := getMyReactions(nobodyID, ""); len(got) != 0 {
+		t.Errorf("reactions of a user without livestreams = %v, want empty", got)
+	}
+	if rec := doRequest(t, http.MethodGet, "/api/user/me/reactions", nil, 0); rec.Code != http.StatusForbidden {
+		t.Errorf("status without session = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestGetMyReactionsDefaultLimitAndTiebreak(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &defaultReactionsLimit, 3)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	// 全て同じ時刻のリアクションでも、id の降順でページ間の順序が確定すること
+	var newest []int64
+	for i := 0; i < 5; i++ {
+		newest = append([]int64{insertTestReaction(t, viewerID, livestreamID, "tada", testTermStart)}, newest...)
+	}
+	warmTestCaches(t)
+
+	getMyReactions := func(query string) []int64 {
+		t.Helper()
+		var reactions []Reaction
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/user/me/reactions"+query, nil, streamerID), http.StatusOK, &reactions)
+		ids := make([]int64, 0, len(reactions))
+		for _, r := range reactions {
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+	// limit省略時はデフォルトの件数で打ち切る
+	if got := getMyReactions(""); !equalIDs(got, newest[:3]) {
+		t.Errorf("my reactions without limit = %v, want %v", got, newest[:3])
+	}
+	if got := getMyReactions("?offset=3"); !equalIDs(got, newest[3:]) {
+		t.Errorf("second page = %v, want %v", got, newest[3:])
+	}
+	if got := getMyReactions("?limit=5&order=oldest"); !equalIDs(got, []int64{newest[4], newest[3], newest[2], newest[1], newest[0]}) {
+		t.Errorf("oldest first = %v, want ids ascending", got)
+	}
+}
+
+func TestPostReactionUniqueMode(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reaction"
+
+	var first, second Reaction
+	decodeResponse(t, doRequest(t, http.MethodPost, path, PostReactionRequest{EmojiName: "tada", Unique: true}, viewerID), http.StatusCreated, &first)
+	// 2回目は新しい行を作らず、同じリアクションを更新する
+	decodeResponse(t, doRequest(t, http.MethodPost, path, PostReactionRequest{EmojiName: "heart", Unique: true}, viewerID), http.StatusOK, &second)
+	if second.ID != first.ID || second.EmojiName != "heart" {
+		t.Errorf("second unique reaction = %+v, want id %d with emoji heart", second, first.ID)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE user_id = ? AND livestream_id = ?", viewerID, livestreamID); n != 1 {
+		t.Errorf("reactions in unique mode = %d, want 1", n)
+	}
+	var emoji string
+	if err := dbConn.Get(&emoji, "SELECT emoji_name FROM reactions WHERE id = ?", first.ID); err != nil || emoji != "heart" {
+		t.Errorf("stored emoji = %q, %v; want heart", emoji, err)
+	}
+	if stats := getTestLivestreamStatistics(t, streamerID, livestreamID); stats.TotalReactions != 1 {
+		t.Errorf("total_reactions = %d, want 1", stats.TotalReactions)
+	}
+
+	// 通常モードは追記する
+	for i := 0; i < 2; i++ {
+		decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "tada"), http.StatusCreated, nil)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE user_id = ? AND livestream_id = ?", viewerID, livestreamID); n != 3 {
+		t.Errorf("reactions after normal posts = %d, want 3", n)
+	}
+}
+
+func TestPostReactionUniqueModeLocking(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reaction"
+
+	// 存在しないかもしれない行への FOR UPDATE (ギャップロック) の代わりに、ユーザの行をロックして READ COMMITTED で探す
+	recorder := recordQueries(t)
+	decodeResponse(t, doRequest(t, http.MethodPost, path, PostReactionRequest{EmojiName: "tada", Unique: true}, viewerID), http.StatusCreated, nil)
+	if txs := recorder.transactions(); len(txs) != 1 || txs[0].Isolation != driver.IsolationLevel(sql.LevelReadCommitted) || txs[0].ReadOnly {
+		t.Errorf("transactions = %+v, want one read-write READ COMMITTED transaction", txs)
+	}
+	if n := len(recorder.matching("SELECT id FROM users WHERE id = ? FOR UPDATE")); n != 1 {
+		t.Errorf("locked the user %d times, want 1", n)
+	}
+	for _, q := range recorder.matching("FROM reactions") {
+		if strings.Contains(q.Query, "FOR UPDATE") {
+			t.Errorf("locking read on reactions: %s", q.Query)
+		}
+	}
+
+	// 通常モードはこれまで通りのトランザクションで、ユーザの行をロックしない
+	recorder.reset()
+	decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "heart"), http.StatusCreated, nil)
+	if txs := recorder.transactions(); len(txs) != 1 || txs[0].Isolation != driver.IsolationLevel(sql.LevelDefault) {
+		t.Errorf("normal mode transactions = %+v, want the default isolation", txs)
+	}
+	if n := len(recorder.matching("FROM users WHERE id = ? FOR UPDATE")); n != 0 {
+		t.Errorf("normal mode locked the user %d times, want 0", n)
+	}
+}
+
+func TestPostReactionUniqueModeWithBuffer(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &reactionFlushInterval, time.Hour)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	startTestReactionBuffer(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reaction"
+
+	// 通常モードの投稿はバッファに溜まったまま
+	var buffered Reaction
+	decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "tada"), http.StatusCreated, &buffered)
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions"); n != 0 {
+		t.Fatalf("reactions in the db = %d, want the post still buffered", n)
+	}
+
+	// ユニークモードは先にバッファを書き込むので、溜まっていたリアクションを見つけて更新する
+	var unique Reaction
+	decodeResponse(t, doRequest(t, http.MethodPost, path, PostReactionRequest{EmojiName: "heart", Unique: true}, viewerID), http.StatusOK, &unique)
+	if unique.ID != buffered.ID {
+		t.Errorf("unique reaction id = %d, want the buffered reaction %d", unique.ID, buffered.ID)
+	}
+
+	// ユニークモードの初回の投稿はバッファせずに書き込むので、続く投稿から見える
+	otherID := insertTestUser(t, "other")
+	var first, second Reaction
+	decodeResponse(t, doRequest(t, http.MethodPost, path, PostReactionRequest{EmojiName: "tada", Unique: true}, otherID), http.StatusCreated, &first)
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE id = ?", first.ID); n != 1 {
+		t.Errorf("unique reaction %d was not written before the response", first.ID)
+	}
+	decodeResponse(t, doRequest(t, http.MethodPost, path, PostReactionRequest{EmojiName: "smile", Unique: true}, otherID), http.StatusOK, &second)
+	if second.ID != first.ID {
+		t.Errorf("second unique reaction id = %d, want %d", second.ID, first.ID)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE livestream_id = ?", livestreamID); n != 2 {
+		t.Errorf("reactions = %d, want one per user", n)
+	}
+}
+
+func TestNormalizeClientCreatedAt(t *testing.T) {
+	const now = testTermStart
+	tests := []struct {
+		name      string
+		createdAt int64
+		want      int64
+		wantErr   bool
+	}{
+		{name: "now", createdAt: now, want: now},
+		{name: "slightly past", createdAt: now - 30, want: now - 30},
+		{name: "slightly future is clamped", createdAt: now + 30, want: now},
+		{name: "edge of tolerance", createdAt: now + reactionCreatedAtToleranceSeconds, want: now},
+		{name: "far future", createdAt: now + 3600, wantErr: true},
+		{name: "far past", createdAt: now - reactionCreatedAtToleranceSeconds - 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeClientCreatedAt(tt.createdAt, now)
+		if tt.wantErr {
+			if !errors.Is(err, errReactionCreatedAtOutOfRange) {
+				t.Errorf("%s: error = %v, want %v", tt.name, err, errReactionCreatedAtOutOfRange)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: normalizeClientCreatedAt(%d) = %d, %v; want %d", tt.name, tt.createdAt, got, err, tt.want)
+		}
+	}
+}
+
+func TestPostReactionUsesServerTime(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reaction"
+
+	// 単体投稿ではクライアントがcreated_atを指定できない
+	rec := doRequest(t, http.MethodPost, path, map[string]interface{}{"emoji_name": "tada", "created_at": time.Now().Unix() + 86400}, streamerID)
+	assertErrorCode(t, rec, http.StatusBadRequest, errCodeBadRequest)
+
+	before := time.Now().Unix()
+	var reaction Reaction
+	decodeResponse(t, postTestReaction(t, streamerID, livestreamID, "tada"), http.StatusCreated, &reaction)
+	if after := time.Now().Unix(); reaction.CreatedAt < before || reaction.CreatedAt > after {
+		t.Errorf("created_at = %d, want server time in [%d, %d]", reaction.CreatedAt, before, after)
+	}
+}
+
+func TestPostReactionSelfReactions(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	// デフォルトでは配信者も自分の配信にリアクションできる
+	decodeResponse(t, postTestReaction(t, streamerID, livestreamID, "tada"), http.StatusCreated, nil)
+
+	setTestVar(t, &rejectSelfReactions, true)
+	assertErrorCode(t, postTestReaction(t, streamerID, livestreamID, "tada"), http.StatusForbidden, errCodeForbidden)
+	decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "tada"), http.StatusCreated, nil)
+
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE user_id = ?", streamerID); n != 1 {
+		t.Errorf("streamer reactions = %d, want 1", n)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reactions WHERE user_id = ?", viewerID); n != 1 {
+		t.Errorf("viewer reactions = %d, want 1", n)
+	}
+}
+
+// insertTestReactionFeed は streamers 人がそれぞれ配信を持ち、全員が全配信 (自分の配信を含む) にリアクションしたフィードを作る
+func insertTestReactionFeed(t testing.TB, streamers int) []ReactionModel {
+	t.Helper()
+	userIDs := make([]int64, 0, streamers)
+	livestreamIDs := make([]int64, 0, streamers)
+	for i := 0; i < streamers; i++ {
+		userID := insertTestUser(t, fmt.Sprintf("streamer%d", i))
+		userIDs = append(userIDs, userID)
+		livestreamIDs = append(livestreamIDs, insertTestLivestream(t, userID, "live", testTermStart, testTermStart+3600))
+	}
+	var feed []ReactionModel
+	for _, livestreamID := range livestreamIDs {
+		for _, userID := range userIDs {
+			id := insertTestReaction(t, userID, livestreamID, "tada", testTermStart)
+			feed = append(feed, ReactionModel{ID: id, EmojiName: "tada", UserID: userID, LivestreamID: livestreamID, CreatedAt: testTermStart})
+		}
+	}
+	return feed
+}
+
+func TestFillReactionResponseBulkSharesUserFetch(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &userCacheEnabled, false)
+	const streamers = 4
+	feed := insertTestReactionFeed(t, streamers)
+	warmTestCaches(t)
+
+	recorder := recordQueries(t)
+	tx, err := dbConn.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	reactions, err := fillReactionResponseBulk(context.Background(), tx, feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reactions) != len(feed) {
+		t.Fatalf("filled %d reactions, want %d", len(reactions), len(feed))
+	}
+	for _, r := range reactions {
+		if r.Livestream.Owner.ID == 0 || r.User.ID == 0 {
+			t.Fatalf("reaction %d has an empty user or owner: %+v", r.ID, r)
+		}
+	}
+
+	// リアクションしたユーザと配信者は重なっているので、ユーザは1回だけ引く
+	userQueries := recorder.matching("FROM users WHERE id IN")
+	if len(userQueries) != 1 || len(userQueries[0].Args) != streamers {
+		t.Errorf("user queries = %+v, want one query with %d args", userQueries, streamers)
+	}
+	if q := recorder.matching("FROM livestreams WHERE id IN"); len(q) != 1 || len(q[0].Args) != streamers {
+		t.Errorf("livestream queries = %+v, want one query with %d args", q, streamers)
+	}
+}
+
+func BenchmarkFillReactionResponseBulkFeed(b *testing.B) {
+	setupTestDB(b)
+	setTestVar(b, &userCacheEnabled, false)
+	feed := insertTestReactionFeed(b, 10)
+	warmTestCaches(b)
+	recorder := recordQueries(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx, err := dbConn.Beginx()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := fillReactionResponseBulk(context.Background(), tx, feed); err != nil {
+			b.Fatal(err)
+		}
+		tx.Rollback()
+	}
+	b.StopTimer()
+	// 配信数・ユーザ数によらず一定になる
+	b.ReportMetric(float64(recorder.count())/float64(b.N), "queries/op")
+}
+
+func TestGetReactionsDefaultLimit(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &defaultReactionsLimit, 3)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	var newest int64
+	for i := 0; i < maxLimit+5; i++ {
+		newest = insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart+int64(i))
+	}
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reaction"
+
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"", 3},
+		{"?limit=10", 10},
+		{"?limit=" + itoa(maxLimit+5), maxLimit},
+	} {
+		var reactions []Reaction
+		decodeResponse(t, doRequest(t, http.MethodGet, path+tt.query, nil, streamerID), http.StatusOK, &reactions)
+		if len(reactions) != tt.want {
+			t.Errorf("%q returned %d reactions, want %d", tt.query, len(reactions), tt.want)
+			continue
+		}
+		// 新しい順
+		if reactions[0].ID != newest {
+			t.Errorf("%q starts with reaction %d, want the newest %d", tt.query, reactions[0].ID, newest)
+		}
+	}
+}
+
+func TestExportReactions(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	otherID := insertTestLivestream(t, streamerID, "other", testTermStart, testTermStart+3600)
+	insertTestReaction(t, viewerID, otherID, "heart", testTermStart)
+
+	const n = 3 * reactionExportFlushRows / 2
+	args := make([]interface{}, 0, n*4)
+	for i := 0; i < n; i++ {
+		args = append(args, viewerID, livestreamID, "tada", testTermStart+int64(i))
+	}
+	mustExec(t, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES "+strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?),", n), ","), args...)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reactions/export"
+
+	rec := doRequest(t, http.MethodGet, path, nil, streamerID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	if ct := rec.Header().Get(echo.HeaderContentType); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+	scanner := bufio.NewScanner(rec.Body)
+	var (
+		lines  int
+		lastID int64
+	)
+	for scanner.Scan() {
+		var record ReactionExportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("line %d is not JSON: %v: %q", lines+1, err, scanner.Text())
+		}
+		if record.LivestreamID != livestreamID || record.UserID != viewerID || record.EmojiName != "tada" || record.CreatedAt != testTermStart+int64(lines) {
+			t.Fatalf("line %d = %+v, want reaction %d of livestream %d", lines+1, record, lines, livestreamID)
+		}
+		if record.ID <= lastID {
+			t.Fatalf("line %d has id %d after %d, want ascending ids", lines+1, record.ID, lastID)
+		}
+		lastID = record.ID
+		lines++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if lines != n {
+		t.Errorf("exported %d lines, want %d", lines, n)
+	}
+
+	assertErrorCode(t, doRequest(t, http.MethodGet, path, nil, viewerID), http.StatusForbidden, errCodeForbidden)
+	if rec := doRequest(t, http.MethodGet, path, nil, 0); rec.Code != http.StatusForbidden {
+		t.Errorf("export without session = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestGetReactionsMine(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	otherID := insertTestLivestream(t, streamerID, "other", testTermStart, testTermStart+3600)
+	var mine, mineTada []int64
+	for i, emoji := range []string{"tada", "heart", "tada", "smile", "tada"} {
+		insertTestReaction(t, streamerID, livestreamID, emoji, testTermStart+int64(i))
+		id := insertTestReaction(t, viewerID, livestreamID, emoji, testTermStart+int64(i))
+		mine = append([]int64{id}, mine...)
+		if emoji == "tada" {
+			mineTada = append([]int64{id}, mineTada...)
+		}
+	}
+	insertTestReaction(t, viewerID, otherID, "tada", testTermStart)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reaction"
+
+	for _, tt := range []struct {
+		query string
+		want  []int64
+	}{
+		{"?mine=1", mine},
+		{"?mine=1&emoji=tada", mineTada},
+		{"?mine=1&limit=2", mine[:2]},
+		{"?mine=1&emoji=tada&limit=2", mineTada[:2]},
+	} {
+		var reactions []Reaction
+		decodeResponse(t, doRequest(t, http.MethodGet, path+tt.query, nil, viewerID), http.StatusOK, &reactions)
+		var got []int64
+		for _, r := range reactions {
+			if r.User.ID != viewerID {
+				t.Errorf("%s returned a reaction by user %d", tt.query, r.User.ID)
+			}
+			got = append(got, r.ID)
+		}
+		if !equalIDs(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// mine を指定しなければ全員のリアクションを返す
+	var all []Reaction
+	decodeResponse(t, doRequest(t, http.MethodGet, path, nil, viewerID), http.StatusOK, &all)
+	if len(all) != 10 {
+		t.Errorf("without mine = %d reactions, want 10", len(all))
+	}
+	if rec := doRequest(t, http.MethodGet, path+"?mine=1", nil, 0); rec.Code != http.StatusForbidden {
+		t.Errorf("mine=1 without session = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestEmptyListsAreArrays(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	livestreamPath := "/api/livestream/" + itoa(livestreamID)
+
+	for _, target := range []string{
+		"/api/livestream/search?tag=none",
+		"/api/livestream/live",
+		"/api/livestream",
+		"/api/user/viewer/livestream",
+		livestreamPath + "/tags",
+		livestreamPath + "/reaction",
+		livestreamPath + "/reaction?emoji=tada",
+		livestreamPath + "/reaction?mine=1",
+		livestreamPath + "/reaction?since=0",
+		"/api/user/me/reactions",
+	} {
+		rec := doRequest(t, http.MethodGet, target, nil, viewerID)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s = %d, want %d: %s", target, rec.Code, http.StatusOK, rec.Body.String())
+			continue
+		}
+		if body := strings.TrimSpace(rec.Body.String()); body != "[]" {
+			t.Errorf("%s body = %s, want []", target, body)
+		}
+	}
+
+	reactions, err := fillReactionResponseBulk(context.Background(), nil, nil)
+	if err != nil || reactions == nil {
+		t.Errorf("fillReactionResponseBulk(nil) = %#v, %v, want an empty slice", reactions, err)
+	}
+}
+
+func TestNormalizeEmojiName(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"+1", "+1"},
+		{":+1:", "+1"},
+		{"thumbsup", "+1"},
+		{":thumbsup:", "+1"},
+		{"thumbsdown", "-1"},
+		{"tada", "tada"},
+		{":tada:", "tada"},
+		{"::", "::"},
+	} {
+		if got := normalizeEmojiName(tt.in); got != tt.want {
+			t.Errorf("normalizeEmojiName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoadEmojiAliases(t *testing.T) {
+	t.Setenv("ISUCON13_EMOJI_ALIASES", "party=tada, thumbsup=like")
+	aliases := loadEmojiAliases(map[string]string{"thumbsup": "+1", "thumbsdown": "-1"})
+	want := map[string]string{"party": "tada", "thumbsup": "like", "thumbsdown": "-1"}
+	if len(aliases) != len(want) {
+		t.Fatalf("aliases = %v, want %v", aliases, want)
+	}
+	for alias, canonical := range want {
+		if aliases[alias] != canonical {
+			t.Errorf("aliases[%q] = %q, want %q", alias, aliases[alias], canonical)
+		}
+	}
+}
+
+func TestPostReactionCollapsesAliases(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	for _, emoji := range []string{"+1", ":+1:", "thumbsup", ":thumbsup:"} {
+		var reaction Reaction
+		decodeResponse(t, postTestReaction(t, viewerID, livestreamID, emoji), http.StatusCreated, &reaction)
+		if reaction.EmojiName != "+1" {
+			t.Errorf("posted %q = %q, want +1", emoji, reaction.EmojiName)
+		}
+	}
+	// 別名ごとに数えると +1 は tada より少なくなる
+	for i := 0; i < 3; i++ {
+		decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "tada"), http.StatusCreated, nil)
+	}
+
+	var stored []string
+	if err := dbConn.Select(&stored, "SELECT DISTINCT emoji_name FROM reactions ORDER BY emoji_name"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(stored, ",") != "+1,tada" {
+		t.Errorf("stored emoji names = %v, want [+1 tada]", stored)
+	}
+
+	var livestreams []Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search?with_reactions=1", nil, viewerID), http.StatusOK, &livestreams)
+	if len(livestreams) != 1 || livestreams[0].ReactionSummary == nil {
+		t.Fatalf("search = %+v, want one livestream with a reaction summary", livestreams)
+	}
+	if got := *livestreams[0].ReactionSummary; got != (LivestreamReactionSummary{TopEmojiName: "+1", TopEmojiCount: 4, TotalReactions: 7}) {
+		t.Errorf("summary = %+v, want +1 x4 of 7", got)
+	}
+
+	var filtered []Reaction
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/reaction?emoji=thumbsup", nil, viewerID), http.StatusOK, &filtered)
+	if len(filtered) != 4 {
+		t.Errorf("emoji=thumbsup = %d reactions, want 4", len(filtered))
+	}
+}
+
+func TestGetReactionsEnvelope(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		ids = append([]int64{insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart)}, ids...)
+	}
+	warmTestCaches(t)
+	type reactionEnvelope struct {
+		Items      []Reaction `json:"items"`
+		NextCursor string     `json:"next_cursor"`
+		HasMore    bool       `json:"has_more"`
+	}
+	fetch := func(query string) reactionEnvelope {
+		t.Helper()
+		var page reactionEnvelope
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/reaction?envelope=1"+query, nil, streamerID), http.StatusOK, &page)
+		return page
+	}
+	pageIDs := func(page reactionEnvelope) []int64 {
+		var got []int64
+		for _, r := range page.Items {
+			got = append(got, r.ID)
+		}
+		return got
+	}
+
+	first := fetch("&limit=3")
+	if !equalIDs(pageIDs(first), ids[:3]) || !first.HasMore || first.NextCursor == "" {
+		t.Fatalf("first page = %v (has_more %v, next_cursor %q), want %v with more", pageIDs(first), first.HasMore, first.NextCursor, ids[:3])
+	}
+	last := fetch("&limit=3&cursor=" + first.NextCursor)
+	if !equalIDs(pageIDs(last), ids[3:]) || last.HasMore || last.NextCursor != "" {
+		t.Errorf("last page = %v (has_more %v, next_cursor %q), want %v and no more", pageIDs(last), last.HasMore, last.NextCursor, ids[3:])
+	}
+	if page := fetch("&limit=5"); len(page.Items) != 5 || page.HasMore {
+		t.Errorf("limit=5 = %d items (has_more %v), want 5 and no more", len(page.Items), page.HasMore)
+	}
+}
+
+func TestGetEmojiLeaderboard(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	carolID := insertTestUser(t, "carol")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	otherID := insertTestLivestream(t, streamerID, "other", testTermStart, testTermStart+3600)
+	for userID, n := range map[int64]int{aliceID: 2, bobID: 4, carolID: 2} {
+		for i := 0; i < n; i++ {
+			insertTestReaction(t, userID, livestreamID, "tada", testTermStart)
+		}
+	}
+	// 他の絵文字や他の配信のリアクションは数えない
+	for i := 0; i < 5; i++ {
+		insertTestReaction(t, carolID, livestreamID, "heart", testTermStart)
+		insertTestReaction(t, aliceID, otherID, "tada", testTermStart)
+	}
+	warmTestCaches(t)
+	leaderboard := func(query string) []EmojiLeaderboardEntry {
+		t.Helper()
+		var entries []EmojiLeaderboardEntry
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/reactions/"+query, nil, streamerID), http.StatusOK, &entries)
+		return entries
+	}
+
+	// 同数は user_id の昇順
+	want := []struct {
+		userID int64
+		count  int64
+	}{{bobID, 4}, {aliceID, 2}, {carolID, 2}}
+	for _, query := range []string{"tada/leaderboard", ":tada:/leaderboard"} {
+		entries := leaderboard(query)
+		if len(entries) != len(want) {
+			t.Fatalf("%s = %+v, want %d entries", query, entries, len(want))
+		}
+		for i, w := range want {
+			if entries[i].Rank != int64(i+1) || entries[i].User.ID != w.userID || entries[i].Count != w.count {
+				t.Errorf("%s[%d] = rank %d user %d count %d, want rank %d user %d count %d", query, i, entries[i].Rank, entries[i].User.ID, entries[i].Count, i+1, w.userID, w.count)
+			}
+		}
+	}
+	if entries := leaderboard("tada/leaderboard?limit=2"); len(entries) != 2 || entries[1].User.ID != aliceID {
+		t.Errorf("limit=2 = %+v, want bob and alice", entries)
+	}
+	if entries := leaderboard("smile/leaderboard"); len(entries) != 0 {
+		t.Errorf("unused emoji = %+v, want empty", entries)
+	}
+
+	assertErrorCode(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/reactions/a%20b/leaderboard", nil, streamerID), http.StatusBadRequest, errCodeBadRequest)
+	assertErrorCode(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/reactions/tada/leaderboard", nil, aliceID), http.StatusForbidden, errCodeForbidden)
+}
+
+func TestGetReactionsPollingSince(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reaction"
+
+	var inserted []int64
+	insert := func(createdAt ...int64) {
+		for _, at := range createdAt {
+			inserted = append(inserted, insertTestReaction(t, streamerID, livestreamID, "tada", at))
+		}
+	}
+	since, sinceID := "0", "0"
+	var seen []int64
+	poll := func() int {
+		t.Helper()
+		rec := doRequest(t, http.MethodGet, path+"?limit=2&since="+since+"&since_id="+sinceID, nil, streamerID)
+		var reactions []Reaction
+		decodeResponse(t, rec, http.StatusOK, &reactions)
+		for i, r := range reactions {
+			if i > 0 && (r.CreatedAt < reactions[i-1].CreatedAt || (r.CreatedAt == reactions[i-1].CreatedAt && r.ID < reactions[i-1].ID)) {
+				t.Errorf("poll returned %+v before %+v, want oldest first", reactions[i-1], r)
+			}
+			seen = append(seen, r.ID)
+		}
+		since, sinceID = rec.Header().Get(headerNextSince), rec.Header().Get(headerNextSinceID)
+		return len(reactions)
+	}
+	drain := func() {
+		t.Helper()
+		for i := 0; poll() > 0; i++ {
+			if i > 20 {
+				t.Fatal("polling did not catch up")
+			}
+		}
+	}
+
+	// 同じ秒のリアクションがページの境目をまたいでも、取りこぼしも重複もしない
+	insert(testTermStart, testTermStart, testTermStart, testTermStart+1)
+	drain()
+	insert(testTermStart+1, testTermStart+1, testTermStart+2)
+	if n := poll(); n != 2 {
+		t.Errorf("poll after new reactions = %d, want a full page of 2", n)
+	}
+	insert(testTermStart + 2)
+	drain()
+	if since != itoa(testTermStart+2) || sinceID != itoa(inserted[len(inserted)-1]) {
+		t.Errorf("next since = %s/%s, want %d/%d", since, sinceID, testTermStart+2, inserted[len(inserted)-1])
+	}
+	if !equalIDs(seen, inserted) {
+		t.Errorf("polled %v, want %v", seen, inserted)
+	}
+
+	// 新しいリアクションが無い間は同じ位置を返す
+	if n := poll(); n != 0 || since != itoa(testTermStart+2) {
+		t.Errorf("idle poll = %d reactions (next since %s), want none at %d", n, since, testTermStart+2)
+	}
+	// since のみなら、その秒より後のリアクションを返す
+	var newer []Reaction
+	decodeResponse(t, doRequest(t, http.MethodGet, path+"?since="+itoa(testTermStart+1), nil, streamerID), http.StatusOK, &newer)
+	if len(newer) != 2 {
+		t.Errorf("since=%d = %d reactions, want 2", testTermStart+1, len(newer))
+	}
+	for _, query := range []string{"?since_id=1", "?since=-1", "?since=abc", "?since=0&since_id=x"} {
+		assertErrorCode(t, doRequest(t, http.MethodGet, path+query, nil, streamerID), http.StatusBadRequest, errCodeBadRequest)
+	}
+}
+
+func TestExportReactionsCSV(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	// カンマや引用符を含む名前もCSVとして正しくエスケープされる
+	viewerID := insertTestUser(t, `view,"er"`)
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	otherID := insertTestLivestream(t, streamerID, "other", testTermStart, testTermStart+3600)
+	insertTestReaction(t, viewerID, otherID, "heart", testTermStart)
+
+	const n = 3 * reactionExportFlushRows / 2
+	args := make([]interface{}, 0, n*4)
+	for i := 0; i < n; i++ {
+		args = append(args, viewerID, livestreamID, "tada", testTermStart+int64(i))
+	}
+	mustExec(t, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES "+strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?),", n), ","), args...)
+	// 退会などでユーザが見つからないリアクションも user_name を空にして含める
+	goneID := insertTestReaction(t, 999999, livestreamID, "wave", testTermStart+n)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID) + "/reactions.csv"
+
+	rec := doRequest(t, http.MethodGet, path, nil, streamerID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	if ct := rec.Header().Get(echo.HeaderContentType); ct != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/csv; charset=utf-8", ct)
+	}
+	if cd := rec.Header().Get(echo.HeaderContentDisposition); !strings.HasPrefix(cd, "attachment;") {
+		t.Errorf("Content-Disposition = %q, want an attachment", cd)
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("response is not CSV: %v", err)
+	}
+	if len(records) != n+2 {
+		t.Fatalf("exported %d rows, want a header and %d reactions", len(records), n+1)
+	}
+	if got := strings.Join(records[0], ","); got != "id,emoji_name,user_id,user_name,created_at" {
+		t.Errorf("header = %q", got)
+	}
+	for i, record := range records[1 : n+1] {
+		want := []string{record[0], "tada", itoa(viewerID), `view,"er"`, time.Unix(testTermStart+int64(i), 0).UTC().Format(time.RFC3339)}
+		if strings.Join(record, "|") != strings.Join(want, "|") {
+			t.Fatalf("row %d = %q, want %q", i+1, record, want)
+		}
+	}
+	if last := records[n+1]; last[0] != itoa(goneID) || last[2] != "999999" || last[3] != "" {
+		t.Errorf("reaction of a missing user = %q, want id %d with an empty user_name", last, goneID)
+	}
+
+	assertErrorCode(t, doRequest(t, http.MethodGet, path, nil, viewerID), http.StatusForbidden, errCodeForbidden)
+	assertErrorCode(t, doRequest(t, http.MethodGet, "/api/livestream/999999/reactions.csv", nil, streamerID), http.StatusNotFound, errCodeNotFound)
+}
+
+func TestGetUserReactionHistory(t *testing.T) {
+	setupTestDB(t)
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	viewerID := insertTestUser(t, "viewer")
+	quietID := insertTestUser(t, "quiet")
+	aliceLive := insertTestLivestream(t, aliceID, "alice live", testTermStart, testTermStart+3600)
+	bobLive := insertTestLivestream(t, bobID, "bob live", testTermStart, testTermStart+3600)
+	first := insertTestReaction(t, viewerID, aliceLive, "tada", testTermStart+10)
+	second := insertTestReaction(t, viewerID, bobLive, "smile", testTermStart+20)
+	third := insertTestReaction(t, viewerID, aliceLive, "heart", testTermStart+30)
+	// 他のユーザのリアクションは含めない
+	insertTestReaction(t, bobID, aliceLive, "wave", testTermStart+40)
+	warmTestCaches(t)
+	const path = "/api/user/me/reactions/history"
+
+	var reactions []Reaction
+	decodeResponse(t, doRequest(t, http.MethodGet, path, nil, viewerID), http.StatusOK, &reactions)
+	want := []struct {
+		id    int64
+		title string
+		owner int64
+	}{
+		{third, "alice live", aliceID},
+		{second, "bob live", bobID},
+		{first, "alice live", aliceID},
+	}
+	if len(reactions) != len(want) {
+		t.Fatalf("history = %+v, want %d reactions", reactions, len(want))
+	}
+	for i, w := range want {
+		r := reactions[i]
+		if r.ID != w.id || r.User.ID != viewerID || r.Livestream.Title != w.title || r.Livestream.Owner.ID != w.owner {
+			t.Errorf("history[%d] = reaction %d by %d on %q (owner %d), want reaction %d on %q (owner %d)",
+				i, r.ID, r.User.ID, r.Livestream.Title, r.Livestream.Owner.ID, w.id, w.title, w.owner)
+		}
+	}
+
+	var page struct {
+		Items   []Reaction `json:"items"`
+		HasMore bool       `json:"has_more"`
+	}
+	decodeResponse(t, doRequest(t, http.MethodGet, path+"?limit=2&envelope=1", nil, viewerID), http.StatusOK, &page)
+	if ids := reactionIDs(page.Items); !equalIDs(ids, []int64{third, second}) || !page.HasMore {
+		t.Errorf("first page = %v (has_more %v), want [%d %d] with more", ids, page.HasMore, third, second)
+	}
+	decodeResponse(t, doRequest(t, http.MethodGet, path+"?limit=2&offset=2&envelope=1", nil, viewerID), http.StatusOK, &page)
+	if ids := reactionIDs(page.Items); !equalIDs(ids, []int64{first}) || page.HasMore {
+		t.Errorf("second page = %v (has_more %v), want [%d] and no more", ids, page.HasMore, first)
+	}
+
+	// リアクションしていないユーザには空の配列を返す
+	rec := doRequest(t, http.MethodGet, path, nil, quietID)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("history without reactions = %d %s, want 200 []", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, http.MethodGet, path, nil, 0); rec.Code != http.StatusForbidden {
+		t.Errorf("history without session = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestGetUserReactionHistoryBreaksTiesByID(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	// 同じ秒に送ったリアクションは新しいIDから順に返し、ページをまたいでも重複・欠落しない
+	var newest []int64
+	for i := 0; i < 4; i++ {
+		newest = append([]int64{insertTestReaction(t, viewerID, livestreamID, "tada", testTermStart)}, newest...)
+	}
+	warmTestCaches(t)
+	const path = "/api/user/me/reactions/history"
+
+	recorder := recordQueries(t)
+	var got []int64
+	for _, query := range []string{"?limit=3&envelope=1", "?limit=3&offset=3&envelope=1"} {
+		var page struct {
+			Items []Reaction `json:"items"`
+		}
+		decodeResponse(t, doRequest(t, http.MethodGet, path+query, nil, viewerID), http.StatusOK, &page)
+		got = append(got, reactionIDs(page.Items)...)
+	}
+	if !equalIDs(got, newest) {
+		t.Errorf("history pages = %v, want %v", got, newest)
+	}
+	if q := recorder.matching("ORDER BY created_at DESC, id DESC"); len(q) != 2 {
+		t.Errorf("history queries ordered by created_at and id = %d, want 2", len(q))
+	}
+}
+
+func reactionIDs(reactions []Reaction) []int64 {
+	ids := make([]int64, 0, len(reactions))
+	for _, r := range reactions {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
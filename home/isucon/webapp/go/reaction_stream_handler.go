@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SSEの接続を保つためにコメント行を送る間隔
+// プロキシが無通信の接続を切らないよう、一般的なタイムアウト(60秒)より短くする
+var reactionStreamHeartbeatInterval = getEnvDuration("ISUCON13_REACTION_STREAM_HEARTBEAT_INTERVAL", 15*time.Second)
+
+// 購読者ごとに溜めておけるリアクションの数
+// 受信が追いつかない購読者へのリアクションは捨てるので、取りこぼした分はリアクション一覧APIの since で取り直す
+const reactionStreamBufferSize = 64
+
+// reactionHub は投稿されたリアクションを、同じプロセス内で配信ごとの購読者に配る
+type reactionHub struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[chan Reaction]struct{}
+	closed      bool
+}
+
+var reactionStreamHub = &reactionHub{subscribers: map[int64]map[chan Reaction]struct{}{}}
+
+// subscribe は livestreamID へのリアクションを受け取るチャネルと、購読をやめる関数を返す
+// チャネルはハブが閉じられると閉じる。閉じた後に購読しようとした場合は false を返す
+func (h *reactionHub) subscribe(livestreamID int64) (<-chan Reaction, func(), bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, nil, false
+	}
+	ch := make(chan Reaction, reactionStreamBufferSize)
+	if h.subscribers[livestreamID] == nil {
+		h.subscribers[livestreamID] = map[chan Reaction]struct{}{}
+	}
+	h.subscribers[livestreamID][ch] = struct{}{}
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		subs, ok := h.subscribers[livestreamID]
+		if !ok {
+			return
+		}
+		if _, ok := subs[ch]; !ok {
+			// close で閉じ済み
+			return
+		}
+		delete(subs, ch)
+		close(ch)
+		if len(subs) == 0 {
+			delete(h.subscribers, livestreamID)
+		}
+	}
+	return ch, unsubscribe, true
+}
+
+// publish はリアクションを配信の購読者に配る。受信が追いついていない購読者には送らない
+func (h *reactionHub) publish(reaction Reaction) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[reaction.Livestream.ID] {
+		select {
+		case ch <- reaction:
+		default:
+		}
+	}
+}
+
+// close はすべての購読を終わらせる
+// SSEの接続はサーバのShutdownでは切れないので、Shutdownの前に呼ぶ
+func (h *reactionHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, subs := range h.subscribers {
+		for ch := range subs {
+			close(ch)
+		}
+	}
+	h.subscribers = map[int64]map[chan Reaction]struct{}{}
+}
+
+// リアクション購読API
+// GET /api/livestream/:livestream_id/reactions/sse
+// 接続を保ったまま、投稿されたリアクションを Server-Sent Events で送る (WebSocketを使えないクライアント向け)
+// 各イベントの id はリアクションID、data はリアクション投稿APIのレスポンスと同じJSON
+func streamReactionsHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	// 接続を保っている間はトランザクションを持たないよう、存在確認だけ先に済ませる
+	if err := func() error {
+		ctx, cancel := txContext(c)
+		defer cancel()
+		var id int64
+		if err := dbConn.GetContext(ctx, &id, "SELECT id FROM livestreams WHERE id = ? AND deleted_at IS NULL", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return httpError(c, http.StatusNotFound, errCodeNotFound, "livestream not found", nil)
+			}
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get livestream", err)
+		}
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	reactions, unsubscribe, ok := reactionStreamHub.subscribe(livestreamID)
+	if !ok {
+		return httpError(c, http.StatusServiceUnavailable, errCodeInternal, "server is shutting down", nil)
+	}
+	defer unsubscribe()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	// nginxにバッファさせず、イベントをすぐに送る
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	heartbeat := time.NewTicker(reactionStreamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	// ヘッダを書き込んだ後はステータスを変えられないので、書き込みに失敗したら(切断されたら)打ち切る
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case reaction, ok := <-reactions:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(reaction)
+			if err != nil {
+				c.Logger().Errorf("failed to encode streamed reaction: %+v", err)
+				return nil
+			}
+			if _, err := fmt.Fprintf(res, "id: %d\ndata: %s\n\n", reaction.ID, data); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
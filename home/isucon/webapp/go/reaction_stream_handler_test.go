@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestReactionStream は実際のHTTPサーバ越しにリアクションを購読し、読み取り用のReaderを返す
+// 返した関数を呼ぶか、テストが終わると接続を切る
+func openTestReactionStream(t *testing.T, userID, livestreamID int64) (*http.Response, *bufio.Reader, context.CancelFunc) {
+	t.Helper()
+	server := httptest.NewServer(testEcho)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/livestream/"+itoa(livestreamID)+"/reactions/sse", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 0 {
+		req.AddCookie(sessionCookie(t, userID))
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		res.Body.Close()
+		server.Close()
+	})
+	return res, bufio.NewReader(res.Body), cancel
+}
+
+// readTestSSEEvent は空行までの1イベント分の行を読む。timeout までに読めなければテストを失敗させる
+func readTestSSEEvent(t *testing.T, r *bufio.Reader, timeout time.Duration) []string {
+	t.Helper()
+	lines := make(chan []string, 1)
+	go func() {
+		var event []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				lines <- event
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				lines <- event
+				return
+			}
+			event = append(event, line)
+		}
+	}()
+	select {
+	case event := <-lines:
+		return event
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for an SSE event")
+		return nil
+	}
+}
+
+// testSubscriberCount は配信の購読者の数を返す
+func testSubscriberCount(livestreamID int64) int {
+	reactionStreamHub.mu.Lock()
+	defer reactionStreamHub.mu.Unlock()
+	return len(reactionStreamHub.subscribers[livestreamID])
+}
+
+func TestStreamReactions(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &reactionStreamHeartbeatInterval, time.Hour)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	otherID := insertTestLivestream(t, streamerID, "other", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	res, r, _ := openTestReactionStream(t, viewerID, livestreamID)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	// 他の配信へのリアクションは届かず、購読中の配信へのリアクションだけが届く
+	decodeResponse(t, postTestReaction(t, viewerID, otherID, "smile"), http.StatusCreated, nil)
+	var posted Reaction
+	decodeResponse(t, postTestReaction(t, viewerID, livestreamID, "tada"), http.StatusCreated, &posted)
+
+	event := readTestSSEEvent(t, r, 5*time.Second)
+	if len(event) != 2 || event[0] != "id: "+itoa(posted.ID) || !strings.HasPrefix(event[1], "data: ") {
+		t.Fatalf("event = %q, want the id and data of reaction %d", event, posted.ID)
+	}
+	var streamed Reaction
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(event[1], "data: ")), &streamed); err != nil {
+		t.Fatal(err)
+	}
+	if streamed.ID != posted.ID || streamed.EmojiName != "tada" || streamed.Livestream.ID != livestreamID || streamed.User.ID != viewerID {
+		t.Errorf("streamed reaction = %+v, want %+v", streamed, posted)
+	}
+}
+
+func TestStreamReactionsHeartbeatAndDisconnect(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &reactionStreamHeartbeatInterval, 20*time.Millisecond)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	_, r, disconnect := openTestReactionStream(t, streamerID, livestreamID)
+	if event := readTestSSEEvent(t, r, 5*time.Second); len(event) != 1 || event[0] != ": heartbeat" {
+		t.Errorf("event = %q, want a heartbeat comment", event)
+	}
+	if n := testSubscriberCount(livestreamID); n != 1 {
+		t.Fatalf("subscribers = %d, want 1", n)
+	}
+
+	// 切断すると購読をやめる
+	disconnect()
+	deadline := time.Now().Add(5 * time.Second)
+	for testSubscriberCount(livestreamID) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the subscription was not cleaned up after the client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamReactionsRequiresSessionAndLivestream(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	if rec := doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/reactions/sse", nil, 0); rec.Code != http.StatusForbidden {
+		t.Errorf("status without a session = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	assertErrorCode(t, doRequest(t, http.MethodGet, "/api/livestream/999999/reactions/sse", nil, streamerID), http.StatusNotFound, errCodeNotFound)
+	if n := testSubscriberCount(livestreamID) + testSubscriberCount(999999); n != 0 {
+		t.Errorf("rejected requests left %d subscribers", n)
+	}
+}
+
+func TestReactionHub(t *testing.T) {
+	h := &reactionHub{subscribers: map[int64]map[chan Reaction]struct{}{}}
+	slow, _, _ := h.subscribe(1)
+	fast, unsubscribe, _ := h.subscribe(1)
+
+	// 受信が追いつかない購読者には送らず、publish は待たされない
+	for i := 0; i < reactionStreamBufferSize+1; i++ {
+		h.publish(Reaction{ID: int64(i), Livestream: Livestream{ID: 1}})
+		<-fast
+	}
+	if n := len(slow); n != reactionStreamBufferSize {
+		t.Errorf("slow subscriber buffered %d reactions, want %d", n, reactionStreamBufferSize)
+	}
+
+	unsubscribe()
+	if _, ok := <-fast; ok {
+		t.Error("the channel is still open after unsubscribe")
+	}
+	unsubscribe()
+
+	// close ですべての購読が終わり、以降は購読できない
+	h.close()
+	for range slow {
+	}
+	if _, _, ok := h.subscribe(1); ok {
+		t.Error("subscribe after close succeeded")
+	}
+}
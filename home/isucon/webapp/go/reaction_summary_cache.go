@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// 配信ごとのリアクション集計をキャッシュする期間 (0以下ならキャッシュしない)
+// 人気の配信で一覧が連続して取得されても、集計のクエリは期間内に1回で済むようにする
+var reactionSummaryCacheTTL = getEnvDuration("ISUCON13_REACTION_SUMMARY_CACHE_TTL", time.Second)
+
+// reactionSummaryCache は livestream_id ごとのリアクション集計を保持する
+// 期限切れのエントリは次の取得時に読み直すだけで、明示的には破棄しない
+type reactionSummaryCache struct {
+	mu      sync.Mutex
+	entries map[int64]reactionSummaryCacheEntry
+}
+
+type reactionSummaryCacheEntry struct {
+	summary   LivestreamReactionSummary
+	expiresAt time.Time
+}
+
+var livestreamReactionSummaryCache = &reactionSummaryCache{entries: map[int64]reactionSummaryCacheEntry{}}
+
+// get は期限内のエントリがあればその集計を返す
+func (rc *reactionSummaryCache) get(livestreamID int64, now time.Time) (LivestreamReactionSummary, bool) {
+	if reactionSummaryCacheTTL <= 0 {
+		return LivestreamReactionSummary{}, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	e, ok := rc.entries[livestreamID]
+	if !ok || !now.Before(e.expiresAt) {
+		return LivestreamReactionSummary{}, false
+	}
+	return e.summary, true
+}
+
+func (rc *reactionSummaryCache) set(livestreamID int64, summary LivestreamReactionSummary, now time.Time) {
+	if reactionSummaryCacheTTL <= 0 {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries[livestreamID] = reactionSummaryCacheEntry{
+		summary:   summary,
+		expiresAt: now.Add(reactionSummaryCacheTTL),
+	}
+}
+
+func (rc *reactionSummaryCache) reset() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries = map[int64]reactionSummaryCacheEntry{}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReactionSummaryCacheExpires(t *testing.T) {
+	setTestVar(t, &reactionSummaryCacheTTL, time.Second)
+	rc := &reactionSummaryCache{entries: map[int64]reactionSummaryCacheEntry{}}
+	now := time.Unix(testTermStart, 0)
+	summary := LivestreamReactionSummary{TopEmojiName: "tada", TopEmojiCount: 2, TotalReactions: 3}
+
+	if _, ok := rc.get(1, now); ok {
+		t.Error("empty cache hit")
+	}
+	rc.set(1, summary, now)
+	if got, ok := rc.get(1, now.Add(reactionSummaryCacheTTL-time.Millisecond)); !ok || got != summary {
+		t.Errorf("get before the TTL = %+v, %v, want %+v", got, ok, summary)
+	}
+	if _, ok := rc.get(1, now.Add(reactionSummaryCacheTTL)); ok {
+		t.Error("get after the TTL hit")
+	}
+	if _, ok := rc.get(2, now); ok {
+		t.Error("another livestream hit")
+	}
+
+	// TTLが0以下ならキャッシュしない
+	setTestVar(t, &reactionSummaryCacheTTL, 0)
+	rc.set(3, summary, now)
+	if _, ok := rc.get(3, now); ok {
+		t.Error("cache hit with caching disabled")
+	}
+}
+
+func TestReactionSummariesShareCachedQuery(t *testing.T) {
+	setupTestDB(t)
+	const ttl = 200 * time.Millisecond
+	setTestVar(t, &reactionSummaryCacheTTL, ttl)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart)
+	warmTestCaches(t)
+	summary := func() LivestreamReactionSummary {
+		t.Helper()
+		var livestreams []Livestream
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search?with_reactions=1", nil, streamerID), http.StatusOK, &livestreams)
+		if len(livestreams) != 1 || livestreams[0].ReactionSummary == nil {
+			t.Fatalf("search = %+v, want one livestream with a reaction summary", livestreams)
+		}
+		return *livestreams[0].ReactionSummary
+	}
+
+	recorder := recordQueries(t)
+	start := time.Now()
+	first := summary()
+	// 期間内は新しいリアクションがあっても同じ集計を返す
+	insertTestReaction(t, streamerID, livestreamID, "tada", testTermStart)
+	second := summary()
+	if time.Since(start) >= ttl {
+		t.Skip("requests took longer than the cache TTL")
+	}
+	if q := recorder.matching("GROUP BY livestream_id, emoji_name"); len(q) != 1 {
+		t.Errorf("summary queries for two rapid requests = %d, want 1", len(q))
+	}
+	if first.TotalReactions != 1 || second != first {
+		t.Errorf("summaries = %+v, %+v, want the cached total of 1 twice", first, second)
+	}
+
+	time.Sleep(ttl)
+	if got := summary(); got.TotalReactions != 2 {
+		t.Errorf("summary after the TTL = %+v, want a total of 2", got)
+	}
+	if q := recorder.matching("GROUP BY livestream_id, emoji_name"); len(q) != 2 {
+		t.Errorf("summary queries after the TTL = %d, want 2", len(q))
+	}
+}
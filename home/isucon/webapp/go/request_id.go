@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+type requestIDContextKey struct{}
+
+// requestIDMiddleware はX-Request-IDを受け取るか採番し、レスポンスヘッダに付与する
+// 同じIDをリクエストのcontextとc.Logger()に載せ、1リクエスト分のログを追えるようにする
+func requestIDMiddleware() echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: func(c echo.Context, rid string) {
+			ctx := context.WithValue(c.Request().Context(), requestIDContextKey{}, rid)
+			c.SetRequest(c.Request().WithContext(ctx))
+			c.SetLogger(&requestIDLogger{Logger: c.Echo().Logger, requestID: rid})
+		},
+	})
+}
+
+// requestIDFromContext はrequestIDMiddlewareが載せたリクエストIDを返す
+func requestIDFromContext(ctx context.Context) string {
+	rid, _ := ctx.Value(requestIDContextKey{}).(string)
+	return rid
+}
+
+// requestIDLogger はログの先頭にリクエストIDを付与するecho.Logger
+type requestIDLogger struct {
+	echo.Logger
+	requestID string
+}
+
+func (l *requestIDLogger) prefixed(format string) string {
+	return "[request_id=" + l.requestID + "] " + format
+}
+
+func (l *requestIDLogger) withID(i []interface{}) []interface{} {
+	return append([]interface{}{fmt.Sprintf("[request_id=%s] ", l.requestID)}, i...)
+}
+
+func (l *requestIDLogger) Print(i ...interface{}) { l.Logger.Print(l.withID(i)...) }
+func (l *requestIDLogger) Debug(i ...interface{}) { l.Logger.Debug(l.withID(i)...) }
+func (l *requestIDLogger) Info(i ...interface{})  { l.Logger.Info(l.withID(i)...) }
+func (l *requestIDLogger) Warn(i ...interface{})  { l.Logger.Warn(l.withID(i)...) }
+func (l *requestIDLogger) Error(i ...interface{}) { l.Logger.Error(l.withID(i)...) }
+
+func (l *requestIDLogger) Printf(format string, args ...interface{}) {
+	l.Logger.Printf(l.prefixed(format), args...)
+}
+
+func (l *requestIDLogger) Debugf(format string, args ...interface{}) {
+	l.Logger.Debugf(l.prefixed(format), args...)
+}
+
+func (l *requestIDLogger) Infof(format string, args ...interface{}) {
+	l.Logger.Infof(l.prefixed(format), args...)
+}
+
+func (l *requestIDLogger) Warnf(format string, args ...interface{}) {
+	l.Logger.Warnf(l.prefixed(format), args...)
+}
+
+func (l *requestIDLogger) Errorf(format string, args ...interface{}) {
+	l.Logger.Errorf(l.prefixed(format), args...)
+}
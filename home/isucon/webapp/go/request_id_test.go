@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRequestIDIsEchoedAndLogged(t *testing.T) {
+	logs := captureLogs(t)
+	req := httptest.NewRequest(http.MethodGet, "/api/livestream/abc", nil)
+	req.Header.Set(echo.HeaderXRequestID, "test-request-1")
+	rec := httptest.NewRecorder()
+	testEcho.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get(echo.HeaderXRequestID); got != "test-request-1" {
+		t.Errorf("X-Request-ID = %q, want %q", got, "test-request-1")
+	}
+	if !strings.Contains(logs.String(), "[request_id=test-request-1]") {
+		t.Errorf("logs do not include the request id: %s", logs)
+	}
+}
+
+func TestRequestIDIsGenerated(t *testing.T) {
+	ids := make(map[string]struct{})
+	for i := 0; i < 2; i++ {
+		rec := doRequest(t, http.MethodGet, "/api/livestream/abc", nil, 0)
+		rid := rec.Header().Get(echo.HeaderXRequestID)
+		if rid == "" {
+			t.Fatal("X-Request-ID is not set on the response")
+		}
+		ids[rid] = struct{}{}
+	}
+	if len(ids) != 2 {
+		t.Errorf("generated request ids = %v, want 2 distinct ids", ids)
+	}
+}
+
+func TestRequestIDFromContext(t *testing.T) {
+	e := echo.New()
+	e.Use(requestIDMiddleware())
+	var got string
+	e.GET("/", func(c echo.Context) error {
+		got = requestIDFromContext(c.Request().Context())
+		return c.NoContent(http.StatusOK)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderXRequestID, "from-client")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "from-client" {
+		t.Errorf("requestIDFromContext = %q, want %q", got, "from-client")
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// 予約枠の仮押さえを保持する期間
+var reservationHoldTTL = getEnvDuration("ISUCON13_RESERVATION_HOLD_TTL", 10*time.Minute)
+
+// 期限切れの仮押さえを解放する間隔
+var reservationHoldSweepInterval = getEnvDuration("ISUCON13_RESERVATION_HOLD_SWEEP_INTERVAL", 30*time.Second)
+
+type ReservationHoldModel struct {
+	ID        int64  `db:"id"`
+	Token     string `db:"token"`
+	UserID    int64  `db:"user_id"`
+	StartAt   int64  `db:"start_at"`
+	EndAt     int64  `db:"end_at"`
+	ExpiresAt int64  `db:"expires_at"`
+}
+
+type HoldReservationRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+}
+
+type HoldReservationResponse struct {
+	HoldToken string `json:"hold_token"`
+	StartAt   int64  `json:"start_at"`
+	EndAt     int64  `json:"end_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// ConfirmReservationRequest は仮押さえした区間で配信を予約するリクエスト
+// 区間は仮押さえのものを使うので指定しない
+type ConfirmReservationRequest struct {
+	HoldToken    string  `json:"hold_token"`
+	Tags         []int64 `json:"tags"`
+	Title        string  `json:"title"`
+	Description  string  `json:"description"`
+	PlaylistUrl  string  `json:"playlist_url"`
+	ThumbnailUrl string  `json:"thumbnail_url"`
+}
+
+// 予約枠仮押さえAPI
+// POST /api/livestream/reservation/hold
+// 予約枠を1つ減らして reservationHoldTTL の間確保し、確定に使うトークンを返す
+func holdReservationHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+	defer c.Request().Body.Close()
+
+	userID := sessionUserID(c)
+
+	var req *HoldReservationRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return err
+	}
+	if err := validateReservationRange(req.StartAt, req.EndAt); err != nil {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, err.Error(), nil)
+	}
+
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	// NOTE: 並列な予約・仮押さえのoverbooking防止にFOR UPDATEが必要
+	slots, err := overlappingSlots(ctx, tx, req.StartAt, req.EndAt, true)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reservation_slots", err)
+	}
+	if !slotsAlignWith(slots, req.StartAt, req.EndAt) {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "start_at and end_at must be on reservation slot boundaries", nil)
+	}
+	conflicts := []ReservationSlotConflict{}
+	for _, slot := range slots {
+		if slot.Slot < 1 {
+			conflicts = append(conflicts, ReservationSlotConflict{
+				StartAt:   slot.StartAt,
+				EndAt:     slot.EndAt,
+				Remaining: slot.Slot,
+			})
+		}
+	}
+	if len(conflicts) > 0 {
+		return &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    errCodeReservationSlotFull,
+			Message: "予約枠が埋まっているため、仮押さえできません",
+			Details: conflicts,
+		}
+	}
+
+	if err := adjustSlots(ctx, tx, slotIDs(slots), -1); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to update reservation_slot", err)
+	}
+
+	hold := ReservationHoldModel{
+		Token:     uuid.NewString(),
+		UserID:    userID,
+		StartAt:   req.StartAt,
+		EndAt:     req.EndAt,
+		ExpiresAt: time.Now().Add(reservationHoldTTL).Unix(),
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_holds (token, user_id, start_at, end_at, expires_at) VALUES (:token, :user_id, :start_at, :end_at, :expires_at)", hold); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to insert reservation hold", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	return c.JSON(http.StatusCreated, HoldReservationResponse{
+		HoldToken: hold.Token,
+		StartAt:   hold.StartAt,
+		EndAt:     hold.EndAt,
+		ExpiresAt: hold.ExpiresAt,
+	})
+}
+
+// 予約確定API
+// POST /api/livestream/reservation/confirm
+// 仮押さえのトークンを消費して配信を作成する。予約枠は仮押さえ時に減らしてあるので、ここでは減らさない
+func confirmReservationHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+	defer c.Request().Body.Close()
+
+	userID := sessionUserID(c)
+
+	var req *ConfirmReservationRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return err
+	}
+	if req.HoldToken == "" {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "hold_token is required", nil)
+	}
+
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	// 同じトークンでの同時確定や、期限切れの解放と競合しないようロックを取る
+	var hold ReservationHoldModel
+	if err := tx.GetContext(ctx, &hold, "SELECT * FROM reservation_holds WHERE token = ? FOR UPDATE", req.HoldToken); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return httpError(c, http.StatusNotFound, errCodeNotFound, "reservation hold not found", nil)
+		}
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reservation hold", err)
+	}
+	if hold.UserID != userID {
+		return httpError(c, http.StatusNotFound, errCodeNotFound, "reservation hold not found", nil)
+	}
+	if hold.ExpiresAt <= time.Now().Unix() {
+		// 予約枠は定期的な解放処理で戻す
+		return httpError(c, http.StatusGone, errCodeReservationHoldExpired, "reservation hold has expired", nil)
+	}
+
+	reserveReq := &ReserveLivestreamRequest{
+		Tags:         req.Tags,
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		StartAt:      hold.StartAt,
+		EndAt:        hold.EndAt,
+	}
+	if err := validateReserveLivestreamRequest(reserveReq); err != nil {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, err.Error(), nil)
+	}
+
+	if rejectOverlappingOwnReservations {
+		// 予約と同じく、重なる予約枠の行ロックを取ってから自分の配信との重なりを数え、同時の予約・確定と直列化する
+		if _, err := overlappingSlots(ctx, tx, hold.StartAt, hold.EndAt, true); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reservation_slots", err)
+		}
+		var overlapping int64
+		if err := tx.GetContext(ctx, &overlapping, "SELECT COUNT(*) FROM livestreams WHERE user_id = ? AND deleted_at IS NULL AND start_at < ? AND end_at > ?", userID, hold.EndAt, hold.StartAt); err != nil {
+			return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to count overlapping livestreams", err)
+		}
+		if overlapping > 0 {
+			// 仮押さえは残し、期限切れで枠を戻す
+			return httpError(c, http.StatusConflict, errCodeReservationOverlap, "you already have a livestream overlapping the requested time range", nil)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reservation_holds WHERE id = ?", hold.ID); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to delete reservation hold", err)
+	}
+
+	livestreamModel := LivestreamModel{
+		UserID:       userID,
+		Title:        reserveReq.Title,
+		Description:  reserveReq.Description,
+		PlaylistUrl:  reserveReq.PlaylistUrl,
+		ThumbnailUrl: reserveReq.ThumbnailUrl,
+		StartAt:      reserveReq.StartAt,
+		EndAt:        reserveReq.EndAt,
+		CreatedAt:    time.Now().Unix(),
+	}
+	if err := insertReservedLivestream(ctx, tx, &livestreamModel, reserveReq.Tags); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to insert livestream", err)
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to fill livestream", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// runReservationHoldSweeper は ctx が終わるまで定期的に期限切れの仮押さえを解放する
+func runReservationHoldSweeper(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(reservationHoldSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sweepExpiredReservationHolds(ctx, time.Now().Unix()); err != nil {
+				logger.Errorf("failed to sweep expired reservation holds: %v", err)
+			}
+		}
+	}
+}
+
+// sweepExpiredReservationHolds は期限切れの仮押さえを削除し、予約枠を戻す
+// 仮押さえ・予約と同じ順(仮押さえの行→予約枠)でロックを取るよう、1件ずつトランザクションを分ける
+func sweepExpiredReservationHolds(ctx context.Context, now int64) error {
+	var expiredIDs []int64
+	if err := dbConn.SelectContext(ctx, &expiredIDs, "SELECT id FROM reservation_holds WHERE expires_at <= ? ORDER BY id", now); err != nil {
+		return err
+	}
+	for _, id := range expiredIDs {
+		if err := releaseReservationHold(ctx, id, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func releaseReservationHold(ctx context.Context, id int64, now int64) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTxTimeout)
+	defer cancel()
+
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var hold ReservationHoldModel
+	if err := tx.GetContext(ctx, &hold, "SELECT * FROM reservation_holds WHERE id = ? FOR UPDATE", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// 一覧を取った後に確定された
+			return nil
+		}
+		return err
+	}
+	if hold.ExpiresAt > now {
+		return nil
+	}
+
+	slots, err := overlappingSlots(ctx, tx, hold.StartAt, hold.EndAt, true)
+	if err != nil {
+		return err
+	}
+	if err := adjustSlots(ctx, tx, slotIDs(slots), 1); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reservation_holds WHERE id = ?", hold.ID); err != nil {
+		return err
+	}
+	// 配信の削除と同じく、戻した枠を待っている予約待ちがあれば同じトランザクションで予約に繰り上げる
+	if _, err := promoteReservationWaitlist(ctx, tx, hold.StartAt, hold.EndAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
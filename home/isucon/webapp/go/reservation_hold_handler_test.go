@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// holdTestReservation は予約枠仮押さえAPIを呼び、トークンを返す
+func holdTestReservation(t *testing.T, userID, startAt, endAt int64) HoldReservationResponse {
+	t.Helper()
+	var res HoldReservationResponse
+	decodeResponse(t, doRequest(t, http.MethodPost, "/api/livestream/reservation/hold", HoldReservationRequest{StartAt: startAt, EndAt: endAt}, userID), http.StatusCreated, &res)
+	return res
+}
+
+func newTestConfirmRequest(token string, tags ...int64) ConfirmReservationRequest {
+	req := newTestReserveRequest(0, 0, tags...)
+	return ConfirmReservationRequest{
+		HoldToken:    token,
+		Tags:         req.Tags,
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+	}
+}
+
+func TestReservationHoldThenConfirm(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	otherID := insertTestUser(t, "other")
+	insertTestSlots(t, testTermStart, testTermStart+2*3600, 1)
+	warmTestCaches(t)
+
+	hold := holdTestReservation(t, userID, testTermStart, testTermStart+2*3600)
+	if hold.HoldToken == "" || hold.ExpiresAt <= time.Now().Unix() {
+		t.Fatalf("hold = %+v, want a token that expires later", hold)
+	}
+	if n := mustCount(t, "SELECT SUM(slot) FROM reservation_slots"); n != 0 {
+		t.Errorf("slots after hold = %d, want 0", n)
+	}
+	// 仮押さえで埋まった枠は予約も仮押さえもできない
+	assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation/hold", HoldReservationRequest{StartAt: testTermStart, EndAt: testTermStart + 3600}, otherID), http.StatusBadRequest, errCodeReservationSlotFull)
+	assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(testTermStart, testTermStart+3600), otherID), http.StatusBadRequest, errCodeReservationSlotFull)
+	// 他のユーザのトークンでは確定できない
+	assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation/confirm", newTestConfirmRequest(hold.HoldToken), otherID), http.StatusNotFound, errCodeNotFound)
+
+	var livestream Livestream
+	decodeResponse(t, doRequest(t, http.MethodPost, "/api/livestream/reservation/confirm", newTestConfirmRequest(hold.HoldToken), userID), http.StatusCreated, &livestream)
+	if livestream.Owner.ID != userID || livestream.StartAt != hold.StartAt || livestream.EndAt != hold.EndAt {
+		t.Errorf("confirmed = %+v, want a livestream of user %d over the held range", livestream, userID)
+	}
+	// 確定では枠を減らさず、仮押さえは消える
+	if n := mustCount(t, "SELECT SUM(slot) FROM reservation_slots"); n != 0 {
+		t.Errorf("slots after confirm = %d, want 0", n)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reservation_holds"); n != 0 {
+		t.Errorf("holds after confirm = %d, want 0", n)
+	}
+	assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation/confirm", newTestConfirmRequest(hold.HoldToken), userID), http.StatusNotFound, errCodeNotFound)
+
+	// 確定した予約は期限切れの解放で戻されない
+	if err := sweepExpiredReservationHolds(context.Background(), time.Now().Add(2*reservationHoldTTL).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if n := mustCount(t, "SELECT SUM(slot) FROM reservation_slots"); n != 0 {
+		t.Errorf("slots after sweeping a confirmed hold = %d, want 0", n)
+	}
+}
+
+func TestReservationHoldExpires(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+3600, 1)
+	warmTestCaches(t)
+
+	hold := holdTestReservation(t, userID, testTermStart, testTermStart+3600)
+	// 期限前の解放では戻さない
+	if err := sweepExpiredReservationHolds(context.Background(), hold.ExpiresAt-1); err != nil {
+		t.Fatal(err)
+	}
+	if n := mustCount(t, "SELECT slot FROM reservation_slots"); n != 0 {
+		t.Errorf("slot after sweeping before expiry = %d, want 0", n)
+	}
+
+	mustExec(t, "UPDATE reservation_holds SET expires_at = ? WHERE token = ?", time.Now().Unix()-1, hold.HoldToken)
+	assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation/confirm", newTestConfirmRequest(hold.HoldToken), userID), http.StatusGone, errCodeReservationHoldExpired)
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != 0 {
+		t.Errorf("livestreams after an expired confirm = %d, want 0", n)
+	}
+
+	if err := sweepExpiredReservationHolds(context.Background(), time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if n := mustCount(t, "SELECT slot FROM reservation_slots"); n != 1 {
+		t.Errorf("slot after the hold expired = %d, want 1", n)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reservation_holds"); n != 0 {
+		t.Errorf("holds after the sweep = %d, want 0", n)
+	}
+	assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation/confirm", newTestConfirmRequest(hold.HoldToken), userID), http.StatusNotFound, errCodeNotFound)
+	// 戻した枠は再び予約できる
+	reserveTestLivestream(t, userID, newTestReserveRequest(testTermStart, testTermStart+3600))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ReservationWaitlistModel は予約枠が空くのを待っている予約リクエスト
+// 予約枠が戻ったとき、登録の古い順に予約へ繰り上げる
+type ReservationWaitlistModel struct {
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	Title        string `db:"title"`
+	Description  string `db:"description"`
+	PlaylistUrl  string `db:"playlist_url"`
+	ThumbnailUrl string `db:"thumbnail_url"`
+	// Tags はタグIDの配列をJSONにしたもの
+	Tags      string `db:"tags"`
+	StartAt   int64  `db:"start_at"`
+	EndAt     int64  `db:"end_at"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type ReservationWaitlistEntry struct {
+	ID        int64 `json:"id"`
+	StartAt   int64 `json:"start_at"`
+	EndAt     int64 `json:"end_at"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+// 予約待ち登録API
+// POST /api/livestream/reservation/waitlist
+// 予約と同じリクエストを受け付け、区間の予約枠が埋まっていれば空くのを待つ
+// 配信の削除で予約枠が戻ると、deleteLivestreamHandler の中で予約に繰り上がる
+func joinReservationWaitlistHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+	defer c.Request().Body.Close()
+
+	userID := sessionUserID(c)
+
+	var req *ReserveLivestreamRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return err
+	}
+	if err := validateReserveLivestreamRequest(req); err != nil {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, err.Error(), nil)
+	}
+	tags, err := json.Marshal(req.Tags)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to encode tags", err)
+	}
+
+	tx, err := beginTx(ctx, nil)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	// 予約枠の行ロックを取り、枠が戻る処理と直列化する
+	slots, err := overlappingSlots(ctx, tx, req.StartAt, req.EndAt, true)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get reservation_slots", err)
+	}
+	if len(slots) == 0 || !slotsAlignWith(slots, req.StartAt, req.EndAt) {
+		return httpError(c, http.StatusBadRequest, errCodeBadRequest, "start_at and end_at must be on reservation slot boundaries", nil)
+	}
+	if slotsAvailable(slots) {
+		return httpError(c, http.StatusConflict, errCodeReservationSlotAvailable, "reservation slots are available; reserve the livestream directly", nil)
+	}
+
+	entry := ReservationWaitlistModel{
+		UserID:       userID,
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		Tags:         string(tags),
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+		CreatedAt:    time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_waitlist (user_id, title, description, playlist_url, thumbnail_url, tags, start_at, end_at, created_at) VALUES (:user_id, :title, :description, :playlist_url, :thumbnail_url, :tags, :start_at, :end_at, :created_at)", entry)
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to insert reservation waitlist entry", err)
+	}
+	entry.ID, err = rs.LastInsertId()
+	if err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to get last inserted reservation waitlist id", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return httpError(c, http.StatusInternalServerError, errCodeInternal, "failed to commit", err)
+	}
+
+	return c.JSON(http.StatusCreated, ReservationWaitlistEntry{
+		ID:        entry.ID,
+		StartAt:   entry.StartAt,
+		EndAt:     entry.EndAt,
+		CreatedAt: entry.CreatedAt,
+	})
+}
+
+// slotsAvailable は slots のすべてに残りがあるかを返す
+func slotsAvailable(slots []*ReservationSlotModel) bool {
+	for _, slot := range slots {
+		if slot.Slot < 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// promoteReservationWaitlist は区間 [startAt, endAt) の予約枠が戻った後に呼び、
+// その区間と重なる予約待ちのうち、予約できる最も古いものを予約に繰り上げる
+// 戻る予約枠は1つ分なので、繰り上げるのは1件まで。繰り上げた配信のIDを返す (無ければ0)
+func promoteReservationWaitlist(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) (int64, error) {
+	var entries []ReservationWaitlistModel
+	if err := tx.SelectContext(ctx, &entries, "SELECT * FROM reservation_waitlist WHERE start_at < ? AND end_at > ? ORDER BY id ASC FOR UPDATE", endAt, startAt); err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		slots, err := overlappingSlots(ctx, tx, entry.StartAt, entry.EndAt, true)
+		if err != nil {
+			return 0, err
+		}
+		if len(slots) == 0 || !slotsAvailable(slots) {
+			// 戻った枠以外の時間帯がまだ埋まっている
+			continue
+		}
+		if rejectOverlappingOwnReservations {
+			var overlapping int64
+			if err := tx.GetContext(ctx, &overlapping, "SELECT COUNT(*) FROM livestreams WHERE user_id = ? AND deleted_at IS NULL AND start_at < ? AND end_at > ?", entry.UserID, entry.EndAt, entry.StartAt); err != nil {
+				return 0, err
+			}
+			if overlapping > 0 {
+				continue
+			}
+		}
+
+		var tagIDs []int64
+		if err := json.Unmarshal([]byte(entry.Tags), &tagIDs); err != nil {
+			return 0, err
+		}
+
+		if err := adjustSlots(ctx, tx, slotIDs(slots), -1); err != nil {
+			return 0, err
+		}
+		livestreamModel := LivestreamModel{
+			UserID:       entry.UserID,
+			Title:        entry.Title,
+			Description:  entry.Description,
+			PlaylistUrl:  entry.PlaylistUrl,
+			ThumbnailUrl: entry.ThumbnailUrl,
+			StartAt:      entry.StartAt,
+			EndAt:        entry.EndAt,
+			CreatedAt:    time.Now().Unix(),
+		}
+		if err := insertReservedLivestream(ctx, tx, &livestreamModel, tagIDs); err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM reservation_waitlist WHERE id = ?", entry.ID); err != nil {
+			return 0, err
+		}
+		return livestreamModel.ID, nil
+	}
+	return 0, nil
+}
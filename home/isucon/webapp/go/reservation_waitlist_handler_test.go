@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func joinTestWaitlist(t *testing.T, userID int64, req ReserveLivestreamRequest) ReservationWaitlistEntry {
+	t.Helper()
+	var entry ReservationWaitlistEntry
+	decodeResponse(t, doRequest(t, http.MethodPost, "/api/livestream/reservation/waitlist", req, userID), http.StatusCreated, &entry)
+	return entry
+}
+
+func deleteTestLivestream(t *testing.T, userID, livestreamID int64) {
+	t.Helper()
+	if rec := doRequest(t, http.MethodDelete, "/api/livestream/"+itoa(livestreamID), nil, userID); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete livestream %d status = %d: %s", livestreamID, rec.Code, rec.Body)
+	}
+}
+
+// activeLivestreamsOf はユーザの削除されていない配信を返す
+func activeLivestreamsOf(t *testing.T, userID int64) []LivestreamModel {
+	t.Helper()
+	var livestreams []LivestreamModel
+	if err := dbConn.Select(&livestreams, "SELECT * FROM livestreams WHERE user_id = ? AND deleted_at IS NULL ORDER BY id", userID); err != nil {
+		t.Fatal(err)
+	}
+	return livestreams
+}
+
+func TestReservationWaitlistPromotesOnDelete(t *testing.T) {
+	setupTestDB(t)
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	carolID := insertTestUser(t, "carol")
+	tagID := insertTestTag(t, "music")
+	insertTestSlots(t, testTermStart, testTermStart+3600, 1)
+	warmTestCaches(t)
+	window := newTestReserveRequest(testTermStart, testTermStart+3600)
+	const path = "/api/livestream/reservation/waitlist"
+
+	// 空いている枠は直接予約させる
+	assertErrorCode(t, doRequest(t, http.MethodPost, path, window, bobID), http.StatusConflict, errCodeReservationSlotAvailable)
+	alice := reserveTestLivestream(t, aliceID, window)
+	assertErrorCode(t, doRequest(t, http.MethodPost, "/api/livestream/reservation", window, bobID), http.StatusBadRequest, errCodeReservationSlotFull)
+
+	bobReq := newTestReserveRequest(testTermStart, testTermStart+3600, tagID)
+	bobReq.Title = "bob waitlisted"
+	bobEntry := joinTestWaitlist(t, bobID, bobReq)
+	carolEntry := joinTestWaitlist(t, carolID, window)
+	if bobEntry.ID == 0 || carolEntry.ID <= bobEntry.ID || bobEntry.StartAt != testTermStart || bobEntry.EndAt != testTermStart+3600 {
+		t.Errorf("waitlist entries = %+v, %+v", bobEntry, carolEntry)
+	}
+	assertErrorCode(t, doRequest(t, http.MethodPost, path, newTestReserveRequest(testTermStart+1800, testTermStart+3600), bobID), http.StatusBadRequest, errCodeBadRequest)
+	assertErrorCode(t, doRequest(t, http.MethodPost, path, newTestReserveRequest(testTermStart+3600, testTermStart+7200), bobID), http.StatusBadRequest, errCodeBadRequest)
+
+	// 予約が取り消されると、最も古い予約待ちが同じトランザクションで予約に繰り上がる
+	deleteTestLivestream(t, aliceID, alice.ID)
+	promoted := activeLivestreamsOf(t, bobID)
+	if len(promoted) != 1 || promoted[0].Title != "bob waitlisted" || promoted[0].StartAt != testTermStart || promoted[0].EndAt != testTermStart+3600 {
+		t.Fatalf("bob's livestreams after the cancel = %+v, want the waitlisted reservation", promoted)
+	}
+	var livestream Livestream
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(promoted[0].ID), nil, bobID), http.StatusOK, &livestream)
+	if len(livestream.Tags) != 1 || livestream.Tags[0].ID != tagID {
+		t.Errorf("promoted tags = %+v, want [%d]", livestream.Tags, tagID)
+	}
+	if n := mustCount(t, "SELECT slot FROM reservation_slots"); n != 0 {
+		t.Errorf("slot after promotion = %d, want 0", n)
+	}
+	if n := len(activeLivestreamsOf(t, carolID)); n != 0 {
+		t.Errorf("carol has %d livestreams, want to stay waitlisted", n)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reservation_waitlist WHERE user_id = ?", bobID); n != 0 {
+		t.Errorf("bob's waitlist entries = %d, want 0 after promotion", n)
+	}
+
+	// 次に枠が戻れば、続きの予約待ちが繰り上がる
+	deleteTestLivestream(t, bobID, promoted[0].ID)
+	if n := len(activeLivestreamsOf(t, carolID)); n != 1 {
+		t.Errorf("carol has %d livestreams after the second cancel, want 1", n)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reservation_waitlist"); n != 0 {
+		t.Errorf("waitlist entries = %d, want 0", n)
+	}
+	if n := mustCount(t, "SELECT slot FROM reservation_slots"); n != 0 {
+		t.Errorf("slot after the second promotion = %d, want 0", n)
+	}
+}
+
+func TestReservationWaitlistSkipsStillFullEntries(t *testing.T) {
+	setupTestDB(t)
+	const h = 3600
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	carolID := insertTestUser(t, "carol")
+	insertTestSlots(t, testTermStart, testTermStart+2*h, 1)
+	warmTestCaches(t)
+
+	first := reserveTestLivestream(t, aliceID, newTestReserveRequest(testTermStart, testTermStart+h))
+	reserveTestLivestream(t, aliceID, newTestReserveRequest(testTermStart+h, testTermStart+2*h))
+	// 古い予約待ちでも、戻った枠以外がまだ埋まっていれば飛ばす
+	joinTestWaitlist(t, bobID, newTestReserveRequest(testTermStart, testTermStart+2*h))
+	joinTestWaitlist(t, carolID, newTestReserveRequest(testTermStart, testTermStart+h))
+
+	deleteTestLivestream(t, aliceID, first.ID)
+	if n := len(activeLivestreamsOf(t, bobID)); n != 0 {
+		t.Errorf("bob has %d livestreams, want none while the second slot is full", n)
+	}
+	if got := activeLivestreamsOf(t, carolID); len(got) != 1 || got[0].StartAt != testTermStart {
+		t.Errorf("carol's livestreams = %+v, want the freed slot", got)
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM reservation_waitlist WHERE user_id = ?", bobID); n != 1 {
+		t.Errorf("bob's waitlist entries = %d, want 1", n)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// 重なりを調べる予約枠は [testTermStart+slotOverlapTestHour, testTermStart+2*slotOverlapTestHour)
+// DBではその前後にも枠を置いて、どの枠が選ばれるかも確かめる
+const slotOverlapTestHour = 3600
+
+var slotOverlapScenarios = []struct {
+	name           string
+	startAt, endAt int64
+	overlaps       bool
+	want           []int64 // overlappingSlots で選ばれる枠の start_at
+}{
+	{"exact", testTermStart + slotOverlapTestHour, testTermStart + 2*slotOverlapTestHour, true, []int64{testTermStart + slotOverlapTestHour}},
+	{"inside", testTermStart + slotOverlapTestHour + 10, testTermStart + slotOverlapTestHour + 20, true, []int64{testTermStart + slotOverlapTestHour}},
+	{"covering", testTermStart + slotOverlapTestHour - 10, testTermStart + 2*slotOverlapTestHour + 10, true, []int64{testTermStart, testTermStart + slotOverlapTestHour, testTermStart + 2*slotOverlapTestHour}},
+	{"straddling left", testTermStart + slotOverlapTestHour/2, testTermStart + slotOverlapTestHour + slotOverlapTestHour/2, true, []int64{testTermStart, testTermStart + slotOverlapTestHour}},
+	{"straddling right", testTermStart + slotOverlapTestHour + slotOverlapTestHour/2, testTermStart + 2*slotOverlapTestHour + slotOverlapTestHour/2, true, []int64{testTermStart + slotOverlapTestHour, testTermStart + 2*slotOverlapTestHour}},
+	{"disjoint before", testTermStart, testTermStart + slotOverlapTestHour/2, false, []int64{testTermStart}},
+	{"disjoint after", testTermStart + 2*slotOverlapTestHour + slotOverlapTestHour/2, testTermStart + 3*slotOverlapTestHour, false, []int64{testTermStart + 2*slotOverlapTestHour}},
+	{"adjacent before", testTermStart, testTermStart + slotOverlapTestHour, false, []int64{testTermStart}},
+	{"adjacent after", testTermStart + 2*slotOverlapTestHour, testTermStart + 3*slotOverlapTestHour, false, []int64{testTermStart + 2*slotOverlapTestHour}},
+	{"zero-length inside", testTermStart + slotOverlapTestHour + 10, testTermStart + slotOverlapTestHour + 10, false, nil},
+	{"zero-length at start", testTermStart + slotOverlapTestHour, testTermStart + slotOverlapTestHour, false, nil},
+	{"reversed", testTermStart + 2*slotOverlapTestHour, testTermStart + slotOverlapTestHour, false, nil},
+}
+
+func TestReservationSlotOverlaps(t *testing.T) {
+	slot := &ReservationSlotModel{StartAt: testTermStart + slotOverlapTestHour, EndAt: testTermStart + 2*slotOverlapTestHour}
+	for _, tt := range slotOverlapScenarios {
+		if got := slot.overlaps(tt.startAt, tt.endAt); got != tt.overlaps {
+			t.Errorf("%s: overlaps(%d, %d) = %v, want %v", tt.name, tt.startAt, tt.endAt, got, tt.overlaps)
+		}
+	}
+}
+
+func TestOverlappingSlotsScenarios(t *testing.T) {
+	setupTestDB(t)
+	insertTestSlots(t, testTermStart, testTermStart+3*slotOverlapTestHour, 5)
+
+	for _, tt := range slotOverlapScenarios {
+		tx, err := dbConn.Beginx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		slots, err := overlappingSlots(context.Background(), tx, tt.startAt, tt.endAt, true)
+		tx.Rollback()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []int64
+		for _, slot := range slots {
+			got = append(got, slot.StartAt)
+			// SQLの条件と overlaps の判定は一致する
+			if !slot.overlaps(tt.startAt, tt.endAt) {
+				t.Errorf("%s: selected slot %d-%d does not overlap", tt.name, slot.StartAt, slot.EndAt)
+			}
+		}
+		if !equalIDs(got, tt.want) {
+			t.Errorf("%s: overlappingSlots(%d, %d) = %v, want %v", tt.name, tt.startAt, tt.endAt, got, tt.want)
+		}
+	}
+}
+
+// 枠の途中から始まる・途中で終わる予約は、予約枠を消費しないまま通ってしまわず、400で断られる
+// 包含 (start_at >= ? AND end_at <= ?) で枠を選ぶと、部分的に重なる枠が選ばれず、その枠の残りを見ずに予約できてしまう
+// 予約は1時間単位なので、2時間の枠を置いて枠の途中にかかる予約を作る
+func TestReservePartiallyOverlappingWindow(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	for at := int64(testTermStart); at < testTermStart+6*slotOverlapTestHour; at += 2 * slotOverlapTestHour {
+		mustExec(t, "INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (?, ?, ?)", 1, at, at+2*slotOverlapTestHour)
+	}
+	warmTestCaches(t)
+	slotCounts := func() []int64 {
+		t.Helper()
+		var counts []int64
+		if err := dbConn.Select(&counts, "SELECT slot FROM reservation_slots ORDER BY start_at"); err != nil {
+			t.Fatal(err)
+		}
+		return counts
+	}
+
+	for _, window := range []struct {
+		name           string
+		startAt, endAt int64
+	}{
+		{"straddling", testTermStart + slotOverlapTestHour, testTermStart + 3*slotOverlapTestHour},
+		{"inside", testTermStart + 2*slotOverlapTestHour, testTermStart + 3*slotOverlapTestHour},
+		{"ending mid-slot", testTermStart, testTermStart + 3*slotOverlapTestHour},
+	} {
+		rec := doRequest(t, http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(window.startAt, window.endAt), userID)
+		assertErrorCode(t, rec, http.StatusBadRequest, errCodeBadRequest)
+		if got := slotCounts(); !equalIDs(got, []int64{1, 1, 1}) {
+			t.Errorf("%s: slots = %v, want [1 1 1]", window.name, got)
+		}
+	}
+	if n := mustCount(t, "SELECT COUNT(*) FROM livestreams"); n != 0 {
+		t.Errorf("partially overlapping windows reserved %d livestreams", n)
+	}
+
+	// 枠の境界に揃った予約は重なる枠をすべて減らし、取り消せば戻す
+	livestream := reserveTestLivestream(t, userID, newTestReserveRequest(testTermStart+2*slotOverlapTestHour, testTermStart+6*slotOverlapTestHour))
+	if got := slotCounts(); !equalIDs(got, []int64{1, 0, 0}) {
+		t.Errorf("slots after an aligned reservation = %v, want [1 0 0]", got)
+	}
+	deleteTestLivestream(t, userID, livestream.ID)
+	if got := slotCounts(); !equalIDs(got, []int64{1, 1, 1}) {
+		t.Errorf("slots after canceling = %v, want [1 1 1]", got)
+	}
+}
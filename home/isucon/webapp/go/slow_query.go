@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// ISUCON13_SLOW_QUERY_THRESHOLD (例: 50ms) が設定されている場合、それ以上かかったクエリをリクエストIDとともにログに出す
+// 負荷試験中にハンドラ内のどのクエリが遅いかを調べるためのもの。未設定なら時刻の取得もしない
+var slowQueryThreshold = getEnvDuration("ISUCON13_SLOW_QUERY_THRESHOLD", 0)
+
+// traceQuery はクエリの実行直前に呼び、返された関数をクエリの実行直後に呼ぶ
+//
+//	done := traceQuery(ctx, query)
+//	err := tx.SelectContext(ctx, &dest, query, args...)
+//	done()
+func traceQuery(ctx context.Context, query string) func() {
+	if slowQueryThreshold <= 0 {
+		return noopTraceDone
+	}
+	start := time.Now()
+	return func() {
+		if elapsed := time.Since(start); elapsed >= slowQueryThreshold {
+			log.Printf("[SLOW] [request_id=%s] %s: %s", requestIDFromContext(ctx), elapsed, query)
+		}
+	}
+}
+
+func noopTraceDone() {}
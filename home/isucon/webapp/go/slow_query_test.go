@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// captureStdLogs はテストの間 log パッケージの出力を取り込む
+func captureStdLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestTraceQueryLogsOnlySlowQueries(t *testing.T) {
+	logs := captureStdLogs(t)
+	ctx := context.WithValue(context.Background(), requestIDContextKey{}, "trace-1")
+
+	setTestVar(t, &slowQueryThreshold, 0)
+	done := traceQuery(ctx, "SELECT disabled")
+	time.Sleep(time.Millisecond)
+	done()
+
+	setTestVar(t, &slowQueryThreshold, 20*time.Millisecond)
+	traceQuery(ctx, "SELECT fast")()
+	done = traceQuery(ctx, "SELECT slow")
+	time.Sleep(30 * time.Millisecond)
+	done()
+
+	out := logs.String()
+	if !strings.Contains(out, "[SLOW] [request_id=trace-1]") || !strings.Contains(out, "SELECT slow") {
+		t.Errorf("logs = %q, want the slow query with its request id", out)
+	}
+	if strings.Contains(out, "SELECT fast") || strings.Contains(out, "SELECT disabled") {
+		t.Errorf("logs = %q, want only the slow query", out)
+	}
+}
+
+func TestSlowQueriesAreLoggedWithRequestID(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	insertTestSlots(t, testTermStart, testTermStart+2*3600, 5)
+	warmTestCaches(t)
+	do := func(requestID, method, target string, body interface{}, wantStatus int) {
+		t.Helper()
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(method, target, bytes.NewReader(b))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXRequestID, requestID)
+		req.AddCookie(sessionCookie(t, userID))
+		rec := httptest.NewRecorder()
+		testEcho.ServeHTTP(rec, req)
+		decodeResponse(t, rec, wantStatus, nil)
+	}
+	logs := captureStdLogs(t)
+
+	// しきい値を超えないクエリはログに出さない
+	setTestVar(t, &slowQueryThreshold, time.Hour)
+	do("fast-reserve", http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(testTermStart, testTermStart+3600), http.StatusCreated)
+	do("fast-search", http.MethodGet, "/api/livestream/search", nil, http.StatusOK)
+	if strings.Contains(logs.String(), "[SLOW]") {
+		t.Errorf("logs below the threshold = %q, want none", logs)
+	}
+
+	setTestVar(t, &slowQueryThreshold, time.Nanosecond)
+	do("slow-reserve", http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(testTermStart+3600, testTermStart+2*3600), http.StatusCreated)
+	do("slow-search", http.MethodGet, "/api/livestream/search", nil, http.StatusOK)
+	out := logs.String()
+	for _, want := range []string{
+		"[request_id=slow-reserve] ",
+		"FROM reservation_slots WHERE start_at < ? AND end_at > ?",
+		"[request_id=slow-search] ",
+		"FROM livestream_tags WHERE livestream_id IN",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("slow query logs do not include %q: %s", want, out)
+		}
+	}
+}
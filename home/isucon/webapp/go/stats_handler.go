@@ -3,10 +3,13 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
+	"time"
 
+	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -16,8 +19,44 @@ type LivestreamStatistics struct {
 	TotalReactions int64 `json:"total_reactions"`
 	TotalReports   int64 `json:"total_reports"`
 	MaxTip         int64 `json:"max_tip"`
+	// 入室したことのあるユーザ数 (再入室や退出済みのユーザも1人として数える)
+	UniqueViewersCount int64 `json:"unique_viewers_count"`
+	// 再入室も含めた延べ入室回数
+	TotalEnters int64 `json:"total_enters"`
+	// 直近1分間のリアクション数
+	ReactionsLastMinute int64 `json:"reactions_last_minute"`
+	// 配信開始から現在(終了済みなら終了時刻)までの1分あたりのリアクション数
+	ReactionsPerMinute float64 `json:"reactions_per_minute"`
+	// 1秒あたりのリアクション数の最大値が中央値の reactionSpikeMultiplier 倍を超えたか (bot対策)
+	// 配信者本人が取得した場合のみ含める
+	Suspicious *bool `json:"suspicious,omitempty"`
 }
 
+// 1秒あたりのリアクション数の最大値が中央値の何倍を超えたら suspicious とするか
+var reactionSpikeMultiplier = getEnvInt("ISUCON13_REACTION_SPIKE_MULTIPLIER", 10)
+
+type LivestreamViewerHistory struct {
+	// 退出していない視聴者数
+	CurrentViewers int64 `json:"current_viewers"`
+	// 退出した視聴者も含めた、入室したことのあるユーザ数
+	UniqueViewers int64                           `json:"unique_viewers"`
+	Series        []LivestreamViewerHistoryBucket `json:"series,omitempty"`
+}
+
+type LivestreamViewerHistoryBucket struct {
+	BucketStart int64 `db:"bucket_start" json:"bucket_start"`
+	// 区間内に入室したユーザ数 (区間内の再入室は1人として数える)
+	Count int64 `db:"count" json:"count"`
+}
+
+type ReactionHistogramBucket struct {
+	BucketStart int64 `db:"bucket_start" json:"bucket_start"`
+	Count       int64 `db:"count" json:"count"`
+}
+
+// リアクション推移で返すバケット数の上限
+const maxReactionHistogramBuckets = 10000
+
 type LivestreamRankingEntry struct {
 	LivestreamID int64
 	Score        int64
@@ -60,7 +99,8 @@ func (r UserRanking) Less(i, j int) bool {
 }
 
 func getUserStatisticsHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
@@ -71,7 +111,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 	// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
 	// また、現在の合計視聴者数もだす
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -173,6 +213,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 	}
 
 	// お気に入り絵文字
+	// 同数の場合は絵文字名の降順で先のものを返す (ベンチマーカーが期待する順序なので変えないこと)
 	var favoriteEmoji string
 	query = `
 	SELECT r.emoji_name
@@ -200,19 +241,24 @@ func getUserStatisticsHandler(c echo.Context) error {
 }
 
 func getLivestreamStatisticsHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
 	if err := verifyUserSession(c); err != nil {
 		return err
 	}
 
-	id, err := strconv.Atoi(c.Param("livestream_id"))
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := parseID(c, "livestream_id")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return err
 	}
-	livestreamID := int64(id)
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -235,8 +281,9 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	// ランク算出
 	var ranking LivestreamRanking
 	for _, livestream := range livestreams {
-		var reactions int64
-		if err := tx.GetContext(ctx, &reactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		// 全配信分を毎回数えると重いので、メモリ上のリアクション数を使う
+		reactions, err := livestreamReactionCounts.get(ctx, livestream.ID)
+		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
 		}
 
@@ -267,6 +314,14 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	if err := tx.GetContext(ctx, &viewersCount, `SELECT COUNT(*) FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
 	}
+	// livestream_viewers_history は (user_id, livestream_id) ごとに1行なので、入室の記録から数える
+	var enters struct {
+		Unique int64 `db:"unique_viewers"`
+		Total  int64 `db:"total_enters"`
+	}
+	if err := tx.GetContext(ctx, &enters, "SELECT COUNT(DISTINCT user_id) AS unique_viewers, COUNT(*) AS total_enters FROM livestream_viewer_entries WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewer entries: "+err.Error())
+	}
 
 	// 最大チップ額
 	var maxTip int64
@@ -275,11 +330,30 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 
 	// リアクション数
-	var totalReactions int64
-	if err := tx.GetContext(ctx, &totalReactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	totalReactions, err := livestreamReactionCounts.get(ctx, livestreamID)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
 	}
 
+	// リアクションの勢い
+	now := time.Now().Unix()
+	var reactionsLastMinute int64
+	if err := tx.GetContext(ctx, &reactionsLastMinute, "SELECT COUNT(*) FROM reactions WHERE livestream_id = ? AND created_at >= ? AND created_at <= ?", livestreamID, now-60, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count recent reactions: "+err.Error())
+	}
+	reactionsPerMinute := reactionRatePerMinute(totalReactions, livestream.StartAt, livestream.EndAt, now)
+
+	// リアクションの急増 (配信者のみ)
+	var suspicious *bool
+	if livestream.UserID == userID {
+		var perSecond []int64
+		if err := tx.SelectContext(ctx, &perSecond, "SELECT COUNT(*) FROM reactions WHERE livestream_id = ? GROUP BY created_at", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions per second: "+err.Error())
+		}
+		spiked := isReactionSpike(perSecond, int64(reactionSpikeMultiplier))
+		suspicious = &spiked
+	}
+
 	// スパム報告数
 	var totalReports int64
 	if err := tx.GetContext(ctx, &totalReports, `SELECT COUNT(*) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
@@ -291,10 +365,209 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 
 	return c.JSON(http.StatusOK, LivestreamStatistics{
-		Rank:           rank,
-		ViewersCount:   viewersCount,
-		MaxTip:         maxTip,
-		TotalReactions: totalReactions,
-		TotalReports:   totalReports,
+		Rank:         rank,
+		ViewersCount: viewersCount,
+		MaxTip:       maxTip,
+
+		UniqueViewersCount: enters.Unique,
+		TotalEnters:        enters.Total,
+		TotalReactions:     totalReactions,
+		TotalReports:       totalReports,
+
+		ReactionsLastMinute: reactionsLastMinute,
+		ReactionsPerMinute:  reactionsPerMinute,
+		Suspicious:          suspicious,
 	})
 }
+
+// isReactionSpike はリアクションのあった秒ごとの件数 perSecond について、最大値が中央値の multiple 倍を超えるかを返す
+// リアクションの無い秒は含めないので、まばらな配信でも中央値が0にならない
+func isReactionSpike(perSecond []int64, multiple int64) bool {
+	if len(perSecond) == 0 {
+		return false
+	}
+	counts := append([]int64(nil), perSecond...)
+	sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+	max := counts[len(counts)-1]
+	// 偶数個の場合は中央の2つの平均を2倍したまま比較し、小数を避ける
+	doubledMedian := counts[(len(counts)-1)/2] + counts[len(counts)/2]
+	return 2*max > multiple*doubledMedian
+}
+
+// reactionRatePerMinute は配信開始から now (終了済みなら終了時刻) までの1分あたりのリアクション数を返す
+// 経過時間が1分未満の場合は1分として扱う
+func reactionRatePerMinute(totalReactions, startAt, endAt, now int64) float64 {
+	if totalReactions == 0 {
+		return 0
+	}
+	until := now
+	if endAt < until {
+		until = endAt
+	}
+	elapsedMinutes := float64(until-startAt) / 60
+	if elapsedMinutes < 1 {
+		elapsedMinutes = 1
+	}
+	return float64(totalReactions) / elapsedMinutes
+}
+
+// 配信の視聴者推移
+// GET /api/livestream/:livestream_id/viewers
+// 現在の視聴者数と、退出した視聴者も含む延べ視聴者数を返す。bucket (秒) を指定すると、区間ごとに入室したユーザ数の推移も返す
+// NOTE: 入室を追記する livestream_viewer_entries (user_id, livestream_id, created_at, INDEX (livestream_id, created_at)) が必要
+func getViewerHistoryHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	var bucket int64
+	if c.QueryParam("bucket") != "" {
+		b, err := strconv.Atoi(c.QueryParam("bucket"))
+		if err != nil || b <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "bucket query parameter must be positive integer")
+		}
+		bucket = int64(b)
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestream LivestreamModel
+	if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ? AND deleted_at IS NULL", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+	if livestream.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's viewer history")
+	}
+
+	// 退出時に行が削除されるので、残っている行が現在の視聴者
+	var history LivestreamViewerHistory
+	if err := tx.GetContext(ctx, &history.CurrentViewers, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count current viewers: "+err.Error())
+	}
+	// 延べ視聴者数と推移は、退出しても消えない入室の記録から求める
+	if err := tx.GetContext(ctx, &history.UniqueViewers, "SELECT COUNT(DISTINCT user_id) FROM livestream_viewer_entries WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count unique viewers: "+err.Error())
+	}
+
+	if bucket > 0 {
+		query := `
+		SELECT (created_at DIV ?) * ? AS bucket_start, COUNT(DISTINCT user_id) AS count
+		FROM livestream_viewer_entries
+		WHERE livestream_id = ?
+		GROUP BY bucket_start
+		ORDER BY bucket_start ASC`
+		history.Series = []LivestreamViewerHistoryBucket{}
+		if err := tx.SelectContext(ctx, &history.Series, query, bucket, bucket, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to aggregate viewer history: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
+
+// 配信のリアクション推移
+// GET /api/livestream/:livestream_id/reactions/histogram?bucket=60
+// 配信の start_at から end_at までを bucket 秒ごとに区切ったリアクション数を返す。リアクションの無い区間も0として含める
+func getReactionHistogramHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := parseID(c, "livestream_id")
+	if err != nil {
+		return err
+	}
+
+	var bucket int64 = 60
+	if c.QueryParam("bucket") != "" {
+		b, err := strconv.Atoi(c.QueryParam("bucket"))
+		if err != nil || b <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "bucket query parameter must be positive integer")
+		}
+		bucket = int64(b)
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestream LivestreamModel
+	if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ? AND deleted_at IS NULL", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+	if livestream.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's reaction histogram")
+	}
+
+	bucketCount := (livestream.EndAt - livestream.StartAt + bucket - 1) / bucket
+	if bucketCount > maxReactionHistogramBuckets {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("bucket query parameter is too small: at most %d buckets are allowed", maxReactionHistogramBuckets))
+	}
+
+	query := `
+	SELECT ? + ((created_at - ?) DIV ?) * ? AS bucket_start, COUNT(*) AS count
+	FROM reactions
+	WHERE livestream_id = ? AND created_at >= ? AND created_at < ?
+	GROUP BY bucket_start`
+	var counts []ReactionHistogramBucket
+	if err := tx.SelectContext(ctx, &counts, query, livestream.StartAt, livestream.StartAt, bucket, bucket, livestreamID, livestream.StartAt, livestream.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to aggregate reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	countByBucket := make(map[int64]int64, len(counts))
+	for _, cnt := range counts {
+		countByBucket[cnt.BucketStart] = cnt.Count
+	}
+	histogram := make([]ReactionHistogramBucket, 0, bucketCount)
+	for start := livestream.StartAt; start < livestream.EndAt; start += bucket {
+		histogram = append(histogram, ReactionHistogramBucket{
+			BucketStart: start,
+			Count:       countByBucket[start],
+		})
+	}
+
+	return c.JSON(http.StatusOK, histogram)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getTestViewerHistory は配信の視聴者推移を取得する
+func getTestViewerHistory(t *testing.T, userID, livestreamID int64, query string) LivestreamViewerHistory {
+	t.Helper()
+	var history LivestreamViewerHistory
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/viewers"+query, nil, userID), http.StatusOK, &history)
+	return history
+}
+
+func TestViewerHistoryEnterExit(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	history := getTestViewerHistory(t, streamerID, livestreamID, "")
+	if history.CurrentViewers != 0 || history.UniqueViewers != 0 {
+		t.Fatalf("never entered livestream = %+v, want zeros", history)
+	}
+
+	enterTestLivestream(t, aliceID, livestreamID)
+	enterTestLivestream(t, bobID, livestreamID)
+	exitTestLivestream(t, aliceID, livestreamID)
+	// 退出後の再入室は延べ視聴者数を増やさない
+	enterTestLivestream(t, bobID, livestreamID)
+
+	history = getTestViewerHistory(t, streamerID, livestreamID, "")
+	if history.CurrentViewers != 1 {
+		t.Errorf("current_viewers = %d, want 1", history.CurrentViewers)
+	}
+	if history.UniqueViewers != 2 {
+		t.Errorf("unique_viewers = %d, want 2", history.UniqueViewers)
+	}
+
+	exitTestLivestream(t, bobID, livestreamID)
+	history = getTestViewerHistory(t, streamerID, livestreamID, "")
+	if history.CurrentViewers != 0 || history.UniqueViewers != 2 {
+		t.Errorf("after everyone exited = %+v, want current 0 and unique 2", history)
+	}
+}
+
+func TestViewerHistoryBuckets(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	for _, entry := range []struct {
+		userID    int64
+		createdAt int64
+	}{
+		{aliceID, testTermStart + 10},
+		{bobID, testTermStart + 50},
+		// 同じ区間内の再入室は1人として数える
+		{aliceID, testTermStart + 59},
+		{aliceID, testTermStart + 130},
+	} {
+		mustExec(t, "INSERT INTO livestream_viewer_entries (user_id, livestream_id, created_at) VALUES (?, ?, ?)", entry.userID, livestreamID, entry.createdAt)
+	}
+	warmTestCaches(t)
+
+	history := getTestViewerHistory(t, streamerID, livestreamID, "?bucket=60")
+	want := []LivestreamViewerHistoryBucket{
+		{BucketStart: testTermStart, Count: 2},
+		{BucketStart: testTermStart + 120, Count: 1},
+	}
+	if len(history.Series) != len(want) {
+		t.Fatalf("series = %+v, want %+v", history.Series, want)
+	}
+	for i := range want {
+		if history.Series[i] != want[i] {
+			t.Errorf("series[%d] = %+v, want %+v", i, history.Series[i], want[i])
+		}
+	}
+	if history.UniqueViewers != 2 {
+		t.Errorf("unique_viewers = %d, want 2", history.UniqueViewers)
+	}
+}
+
+func TestViewerHistoryRejectsOthers(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	otherID := insertTestUser(t, "other")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	rec := doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/viewers", nil, otherID)
+	decodeResponse(t, rec, http.StatusForbidden, nil)
+	rec = doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/viewers?bucket=0", nil, streamerID)
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestViewerHistoryAndHistogramIgnoreDeletedLivestreams(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	mustExec(t, "UPDATE livestreams SET deleted_at = ? WHERE id = ?", testTermStart, livestreamID)
+	warmTestCaches(t)
+
+	// 削除済みの配信は存在しないものとして扱う
+	for _, path := range []string{"/viewers", "/viewers?bucket=60", "/reactions/histogram"} {
+		rec := doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+path, nil, streamerID)
+		decodeResponse(t, rec, http.StatusNotFound, nil)
+	}
+}
+
+// getTestLivestreamStatistics は配信の統計情報を取得する
+func getTestLivestreamStatistics(t *testing.T, userID, livestreamID int64) LivestreamStatistics {
+	t.Helper()
+	var stats LivestreamStatistics
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/"+itoa(livestreamID)+"/statistics", nil, userID), http.StatusOK, &stats)
+	return stats
+}
+
+func TestReactionRatePerMinute(t *testing.T) {
+	tests := []struct {
+		name                  string
+		total, start, end, at int64
+		want                  float64
+	}{
+		{name: "no reactions", total: 0, start: 0, end: 3600, at: 600, want: 0},
+		{name: "live", total: 30, start: 0, end: 3600, at: 600, want: 3},
+		{name: "ended", total: 60, start: 0, end: 1200, at: 3600, want: 3},
+		{name: "under a minute", total: 5, start: 0, end: 3600, at: 10, want: 5},
+	}
+	for _, tt := range tests {
+		if got := reactionRatePerMinute(tt.total, tt.start, tt.end, tt.at); got != tt.want {
+			t.Errorf("%s: reactionRatePerMinute = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLivestreamStatisticsReactionVelocity(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	now := time.Now().Unix()
+	livestreamID := insertTestLivestream(t, streamerID, "live", now-600, now+600)
+	quietID := insertTestLivestream(t, streamerID, "quiet", now-600, now+600)
+	// 直近1分以内が3件、それより前が2件
+	for _, ago := range []int64{1, 20, 50, 120, 500} {
+		insertTestReaction(t, streamerID, livestreamID, "tada", now-ago)
+	}
+	insertTestReaction(t, streamerID, quietID, "tada", now-300)
+	warmTestCaches(t)
+
+	stats := getTestLivestreamStatistics(t, streamerID, livestreamID)
+	if stats.ReactionsLastMinute != 3 {
+		t.Errorf("reactions_last_minute = %d, want 3", stats.ReactionsLastMinute)
+	}
+	if stats.TotalReactions != 5 {
+		t.Errorf("total_reactions = %d, want 5", stats.TotalReactions)
+	}
+	// 開始から約10分で5件
+	if stats.ReactionsPerMinute < 0.45 || stats.ReactionsPerMinute > 0.55 {
+		t.Errorf("reactions_per_minute = %v, want about 0.5", stats.ReactionsPerMinute)
+	}
+
+	if quiet := getTestLivestreamStatistics(t, streamerID, quietID); quiet.ReactionsLastMinute != 0 {
+		t.Errorf("quiet reactions_last_minute = %d, want 0", quiet.ReactionsLastMinute)
+	}
+}
+
+func TestLivestreamStatisticsUniqueViewers(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	aliceID := insertTestUser(t, "alice")
+	bobID := insertTestUser(t, "bob")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	stats := getTestLivestreamStatistics(t, streamerID, livestreamID)
+	if stats.UniqueViewersCount != 0 || stats.TotalEnters != 0 {
+		t.Errorf("never entered = unique %d, total %d; want zeros", stats.UniqueViewersCount, stats.TotalEnters)
+	}
+
+	// alice は退出して再入室する
+	enterTestLivestream(t, aliceID, livestreamID)
+	exitTestLivestream(t, aliceID, livestreamID)
+	enterTestLivestream(t, aliceID, livestreamID)
+	enterTestLivestream(t, bobID, livestreamID)
+
+	stats = getTestLivestreamStatistics(t, streamerID, livestreamID)
+	if stats.UniqueViewersCount != 2 {
+		t.Errorf("unique_viewers_count = %d, want 2", stats.UniqueViewersCount)
+	}
+	if stats.TotalEnters != 3 {
+		t.Errorf("total_enters = %d, want 3", stats.TotalEnters)
+	}
+	if stats.ViewersCount != 2 {
+		t.Errorf("viewers_count = %d, want 2", stats.ViewersCount)
+	}
+}
+
+func TestIsReactionSpike(t *testing.T) {
+	tests := []struct {
+		name      string
+		perSecond []int64
+		want      bool
+	}{
+		{name: "no reactions", perSecond: nil, want: false},
+		{name: "steady", perSecond: []int64{2, 3, 2, 2, 3}, want: false},
+		{name: "just 10x the median", perSecond: []int64{2, 2, 20}, want: false},
+		{name: "over 10x the median", perSecond: []int64{2, 2, 21}, want: true},
+		{name: "even count uses the middle average", perSecond: []int64{1, 3, 3, 21}, want: false},
+		{name: "even count burst", perSecond: []int64{1, 3, 3, 40}, want: true},
+		{name: "single second", perSecond: []int64{50}, want: false},
+	}
+	for _, tt := range tests {
+		if got := isReactionSpike(tt.perSecond, 10); got != tt.want {
+			t.Errorf("%s: isReactionSpike(%v, 10) = %v, want %v", tt.name, tt.perSecond, got, tt.want)
+		}
+	}
+}
+
+func TestLivestreamStatisticsSuspicious(t *testing.T) {
+	setupTestDB(t)
+	setTestVar(t, &reactionSpikeMultiplier, 10)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	steady := insertTestLivestream(t, streamerID, "steady", testTermStart, testTermStart+3600)
+	bursty := insertTestLivestream(t, streamerID, "bursty", testTermStart, testTermStart+3600)
+	insertReactions := func(livestreamID int64, n int, createdAt int64) {
+		args := make([]interface{}, 0, n*4)
+		for i := 0; i < n; i++ {
+			args = append(args, viewerID, livestreamID, "tada", createdAt)
+		}
+		mustExec(t, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES "+strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?),", n), ","), args...)
+	}
+	for sec := int64(0); sec < 30; sec++ {
+		insertReactions(steady, 2+int(sec%2), testTermStart+sec)
+		insertReactions(bursty, 2+int(sec%2), testTermStart+sec)
+	}
+	// bot による1秒間の急増
+	insertReactions(bursty, 100, testTermStart+30)
+	warmTestCaches(t)
+
+	if stats := getTestLivestreamStatistics(t, streamerID, steady); stats.Suspicious == nil || *stats.Suspicious {
+		t.Errorf("steady suspicious = %v, want false", stats.Suspicious)
+	}
+	if stats := getTestLivestreamStatistics(t, streamerID, bursty); stats.Suspicious == nil || !*stats.Suspicious {
+		t.Errorf("bursty suspicious = %v, want true", stats.Suspicious)
+	}
+	// 配信者以外には含めない
+	if stats := getTestLivestreamStatistics(t, viewerID, bursty); stats.Suspicious != nil {
+		t.Errorf("viewer suspicious = %v, want omitted", *stats.Suspicious)
+	}
+	// 倍率を上げれば同じ急増でも検知しない
+	setTestVar(t, &reactionSpikeMultiplier, 50)
+	if stats := getTestLivestreamStatistics(t, streamerID, bursty); stats.Suspicious == nil || *stats.Suspicious {
+		t.Errorf("bursty suspicious with multiplier 50 = %v, want false", stats.Suspicious)
+	}
+}
+
+func TestReactionHistogram(t *testing.T) {
+	setupTestDB(t)
+	ownerID := insertTestUser(t, "owner")
+	viewerID := insertTestUser(t, "viewer")
+	livestreamID := insertTestLivestream(t, ownerID, "live", testTermStart, testTermStart+250)
+	for _, offset := range []int64{-1, 0, 59, 130, 249, 250} {
+		insertTestReaction(t, viewerID, livestreamID, "smile", testTermStart+offset)
+	}
+	warmTestCaches(t)
+	target := "/api/livestream/" + itoa(livestreamID) + "/reactions/histogram"
+
+	// 配信時間外のリアクションは数えず、最後の区間は end_at までの端数
+	var histogram []ReactionHistogramBucket
+	decodeResponse(t, doRequest(t, http.MethodGet, target+"?bucket=60", nil, ownerID), http.StatusOK, &histogram)
+	want := []ReactionHistogramBucket{
+		{BucketStart: testTermStart, Count: 2},
+		{BucketStart: testTermStart + 60, Count: 0},
+		{BucketStart: testTermStart + 120, Count: 1},
+		{BucketStart: testTermStart + 180, Count: 0},
+		{BucketStart: testTermStart + 240, Count: 1},
+	}
+	if len(histogram) != len(want) {
+		t.Fatalf("histogram = %+v, want %+v", histogram, want)
+	}
+	for i := range want {
+		if histogram[i] != want[i] {
+			t.Errorf("histogram[%d] = %+v, want %+v", i, histogram[i], want[i])
+		}
+	}
+
+	// 省略時は60秒ごと
+	var defaulted []ReactionHistogramBucket
+	decodeResponse(t, doRequest(t, http.MethodGet, target, nil, ownerID), http.StatusOK, &defaulted)
+	if len(defaulted) != len(want) {
+		t.Errorf("default bucket returned %d buckets, want %d", len(defaulted), len(want))
+	}
+
+	var single []ReactionHistogramBucket
+	decodeResponse(t, doRequest(t, http.MethodGet, target+"?bucket=1000", nil, ownerID), http.StatusOK, &single)
+	if len(single) != 1 || single[0] != (ReactionHistogramBucket{BucketStart: testTermStart, Count: 4}) {
+		t.Errorf("single bucket histogram = %+v, want one bucket with 4 reactions", single)
+	}
+
+	if rec := doRequest(t, http.MethodGet, target, nil, viewerID); rec.Code != http.StatusForbidden {
+		t.Errorf("other user's histogram status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	for _, bucket := range []string{"0", "-60", "x"} {
+		if rec := doRequest(t, http.MethodGet, target+"?bucket="+bucket, nil, ownerID); rec.Code != http.StatusBadRequest {
+			t.Errorf("bucket=%s status = %d, want %d", bucket, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if rec := doRequest(t, http.MethodGet, "/api/livestream/999999/reactions/histogram", nil, ownerID); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown livestream status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestReactionHistogramBucketLimit(t *testing.T) {
+	setupTestDB(t)
+	ownerID := insertTestUser(t, "owner")
+	livestreamID := insertTestLivestream(t, ownerID, "live", testTermStart, testTermStart+maxReactionHistogramBuckets+1)
+	warmTestCaches(t)
+	target := "/api/livestream/" + itoa(livestreamID) + "/reactions/histogram?bucket="
+
+	if rec := doRequest(t, http.MethodGet, target+"1", nil, ownerID); rec.Code != http.StatusBadRequest {
+		t.Errorf("too many buckets status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var histogram []ReactionHistogramBucket
+	decodeResponse(t, doRequest(t, http.MethodGet, target+"2", nil, ownerID), http.StatusOK, &histogram)
+	if len(histogram) != maxReactionHistogramBuckets/2+1 {
+		t.Errorf("histogram has %d buckets, want %d", len(histogram), maxReactionHistogramBuckets/2+1)
+	}
+}
+
+func TestUserStatisticsFavoriteEmojiTies(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	first := insertTestLivestream(t, streamerID, "first", testTermStart, testTermStart+3600)
+	second := insertTestLivestream(t, streamerID, "second", testTermStart+3600, testTermStart+7200)
+	// 配信をまたいで数え、同数なら絵文字名の降順で先のものを返す (リアクション集計の昇順とは異なる)
+	insertTestReaction(t, viewerID, first, "wave", testTermStart)
+	insertTestReaction(t, viewerID, first, "tada", testTermStart+1)
+	insertTestReaction(t, viewerID, second, "wave", testTermStart+3600)
+	insertTestReaction(t, viewerID, second, "tada", testTermStart+3601)
+	insertTestReaction(t, viewerID, second, "smile", testTermStart+3602)
+	warmTestCaches(t)
+
+	var stats UserStatistics
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/user/streamer/statistics", nil, viewerID), http.StatusOK, &stats)
+	if stats.FavoriteEmoji != "wave" || stats.TotalReactions != 5 {
+		t.Errorf("statistics = %+v, want favorite wave out of 5 reactions", stats)
+	}
+
+	// 1件増えればそちらが単独の最多になる
+	insertTestReaction(t, viewerID, second, "tada", testTermStart+3603)
+	decodeResponse(t, doRequest(t, http.MethodGet, "/api/user/streamer/statistics", nil, viewerID), http.StatusOK, &stats)
+	if stats.FavoriteEmoji != "tada" {
+		t.Errorf("favorite emoji = %q, want tada", stats.FavoriteEmoji)
+	}
+}
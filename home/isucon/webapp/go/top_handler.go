@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"sort"
+	"sync"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
 
@@ -22,17 +28,192 @@ type TagsResponse struct {
 	Tags []*Tag `json:"tags"`
 }
 
+// tagCache はタグのIDと名前からの引き当てを保持するキャッシュ
+// タグはAPIから追加・変更されないので、/api/initialize で全件を載せれば以降はDBを引かない
+// 載せる前(初期化前に起動した直後など)はDBから引く
+type tagCache struct {
+	mu     sync.RWMutex
+	loaded bool
+	byID   map[int64]Tag
+	byName map[string][]int64
+	// sorted はタグ一覧APIと同じく名前順(同名ならID順)に並べた全タグ
+	sorted []Tag
+}
+
+var (
+	tagsCache = &tagCache{}
+	// ISUCON13_DISABLE_TAG_CACHE が設定されていればキャッシュを使わない
+	tagCacheEnabled = os.Getenv("ISUCON13_DISABLE_TAG_CACHE") == ""
+)
+
+func (tc *tagCache) load(tagModels []TagModel) {
+	byID := make(map[int64]Tag, len(tagModels))
+	byName := make(map[string][]int64, len(tagModels))
+	for _, tagModel := range tagModels {
+		byID[tagModel.ID] = Tag{
+			ID:   tagModel.ID,
+			Name: tagModel.Name,
+		}
+		byName[tagModel.Name] = append(byName[tagModel.Name], tagModel.ID)
+	}
+	sorted := make([]Tag, 0, len(byID))
+	for _, tag := range byID {
+		sorted = append(sorted, tag)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.loaded = true
+	tc.byID = byID
+	tc.byName = byName
+	tc.sorted = sorted
+}
+
+// sortedTags は名前順の全タグを返す。キャッシュを載せていなければokがfalseになる
+func (tc *tagCache) sortedTags() (tags []*Tag, ok bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if !tc.loaded {
+		return nil, false
+	}
+	tags = make([]*Tag, len(tc.sorted))
+	for i := range tc.sorted {
+		tag := tc.sorted[i]
+		tags[i] = &tag
+	}
+	return tags, true
+}
+
+// idsByName はキャッシュを載せていなければokがfalseになる
+func (tc *tagCache) idsByName(name string) (ids []int64, ok bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if !tc.loaded {
+		return nil, false
+	}
+	return tc.byName[name], true
+}
+
+// tagsByIDs はキャッシュを載せていなければokがfalseになる
+// キャッシュに無いIDは結果のマップに含まれない
+func (tc *tagCache) tagsByIDs(ids []int64) (tags map[int64]Tag, ok bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if !tc.loaded {
+		return nil, false
+	}
+	tags = make(map[int64]Tag, len(ids))
+	for _, id := range ids {
+		if tag, ok := tc.byID[id]; ok {
+			tags[id] = tag
+		}
+	}
+	return tags, true
+}
+
+func (tc *tagCache) reset() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.loaded = false
+	tc.byID = nil
+	tc.byName = nil
+	tc.sorted = nil
+}
+
+// warmTagCache は全タグをキャッシュに載せる
+func warmTagCache(ctx context.Context) error {
+	tagsCache.reset()
+	if !tagCacheEnabled {
+		return nil
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var tagModels []TagModel
+	if err := tx.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
+		return err
+	}
+	tagsCache.load(tagModels)
+
+	return tx.Commit()
+}
+
+// getTagIDsByName は名前が name のタグのIDを返す
+func getTagIDsByName(ctx context.Context, tx *sqlx.Tx, name string) ([]int64, error) {
+	if ids, ok := tagsCache.idsByName(name); ok {
+		return ids, nil
+	}
+	var ids []int64
+	if err := tx.SelectContext(ctx, &ids, "SELECT id FROM tags WHERE name = ?", name); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// getTagsByIDs はタグをIDをキーにしたマップで返す
+// DBに存在しないIDは結果のマップに含まれない
+func getTagsByIDs(ctx context.Context, tx *sqlx.Tx, tagIDs []int64) (map[int64]Tag, error) {
+	if tags, ok := tagsCache.tagsByIDs(tagIDs); ok {
+		return tags, nil
+	}
+	tags := make(map[int64]Tag, len(tagIDs))
+	if len(tagIDs) == 0 {
+		return tags, nil
+	}
+
+	var tagModels []TagModel
+	query, args, err := sqlx.In("SELECT * FROM tags WHERE id IN (?)", tagIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build tag query: %w", err)
+	}
+	query = tx.Rebind(query)
+	done := traceQuery(ctx, query)
+	err = tx.SelectContext(ctx, &tagModels, query, args...)
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch tags: %w", err)
+	}
+	for _, tagModel := range tagModels {
+		tags[tagModel.ID] = Tag{
+			ID:   tagModel.ID,
+			Name: tagModel.Name,
+		}
+	}
+	return tags, nil
+}
+
+// タグ一覧取得API
+// GET /api/tag
+// タグは公開情報なのでセッション不要。フロントエンドの表示が揺れないよう名前順で返す
+// タグキャッシュを載せていればDBは引かない
 func getTagHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	if tags, ok := tagsCache.sortedTags(); ok {
+		return c.JSON(http.StatusOK, &TagsResponse{
+			Tags: tags,
+		})
+	}
+
+	ctx, cancel := txContext(c)
+	defer cancel()
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin new transaction: : "+err.Error()+err.Error())
 	}
 	defer tx.Rollback()
 
 	var tagModels []*TagModel
-	if err := tx.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
+	if err := tx.SelectContext(ctx, &tagModels, "SELECT * FROM tags ORDER BY name ASC, id ASC"); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
 	}
 
@@ -55,7 +236,8 @@ func getTagHandler(c echo.Context) error {
 // 配信者のテーマ取得API
 // GET /api/user/:username/theme
 func getStreamerThemeHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
@@ -65,7 +247,7 @@ func getStreamerThemeHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetTagHandlerSortsByName(t *testing.T) {
+	setupTestDB(t)
+	// 挿入順 (id順) と名前順が異なるようにする。tags.name は utf8mb4_bin なので大文字が先に並ぶ
+	names := []string{"music", "あいう", "Game", "art", "zoo"}
+	for _, name := range names {
+		insertTestTag(t, name)
+	}
+	warmTestCaches(t)
+	want := []string{"Game", "art", "music", "zoo", "あいう"}
+
+	recorder := recordQueries(t)
+	// 1回目はキャッシュから、2回目はキャッシュを捨ててDBから引き、同じ順序になること
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			tagsCache.reset()
+		}
+		recorder.reset()
+		var res TagsResponse
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/tag", nil, 0), http.StatusOK, &res)
+		if len(res.Tags) != len(want) {
+			t.Fatalf("tags = %d, want %d", len(res.Tags), len(want))
+		}
+		for j, tag := range res.Tags {
+			if tag.Name != want[j] || tag.ID == 0 {
+				t.Errorf("request %d tag %d = %+v, want name %q", i, j, tag, want[j])
+			}
+		}
+		wantQueries := i
+		if q := recorder.matching("FROM tags"); len(q) != wantQueries {
+			t.Errorf("request %d tag queries = %d, want %d", i, len(q), wantQueries)
+		}
+	}
+}
+
+func TestTagCacheResolvesNames(t *testing.T) {
+	tc := &tagCache{}
+	if _, ok := tc.idsByName("music"); ok {
+		t.Error("idsByName before load is ok")
+	}
+	if _, ok := tc.tagsByIDs([]int64{1}); ok {
+		t.Error("tagsByIDs before load is ok")
+	}
+	tc.load([]TagModel{{ID: 1, Name: "music"}, {ID: 2, Name: "game"}})
+	if ids, ok := tc.idsByName("music"); !ok || !equalIDs(ids, []int64{1}) {
+		t.Errorf("idsByName(music) = %v, %v, want [1]", ids, ok)
+	}
+	if ids, ok := tc.idsByName("none"); !ok || len(ids) != 0 {
+		t.Errorf("idsByName(none) = %v, %v, want a cached miss", ids, ok)
+	}
+	if tags, ok := tc.tagsByIDs([]int64{2, 3}); !ok || len(tags) != 1 || tags[2].Name != "game" {
+		t.Errorf("tagsByIDs([2 3]) = %v, %v, want only game", tags, ok)
+	}
+	tc.reset()
+	if _, ok := tc.idsByName("music"); ok {
+		t.Error("idsByName after reset is ok")
+	}
+}
+
+func TestSearchByTagIsServedFromTagCache(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	musicID := insertTestTag(t, "music")
+	livestreamID := insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	mustExec(t, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", livestreamID, musicID)
+	insertTestLivestream(t, streamerID, "untagged", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+
+	recorder := recordQueries(t)
+	// キャッシュを載せた後はタグを引くクエリを発行しない
+	recorder.injectErrors(func(query string) error {
+		if strings.Contains(query, "FROM tags") {
+			return errors.New("tags queried despite the cache")
+		}
+		return nil
+	})
+	if got := searchTestLivestreams(t, streamerID, "?tag=music"); !equalIDs(got, []int64{livestreamID}) {
+		t.Errorf("tag=music = %v, want %v", got, []int64{livestreamID})
+	}
+	if got := searchTestLivestreams(t, streamerID, "?tag=none"); len(got) != 0 {
+		t.Errorf("tag=none = %v, want empty", got)
+	}
+	if q := recorder.matching("FROM tags"); len(q) != 0 {
+		t.Errorf("tag queries after warmup = %d, want 0", len(q))
+	}
+
+	// 初期化で読み直すまではDBから引く
+	recorder.injectErrors(nil)
+	tagsCache.reset()
+	recorder.reset()
+	if got := searchTestLivestreams(t, streamerID, "?tag=music"); !equalIDs(got, []int64{livestreamID}) {
+		t.Errorf("tag=music without the cache = %v, want %v", got, []int64{livestreamID})
+	}
+	if q := recorder.matching("FROM tags WHERE name = ?"); len(q) != 1 {
+		t.Errorf("tag name queries without the cache = %d, want 1", len(q))
+	}
+	// 初期化後に追加したタグも読み直せば引ける
+	insertTestTag(t, "game")
+	if err := warmTagCache(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ids, ok := tagsCache.idsByName("game"); !ok || len(ids) != 1 {
+		t.Errorf("idsByName(game) after reload = %v, %v, want one id", ids, ok)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -85,12 +86,132 @@ type PostIconResponse struct {
 	ID int64 `json:"id"`
 }
 
+// userCache は配信者などよく参照されるユーザのレスポンスを保持するキャッシュ
+// /api/initialize で温め、ユーザ情報が変わったら該当ユーザを破棄する
+type userCache struct {
+	mu    sync.RWMutex
+	users map[int64]User
+}
+
+var (
+	usersCache = &userCache{users: map[int64]User{}}
+	// ISUCON13_DISABLE_USER_CACHE が設定されていればキャッシュを使わない
+	userCacheEnabled = os.Getenv("ISUCON13_DISABLE_USER_CACHE") == ""
+)
+
+func (uc *userCache) get(id int64) (User, bool) {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	user, ok := uc.users[id]
+	return user, ok
+}
+
+func (uc *userCache) set(users map[int64]User) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	for id, user := range users {
+		uc.users[id] = user
+	}
+}
+
+func (uc *userCache) invalidate(id int64) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	delete(uc.users, id)
+}
+
+func (uc *userCache) reset() {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.users = map[int64]User{}
+}
+
+// warmUserCache は配信を持つユーザをキャッシュに載せる
+func warmUserCache(ctx context.Context) error {
+	usersCache.reset()
+	if !userCacheEnabled {
+		return nil
+	}
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, "SELECT * FROM users WHERE id IN (SELECT DISTINCT user_id FROM livestreams)"); err != nil {
+		return err
+	}
+	if len(userModels) == 0 {
+		return tx.Commit()
+	}
+	users, err := fillUserResponseBulk(ctx, tx, userModels)
+	if err != nil {
+		return err
+	}
+	usersCache.set(users)
+
+	return tx.Commit()
+}
+
+// getUsersByIDs はキャッシュにあるユーザはキャッシュから、無いユーザのみDBから取得する
+// DBに存在しないIDは結果のマップに含まれない
+func getUsersByIDs(ctx context.Context, tx *sqlx.Tx, userIDs []int64) (map[int64]User, error) {
+	users := make(map[int64]User, len(userIDs))
+	missIDs := make([]int64, 0, len(userIDs))
+	for _, id := range userIDs {
+		if _, ok := users[id]; ok {
+			continue
+		}
+		if userCacheEnabled {
+			if user, ok := usersCache.get(id); ok {
+				users[id] = user
+				continue
+			}
+		}
+		missIDs = append(missIDs, id)
+	}
+	if len(missIDs) == 0 {
+		return users, nil
+	}
+
+	var userModels []UserModel
+	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", missIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build user query: %w", err)
+	}
+	query = tx.Rebind(query)
+	done := traceQuery(ctx, query)
+	err = tx.SelectContext(ctx, &userModels, query, args...)
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch users: %w", err)
+	}
+	if len(userModels) == 0 {
+		return users, nil
+	}
+	fetched, err := fillUserResponseBulk(ctx, tx, userModels)
+	if err != nil {
+		return nil, err
+	}
+	if userCacheEnabled {
+		usersCache.set(fetched)
+	}
+	for id, user := range fetched {
+		users[id] = user
+	}
+
+	return users, nil
+}
+
 func getIconHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -117,24 +238,20 @@ func getIconHandler(c echo.Context) error {
 }
 
 func postIconHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := sessionUserID(c)
 
 	var req *PostIconRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must not be null")
+	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -157,6 +274,9 @@ func postIconHandler(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	// アイコンハッシュが変わるのでキャッシュを破棄
+	usersCache.invalidate(userID)
+	livestreamResponseCache.invalidateOwner(userID)
 
 	return c.JSON(http.StatusCreated, &PostIconResponse{
 		ID: iconID,
@@ -164,7 +284,8 @@ func postIconHandler(c echo.Context) error {
 }
 
 func getMeHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
@@ -176,7 +297,7 @@ func getMeHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -206,7 +327,8 @@ func getMeHandler(c echo.Context) error {
 // ユーザ登録API
 // POST /api/register
 func registerHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 	defer c.Request().Body.Close()
 
 	req := PostUserRequest{}
@@ -223,7 +345,7 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -275,7 +397,8 @@ func registerHandler(c echo.Context) error {
 // ユーザログインAPI
 // POST /api/login
 func loginHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 	defer c.Request().Body.Close()
 
 	req := LoginRequest{}
@@ -283,7 +406,7 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -311,7 +434,7 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
 	}
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
+	sessionEndAt := time.Now().Add(sessionLifetime)
 
 	sessionID := uuid.NewString()
 
@@ -320,11 +443,7 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
 	}
 
-	sess.Options = &sessions.Options{
-		Domain: "u.isucon.local",
-		MaxAge: int(60000),
-		Path:   "/",
-	}
+	sess.Options = newSessionOptions()
 	sess.Values[defaultSessionIDKey] = sessionID
 	sess.Values[defaultUserIDKey] = userModel.ID
 	sess.Values[defaultUsernameKey] = userModel.Name
@@ -337,10 +456,62 @@ func loginHandler(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
+// ログイン・セッション延長からセッションが切れるまでの時間
+const sessionLifetime = 1 * time.Hour
+
+func newSessionOptions() *sessions.Options {
+	return &sessions.Options{
+		Domain: "u.isucon.local",
+		MaxAge: int(60000),
+		Path:   "/",
+	}
+}
+
+// セッション延長API
+// POST /api/session/refresh
+// 有効なセッションの期限を現在から sessionLifetime 後まで延ばし、ログイン中のユーザを返す
+// 配信の視聴中にセッションが切れて再ログインが必要になるのを防ぐ
+func refreshSessionHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+
+	userID := sessionUserID(c)
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	users, err := getUsersByIDs(ctx, tx, []int64{userID})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	user, ok := users[userID]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	sess.Options = newSessionOptions()
+	sess.Values[defaultSessionExpiresKey] = time.Now().Add(sessionLifetime).Unix()
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
 // ユーザ詳細API
 // GET /api/user/:username
 func getUserHandler(c echo.Context) error {
-	ctx := c.Request().Context()
+	ctx, cancel := txContext(c)
+	defer cancel()
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
@@ -348,7 +519,7 @@ func getUserHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, readOnlyTxOptions)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -374,6 +545,70 @@ func getUserHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+// UserProfile はユーザ情報と配信者としての集計
+type UserProfile struct {
+	User
+	LivestreamsCount int64 `json:"livestreams_count"`
+	TotalReactions   int64 `json:"total_reactions"`
+	TotalTip         int64 `json:"total_tip"`
+}
+
+// ユーザプロフィール取得API
+// GET /api/user/:username/profile
+// プロフィール画面でユーザ情報と配信一覧を別々に取得しなくて済むよう、集計値をまとめて返す
+func getUserProfileHandler(c echo.Context) error {
+	ctx, cancel := txContext(c)
+	defer cancel()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	username := c.Param("username")
+
+	tx, err := beginTx(ctx, readOnlyTxOptions)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	profile := UserProfile{User: user}
+	if err := tx.GetContext(ctx, &profile.LivestreamsCount, "SELECT COUNT(*) FROM livestreams WHERE user_id = ? AND deleted_at IS NULL", userModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestreams: "+err.Error())
+	}
+	if err := tx.GetContext(ctx, &profile.TotalReactions, `
+		SELECT COUNT(*) FROM livestreams l
+		INNER JOIN reactions r ON r.livestream_id = l.id
+		WHERE l.user_id = ? AND l.deleted_at IS NULL`, userModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
+	}
+	if err := tx.GetContext(ctx, &profile.TotalTip, `
+		SELECT IFNULL(SUM(l2.tip), 0) FROM livestreams l
+		INNER JOIN livecomments l2 ON l2.livestream_id = l.id
+		WHERE l.user_id = ? AND l.deleted_at IS NULL`, userModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, profile)
+}
+
 func verifyUserSession(c echo.Context) error {
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
@@ -398,6 +633,37 @@ func verifyUserSession(c echo.Context) error {
 	return nil
 }
 
+// requireSession のミドルウェアがログイン中のユーザIDを載せるキー
+const sessionUserIDContextKey = "session_user_id"
+
+// requireSession はセッションを検証するミドルウェア
+// ハンドラがパスパラメータの解釈やDBアクセスをする前に401を返し、ログイン中のユーザIDを sessionUserID で読めるようにする
+func requireSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// ログインしていない(セッションが無い)場合、verifyUserSession は403を返すが、変更系のAPIでは401に揃える
+		if sess, err := session.Get(defaultSessionIDKey, c); err == nil {
+			if _, ok := sess.Values[defaultSessionExpiresKey]; !ok {
+				return echo.NewHTTPError(http.StatusUnauthorized, "login required")
+			}
+		}
+		if err := verifyUserSession(c); err != nil {
+			// echo.NewHTTPErrorが返っているのでそのまま出力
+			return err
+		}
+		// error already checked
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		// existence already checked
+		c.Set(sessionUserIDContextKey, sess.Values[defaultUserIDKey].(int64))
+		return next(c)
+	}
+}
+
+// sessionUserID は requireSession を通ったリクエストのログイン中のユーザIDを返す
+func sessionUserID(c echo.Context) int64 {
+	userID, _ := c.Get(sessionUserIDContextKey).(int64)
+	return userID
+}
+
 func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
 	themeModel := ThemeModel{}
 	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
@@ -432,81 +698,85 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 }
 
 func fillUserResponseBulk(ctx context.Context, tx *sqlx.Tx, userModels []UserModel) (map[int64]User, error) {
-    // 1. ユーザーIDの収集
-    userIDs := make([]int64, 0, len(userModels))
-    for _, userModel := range userModels {
-        userIDs = append(userIDs, userModel.ID)
-    }
-
-    // 2. テーマの一括取得とマッピング
-    var themeModels []ThemeModel
-    query, args, err := sqlx.In("SELECT * FROM themes WHERE user_id IN (?)", userIDs)
-    if err != nil {
-        return nil, fmt.Errorf("failed to build theme query: %w", err)
-    }
-    query = tx.Rebind(query)
-    if err := tx.SelectContext(ctx, &themeModels, query, args...); err != nil {
-        return nil, fmt.Errorf("failed to fetch themes: %w", err)
-    }
-    themeMap := make(map[int64]ThemeModel)
-    for _, themeModel := range themeModels {
-        themeMap[themeModel.UserID] = themeModel
-    }
-
-    // 3. アイコンの一括取得とマッピング
-    var iconRows []struct {
-        UserID int64  `db:"user_id"`
-        Image  []byte `db:"image"`
-    }
-	
-    query, args, err = sqlx.In("SELECT user_id, image FROM icons WHERE user_id IN (?)", userIDs)
-    if err != nil {
-        return nil, fmt.Errorf("failed to build icon query: %w", err)
-    }
-    query = tx.Rebind(query)
-    if err := tx.SelectContext(ctx, &iconRows, query, args...); err != nil {
-        return nil, fmt.Errorf("failed to fetch icons: %w", err)
-    }
-    iconMap := make(map[int64][]byte)
-    for _, row := range iconRows {
-        iconMap[row.UserID] = row.Image
-    }
-
-    // 4. Userの組み立て
-    users := make(map[int64]User)
-    for _, userModel := range userModels {
-        // テーマを取得
-        themeModel, ok := themeMap[userModel.ID]
-        if !ok {
-            return nil, fmt.Errorf("theme not found for user ID %d", userModel.ID)
-        }
-        theme := Theme{
-            ID:       themeModel.ID,
-            DarkMode: themeModel.DarkMode,
-        }
-
-        // アイコンを取得
-        image, ok := iconMap[userModel.ID]
-        if !ok {
-            // アイコンが存在しない場合はフォールバック画像を読み込む
-            image, err = os.ReadFile(fallbackImage)
-            if err != nil {
-                return nil, fmt.Errorf("failed to read fallback image: %w", err)
-            }
-        }
-        iconHash := sha256.Sum256(image)
-
-        // Userを組み立て
-        users[userModel.ID] = User{
-            ID:          userModel.ID,
-            Name:        userModel.Name,
-            DisplayName: userModel.DisplayName,
-            Description: userModel.Description,
-            Theme:       theme,
-            IconHash:    fmt.Sprintf("%x", iconHash),
-        }
-    }
-
-    return users, nil
-}
+	// 空のIN句はsqlx.Inがエラーにするので、クエリを組み立てずに返す
+	if len(userModels) == 0 {
+		return map[int64]User{}, nil
+	}
+
+	// 1. ユーザーIDの収集
+	userIDs := make([]int64, 0, len(userModels))
+	for _, userModel := range userModels {
+		userIDs = append(userIDs, userModel.ID)
+	}
 
+	// 2. テーマの一括取得とマッピング
+	var themeModels []ThemeModel
+	query, args, err := sqlx.In("SELECT * FROM themes WHERE user_id IN (?)", userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build theme query: %w", err)
+	}
+	query = tx.Rebind(query)
+	if err := tx.SelectContext(ctx, &themeModels, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to fetch themes: %w", err)
+	}
+	themeMap := make(map[int64]ThemeModel)
+	for _, themeModel := range themeModels {
+		themeMap[themeModel.UserID] = themeModel
+	}
+
+	// 3. アイコンの一括取得とマッピング
+	var iconRows []struct {
+		UserID int64  `db:"user_id"`
+		Image  []byte `db:"image"`
+	}
+
+	query, args, err = sqlx.In("SELECT user_id, image FROM icons WHERE user_id IN (?)", userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build icon query: %w", err)
+	}
+	query = tx.Rebind(query)
+	if err := tx.SelectContext(ctx, &iconRows, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to fetch icons: %w", err)
+	}
+	iconMap := make(map[int64][]byte)
+	for _, row := range iconRows {
+		iconMap[row.UserID] = row.Image
+	}
+
+	// 4. Userの組み立て
+	users := make(map[int64]User)
+	for _, userModel := range userModels {
+		// テーマを取得
+		themeModel, ok := themeMap[userModel.ID]
+		if !ok {
+			return nil, fmt.Errorf("theme not found for user ID %d", userModel.ID)
+		}
+		theme := Theme{
+			ID:       themeModel.ID,
+			DarkMode: themeModel.DarkMode,
+		}
+
+		// アイコンを取得
+		image, ok := iconMap[userModel.ID]
+		if !ok {
+			// アイコンが存在しない場合はフォールバック画像を読み込む
+			image, err = os.ReadFile(fallbackImage)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read fallback image: %w", err)
+			}
+		}
+		iconHash := sha256.Sum256(image)
+
+		// Userを組み立て
+		users[userModel.ID] = User{
+			ID:          userModel.ID,
+			Name:        userModel.Name,
+			DisplayName: userModel.DisplayName,
+			Description: userModel.Description,
+			Theme:       theme,
+			IconHash:    fmt.Sprintf("%x", iconHash),
+		}
+	}
+
+	return users, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+func TestSearchOwnersHitUserCache(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	for i := 0; i < 3; i++ {
+		insertTestLivestream(t, streamerID, "live", testTermStart, testTermStart+3600)
+	}
+	warmTestCaches(t)
+
+	recorder := recordQueries(t)
+	for i := 0; i < 2; i++ {
+		var livestreams []Livestream
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/livestream/search", nil, streamerID), http.StatusOK, &livestreams)
+		if len(livestreams) != 3 || livestreams[0].Owner.Name != "streamer" {
+			t.Fatalf("search %d = %+v, want 3 livestreams owned by streamer", i, livestreams)
+		}
+	}
+	if q := recorder.matching("FROM users"); len(q) != 0 {
+		t.Errorf("owner lookups queried users %d times, want 0 (cache hits)", len(q))
+	}
+}
+
+func TestUserCacheResolvesNewUser(t *testing.T) {
+	setupTestDB(t)
+	warmTestCaches(t)
+	// 初期化後に登録されたユーザはキャッシュに無いので、DBから引いてキャッシュに載せる
+	userID := insertTestUser(t, "newcomer")
+
+	recorder := recordQueries(t)
+	for i := 0; i < 2; i++ {
+		var user User
+		decodeResponse(t, doRequest(t, http.MethodPost, "/api/session/refresh", nil, userID), http.StatusOK, &user)
+		if user.ID != userID || user.Name != "newcomer" {
+			t.Fatalf("refresh %d = %+v, want newcomer", i, user)
+		}
+	}
+	if q := recorder.matching("FROM users WHERE id IN"); len(q) != 1 {
+		t.Errorf("users queried %d times, want 1 (miss then hit)", len(q))
+	}
+	if _, ok := usersCache.get(userID); !ok {
+		t.Error("new user is not cached after lookup")
+	}
+}
+
+func TestGetUserProfile(t *testing.T) {
+	setupTestDB(t)
+	streamerID := insertTestUser(t, "streamer")
+	viewerID := insertTestUser(t, "viewer")
+	insertTestUser(t, "newcomer")
+	first := insertTestLivestream(t, streamerID, "first", testTermStart, testTermStart+3600)
+	second := insertTestLivestream(t, streamerID, "second", testTermStart, testTermStart+3600)
+	deleted := insertTestLivestream(t, streamerID, "deleted", testTermStart, testTermStart+3600)
+	mustExec(t, "UPDATE livestreams SET deleted_at = ? WHERE id = ?", testTermStart, deleted)
+	viewerLive := insertTestLivestream(t, viewerID, "viewer live", testTermStart, testTermStart+3600)
+	for _, livestreamID := range []int64{first, first, second, deleted, viewerLive} {
+		insertTestReaction(t, viewerID, livestreamID, "tada", testTermStart)
+		insertTestLivecomment(t, viewerID, livestreamID, "nice", 100)
+	}
+	insertTestLivecomment(t, viewerID, second, "no tip", 0)
+	warmTestCaches(t)
+
+	for _, tt := range []struct {
+		username string
+		want     UserProfile
+	}{
+		// 削除した配信と他の配信者の配信は数えない
+		{"streamer", UserProfile{LivestreamsCount: 2, TotalReactions: 3, TotalTip: 300}},
+		{"viewer", UserProfile{LivestreamsCount: 1, TotalReactions: 1, TotalTip: 100}},
+		{"newcomer", UserProfile{}},
+	} {
+		var got UserProfile
+		decodeResponse(t, doRequest(t, http.MethodGet, "/api/user/"+tt.username+"/profile", nil, viewerID), http.StatusOK, &got)
+		if got.Name != tt.username {
+			t.Errorf("%s profile user = %+v", tt.username, got.User)
+		}
+		if got.LivestreamsCount != tt.want.LivestreamsCount || got.TotalReactions != tt.want.TotalReactions || got.TotalTip != tt.want.TotalTip {
+			t.Errorf("%s profile counts = (%d, %d, %d), want (%d, %d, %d)", tt.username,
+				got.LivestreamsCount, got.TotalReactions, got.TotalTip,
+				tt.want.LivestreamsCount, tt.want.TotalReactions, tt.want.TotalTip)
+		}
+	}
+
+	if rec := doRequest(t, http.MethodGet, "/api/user/nobody/profile", nil, viewerID); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown user profile = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestRequireSessionRejectsBeforeDBWork(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "streamer")
+	livestreamID := insertTestLivestream(t, userID, "live", testTermStart, testTermStart+3600)
+	warmTestCaches(t)
+	path := "/api/livestream/" + itoa(livestreamID)
+
+	recorder := recordQueries(t)
+	for _, route := range []struct {
+		method, target string
+		body           interface{}
+	}{
+		{http.MethodPost, "/api/livestream/reservation", newTestReserveRequest(testTermStart, testTermStart+3600)},
+		{http.MethodPatch, path, map[string]interface{}{"version": 0, "title": "t"}},
+		{http.MethodDelete, path, nil},
+		{http.MethodPost, path + "/reaction", PostReactionRequest{EmojiName: "tada"}},
+		// パスパラメータが不正でも、先にセッションを検証する
+		{http.MethodPost, "/api/livestream/abc/reaction", PostReactionRequest{EmojiName: "tada"}},
+		{http.MethodPost, path + "/livecomment", map[string]interface{}{"comment": "hi", "tip": 0}},
+		{http.MethodPost, path + "/enter", nil},
+		{http.MethodDelete, path + "/exit", nil},
+		{http.MethodPost, "/api/icon", map[string]interface{}{"image": ""}},
+	} {
+		if rec := doRequest(t, route.method, route.target, route.body, 0); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without session = %d, want %d", route.method, route.target, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	if n := recorder.count(); n != 0 {
+		t.Errorf("protected routes ran %d queries without a session, want 0", n)
+	}
+
+	// ログインしていれば、ハンドラはセッションのユーザIDで処理する
+	var reaction Reaction
+	decodeResponse(t, doRequest(t, http.MethodPost, path+"/reaction", PostReactionRequest{EmojiName: "tada"}, userID), http.StatusCreated, &reaction)
+	if reaction.User.ID != userID {
+		t.Errorf("reaction user = %d, want %d", reaction.User.ID, userID)
+	}
+}
+
+func TestSessionUserID(t *testing.T) {
+	e := echo.New()
+	var got int64
+	e.POST("/", func(c echo.Context) error {
+		got = sessionUserID(c)
+		return c.NoContent(http.StatusNoContent)
+	}, session.Middleware(sessions.NewCookieStore(secret)), requireSession)
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.AddCookie(sessionCookie(t, 42))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || got != 42 {
+		t.Errorf("with session = %d (user %d), want %d and user 42", rec.Code, got, http.StatusNoContent)
+	}
+
+	got = 0
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusUnauthorized || got != 0 {
+		t.Errorf("without session = %d (user %d), want %d and the handler not run", rec.Code, got, http.StatusUnauthorized)
+	}
+}
+
+// sessionExpiresAt はCookieのセッションに保存された期限を読む
+func sessionExpiresAt(t *testing.T, cookie *http.Cookie) int64 {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	sess, err := sessions.NewCookieStore(secret).Get(req, defaultSessionIDKey)
+	if err != nil {
+		t.Fatalf("failed to decode session cookie: %v", err)
+	}
+	expires, ok := sess.Values[defaultSessionExpiresKey].(int64)
+	if !ok {
+		t.Fatalf("session has no expiry: %v", sess.Values)
+	}
+	return expires
+}
+
+func TestRefreshSession(t *testing.T) {
+	setupTestDB(t)
+	userID := insertTestUser(t, "viewer")
+	warmTestCaches(t)
+	refresh := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/session/refresh", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		testEcho.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// 期限間近のセッションは現在から sessionLifetime 後まで延びる
+	soon := sessionCookieExpiring(t, userID, time.Now().Add(time.Minute))
+	rec := refresh(soon)
+	var user User
+	decodeResponse(t, rec, http.StatusOK, &user)
+	if user.ID != userID || user.Name != "viewer" {
+		t.Errorf("refreshed user = %+v, want viewer %d", user, userID)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != defaultSessionIDKey {
+		t.Fatalf("refresh set cookies %v, want the session cookie", cookies)
+	}
+	if min := time.Now().Add(sessionLifetime - time.Minute).Unix(); sessionExpiresAt(t, cookies[0]) < min {
+		t.Errorf("refreshed expiry = %d, want at least %d", sessionExpiresAt(t, cookies[0]), min)
+	}
+	if cookies[0].MaxAge <= 0 {
+		t.Errorf("refreshed cookie max-age = %d, want positive", cookies[0].MaxAge)
+	}
+	// 延長したセッションでそのまま操作できる
+	if rec := refresh(cookies[0]); rec.Code != http.StatusOK {
+		t.Errorf("refresh with the extended session = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// 期限切れのセッションは延長せず401を返す
+	expired := sessionCookieExpiring(t, userID, time.Now().Add(-time.Second))
+	rec = refresh(expired)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh with an expired session = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("rejected refresh set cookies %v", cookies)
+	}
+	if rec := doRequest(t, http.MethodPost, "/api/session/refresh", nil, 0); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh without session = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}